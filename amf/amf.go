@@ -0,0 +1,153 @@
+package amf
+
+import (
+	"bytes"
+	"io"
+)
+
+// Action Message Format -- AMF 0
+// Action Message Format -- AMF 3
+// http://download.macromedia.com/pub/labs/amf/amf0_spec_121207.pdf
+// http://wwwimages.adobe.com/www.adobe.com/content/dam/Adobe/en/devnet/amf/pdf/amf-file-format-spec.pdf
+//
+// Go 类型和AMF0类型的对应关系:
+//
+// AMF0                     解码                      编码
+// number                   float64                   int*, uint*, float*
+// boolean                  bool                      bool
+// string, long string      string                    string (长度超过 0xffff 的时候写 long string)
+// object                   Object                    Object, map[string]T, struct
+// null, undefined          nil, Undefined            nil, Undefined
+// reference                引用的值                   同一个 map, slice, 指针第二次出现的时候写引用
+// ECMA array               ECMAArray                 ECMAArray
+// strict array             []interface{}             slice, array
+// date                     time.Time                 time.Time
+// XML document             XMLDocument               XMLDocument
+// typed object             *TypedObject              TypedObject, *TypedObject
+// unsupported              Unsupported               Unsupported
+// AVM+(切换到AMF3)          AMF3 的值                  AVMPlus, []byte(AMF3 ByteArray)
+//
+// struct 的字段名可以用 tag 指定: `amf:"name"`, `amf:"name,omitempty"`, `amf:"-"` 表示忽略.
+
+const (
+	AMF0_NUMBER         = 0x00 // 浮点数
+	AMF0_BOOLEAN        = 0x01 // 布尔型
+	AMF0_STRING         = 0x02 // 字符串
+	AMF0_OBJECT         = 0x03 // 对象,开始
+	AMF0_MOVIECLIP      = 0x04 // 保留,不支持
+	AMF0_NULL           = 0x05 // null
+	AMF0_UNDEFINED      = 0x06
+	AMF0_REFERENCE      = 0x07 // 引用,2个字节的索引
+	AMF0_ECMA_ARRAY     = 0x08
+	AMF0_END_OBJECT     = 0x09 // 对象,结束
+	AMF0_STRICT_ARRAY   = 0x0A
+	AMF0_DATE           = 0x0B // 日期
+	AMF0_LONG_STRING    = 0x0C // 字符串,4个字节的长度
+	AMF0_UNSUPPORTED    = 0x0D
+	AMF0_RECORDSET      = 0x0E // 保留,不支持
+	AMF0_XML_DOCUMENT   = 0x0F
+	AMF0_TYPED_OBJECT   = 0x10
+	AMF0_AVMPLUS_OBJECT = 0x11 // 切换到AMF3
+
+	AMF3_UNDEFINED     = 0x00
+	AMF3_NULL          = 0x01
+	AMF3_FALSE         = 0x02
+	AMF3_TRUE          = 0x03
+	AMF3_INTEGER       = 0x04
+	AMF3_DOUBLE        = 0x05
+	AMF3_STRING        = 0x06
+	AMF3_XML_DOC       = 0x07
+	AMF3_DATE          = 0x08
+	AMF3_ARRAY         = 0x09
+	AMF3_OBJECT        = 0x0A
+	AMF3_XML           = 0x0B
+	AMF3_BYTE_ARRAY    = 0x0C
+	AMF3_VECTOR_INT    = 0x0D
+	AMF3_VECTOR_UINT   = 0x0E
+	AMF3_VECTOR_DOUBLE = 0x0F
+	AMF3_VECTOR_OBJECT = 0x10
+	AMF3_DICTIONARY    = 0x11
+
+	AMF0_STRING_MAX  = 0xffff      // string 的最大长度, 超过的用 long string
+	AMF0_MAX_REFS    = 0xffff      // 引用的索引只有2个字节
+	AMF3_INTEGER_MAX = 0x0fffffff  // 29 bits 有符号整数最大值
+	AMF3_INTEGER_MIN = -0x10000000 // 29 bits 有符号整数最小值
+)
+
+// 匿名对象
+type Object map[string]interface{}
+
+// 关联数组, onMetaData 一般都是 ECMA array
+type ECMAArray map[string]interface{}
+
+// 有类名的对象
+type TypedObject struct {
+	ClassName string
+	Object    Object
+}
+
+type XMLDocument string
+
+// AMF3 XML(0x0B), 和 XMLDocument(0x07) 区分开
+type XML string
+
+type Undefined struct{}
+
+type Unsupported struct{}
+
+// 编码的时候切换到AMF3: AMF0_AVMPLUS_OBJECT + AMF3的值
+type AVMPlus struct {
+	Value interface{}
+}
+
+// AMF3 Dictionary, key 可以是任意类型(包括对象), 所以不能用 map
+type Dictionary struct {
+	WeakKeys bool
+	Entries  []DictionaryEntry
+}
+
+type DictionaryEntry struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// 把 v 编码成AMF0
+func Marshal(v interface{}) (b []byte, err error) {
+	return MarshalValues(v)
+}
+
+// 把多个值依次编码成AMF0, 例如 FLV script tag: "onMetaData" + ECMA array
+func MarshalValues(vs ...interface{}) (b []byte, err error) {
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+
+	for _, v := range vs {
+		if err = enc.Encode(v); err != nil {
+			return
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// 解码第一个AMF0的值到 v, v 必须是非nil的指针
+func Unmarshal(data []byte, v interface{}) (err error) {
+	return NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// 解码所有的AMF0的值, 例如 FLV script tag
+func UnmarshalValues(data []byte) (vs []interface{}, err error) {
+	dec := NewDecoder(bytes.NewReader(data))
+
+	for {
+		var v interface{}
+		if v, err = dec.DecodeValue(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+
+		vs = append(vs, v)
+	}
+}
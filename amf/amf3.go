@@ -0,0 +1,1118 @@
+package amf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Action Message Format -- AMF 3
+//
+// U29 : 1 ~ 4 个字节的可变长度整数. 前3个字节最高位为1表示后面还有字节,低7位为数据. 第4个字节8位都是数据. 一共29位.
+//
+// String, XMLDocument, Date, Array, Object, XML, ByteArray, Vector, Dictionary 都可以用引用:
+// U29 的最低位为0表示引用, 剩下的位为引用表中的索引. 最低位为1表示后面跟着的是值.
+// 引用表一共3个: 字符串表, 对象表(Date, Array, Object, XML, ByteArray, Vector, Dictionary), traits表.
+// 空字符串不会放到字符串表里面.
+//
+// Go 类型和AMF3类型的对应关系:
+//
+// AMF3                     解码                      编码
+// undefined, null          Undefined, nil            Undefined, nil
+// false, true              bool                      bool
+// integer, double          float64                   int*, uint* (超过29 bits的用 double), float*
+// string                   string                    string
+// XMLDocument, XML         XMLDocument, XML          XMLDocument, XML
+// date                     time.Time                 time.Time
+// array                    []interface{}, ECMAArray  slice, array, ECMAArray
+// object                   Object, *TypedObject      Object, map[string]T, struct, TypedObject
+// ByteArray                []byte                    []byte
+// Vector                   []int32, []uint32, []float64, []interface{}
+// Dictionary               *Dictionary               Dictionary, *Dictionary
+
+const (
+	// Flex 常用的 externalizable 类, 里面只有一个值(ArrayCollection -> Array, ObjectProxy -> Object)
+	AMF3_CLASS_ARRAY_COLLECTION = "flex.messaging.io.ArrayCollection"
+	AMF3_CLASS_ARRAY_LIST       = "flex.messaging.io.ArrayList"
+	AMF3_CLASS_OBJECT_PROXY     = "flex.messaging.io.ObjectProxy"
+)
+
+type amf3Traits struct {
+	className      string
+	externalizable bool
+	dynamic        bool
+	members        []string
+}
+
+type amf3Decoder struct {
+	r reader
+
+	stringRefs []string
+	objectRefs []interface{}
+	traitRefs  []*amf3Traits
+
+	depth    int // 当前解码的嵌套深度
+	maxDepth int
+}
+
+type amf3Encoder struct {
+	buf *bytes.Buffer
+
+	stringTable map[string]int
+	traitTable  map[string]int
+	objectTable map[refKey]int
+	nobject     int // 对象表的个数, 和解码端的引用表下标一致
+}
+
+func newAMF3Decoder(r reader, depth, maxDepth int) *amf3Decoder {
+	return &amf3Decoder{r: r, depth: depth, maxDepth: maxDepth}
+}
+
+func newAMF3Encoder(buf *bytes.Buffer) *amf3Encoder {
+	return &amf3Encoder{
+		buf:         buf,
+		stringTable: make(map[string]int),
+		traitTable:  make(map[string]int),
+		objectTable: make(map[refKey]int),
+	}
+}
+
+//
+// Decode
+//
+
+func (d *amf3Decoder) decodeNext() (v interface{}, err error) {
+	if d.depth >= d.maxDepth {
+		return nil, ErrDepth
+	}
+
+	d.depth++
+	defer func() { d.depth-- }()
+
+	var t byte
+	if t, err = d.r.ReadByte(); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	switch t {
+	case AMF3_UNDEFINED:
+		{
+			return Undefined{}, nil
+		}
+	case AMF3_NULL:
+		{
+			return nil, nil
+		}
+	case AMF3_FALSE:
+		{
+			return false, nil
+		}
+	case AMF3_TRUE:
+		{
+			return true, nil
+		}
+	case AMF3_INTEGER:
+		{
+			// 和AMF0一样解码成 float64
+			n, err := d.readInteger()
+			return float64(n), err
+		}
+	case AMF3_DOUBLE:
+		{
+			return readDouble(d.r)
+		}
+	case AMF3_STRING:
+		{
+			return d.readUTF8()
+		}
+	case AMF3_XML_DOC:
+		{
+			s, err := d.readXML()
+			return XMLDocument(s), err
+		}
+	case AMF3_XML:
+		{
+			s, err := d.readXML()
+			return XML(s), err
+		}
+	case AMF3_DATE:
+		{
+			return d.readDate()
+		}
+	case AMF3_ARRAY:
+		{
+			return d.readArray()
+		}
+	case AMF3_OBJECT:
+		{
+			return d.readObject()
+		}
+	case AMF3_BYTE_ARRAY:
+		{
+			return d.readByteArray()
+		}
+	case AMF3_VECTOR_INT, AMF3_VECTOR_UINT, AMF3_VECTOR_DOUBLE, AMF3_VECTOR_OBJECT:
+		{
+			return d.readVector(t)
+		}
+	case AMF3_DICTIONARY:
+		{
+			return d.readDictionary()
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf("amf: unsupported amf3 type %v", t))
+}
+
+func (d *amf3Decoder) readU29() (n uint32, err error) {
+	var b byte
+	for i := 0; i < 4; i++ {
+		if b, err = d.r.ReadByte(); err != nil {
+			return 0, unexpectedEOF(err)
+		}
+
+		// 第4个字节8位都是数据
+		if i == 3 {
+			n = n<<8 | uint32(b)
+			return
+		}
+
+		n = n<<7 | uint32(b&0x7f)
+		if b&0x80 == 0 {
+			return
+		}
+	}
+
+	return
+}
+
+// 29 bits 有符号整数
+func (d *amf3Decoder) readInteger() (n int32, err error) {
+	var u uint32
+	if u, err = d.readU29(); err != nil {
+		return
+	}
+
+	n = int32(u<<3) >> 3
+
+	return
+}
+
+// UTF-8-vr
+func (d *amf3Decoder) readUTF8() (s string, err error) {
+	var ref uint32
+	if ref, err = d.readU29(); err != nil {
+		return
+	}
+
+	if ref&0x01 == 0 {
+		index := int(ref >> 1)
+		if index >= len(d.stringRefs) {
+			err = errors.New(fmt.Sprintf("amf: amf3 string reference out of range, %v/%v", index, len(d.stringRefs)))
+			return
+		}
+
+		return d.stringRefs[index], nil
+	}
+
+	length := int64(ref >> 1)
+	if length == 0 {
+		return "", nil
+	}
+
+	var b []byte
+	if b, err = readBytes(d.r, length); err != nil {
+		return
+	}
+
+	s = string(b)
+	d.stringRefs = append(d.stringRefs, s)
+
+	return
+}
+
+// 对象表的引用. U29 最低位为0的时候返回引用的对象, isRef 为 true
+func (d *amf3Decoder) readObjectRef() (ref uint32, v interface{}, isRef bool, err error) {
+	if ref, err = d.readU29(); err != nil {
+		return
+	}
+
+	if ref&0x01 != 0 {
+		return
+	}
+
+	index := int(ref >> 1)
+	if index >= len(d.objectRefs) {
+		err = errors.New(fmt.Sprintf("amf: amf3 object reference out of range, %v/%v", index, len(d.objectRefs)))
+		return
+	}
+
+	return ref, d.objectRefs[index], true, nil
+}
+
+func (d *amf3Decoder) readXML() (s string, err error) {
+	var ref uint32
+	var v interface{}
+	var isRef bool
+
+	if ref, v, isRef, err = d.readObjectRef(); err != nil || isRef {
+		s, _ = v.(string)
+		return
+	}
+
+	var b []byte
+	if b, err = readBytes(d.r, int64(ref>>1)); err != nil {
+		return
+	}
+
+	s = string(b)
+	d.objectRefs = append(d.objectRefs, s)
+
+	return
+}
+
+func (d *amf3Decoder) readDate() (t time.Time, err error) {
+	var v interface{}
+	var isRef bool
+
+	if _, v, isRef, err = d.readObjectRef(); err != nil || isRef {
+		t, _ = v.(time.Time)
+		return
+	}
+
+	var ms float64
+	if ms, err = readDouble(d.r); err != nil {
+		return
+	}
+
+	t = millisecondToTime(ms)
+	d.objectRefs = append(d.objectRefs, t)
+
+	return
+}
+
+// Array = 关联部分(key-value,以空字符串结束) + 密集部分(dense)
+// 只有密集部分的时候解码成 []interface{}, 否则解码成 ECMAArray, 密集部分的 key 为下标
+func (d *amf3Decoder) readArray() (v interface{}, err error) {
+	var ref uint32
+	var isRef bool
+
+	if ref, v, isRef, err = d.readObjectRef(); err != nil || isRef {
+		return
+	}
+
+	index := len(d.objectRefs)
+	d.objectRefs = append(d.objectRefs, nil)
+
+	assoc := make(ECMAArray)
+	for {
+		var k string
+		if k, err = d.readUTF8(); err != nil {
+			return
+		}
+
+		if k == "" {
+			break
+		}
+
+		if assoc[k], err = d.decodeNext(); err != nil {
+			return
+		}
+	}
+
+	count := int(ref >> 1)
+	dense := make([]interface{}, 0, preallocSize(int64(count)))
+	for i := 0; i < count; i++ {
+		var e interface{}
+		if e, err = d.decodeNext(); err != nil {
+			return
+		}
+
+		dense = append(dense, e)
+	}
+
+	if len(assoc) == 0 {
+		v = dense
+	} else {
+		for i, e := range dense {
+			assoc[strconv.Itoa(i)] = e
+		}
+		v = assoc
+	}
+
+	d.objectRefs[index] = v
+
+	return
+}
+
+// U29O-traits: 最低位为1(对象不是引用), 第2位为1(traits不是引用), 第3位为1(externalizable), 第4位为1(dynamic), 剩下的为sealed成员的个数
+func (d *amf3Decoder) readTraits(ref uint32) (traits *amf3Traits, err error) {
+	if ref&0x02 == 0 {
+		index := int(ref >> 2)
+		if index >= len(d.traitRefs) {
+			err = errors.New(fmt.Sprintf("amf: amf3 traits reference out of range, %v/%v", index, len(d.traitRefs)))
+			return
+		}
+
+		return d.traitRefs[index], nil
+	}
+
+	traits = new(amf3Traits)
+	traits.externalizable = ref&0x04 != 0
+	traits.dynamic = ref&0x08 != 0
+
+	if traits.className, err = d.readUTF8(); err != nil {
+		return
+	}
+
+	count := int(ref >> 4)
+	for i := 0; i < count; i++ {
+		var member string
+		if member, err = d.readUTF8(); err != nil {
+			return
+		}
+
+		traits.members = append(traits.members, member)
+	}
+
+	d.traitRefs = append(d.traitRefs, traits)
+
+	return
+}
+
+func (d *amf3Decoder) readObject() (v interface{}, err error) {
+	var ref uint32
+	var isRef bool
+
+	if ref, v, isRef, err = d.readObjectRef(); err != nil || isRef {
+		return
+	}
+
+	var traits *amf3Traits
+	if traits, err = d.readTraits(ref); err != nil {
+		return
+	}
+
+	index := len(d.objectRefs)
+	d.objectRefs = append(d.objectRefs, nil)
+
+	if traits.externalizable {
+		switch traits.className {
+		case AMF3_CLASS_ARRAY_COLLECTION, AMF3_CLASS_ARRAY_LIST, AMF3_CLASS_OBJECT_PROXY:
+			{
+				if v, err = d.decodeNext(); err != nil {
+					return
+				}
+
+				d.objectRefs[index] = v
+				return
+			}
+		}
+
+		err = errors.New(fmt.Sprintf("amf: unsupported amf3 externalizable class %v", traits.className))
+		return
+	}
+
+	m := make(Object)
+	if traits.className == "" {
+		v = m
+	} else {
+		v = &TypedObject{ClassName: traits.className, Object: m}
+	}
+
+	d.objectRefs[index] = v
+
+	for _, member := range traits.members {
+		if m[member], err = d.decodeNext(); err != nil {
+			return
+		}
+	}
+
+	if traits.dynamic {
+		for {
+			var k string
+			if k, err = d.readUTF8(); err != nil {
+				return
+			}
+
+			if k == "" {
+				break
+			}
+
+			if m[k], err = d.decodeNext(); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+func (d *amf3Decoder) readByteArray() (b []byte, err error) {
+	var ref uint32
+	var v interface{}
+	var isRef bool
+
+	if ref, v, isRef, err = d.readObjectRef(); err != nil || isRef {
+		b, _ = v.([]byte)
+		return
+	}
+
+	if b, err = readBytes(d.r, int64(ref>>1)); err != nil {
+		return
+	}
+
+	d.objectRefs = append(d.objectRefs, b)
+
+	return
+}
+
+// Vector: U29V + fixed-vector(1 byte) + (Vector.<Object>才有 object-type-name) + 值
+// Vector.<int> -> []int32, Vector.<uint> -> []uint32, Vector.<Number> -> []float64, Vector.<Object> -> []interface{}
+func (d *amf3Decoder) readVector(t byte) (v interface{}, err error) {
+	var ref uint32
+	var isRef bool
+
+	if ref, v, isRef, err = d.readObjectRef(); err != nil || isRef {
+		return
+	}
+
+	count := int(ref >> 1)
+
+	// fixed-vector
+	if _, err = d.r.ReadByte(); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	switch t {
+	case AMF3_VECTOR_INT:
+		{
+			list := make([]int32, 0, preallocSize(int64(count)))
+			for i := 0; i < count; i++ {
+				var n int32
+				if err = binary.Read(d.r, binary.BigEndian, &n); err != nil {
+					return nil, unexpectedEOF(err)
+				}
+				list = append(list, n)
+			}
+			v = list
+		}
+	case AMF3_VECTOR_UINT:
+		{
+			list := make([]uint32, 0, preallocSize(int64(count)))
+			for i := 0; i < count; i++ {
+				var n uint32
+				if n, err = readUint32(d.r); err != nil {
+					return
+				}
+				list = append(list, n)
+			}
+			v = list
+		}
+	case AMF3_VECTOR_DOUBLE:
+		{
+			list := make([]float64, 0, preallocSize(int64(count)))
+			for i := 0; i < count; i++ {
+				var n float64
+				if n, err = readDouble(d.r); err != nil {
+					return
+				}
+				list = append(list, n)
+			}
+			v = list
+		}
+	case AMF3_VECTOR_OBJECT:
+		{
+			// object-type-name, "*" 表示任意类型
+			if _, err = d.readUTF8(); err != nil {
+				return
+			}
+
+			index := len(d.objectRefs)
+			d.objectRefs = append(d.objectRefs, nil)
+
+			list := make([]interface{}, 0, preallocSize(int64(count)))
+			for i := 0; i < count; i++ {
+				var e interface{}
+				if e, err = d.decodeNext(); err != nil {
+					return
+				}
+				list = append(list, e)
+			}
+
+			d.objectRefs[index] = list
+
+			return list, nil
+		}
+	}
+
+	d.objectRefs = append(d.objectRefs, v)
+
+	return
+}
+
+func (d *amf3Decoder) readDictionary() (v interface{}, err error) {
+	var ref uint32
+	var isRef bool
+
+	if ref, v, isRef, err = d.readObjectRef(); err != nil || isRef {
+		return
+	}
+
+	dict := new(Dictionary)
+	d.objectRefs = append(d.objectRefs, dict)
+
+	var weak byte
+	if weak, err = d.r.ReadByte(); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	dict.WeakKeys = weak == 1
+
+	for i := 0; i < int(ref>>1); i++ {
+		var entry DictionaryEntry
+
+		if entry.Key, err = d.decodeNext(); err != nil {
+			return
+		}
+
+		if entry.Value, err = d.decodeNext(); err != nil {
+			return
+		}
+
+		dict.Entries = append(dict.Entries, entry)
+	}
+
+	return dict, nil
+}
+
+//
+// Encode
+//
+
+func (e *amf3Encoder) encode(v interface{}) (err error) {
+	buf := e.buf
+
+	switch data := v.(type) {
+	case nil:
+		{
+			return buf.WriteByte(AMF3_NULL)
+		}
+	case Undefined, *Undefined, Unsupported, *Unsupported:
+		{
+			return buf.WriteByte(AMF3_UNDEFINED)
+		}
+	case bool:
+		{
+			if data {
+				return buf.WriteByte(AMF3_TRUE)
+			}
+
+			return buf.WriteByte(AMF3_FALSE)
+		}
+	case float64:
+		{
+			return e.writeDouble(data)
+		}
+	case string:
+		{
+			if err = buf.WriteByte(AMF3_STRING); err != nil {
+				return
+			}
+
+			return e.writeUTF8(data)
+		}
+	case XMLDocument:
+		{
+			return e.writeXML(AMF3_XML_DOC, string(data))
+		}
+	case XML:
+		{
+			return e.writeXML(AMF3_XML, string(data))
+		}
+	case time.Time:
+		{
+			return e.writeDate(data)
+		}
+	case []byte:
+		{
+			return e.writeByteArray(data)
+		}
+	case ECMAArray:
+		{
+			return e.writeAssocArray(data)
+		}
+	case TypedObject:
+		{
+			return e.writeObject(reflect.Value{}, data.ClassName, mapProps(reflect.ValueOf(data.Object)))
+		}
+	case *TypedObject:
+		{
+			if data == nil {
+				return buf.WriteByte(AMF3_NULL)
+			}
+
+			return e.writeObject(reflect.ValueOf(data), data.ClassName, mapProps(reflect.ValueOf(data.Object)))
+		}
+	case []int32:
+		{
+			return e.writeVector(AMF3_VECTOR_INT, reflect.ValueOf(data))
+		}
+	case []uint32:
+		{
+			return e.writeVector(AMF3_VECTOR_UINT, reflect.ValueOf(data))
+		}
+	case []float64:
+		{
+			return e.writeVector(AMF3_VECTOR_DOUBLE, reflect.ValueOf(data))
+		}
+	case Dictionary:
+		{
+			return e.writeDictionary(reflect.Value{}, &data)
+		}
+	case *Dictionary:
+		{
+			if data == nil {
+				return buf.WriteByte(AMF3_NULL)
+			}
+
+			return e.writeDictionary(reflect.ValueOf(data), data)
+		}
+	case AVMPlus:
+		{
+			return e.encode(data.Value)
+		}
+	case *AVMPlus:
+		{
+			return e.encode(data.Value)
+		}
+	}
+
+	return e.encodeValue(reflect.ValueOf(v))
+}
+
+func (e *amf3Encoder) encodeValue(v reflect.Value) (err error) {
+	buf := e.buf
+
+	switch v.Kind() {
+	case reflect.Bool:
+		{
+			return e.encode(v.Bool())
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		{
+			return e.writeInteger(v.Int())
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		{
+			if v.Uint() > math.MaxInt64 {
+				return e.writeDouble(float64(v.Uint()))
+			}
+
+			return e.writeInteger(int64(v.Uint()))
+		}
+	case reflect.Float32, reflect.Float64:
+		{
+			return e.writeDouble(v.Float())
+		}
+	case reflect.String:
+		{
+			return e.encode(v.String())
+		}
+	case reflect.Interface:
+		{
+			if v.IsNil() {
+				return buf.WriteByte(AMF3_NULL)
+			}
+
+			return e.encode(v.Elem().Interface())
+		}
+	case reflect.Ptr:
+		{
+			if v.IsNil() {
+				return buf.WriteByte(AMF3_NULL)
+			}
+
+			// 指向 struct 的指针可以被引用
+			if v.Elem().Kind() == reflect.Struct && v.Elem().Type() != reflect.TypeOf(time.Time{}) {
+				return e.writeObject(v, "", structProps(v.Elem()))
+			}
+
+			return e.encode(v.Elem().Interface())
+		}
+	case reflect.Map:
+		{
+			if v.IsNil() {
+				return buf.WriteByte(AMF3_NULL)
+			}
+
+			if v.Type().Key().Kind() != reflect.String {
+				break
+			}
+
+			return e.writeObject(v, "", mapProps(v))
+		}
+	case reflect.Slice:
+		{
+			if v.IsNil() {
+				return buf.WriteByte(AMF3_NULL)
+			}
+
+			return e.writeArray(v)
+		}
+	case reflect.Array:
+		{
+			return e.writeArray(v)
+		}
+	case reflect.Struct:
+		{
+			return e.writeObject(reflect.Value{}, "", structProps(v))
+		}
+	}
+
+	return errors.New(fmt.Sprintf("amf: unsupported amf3 type %v", v.Type()))
+}
+
+func (e *amf3Encoder) writeU29(n uint32) (err error) {
+	n &= 0x1fffffff
+
+	switch {
+	case n < 0x80:
+		{
+			_, err = e.buf.Write([]byte{byte(n)})
+		}
+	case n < 0x4000:
+		{
+			_, err = e.buf.Write([]byte{byte(n>>7) | 0x80, byte(n & 0x7f)})
+		}
+	case n < 0x200000:
+		{
+			_, err = e.buf.Write([]byte{byte(n>>14) | 0x80, byte(n>>7) | 0x80, byte(n & 0x7f)})
+		}
+	default:
+		{
+			_, err = e.buf.Write([]byte{byte(n>>22) | 0x80, byte(n>>15) | 0x80, byte(n>>8) | 0x80, byte(n)})
+		}
+	}
+
+	return
+}
+
+// 写对象表的引用, 返回 true 表示已经写了引用. 第一次出现的时候加到对象表里面, v 无效的时候只占一个下标
+func (e *amf3Encoder) writeReference(v reflect.Value) (isRef bool, err error) {
+	k, ok := refKeyOf(v)
+
+	if ok {
+		if index, exist := e.objectTable[k]; exist {
+			return true, e.writeU29(uint32(index) << 1)
+		}
+
+		e.objectTable[k] = e.nobject
+	}
+
+	e.nobject++
+
+	return
+}
+
+// 超过29 bits的整数用 double 编码
+func (e *amf3Encoder) writeInteger(n int64) (err error) {
+	if n < AMF3_INTEGER_MIN || n > AMF3_INTEGER_MAX {
+		return e.writeDouble(float64(n))
+	}
+
+	if err = e.buf.WriteByte(AMF3_INTEGER); err != nil {
+		return
+	}
+
+	return e.writeU29(uint32(n))
+}
+
+func (e *amf3Encoder) writeDouble(num float64) (err error) {
+	if err = e.buf.WriteByte(AMF3_DOUBLE); err != nil {
+		return
+	}
+
+	return binary.Write(e.buf, binary.BigEndian, num)
+}
+
+func (e *amf3Encoder) writeUTF8(s string) (err error) {
+	if s == "" {
+		return e.writeU29(0x01)
+	}
+
+	if index, ok := e.stringTable[s]; ok {
+		return e.writeU29(uint32(index) << 1)
+	}
+
+	e.stringTable[s] = len(e.stringTable)
+
+	if err = e.writeU29(uint32(len(s))<<1 | 0x01); err != nil {
+		return
+	}
+
+	_, err = e.buf.WriteString(s)
+
+	return
+}
+
+func (e *amf3Encoder) writeXML(t byte, s string) (err error) {
+	if err = e.buf.WriteByte(t); err != nil {
+		return
+	}
+
+	if _, err = e.writeReference(reflect.Value{}); err != nil {
+		return
+	}
+
+	if err = e.writeU29(uint32(len(s))<<1 | 0x01); err != nil {
+		return
+	}
+
+	_, err = e.buf.WriteString(s)
+
+	return
+}
+
+func (e *amf3Encoder) writeDate(t time.Time) (err error) {
+	if err = e.buf.WriteByte(AMF3_DATE); err != nil {
+		return
+	}
+
+	if _, err = e.writeReference(reflect.Value{}); err != nil {
+		return
+	}
+
+	if err = e.writeU29(0x01); err != nil {
+		return
+	}
+
+	return binary.Write(e.buf, binary.BigEndian, timeToMillisecond(t))
+}
+
+func (e *amf3Encoder) writeByteArray(b []byte) (err error) {
+	if err = e.buf.WriteByte(AMF3_BYTE_ARRAY); err != nil {
+		return
+	}
+
+	var isRef bool
+	if isRef, err = e.writeReference(reflect.ValueOf(b)); err != nil || isRef {
+		return
+	}
+
+	if err = e.writeU29(uint32(len(b))<<1 | 0x01); err != nil {
+		return
+	}
+
+	_, err = e.buf.Write(b)
+
+	return
+}
+
+// 只写密集部分, 关联部分为空
+func (e *amf3Encoder) writeArray(v reflect.Value) (err error) {
+	if err = e.buf.WriteByte(AMF3_ARRAY); err != nil {
+		return
+	}
+
+	var isRef bool
+	if v.Kind() == reflect.Slice {
+		isRef, err = e.writeReference(v)
+	} else {
+		isRef, err = e.writeReference(reflect.Value{})
+	}
+	if err != nil || isRef {
+		return
+	}
+
+	if err = e.writeU29(uint32(v.Len())<<1 | 0x01); err != nil {
+		return
+	}
+
+	if err = e.writeUTF8(""); err != nil {
+		return
+	}
+
+	for i := 0; i < v.Len(); i++ {
+		if err = e.encode(v.Index(i).Interface()); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// 只写关联部分, 密集部分为空
+func (e *amf3Encoder) writeAssocArray(arr ECMAArray) (err error) {
+	if arr == nil {
+		return e.buf.WriteByte(AMF3_NULL)
+	}
+
+	if err = e.buf.WriteByte(AMF3_ARRAY); err != nil {
+		return
+	}
+
+	var isRef bool
+	if isRef, err = e.writeReference(reflect.ValueOf(arr)); err != nil || isRef {
+		return
+	}
+
+	if err = e.writeU29(0x01); err != nil {
+		return
+	}
+
+	for _, p := range mapProps(reflect.ValueOf(arr)) {
+		if err = e.writeUTF8(p.name); err != nil {
+			return
+		}
+
+		if err = e.encode(p.value); err != nil {
+			return
+		}
+	}
+
+	return e.writeUTF8("")
+}
+
+// 匿名对象: dynamic, 没有sealed成员. 有类名的对象: sealed成员, 不是dynamic.
+// 相同的traits第二次出现的时候写traits引用.
+func (e *amf3Encoder) writeObject(v reflect.Value, className string, props []objectProp) (err error) {
+	if err = e.buf.WriteByte(AMF3_OBJECT); err != nil {
+		return
+	}
+
+	var isRef bool
+	if isRef, err = e.writeReference(v); err != nil || isRef {
+		return
+	}
+
+	dynamic := className == ""
+
+	var traitKey string
+	if dynamic {
+		traitKey = "*dynamic"
+	} else {
+		keys := make([]string, len(props))
+		for i, p := range props {
+			keys[i] = p.name
+		}
+		traitKey = className + "\x00" + strings.Join(keys, "\x00")
+	}
+
+	if index, ok := e.traitTable[traitKey]; ok {
+		// 对象不是引用(1) + traits是引用(0)
+		if err = e.writeU29(uint32(index)<<2 | 0x01); err != nil {
+			return
+		}
+	} else {
+		e.traitTable[traitKey] = len(e.traitTable)
+
+		if dynamic {
+			// 对象不是引用(1) + traits不是引用(1) + 不是externalizable(0) + dynamic(1) + sealed成员个数(0)
+			err = e.writeU29(0x0b)
+		} else {
+			err = e.writeU29(uint32(len(props))<<4 | 0x03)
+		}
+		if err != nil {
+			return
+		}
+
+		if err = e.writeUTF8(className); err != nil {
+			return
+		}
+
+		if !dynamic {
+			for _, p := range props {
+				if err = e.writeUTF8(p.name); err != nil {
+					return
+				}
+			}
+		}
+	}
+
+	for _, p := range props {
+		if dynamic {
+			if p.name == "" {
+				return errors.New("amf: object property name is empty")
+			}
+
+			if err = e.writeUTF8(p.name); err != nil {
+				return
+			}
+		}
+
+		if err = e.encode(p.value); err != nil {
+			return
+		}
+	}
+
+	if dynamic {
+		return e.writeUTF8("")
+	}
+
+	return
+}
+
+func (e *amf3Encoder) writeVector(t byte, v reflect.Value) (err error) {
+	if err = e.buf.WriteByte(t); err != nil {
+		return
+	}
+
+	var isRef bool
+	if isRef, err = e.writeReference(v); err != nil || isRef {
+		return
+	}
+
+	if err = e.writeU29(uint32(v.Len())<<1 | 0x01); err != nil {
+		return
+	}
+
+	// fixed-vector
+	if err = e.buf.WriteByte(0); err != nil {
+		return
+	}
+
+	return binary.Write(e.buf, binary.BigEndian, v.Interface())
+}
+
+func (e *amf3Encoder) writeDictionary(v reflect.Value, dict *Dictionary) (err error) {
+	if err = e.buf.WriteByte(AMF3_DICTIONARY); err != nil {
+		return
+	}
+
+	var isRef bool
+	if isRef, err = e.writeReference(v); err != nil || isRef {
+		return
+	}
+
+	if err = e.writeU29(uint32(len(dict.Entries))<<1 | 0x01); err != nil {
+		return
+	}
+
+	var weak byte
+	if dict.WeakKeys {
+		weak = 1
+	}
+
+	if err = e.buf.WriteByte(weak); err != nil {
+		return
+	}
+
+	for _, entry := range dict.Entries {
+		if err = e.encode(entry.Key); err != nil {
+			return
+		}
+
+		if err = e.encode(entry.Value); err != nil {
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,350 @@
+package amf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"reflect"
+)
+
+// 一次分配的最大长度, 长度字段可能是错的, 超过的时候边读边分配
+const maxPrealloc = 0x10000
+
+// 默认的最大嵌套深度, 对象, 数组和它们里面的值每层加1
+const DefaultMaxDepth = 32
+
+// 嵌套超过了最大深度
+var ErrDepth = errors.New("amf: nesting too deep")
+
+type reader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// AMF0 解码器, 引用表在 Decoder 的整个生命周期里面有效(一个 RTMP 消息用一个 Decoder), 可以用 Reset 清空.
+// 嵌套超过 maxDepth 的时候返回 ErrDepth, 包括 AVM+ 里面的AMF3的值.
+type Decoder struct {
+	r    reader
+	refs []interface{}
+
+	depth    int // 当前解码的嵌套深度
+	maxDepth int
+}
+
+// r 没有实现 io.ByteReader 的时候用 bufio 包一层, 可能会多读数据
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	return &Decoder{r: br, maxDepth: DefaultMaxDepth}
+}
+
+// 设置最大嵌套深度, 默认为 DefaultMaxDepth
+func (d *Decoder) SetMaxDepth(n int) {
+	d.maxDepth = n
+}
+
+// 清空引用表
+func (d *Decoder) Reset() {
+	d.refs = nil
+}
+
+// 解码一个AMF0的值到 v, v 必须是非nil的指针
+func (d *Decoder) Decode(v interface{}) (err error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New(fmt.Sprintf("amf: Decode(non-pointer %T)", v))
+	}
+
+	var obj interface{}
+	if obj, err = d.DecodeValue(); err != nil {
+		return
+	}
+
+	// 赋值的嵌套深度和解码一样限制, 自己引用自己的对象也会在 maxDepth 层之后返回 ErrDepth
+	return assign(rv.Elem(), obj, d.maxDepth)
+}
+
+// 解码一个AMF0的值, 没有数据的时候返回 io.EOF
+func (d *Decoder) DecodeValue() (v interface{}, err error) {
+	var t byte
+	if t, err = d.r.ReadByte(); err != nil {
+		return
+	}
+
+	return d.decode(t)
+}
+
+func (d *Decoder) decodeNext() (v interface{}, err error) {
+	var t byte
+	if t, err = d.r.ReadByte(); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	return d.decode(t)
+}
+
+func (d *Decoder) decode(t byte) (v interface{}, err error) {
+	if d.depth >= d.maxDepth {
+		return nil, ErrDepth
+	}
+
+	d.depth++
+	defer func() { d.depth-- }()
+
+	switch t {
+	case AMF0_NUMBER:
+		{
+			return readDouble(d.r)
+		}
+	case AMF0_BOOLEAN:
+		{
+			var b byte
+			if b, err = d.r.ReadByte(); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+
+			return b != 0, nil
+		}
+	case AMF0_STRING:
+		{
+			return d.readUTF8()
+		}
+	case AMF0_LONG_STRING:
+		{
+			return d.readLongUTF8()
+		}
+	case AMF0_XML_DOCUMENT:
+		{
+			s, err := d.readLongUTF8()
+			return XMLDocument(s), err
+		}
+	case AMF0_NULL:
+		{
+			return nil, nil
+		}
+	case AMF0_UNDEFINED:
+		{
+			return Undefined{}, nil
+		}
+	case AMF0_UNSUPPORTED:
+		{
+			return Unsupported{}, nil
+		}
+	case AMF0_REFERENCE:
+		{
+			var index uint16
+			if err = binary.Read(d.r, binary.BigEndian, &index); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+
+			if int(index) >= len(d.refs) {
+				return nil, errors.New(fmt.Sprintf("amf: reference out of range, %v/%v", index, len(d.refs)))
+			}
+
+			return d.refs[index], nil
+		}
+	case AMF0_OBJECT:
+		{
+			obj := make(Object)
+			d.refs = append(d.refs, obj)
+
+			return obj, d.readProps(obj)
+		}
+	case AMF0_ECMA_ARRAY:
+		{
+			// 个数只是参考, 以 end 为准
+			if _, err = readUint32(d.r); err != nil {
+				return
+			}
+
+			arr := make(ECMAArray)
+			d.refs = append(d.refs, arr)
+
+			return arr, d.readProps(arr)
+		}
+	case AMF0_TYPED_OBJECT:
+		{
+			var className string
+			if className, err = d.readUTF8(); err != nil {
+				return
+			}
+
+			obj := &TypedObject{ClassName: className, Object: make(Object)}
+			d.refs = append(d.refs, obj)
+
+			return obj, d.readProps(obj.Object)
+		}
+	case AMF0_STRICT_ARRAY:
+		{
+			return d.readStrictArray()
+		}
+	case AMF0_DATE:
+		{
+			var ms float64
+			if ms, err = readDouble(d.r); err != nil {
+				return
+			}
+
+			// 时区, 保留
+			var tz int16
+			if err = binary.Read(d.r, binary.BigEndian, &tz); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+
+			return millisecondToTime(ms), nil
+		}
+	case AMF0_AVMPLUS_OBJECT:
+		{
+			// AMF3 的引用表重新开始, 深度接着算
+			return newAMF3Decoder(d.r, d.depth, d.maxDepth).decodeNext()
+		}
+	case AMF0_END_OBJECT:
+		{
+			return nil, errors.New("amf: unexpected object end")
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf("amf: unsupported type %v", t))
+}
+
+func (d *Decoder) readUTF8() (s string, err error) {
+	var length uint16
+	if err = binary.Read(d.r, binary.BigEndian, &length); err != nil {
+		return "", unexpectedEOF(err)
+	}
+
+	var b []byte
+	if b, err = readBytes(d.r, int64(length)); err != nil {
+		return
+	}
+
+	return string(b), nil
+}
+
+func (d *Decoder) readLongUTF8() (s string, err error) {
+	var length uint32
+	if length, err = readUint32(d.r); err != nil {
+		return
+	}
+
+	var b []byte
+	if b, err = readBytes(d.r, int64(length)); err != nil {
+		return
+	}
+
+	return string(b), nil
+}
+
+// 属性: UTF-8(2个字节的长度) + 值, 以 00 00 09 结束
+func (d *Decoder) readProps(m map[string]interface{}) (err error) {
+	for {
+		var k string
+		if k, err = d.readUTF8(); err != nil {
+			return
+		}
+
+		if k == "" {
+			var t byte
+			if t, err = d.r.ReadByte(); err != nil {
+				return unexpectedEOF(err)
+			}
+
+			if t != AMF0_END_OBJECT {
+				return errors.New(fmt.Sprintf("amf: object end expected, got %v", t))
+			}
+
+			return
+		}
+
+		if m[k], err = d.decodeNext(); err != nil {
+			return
+		}
+	}
+}
+
+func (d *Decoder) readStrictArray() (list []interface{}, err error) {
+	var count uint32
+	if count, err = readUint32(d.r); err != nil {
+		return
+	}
+
+	index := len(d.refs)
+	d.refs = append(d.refs, nil)
+
+	list = make([]interface{}, 0, preallocSize(int64(count)))
+	for i := uint32(0); i < count; i++ {
+		var v interface{}
+		if v, err = d.decodeNext(); err != nil {
+			return
+		}
+
+		list = append(list, v)
+	}
+
+	d.refs[index] = list
+
+	return
+}
+
+func readDouble(r io.Reader) (num float64, err error) {
+	var u uint64
+	if err = binary.Read(r, binary.BigEndian, &u); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+
+	return math.Float64frombits(u), nil
+}
+
+func readUint32(r io.Reader) (n uint32, err error) {
+	if err = binary.Read(r, binary.BigEndian, &n); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+
+	return
+}
+
+// 读取 n 个字节, n 很大的时候边读边分配, 防止长度字段错误导致分配过多内存
+func readBytes(r io.Reader, n int64) (b []byte, err error) {
+	if n <= maxPrealloc {
+		b = make([]byte, n)
+		if _, err = io.ReadFull(r, b); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		return
+	}
+
+	if b, err = ioutil.ReadAll(io.LimitReader(r, n)); err != nil {
+		return
+	}
+
+	if int64(len(b)) != n {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return
+}
+
+func preallocSize(n int64) int {
+	if n > maxPrealloc {
+		return maxPrealloc
+	}
+
+	return int(n)
+}
+
+// 值的中间遇到 EOF 说明数据不完整
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
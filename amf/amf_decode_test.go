@@ -0,0 +1,26 @@
+package amf
+
+import (
+	"bytes"
+	"testing"
+)
+
+// AMF0 的值, AVM+ 里面是 AMF3 的值, 解码不能 panic, 嵌套不能超过最大深度
+func FuzzDecoder(f *testing.F) {
+	b, _ := MarshalValues("onMetaData", Object{"width": float64(1280), "tags": []interface{}{"a", float64(1), nil}}, ECMAArray{"n": true})
+	f.Add(b)
+
+	b, _ = Marshal(AVMPlus{Value: TypedObject{ClassName: "c", Object: Object{"list": []interface{}{"x", 2}}}})
+	f.Add(b)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dec := NewDecoder(bytes.NewReader(data))
+		dec.SetMaxDepth(8)
+
+		for i := 0; i < 64; i++ {
+			if _, err := dec.DecodeValue(); err != nil {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,449 @@
+package amf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"time"
+)
+
+// 引用表的 key, 同一个 map, slice, 指针第二次出现的时候写引用
+type refKey struct {
+	t reflect.Type
+	p uintptr
+	n int
+}
+
+func refKeyOf(v reflect.Value) (k refKey, ok bool) {
+	switch v.Kind() {
+	case reflect.Map, reflect.Ptr:
+		{
+			if v.IsNil() {
+				return
+			}
+
+			return refKey{t: v.Type(), p: v.Pointer()}, true
+		}
+	case reflect.Slice:
+		{
+			if v.IsNil() {
+				return
+			}
+
+			return refKey{t: v.Type(), p: v.Pointer(), n: v.Len()}, true
+		}
+	}
+
+	return
+}
+
+// AMF0 编码器, 引用表在 Encoder 的整个生命周期里面有效(一个 RTMP 消息用一个 Encoder), 可以用 Reset 清空
+type Encoder struct {
+	w    io.Writer
+	buf  bytes.Buffer
+	refs map[refKey]int
+	nref int // object, typed object, ECMA array, strict array 的个数, 和解码端的引用表下标一致
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{
+		w:    w,
+		refs: make(map[refKey]int),
+	}
+}
+
+// 清空引用表
+func (e *Encoder) Reset() {
+	e.refs = make(map[refKey]int)
+	e.nref = 0
+}
+
+func (e *Encoder) Encode(v interface{}) (err error) {
+	e.buf.Reset()
+
+	if err = e.encode(v); err != nil {
+		return
+	}
+
+	_, err = e.w.Write(e.buf.Bytes())
+
+	return
+}
+
+func (e *Encoder) encode(v interface{}) (err error) {
+	buf := &e.buf
+
+	switch data := v.(type) {
+	case nil:
+		{
+			return buf.WriteByte(AMF0_NULL)
+		}
+	case Undefined, *Undefined:
+		{
+			return buf.WriteByte(AMF0_UNDEFINED)
+		}
+	case Unsupported, *Unsupported:
+		{
+			return buf.WriteByte(AMF0_UNSUPPORTED)
+		}
+	case bool:
+		{
+			return e.writeBool(data)
+		}
+	case float64:
+		{
+			return e.writeNumber(data)
+		}
+	case string:
+		{
+			return e.writeString(data)
+		}
+	case XMLDocument:
+		{
+			if err = buf.WriteByte(AMF0_XML_DOCUMENT); err != nil {
+				return
+			}
+
+			return e.writeLongUTF8(string(data))
+		}
+	case time.Time:
+		{
+			return e.writeDate(data)
+		}
+	case TypedObject:
+		{
+			return e.writeTypedObject(reflect.Value{}, &data)
+		}
+	case *TypedObject:
+		{
+			if data == nil {
+				return buf.WriteByte(AMF0_NULL)
+			}
+
+			return e.writeTypedObject(reflect.ValueOf(data), data)
+		}
+	case ECMAArray:
+		{
+			return e.writeECMAArray(reflect.ValueOf(data))
+		}
+	case AVMPlus:
+		{
+			return e.writeAVMPlus(data.Value)
+		}
+	case *AVMPlus:
+		{
+			return e.writeAVMPlus(data.Value)
+		}
+	case []byte:
+		{
+			// AMF0 没有字节数组, 用 AMF3 ByteArray
+			return e.writeAVMPlus(data)
+		}
+	}
+
+	return e.encodeValue(reflect.ValueOf(v))
+}
+
+func (e *Encoder) encodeValue(v reflect.Value) (err error) {
+	buf := &e.buf
+
+	switch v.Kind() {
+	case reflect.Bool:
+		{
+			return e.writeBool(v.Bool())
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		{
+			return e.writeNumber(float64(v.Int()))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		{
+			return e.writeNumber(float64(v.Uint()))
+		}
+	case reflect.Float32, reflect.Float64:
+		{
+			return e.writeNumber(v.Float())
+		}
+	case reflect.String:
+		{
+			return e.writeString(v.String())
+		}
+	case reflect.Interface:
+		{
+			if v.IsNil() {
+				return buf.WriteByte(AMF0_NULL)
+			}
+
+			return e.encode(v.Elem().Interface())
+		}
+	case reflect.Ptr:
+		{
+			if v.IsNil() {
+				return buf.WriteByte(AMF0_NULL)
+			}
+
+			// 指向 struct 的指针可以被引用
+			if v.Elem().Kind() == reflect.Struct && v.Elem().Type() != reflect.TypeOf(time.Time{}) {
+				return e.writeObject(v, structProps(v.Elem()))
+			}
+
+			return e.encode(v.Elem().Interface())
+		}
+	case reflect.Map:
+		{
+			if v.IsNil() {
+				return buf.WriteByte(AMF0_NULL)
+			}
+
+			if v.Type().Key().Kind() != reflect.String {
+				break
+			}
+
+			return e.writeObject(v, mapProps(v))
+		}
+	case reflect.Slice:
+		{
+			if v.IsNil() {
+				return buf.WriteByte(AMF0_NULL)
+			}
+
+			return e.writeStrictArray(v)
+		}
+	case reflect.Array:
+		{
+			return e.writeStrictArray(v)
+		}
+	case reflect.Struct:
+		{
+			return e.writeObject(reflect.Value{}, structProps(v))
+		}
+	}
+
+	return errors.New(fmt.Sprintf("amf: unsupported type %v", v.Type()))
+}
+
+// 写引用, 返回 true 表示已经写了引用. 第一次出现的时候加到引用表里面, v 无效的时候只占一个下标
+func (e *Encoder) writeReference(v reflect.Value) (isRef bool, err error) {
+	k, ok := refKeyOf(v)
+
+	if ok {
+		if index, exist := e.refs[k]; exist {
+			if err = e.buf.WriteByte(AMF0_REFERENCE); err != nil {
+				return
+			}
+
+			return true, binary.Write(&e.buf, binary.BigEndian, uint16(index))
+		}
+
+		// 引用的下标只有2个字节
+		if e.nref < AMF0_MAX_REFS {
+			e.refs[k] = e.nref
+		}
+	}
+
+	e.nref++
+
+	return
+}
+
+func (e *Encoder) writeBool(b bool) (err error) {
+	if err = e.buf.WriteByte(AMF0_BOOLEAN); err != nil {
+		return
+	}
+
+	if b {
+		return e.buf.WriteByte(1)
+	}
+
+	return e.buf.WriteByte(0)
+}
+
+func (e *Encoder) writeNumber(num float64) (err error) {
+	if err = e.buf.WriteByte(AMF0_NUMBER); err != nil {
+		return
+	}
+
+	return binary.Write(&e.buf, binary.BigEndian, num)
+}
+
+// 长度超过 0xffff 的时候写 long string
+func (e *Encoder) writeString(s string) (err error) {
+	if len(s) > AMF0_STRING_MAX {
+		if err = e.buf.WriteByte(AMF0_LONG_STRING); err != nil {
+			return
+		}
+
+		return e.writeLongUTF8(s)
+	}
+
+	if err = e.buf.WriteByte(AMF0_STRING); err != nil {
+		return
+	}
+
+	return e.writeUTF8(s)
+}
+
+func (e *Encoder) writeUTF8(s string) (err error) {
+	if len(s) > AMF0_STRING_MAX {
+		return errors.New(fmt.Sprintf("amf: string too long, %v", len(s)))
+	}
+
+	if err = binary.Write(&e.buf, binary.BigEndian, uint16(len(s))); err != nil {
+		return
+	}
+
+	_, err = e.buf.WriteString(s)
+
+	return
+}
+
+func (e *Encoder) writeLongUTF8(s string) (err error) {
+	if uint64(len(s)) > math.MaxUint32 {
+		return errors.New(fmt.Sprintf("amf: long string too long, %v", len(s)))
+	}
+
+	if err = binary.Write(&e.buf, binary.BigEndian, uint32(len(s))); err != nil {
+		return
+	}
+
+	_, err = e.buf.WriteString(s)
+
+	return
+}
+
+// date: 从1970年1月1日开始的毫秒数(double) + 时区(s16, 保留, 写0)
+func (e *Encoder) writeDate(t time.Time) (err error) {
+	if err = e.buf.WriteByte(AMF0_DATE); err != nil {
+		return
+	}
+
+	if err = binary.Write(&e.buf, binary.BigEndian, timeToMillisecond(t)); err != nil {
+		return
+	}
+
+	return binary.Write(&e.buf, binary.BigEndian, int16(0))
+}
+
+func (e *Encoder) writeProps(props []objectProp) (err error) {
+	for _, p := range props {
+		if p.name == "" {
+			return errors.New("amf: object property name is empty")
+		}
+
+		if err = e.writeUTF8(p.name); err != nil {
+			return
+		}
+
+		if err = e.encode(p.value); err != nil {
+			return
+		}
+	}
+
+	// end: 00 00 09
+	_, err = e.buf.Write([]byte{0x00, 0x00, AMF0_END_OBJECT})
+
+	return
+}
+
+func (e *Encoder) writeObject(v reflect.Value, props []objectProp) (err error) {
+	var isRef bool
+	if isRef, err = e.writeReference(v); err != nil || isRef {
+		return
+	}
+
+	if err = e.buf.WriteByte(AMF0_OBJECT); err != nil {
+		return
+	}
+
+	return e.writeProps(props)
+}
+
+// ECMA array: 4个字节的个数 + 和 object 一样的属性
+func (e *Encoder) writeECMAArray(v reflect.Value) (err error) {
+	if v.IsNil() {
+		return e.buf.WriteByte(AMF0_NULL)
+	}
+
+	var isRef bool
+	if isRef, err = e.writeReference(v); err != nil || isRef {
+		return
+	}
+
+	if err = e.buf.WriteByte(AMF0_ECMA_ARRAY); err != nil {
+		return
+	}
+
+	if err = binary.Write(&e.buf, binary.BigEndian, uint32(v.Len())); err != nil {
+		return
+	}
+
+	return e.writeProps(mapProps(v))
+}
+
+func (e *Encoder) writeTypedObject(v reflect.Value, obj *TypedObject) (err error) {
+	var isRef bool
+	if isRef, err = e.writeReference(v); err != nil || isRef {
+		return
+	}
+
+	if err = e.buf.WriteByte(AMF0_TYPED_OBJECT); err != nil {
+		return
+	}
+
+	if err = e.writeUTF8(obj.ClassName); err != nil {
+		return
+	}
+
+	return e.writeProps(mapProps(reflect.ValueOf(obj.Object)))
+}
+
+// strict array: 4个字节的个数 + 值
+func (e *Encoder) writeStrictArray(v reflect.Value) (err error) {
+	var isRef bool
+	if v.Kind() == reflect.Slice {
+		isRef, err = e.writeReference(v)
+	} else {
+		isRef, err = e.writeReference(reflect.Value{})
+	}
+	if err != nil || isRef {
+		return
+	}
+
+	if err = e.buf.WriteByte(AMF0_STRICT_ARRAY); err != nil {
+		return
+	}
+
+	if err = binary.Write(&e.buf, binary.BigEndian, uint32(v.Len())); err != nil {
+		return
+	}
+
+	for i := 0; i < v.Len(); i++ {
+		if err = e.encode(v.Index(i).Interface()); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// AMF0_AVMPLUS_OBJECT + AMF3的值, 每次切换AMF3的引用表都重新开始
+func (e *Encoder) writeAVMPlus(v interface{}) (err error) {
+	if err = e.buf.WriteByte(AMF0_AVMPLUS_OBJECT); err != nil {
+		return
+	}
+
+	return newAMF3Encoder(&e.buf).encode(v)
+}
+
+func timeToMillisecond(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Millisecond)
+}
+
+// 秒和毫秒分开算, 换算成 time.Duration(纳秒) 超过大约292年会溢出
+func millisecondToTime(ms float64) time.Time {
+	return time.Unix(int64(ms)/1000, (int64(ms)%1000)*int64(time.Millisecond))
+}
@@ -0,0 +1,315 @@
+package amf
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// struct 的字段, 名字来自 tag `amf:"name,omitempty"`, 没有 tag 的时候用字段名
+type structField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+func structFields(t reflect.Type) (fields []structField) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		tag := f.Tag.Get("amf")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts := tag, ""
+		if i := strings.Index(tag, ","); i != -1 {
+			name, opts = tag[:i], tag[i+1:]
+		}
+
+		// 匿名的 struct 字段, 没有 tag 的时候展开
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for _, ff := range structFields(f.Type) {
+				ff.index = append([]int{i}, ff.index...)
+				fields = append(fields, ff)
+			}
+			continue
+		}
+
+		// 不导出的字段
+		if f.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		fields = append(fields, structField{
+			name:      name,
+			index:     []int{i},
+			omitEmpty: opts == "omitempty",
+		})
+	}
+
+	return
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		{
+			return v.Len() == 0
+		}
+	case reflect.Bool:
+		{
+			return !v.Bool()
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		{
+			return v.Int() == 0
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		{
+			return v.Uint() == 0
+		}
+	case reflect.Float32, reflect.Float64:
+		{
+			return v.Float() == 0
+		}
+	case reflect.Interface, reflect.Ptr:
+		{
+			return v.IsNil()
+		}
+	}
+
+	return false
+}
+
+// 对象的一个属性, 编码的时候按顺序写
+type objectProp struct {
+	name  string
+	value interface{}
+}
+
+// struct 的属性, 按字段的顺序
+func structProps(v reflect.Value) (props []objectProp) {
+	for _, f := range structFields(v.Type()) {
+		fv := v.FieldByIndex(f.index)
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+
+		props = append(props, objectProp{name: f.name, value: fv.Interface()})
+	}
+
+	return
+}
+
+// map 的属性, 按 key 排序, 这样每次编码的结果都一样
+func mapProps(v reflect.Value) (props []objectProp) {
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+	for _, k := range keys {
+		props = append(props, objectProp{name: k.String(), value: v.MapIndex(k).Interface()})
+	}
+
+	return
+}
+
+// 解码出来的对象(Object, ECMAArray, *TypedObject)
+func objectOf(src interface{}) (m map[string]interface{}, ok bool) {
+	switch v := src.(type) {
+	case Object:
+		{
+			return v, true
+		}
+	case ECMAArray:
+		{
+			return v, true
+		}
+	case *TypedObject:
+		{
+			return v.Object, true
+		}
+	case TypedObject:
+		{
+			return v.Object, true
+		}
+	}
+
+	return nil, false
+}
+
+// 把解码出来的值(src)赋值给 dst, 数字可以赋值给任意的整数和浮点数类型, 对象可以赋值给 struct 和 map.
+// depth 是剩下可以嵌套的层数, 引用可以指向自己(对象里面引用自己), 没有限制的时候会一直递归下去.
+func assign(dst reflect.Value, src interface{}, depth int) (err error) {
+	if depth <= 0 {
+		return ErrDepth
+	}
+
+	if src == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return
+	}
+
+	sv := reflect.ValueOf(src)
+
+	// 类型一样或者是 interface{} 的时候直接赋值
+	if sv.Type().AssignableTo(dst.Type()) {
+		dst.Set(sv)
+		return
+	}
+
+	if _, ok := src.(Undefined); ok {
+		dst.Set(reflect.Zero(dst.Type()))
+		return
+	}
+
+	switch dst.Kind() {
+	case reflect.Ptr:
+		{
+			if dst.IsNil() {
+				dst.Set(reflect.New(dst.Type().Elem()))
+			}
+
+			return assign(dst.Elem(), src, depth)
+		}
+	case reflect.Bool:
+		{
+			if b, ok := src.(bool); ok {
+				dst.SetBool(b)
+				return
+			}
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		{
+			if f, ok := src.(float64); ok {
+				// 和 encoding/json 一样, 有小数或者超出范围的时候返回错误, 不截断
+				if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 || dst.OverflowInt(int64(f)) {
+					return errors.New(fmt.Sprintf("amf: cannot unmarshal number %v into Go value of type %v", f, dst.Type()))
+				}
+
+				dst.SetInt(int64(f))
+				return
+			}
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		{
+			if f, ok := src.(float64); ok {
+				if f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 || dst.OverflowUint(uint64(f)) {
+					return errors.New(fmt.Sprintf("amf: cannot unmarshal number %v into Go value of type %v", f, dst.Type()))
+				}
+
+				dst.SetUint(uint64(f))
+				return
+			}
+		}
+	case reflect.Float32, reflect.Float64:
+		{
+			if f, ok := src.(float64); ok {
+				if dst.OverflowFloat(f) {
+					return errors.New(fmt.Sprintf("amf: cannot unmarshal number %v into Go value of type %v", f, dst.Type()))
+				}
+
+				dst.SetFloat(f)
+				return
+			}
+		}
+	case reflect.String:
+		{
+			switch s := src.(type) {
+			case string:
+				{
+					dst.SetString(s)
+					return
+				}
+			case XMLDocument:
+				{
+					dst.SetString(string(s))
+					return
+				}
+			case XML:
+				{
+					dst.SetString(string(s))
+					return
+				}
+			}
+		}
+	case reflect.Struct:
+		{
+			if m, ok := objectOf(src); ok {
+				return assignStruct(dst, m, depth-1)
+			}
+		}
+	case reflect.Map:
+		{
+			if m, ok := objectOf(src); ok && dst.Type().Key().Kind() == reflect.String {
+				mv := reflect.MakeMap(dst.Type())
+
+				for k, v := range m {
+					ev := reflect.New(dst.Type().Elem()).Elem()
+					if err = assign(ev, v, depth-1); err != nil {
+						return
+					}
+
+					mv.SetMapIndex(reflect.ValueOf(k).Convert(dst.Type().Key()), ev)
+				}
+
+				dst.Set(mv)
+				return
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		{
+			if sv.Kind() == reflect.Slice || sv.Kind() == reflect.Array {
+				n := sv.Len()
+
+				if dst.Kind() == reflect.Slice {
+					dst.Set(reflect.MakeSlice(dst.Type(), n, n))
+				} else if n > dst.Len() {
+					n = dst.Len()
+				}
+
+				for i := 0; i < n; i++ {
+					if err = assign(dst.Index(i), sv.Index(i).Interface(), depth-1); err != nil {
+						return
+					}
+				}
+
+				return
+			}
+		}
+	}
+
+	return errors.New(fmt.Sprintf("amf: cannot unmarshal %T into Go value of type %v", src, dst.Type()))
+}
+
+func assignStruct(dst reflect.Value, m map[string]interface{}, depth int) (err error) {
+	for _, f := range structFields(dst.Type()) {
+		v, ok := m[f.name]
+		if !ok {
+			// 和 encoding/json 一样, 名字不区分大小写
+			for k, vv := range m {
+				if strings.EqualFold(k, f.name) {
+					v, ok = vv, true
+					break
+				}
+			}
+		}
+
+		if !ok {
+			continue
+		}
+
+		if err = assign(dst.FieldByIndex(f.index), v, depth); err != nil {
+			return
+		}
+	}
+
+	return
+}
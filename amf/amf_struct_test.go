@@ -0,0 +1,240 @@
+package amf
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testItem struct {
+	Name  string `amf:"name"`
+	Value int    `amf:"value,omitempty"`
+}
+
+// 每一种 AMF0 的类型都有一个字段
+type testAll struct {
+	Number  float64          `amf:"number"`
+	Int     int16            `amf:"int"`
+	Uint    uint8            `amf:"uint"`
+	Bool    bool             `amf:"bool"`
+	String  string           `amf:"string"`
+	Long    string           `amf:"long"`
+	Null    *testItem        `amf:"null"`
+	Strict  []int            `amf:"strict"`
+	Array   [2]string        `amf:"array"`
+	ECMA    ECMAArray        `amf:"ecma"`
+	Date    time.Time        `amf:"date"`
+	Typed   *TypedObject     `amf:"typed"`
+	XML     XMLDocument      `amf:"xml"`
+	Item    *testItem        `amf:"item"`
+	Same    *testItem        `amf:"same"` // 和 Item 是同一个指针, 编码成引用, 解码的时候分别分配
+	Map     map[string]int   `amf:"map"`
+	AMF3    AVMPlus          `amf:"amf3"`
+	Ignored string           `amf:"-"`
+	Any     interface{}      `amf:"any"`
+	Items   []testItem       `amf:"items"`
+	Props   map[string]*bool `amf:"props,omitempty"`
+}
+
+func TestStructRoundTrip(t *testing.T) {
+	item := &testItem{Name: "item", Value: 1}
+	in := testAll{
+		Number:  1.5,
+		Int:     -300,
+		Uint:    255,
+		Bool:    true,
+		String:  "string",
+		Long:    strings.Repeat("x", AMF0_STRING_MAX+1),
+		Strict:  []int{1, 2, 3},
+		Array:   [2]string{"a", "b"},
+		ECMA:    ECMAArray{"duration": float64(10)},
+		Date:    time.Date(2020, 1, 2, 3, 4, 5, 678*int(time.Millisecond), time.UTC),
+		Typed:   &TypedObject{ClassName: "class", Object: Object{"k": "v"}},
+		XML:     "<a/>",
+		Item:    item,
+		Same:    item,
+		Map:     map[string]int{"width": 1280},
+		AMF3:    AVMPlus{Value: Object{"amf3": float64(3)}},
+		Ignored: "ignored",
+		Any:     "any",
+		Items:   []testItem{{Name: "a"}, {Name: "b", Value: 2}},
+	}
+
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 解码成 AMF 的类型, 检查每个字段编码用的类型
+	var v interface{}
+	if v, err = NewDecoder(strings.NewReader(string(b))).DecodeValue(); err != nil {
+		t.Fatal(err)
+	}
+
+	obj, ok := v.(Object)
+	if !ok {
+		t.Fatalf("decode %T", v)
+	}
+
+	if _, ok = obj["Ignored"]; ok {
+		t.Fatal("ignored field encoded")
+	}
+
+	if _, ok = obj["props"]; ok {
+		t.Fatal("omitempty field encoded")
+	}
+
+	if s, _ := obj["long"].(string); len(s) != AMF0_STRING_MAX+1 {
+		t.Fatalf("long string %v", len(s))
+	}
+
+	for name, want := range map[string]reflect.Type{
+		"null":   nil,
+		"strict": reflect.TypeOf([]interface{}{}),
+		"ecma":   reflect.TypeOf(ECMAArray{}),
+		"date":   reflect.TypeOf(time.Time{}),
+		"typed":  reflect.TypeOf(&TypedObject{}),
+		"xml":    reflect.TypeOf(XMLDocument("")),
+		"item":   reflect.TypeOf(Object{}),
+		"amf3":   reflect.TypeOf(Object{}),
+	} {
+		if got := reflect.TypeOf(obj[name]); got != want {
+			t.Fatalf("%v: %v, want %v", name, got, want)
+		}
+	}
+
+	if reflect.ValueOf(obj["item"]).Pointer() != reflect.ValueOf(obj["same"]).Pointer() {
+		t.Fatal("same pointer not encoded as reference")
+	}
+
+	out := testAll{Ignored: "keep"}
+	if err = Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if !out.Date.Equal(in.Date) {
+		t.Fatalf("date %v, want %v", out.Date, in.Date)
+	}
+
+	// AVM+ 解码出来是 AMF3 的值, 不再是 AVMPlus
+	if out.AMF3.Value != nil || out.Ignored != "keep" {
+		t.Fatalf("amf3 %v, ignored %v", out.AMF3, out.Ignored)
+	}
+
+	in.Date, out.Date = time.Time{}, time.Time{}
+	in.AMF3, in.Ignored, out.Ignored = AVMPlus{}, "", ""
+
+	if !reflect.DeepEqual(out, in) {
+		t.Fatalf("round trip\n%+v\nwant\n%+v", out, in)
+	}
+
+	// AMF3 的对象可以赋值给 struct
+	var amf3 struct {
+		AMF3 map[string]int `amf:"amf3"`
+	}
+
+	if err = Unmarshal(b, &amf3); err != nil || amf3.AMF3["amf3"] != 3 {
+		t.Fatalf("amf3 %v, error %v", amf3.AMF3, err)
+	}
+}
+
+// ECMA array 和 typed object 可以赋值给 map 和 struct
+func TestUnmarshalObjects(t *testing.T) {
+	b, err := MarshalValues(
+		ECMAArray{"width": float64(1280), "height": float64(720)},
+		TypedObject{ClassName: "item", Object: Object{"name": "typed", "value": float64(2)}},
+		[]interface{}{"a", Undefined{}, nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var size map[string]uint16
+	var item testItem
+	var list []*string
+
+	dec := NewDecoder(strings.NewReader(string(b)))
+	for _, v := range []interface{}{&size, &item, &list} {
+		if err = dec.Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if size["width"] != 1280 || size["height"] != 720 {
+		t.Fatalf("ECMA array %v", size)
+	}
+
+	if item.Name != "typed" || item.Value != 2 {
+		t.Fatalf("typed object %+v", item)
+	}
+
+	if len(list) != 3 || *list[0] != "a" || list[1] != nil || list[2] != nil {
+		t.Fatalf("strict array %v", list)
+	}
+}
+
+// 数字超出范围或者有小数的时候返回错误, 不截断
+func TestUnmarshalNumber(t *testing.T) {
+	for _, c := range []struct {
+		num float64
+		v   interface{}
+		ok  bool
+	}{
+		{255, new(uint8), true},
+		{300, new(uint8), false},
+		{-1, new(uint), false},
+		{-128, new(int8), true},
+		{-129, new(int8), false},
+		{1.7, new(int), false},
+		{1e20, new(int64), false},
+		{1e20, new(uint64), false},
+		{1e300, new(float32), false},
+		{1.7, new(float32), true},
+	} {
+		b, _ := Marshal(c.num)
+
+		if err := Unmarshal(b, c.v); (err == nil) != c.ok {
+			t.Fatalf("%v into %T: error %v", c.num, c.v, err)
+		}
+	}
+}
+
+type testSelf struct {
+	Self *testSelf `amf:"self"`
+}
+
+// 对象里面引用自己, 赋值的时候不能一直递归下去
+func TestUnmarshalSelfReference(t *testing.T) {
+	data := []byte{AMF0_OBJECT, 0x00, 0x04, 's', 'e', 'l', 'f', AMF0_REFERENCE, 0x00, 0x00, 0x00, 0x00, AMF0_END_OBJECT}
+
+	if err := Unmarshal(data, &testSelf{}); err != ErrDepth {
+		t.Fatalf("error %v", err)
+	}
+
+	// 解码成 AMF 的类型可以, 引用的是同一个对象
+	var v interface{}
+	if err := Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := v.(Object)
+	if reflect.ValueOf(obj["self"]).Pointer() != reflect.ValueOf(obj).Pointer() {
+		t.Fatal("self reference")
+	}
+}
+
+// 毫秒数换算成时间不能溢出, 也不能丢失精度
+func TestMillisecondToTime(t *testing.T) {
+	for _, tm := range []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1600000000, 123*int64(time.Millisecond)),
+		time.Unix(-1, -500*int64(time.Millisecond)),
+		time.Date(9999, 12, 31, 23, 59, 59, 999*int(time.Millisecond), time.UTC),
+	} {
+		ms := float64(tm.Unix()*1000 + int64(tm.Nanosecond())/int64(time.Millisecond))
+
+		if got := millisecondToTime(ms); !got.Equal(tm) {
+			t.Fatalf("%v ms: %v, want %v", ms, got, tm)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package avformat
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 )
 
 const (
@@ -30,6 +32,99 @@ type AVCDecoderConfigurationRecord struct {
 	PictureParameterSetNALUnit  []byte // n byte  PPS
 }
 
+// ISO/IEC 14496-15 8.3.3.1
+//
+// High Efficiency Video Coding
+//
+
+type HEVCDecoderConfigurationRecord struct {
+	ConfigurationVersion             byte   // 8 bits Version 1
+	GeneralProfileSpace              byte   // 2 bits
+	GeneralTierFlag                  byte   // 1 bit
+	GeneralProfileIdc                byte   // 5 bits
+	GeneralProfileCompatibilityFlags uint32 // 32 bits
+	GeneralConstraintIndicatorFlags  uint64 // 48 bits
+	GeneralLevelIdc                  byte   // 8 bits
+	MinSpatialSegmentationIdc        uint16 // 4 bits reserved(1111) + 12 bits
+	ParallelismType                  byte   // 6 bits reserved(111111) + 2 bits
+	ChromaFormat                     byte   // 6 bits reserved(111111) + 2 bits
+	BitDepthLumaMinus8               byte   // 5 bits reserved(11111) + 3 bits
+	BitDepthChromaMinus8             byte   // 5 bits reserved(11111) + 3 bits
+	AvgFrameRate                     uint16 // 16 bits
+	ConstantFrameRate                byte   // 2 bits
+	NumTemporalLayers                byte   // 3 bits
+	TemporalIdNested                 byte   // 1 bit
+	LengthSizeMinusOne               byte   // 2 bits 和AVC一样,每个NALU包前面都有(lengthSizeMinusOne & 3)+1个字节的NAL包长度描述
+	NumOfArrays                      byte   // 8 bits
+
+	Arrays []HEVCNALUArray // VPS, SPS, PPS, SEI ...
+}
+
+type HEVCNALUArray struct {
+	ArrayCompleteness byte     // 1 bit
+	Reserved          byte     // 1 bit
+	NALUnitType       byte     // 6 bits 32->VPS, 33->SPS, 34->PPS
+	NumNalus          uint16   // 16 bits
+	NALUnits          [][]byte // 每个NALU前面都有 nalUnitLength(16 bits)
+}
+
+// 取出某种类型(VPS,SPS,PPS)的所有NALU
+func (hvcc *HEVCDecoderConfigurationRecord) NALUnits(naluType byte) (nalus [][]byte) {
+	for _, array := range hvcc.Arrays {
+		if array.NALUnitType == naluType {
+			nalus = append(nalus, array.NALUnits...)
+		}
+	}
+
+	return
+}
+
+// RFC 6381, HLS EXT-X-STREAM-INF CODECS
+//
+// avc1.PPCCLL -> AVCProfileIndication + ProfileCompatibility + AVCLevelIndication
+func AVCCodecString(avc AVCDecoderConfigurationRecord) string {
+	return fmt.Sprintf("avc1.%02x%02x%02x", avc.AVCProfileIndication, avc.ProfileCompatibility, avc.AVCLevelIndication)
+}
+
+// ISO/IEC 14496-15 Annex E
+//
+// hvc1.[profile_space]profile_idc.compatibility_flags(反序).[L|H]level_idc.constraint_flags(去掉末尾的0)
+// 比如: hvc1.1.6.L93.B0
+func HEVCCodecString(hvcc HEVCDecoderConfigurationRecord) string {
+	var compatibility uint32
+	for i := uint(0); i < 32; i++ {
+		compatibility |= ((hvcc.GeneralProfileCompatibilityFlags >> i) & 1) << (31 - i)
+	}
+
+	tier := "L"
+	if hvcc.GeneralTierFlag == 1 {
+		tier = "H"
+	}
+
+	codec := fmt.Sprintf("hvc1.%s%d.%X.%s%d", []string{"", "A", "B", "C"}[hvcc.GeneralProfileSpace&0x03], hvcc.GeneralProfileIdc, compatibility, tier, hvcc.GeneralLevelIdc)
+
+	// 6个字节的constraint flags,末尾为0的字节省略
+	var constraints []string
+	for i := 5; i >= 0; i-- {
+		constraints = append(constraints, fmt.Sprintf("%X", byte(hvcc.GeneralConstraintIndicatorFlags>>(uint(i)*8))))
+	}
+
+	for len(constraints) > 0 && constraints[len(constraints)-1] == "0" {
+		constraints = constraints[:len(constraints)-1]
+	}
+
+	if len(constraints) > 0 {
+		codec += "." + strings.Join(constraints, ".")
+	}
+
+	return codec
+}
+
+// mp4a.40.AudioObjectType, 比如 AAC LC -> mp4a.40.2
+func AACCodecString(asc AudioSpecificConfig) string {
+	return fmt.Sprintf("mp4a.40.%d", asc.AudioObjectType)
+}
+
 // ISO/IEC 14496-3 38(52)/page
 //
 // Audio
@@ -17,6 +17,46 @@ const (
 	FLV_TAG_TYPE_AUDIO  = 0x08
 	FLV_TAG_TYPE_VIDEO  = 0x09
 	FLV_TAG_TYPE_SCRIPT = 0x12
+
+	// Video Codec ID
+	FLV_CODECID_AVC  = 7
+	FLV_CODECID_HEVC = 12 // 非官方,国内CDN和ffmpeg(扩展)通用的H265 Codec ID
+
+	// AVC/HEVC Packet Type
+	AVC_PACKET_TYPE_SEQUENCE_HEADER = 0
+	AVC_PACKET_TYPE_NALU            = 1
+	AVC_PACKET_TYPE_END_OF_SEQUENCE = 2
+
+	// Enhanced RTMP, IsExHeader(1) + FrameType(3) + PacketType(4), 后面紧跟 FourCC(32)
+	FLV_VIDEO_EX_HEADER                       = 0x80
+	FLV_EX_PACKET_TYPE_SEQUENCE_START         = 0
+	FLV_EX_PACKET_TYPE_CODED_FRAMES           = 1 // 带有 CompositionTime(24)
+	FLV_EX_PACKET_TYPE_SEQUENCE_END           = 2
+	FLV_EX_PACKET_TYPE_CODED_FRAMES_X         = 3 // CompositionTime 为 0, 不带 CompositionTime 字段
+	FLV_EX_PACKET_TYPE_METADATA               = 4
+	FLV_EX_PACKET_TYPE_MPEG2TS_SEQUENCE_START = 5
+)
+
+var (
+	// Enhanced RTMP FourCC
+	FOURCC_AV1  = [4]byte{'a', 'v', '0', '1'}
+	FOURCC_VP9  = [4]byte{'v', 'p', '0', '9'}
+	FOURCC_HEVC = [4]byte{'h', 'v', 'c', '1'}
+
+	// Enhanced RTMP 视频编码类型. 32 bits
+	VideoFourCC = map[[4]byte]string{
+		FOURCC_AV1:  "AV1",
+		FOURCC_VP9:  "VP9",
+		FOURCC_HEVC: "HEVC"}
+
+	// Enhanced RTMP 视频包类型. 4 bits
+	VideoPacketType = map[byte]string{
+		FLV_EX_PACKET_TYPE_SEQUENCE_START:         "SequenceStart",
+		FLV_EX_PACKET_TYPE_CODED_FRAMES:           "CodedFrames",
+		FLV_EX_PACKET_TYPE_SEQUENCE_END:           "SequenceEnd",
+		FLV_EX_PACKET_TYPE_CODED_FRAMES_X:         "CodedFramesX",
+		FLV_EX_PACKET_TYPE_METADATA:               "Metadata",
+		FLV_EX_PACKET_TYPE_MPEG2TS_SEQUENCE_START: "MPEG2TSSequenceStart"}
 )
 
 var (
@@ -64,13 +104,14 @@ var (
 
 	// 视频编码类型. 4bit
 	CodecID = map[byte]string{
-		1: "JPEG (currently unused)",
-		2: "Sorenson H.263",
-		3: "Screen video",
-		4: "On2 VP6",
-		5: "On2 VP6 with alpha channel",
-		6: "Screen video version 2",
-		7: "AVC"}
+		1:  "JPEG (currently unused)",
+		2:  "Sorenson H.263",
+		3:  "Screen video",
+		4:  "On2 VP6",
+		5:  "On2 VP6 with alpha channel",
+		6:  "Screen video version 2",
+		7:  "AVC",
+		12: "HEVC"}
 )
 
 type FLVStream struct {
@@ -315,7 +356,7 @@ func ReadFLVHeader(r io.Reader) (header FLVHeader, err error) {
 	header.SignatureL = byte((signatureFLV & 0xff00) >> 8)
 	header.SignatureV = byte(signatureFLV & 0xff)
 
-	if header.SignatureF != 0x46 && header.SignatureL != 0x4c && header.SignatureV != 0x56 {
+	if header.SignatureF != 0x46 || header.SignatureL != 0x4c || header.SignatureV != 0x56 {
 		err = errors.New("flv header is not 'flv'")
 		return
 	}
@@ -330,8 +371,8 @@ func ReadFLVHeader(r io.Reader) (header FLVHeader, err error) {
 		return
 	}
 
-	header.TypeFlagsAudio = flags & 0x20
-	header.TypeFlagsVideo = flags & 0x80
+	header.TypeFlagsAudio = (flags >> 2) & 0x01
+	header.TypeFlagsVideo = flags & 0x01
 
 	header.DataOffse, err = util.ReadByteToUint32(r, true)
 	if err != nil {
@@ -382,7 +423,7 @@ func WriteFLVHeader(w io.Writer, header FLVHeader) (err error) {
 		return
 	}
 
-	flags := uint8(header.TypeFlagsReserved1)<<3 + uint8(header.TypeFlagsAudio)<<2 + uint8(header.TypeFlagsReserved2)<<1 + uint8(header.TypeFlagsReserved1)
+	flags := uint8(header.TypeFlagsReserved1)<<3 + uint8(header.TypeFlagsAudio)<<2 + uint8(header.TypeFlagsReserved2)<<1 + uint8(header.TypeFlagsVideo)
 	if err = util.WriteUint8ToByte(w, flags); err != nil {
 		return
 	}
@@ -0,0 +1,115 @@
+package avformat
+
+import (
+	"errors"
+
+	"github.com/sevenzoe/gortmp/util"
+)
+
+// ITU-T H.265 7.3.1.2
+//
+// NALU Header(2 bytes) -> forbidden_zero_bit(1) + nal_unit_type(6) + nuh_layer_id(6) + nuh_temporal_id_plus1(3)
+// nal_unit_type = (NALU[0] >> 1) & 0x3f
+
+const (
+	// HEVC NALU Type
+	HEVC_NALU_TRAIL_N        = 0
+	HEVC_NALU_TRAIL_R        = 1
+	HEVC_NALU_BLA_W_LP       = 16
+	HEVC_NALU_BLA_W_RADL     = 17
+	HEVC_NALU_BLA_N_LP       = 18
+	HEVC_NALU_IDR_W_RADL     = 19
+	HEVC_NALU_IDR_N_LP       = 20
+	HEVC_NALU_CRA_NUT        = 21
+	HEVC_NALU_RSV_IRAP_22    = 22
+	HEVC_NALU_RSV_IRAP_23    = 23
+	HEVC_NALU_VPS            = 32
+	HEVC_NALU_SPS            = 33
+	HEVC_NALU_PPS            = 34
+	HEVC_NALU_AUD            = 35
+	HEVC_NALU_EOS            = 36
+	HEVC_NALU_EOB            = 37
+	HEVC_NALU_FD             = 38
+	HEVC_NALU_SEI_PREFIX     = 39
+	HEVC_NALU_SEI_SUFFIX     = 40
+	HEVC_DCR_FIXED_LENGTH    = 23 // HEVCDecoderConfigurationRecord 固定部分的长度
+	HEVC_NALU_ARRAY_MIN_SIZE = 3  // array_completeness(1) + reserved(1) + NAL_unit_type(6) + numNalus(16)
+)
+
+// AUD: 00 00 00 01 + NALU Header(type 35) + pic_type(3) + rbsp_stop_one_bit
+var HEVC_NALU_AUD_BYTE = []byte{0x00, 0x00, 0x00, 0x01, 0x46, 0x01, 0x50}
+
+func HEVCNALUType(nalu []byte) byte {
+	return (nalu[0] >> 1) & 0x3f
+}
+
+// IRAP (Intra Random Access Point), 16 ~ 23, 相当于 H264 的 IDR
+func HEVCNALUIsIRAP(naluType byte) bool {
+	return naluType >= HEVC_NALU_BLA_W_LP && naluType <= HEVC_NALU_RSV_IRAP_23
+}
+
+func ReadHEVCDecoderConfigurationRecord(data []byte) (hvcc HEVCDecoderConfigurationRecord, err error) {
+	if len(data) < HEVC_DCR_FIXED_LENGTH {
+		err = errors.New("HEVCDecoderConfigurationRecord length < 23")
+		return
+	}
+
+	hvcc.ConfigurationVersion = data[0]
+	hvcc.GeneralProfileSpace = data[1] >> 6
+	hvcc.GeneralTierFlag = (data[1] >> 5) & 0x01
+	hvcc.GeneralProfileIdc = data[1] & 0x1f
+	hvcc.GeneralProfileCompatibilityFlags = util.BigEndian.Uint32(data[2:6])
+	hvcc.GeneralConstraintIndicatorFlags = util.BigEndian.Uint48(data[6:12])
+	hvcc.GeneralLevelIdc = data[12]
+	hvcc.MinSpatialSegmentationIdc = util.BigEndian.Uint16(data[13:15]) & 0x0fff
+	hvcc.ParallelismType = data[15] & 0x03
+	hvcc.ChromaFormat = data[16] & 0x03
+	hvcc.BitDepthLumaMinus8 = data[17] & 0x07
+	hvcc.BitDepthChromaMinus8 = data[18] & 0x07
+	hvcc.AvgFrameRate = util.BigEndian.Uint16(data[19:21])
+	hvcc.ConstantFrameRate = data[21] >> 6
+	hvcc.NumTemporalLayers = (data[21] >> 3) & 0x07
+	hvcc.TemporalIdNested = (data[21] >> 2) & 0x01
+	hvcc.LengthSizeMinusOne = data[21] & 0x03
+	hvcc.NumOfArrays = data[22]
+
+	index := HEVC_DCR_FIXED_LENGTH
+
+	for i := 0; i < int(hvcc.NumOfArrays); i++ {
+		if index+HEVC_NALU_ARRAY_MIN_SIZE > len(data) {
+			err = errors.New("HEVCDecoderConfigurationRecord array error")
+			return
+		}
+
+		array := HEVCNALUArray{
+			ArrayCompleteness: data[index] >> 7,
+			Reserved:          (data[index] >> 6) & 0x01,
+			NALUnitType:       data[index] & 0x3f,
+			NumNalus:          util.BigEndian.Uint16(data[index+1:]),
+		}
+
+		index += HEVC_NALU_ARRAY_MIN_SIZE
+
+		for j := 0; j < int(array.NumNalus); j++ {
+			if index+2 > len(data) {
+				err = errors.New("HEVCDecoderConfigurationRecord nalu length error")
+				return
+			}
+
+			length := int(util.BigEndian.Uint16(data[index:]))
+			index += 2
+
+			if index+length > len(data) {
+				err = errors.New("HEVCDecoderConfigurationRecord nalu data error")
+				return
+			}
+
+			array.NALUnits = append(array.NALUnits, data[index:index+length])
+			index += length
+		}
+
+		hvcc.Arrays = append(hvcc.Arrays, array)
+	}
+
+	return
+}
@@ -9,13 +9,41 @@ import (
 	"github.com/sevenzoe/gortmp/util"
 )
 
+// 重复发布同一个流名字的策略(LiveRepublish), rtmp 包里面的 RTMP_REPUBLISH_* 就是这几个
+const (
+	LiveRepublishReject   = "reject"
+	LiveRepublishTakeover = "takeover"
+	LiveRepublishBackup   = "backup"
+)
+
 var (
-	AppName          string
-	DebugMode        bool
-	HLSEnabled       bool
-	HLSFragment      int64
-	HLSWindow        int
-	HLSPath          string
+	AppName         string
+	DebugMode       bool
+	HLSEnabled      bool
+	HLSFragment     int64
+	HLSWindow       int
+	HLSPath         string
+	TSServiceName   string // SDT 业务名称
+	TSProviderName  string // SDT 提供商名称
+	TSProgramNumber int    // 节目号
+	TSPmtPID        int    // PMT PID
+	TSVideoPID      int    // 视频 PID
+	TSAudioPID      int    // 音频 PID
+	TSAudioLanguage string // 音频语言(ISO 639, 比如 chi, eng), 为空则不写语言描述符
+
+	LiveUnpublishTimeout int                 // 发布者停止发布之后, 播放者等待重新发布的秒数
+	LiveRepublish        map[string]string   // 重复发布同一个流名字: reject, takeover, backup. key 是 app, "" 是默认
+	LiveFailover         map[string][]string // 主备输入, key 是播放的流路径, 值是主输入和备用输入的流路径
+	LiveFailoverStall    int                 // 正在用的输入多少毫秒没有数据之后切换到另一个输入
+
+	TLSEnabled        bool                   // 是否开启 RTMPS 和 HTTPS
+	TLSRtmpsAddr      string                 // RTMPS 监听的地址
+	TLSHttpsAddr      string                 // HTTPS 监听的地址
+	TLSCertificates   []util.CertificateFile // 证书和私钥文件, 第一个是默认的证书, 其他的按照 SNI 选择
+	TLSReloadInterval int                    // 检查证书文件修改的秒数
+
+	SOPersistence    bool   // 是否保存永久共享对象(Remote Shared Object)
+	SOPath           string // 永久共享对象保存的路径
 	ResourcePath     string // 资源文件的路径
 	ResourceLivePath string // 资源文件的路径
 	ResourceVodPath  string // 资源文件的路径
@@ -183,6 +211,79 @@ func (cfg *Config) initBaseData() (err error) {
 		}
 	}
 
+	if value, err = cfg.Read("TS", "Service_Name"); err != nil {
+		TSServiceName = AppName
+	} else {
+		TSServiceName = value
+	}
+
+	if value, err = cfg.Read("TS", "Provider_Name"); err != nil {
+		TSProviderName = AppName
+	} else {
+		TSProviderName = value
+	}
+
+	TSProgramNumber = cfg.readInt("TS", "Program_Number", 0x0001)
+	TSPmtPID = cfg.readInt("TS", "PMT_PID", 0x1001)
+	TSVideoPID = cfg.readInt("TS", "Video_PID", 0x0101)
+	TSAudioPID = cfg.readInt("TS", "Audio_PID", 0x0102)
+
+	if value, err = cfg.Read("TS", "Audio_Language"); err != nil {
+		TSAudioLanguage = ""
+	} else {
+		TSAudioLanguage = value
+	}
+
+	LiveUnpublishTimeout = cfg.readInt("Live", "Unpublish_Timeout", 10)
+
+	// Republish = reject, Republish.myapp = takeover
+	LiveRepublish = map[string]string{"": LiveRepublishReject}
+
+	if sec, ok := cfg.Secions["Live"]; ok {
+		for key, value := range sec.Fields {
+			if key == "Republish" {
+				LiveRepublish[""] = value
+			} else if strings.HasPrefix(key, "Republish.") {
+				LiveRepublish[strings.TrimPrefix(key, "Republish.")] = value
+			}
+		}
+	}
+
+	LiveFailoverStall = cfg.readInt("Live", "Failover_Stall", 3000)
+
+	// live/main = main_a, main_b. 输入的名字在同一个 app 下面
+	LiveFailover = make(map[string][]string)
+
+	if sec, ok := cfg.Secions["Failover"]; ok {
+		for key, value := range sec.Fields {
+			key = strings.Trim(key, "/")
+
+			names := strings.Split(value, ",")
+			if len(names) != 2 || strings.Index(key, "/") < 0 {
+				return errors.New("Init error, Failover: " + key + " = " + value)
+			}
+
+			app := key[:strings.LastIndex(key, "/")]
+			for _, name := range names {
+				LiveFailover[key] = append(LiveFailover[key], app+"/"+strings.TrimSpace(name))
+			}
+		}
+	}
+
+	if err = cfg.initTLS(); err != nil {
+		return
+	}
+
+	if value, err = cfg.Read("SharedObject", "Persistence"); err != nil {
+		SOPersistence = false
+	} else {
+		if value == "on" {
+			SOPersistence = true
+		} else {
+			SOPersistence = false
+		}
+	}
+
 	if dir, err = os.Getwd(); err != nil {
 		return
 	}
@@ -192,6 +293,12 @@ func (cfg *Config) initBaseData() (err error) {
 	ResourceTempPath = ResourcePath + "/temp"
 	ResourceLivePath = ResourcePath + "/live"
 
+	if value, err = cfg.Read("SharedObject", "Path"); err != nil {
+		SOPath = ResourcePath + "/so"
+	} else {
+		SOPath = value
+	}
+
 	if !util.Exist(ResourcePath) {
 		if err = os.Mkdir(ResourcePath, os.ModePerm); err != nil {
 			return
@@ -218,3 +325,96 @@ func (cfg *Config) initBaseData() (err error) {
 
 	return
 }
+
+// Cert = a.pem, Key = a.key 是默认的证书, Cert.<name> = b.pem, Key.<name> = b.key 是其他的证书
+func (cfg *Config) initTLS() (err error) {
+	var value string
+	if value, err = cfg.Read("TLS", "Enabled"); err != nil || value != "on" {
+		TLSEnabled = false
+		return nil
+	}
+
+	TLSEnabled = true
+
+	if TLSRtmpsAddr, err = cfg.Read("TLS", "RTMPS_Addr"); err != nil {
+		TLSRtmpsAddr = ":443"
+	}
+
+	if TLSHttpsAddr, err = cfg.Read("TLS", "HTTPS_Addr"); err != nil {
+		TLSHttpsAddr = ":8443"
+	}
+
+	TLSReloadInterval = cfg.readInt("TLS", "Reload_Interval", 10)
+
+	TLSCertificates = nil
+
+	var f util.CertificateFile
+	if f.Cert, err = cfg.Read("TLS", "Cert"); err != nil {
+		return errors.New("Init error, TLS Cert not found.")
+	}
+
+	if f.Key, err = cfg.Read("TLS", "Key"); err != nil {
+		return errors.New("Init error, TLS Key not found.")
+	}
+
+	TLSCertificates = append(TLSCertificates, f)
+
+	for key, value := range cfg.Secions["TLS"].Fields {
+		if !strings.HasPrefix(key, "Cert.") {
+			continue
+		}
+
+		f.Cert = value
+		if f.Key, err = cfg.Read("TLS", "Key."+strings.TrimPrefix(key, "Cert.")); err != nil {
+			return errors.New("Init error, TLS " + key + " without Key.")
+		}
+
+		TLSCertificates = append(TLSCertificates, f)
+	}
+
+	return nil
+}
+
+// 读取整数,支持十进制和十六进制(0x开头),读取失败返回默认值
+func (cfg *Config) readInt(sectionName string, key string, def int) int {
+	value, err := cfg.Read(sectionName, key)
+	if err != nil {
+		return def
+	}
+
+	v, err := strconv.ParseInt(value, 0, 32)
+	if err != nil {
+		return def
+	}
+
+	return int(v)
+}
+
+// app 的重复发布策略, 没有配置的时候使用默认的
+func Republish(app string) string {
+	app = strings.Trim(app, "/")
+	if v, ok := LiveRepublish[app]; ok {
+		return v
+	}
+
+	if v, ok := LiveRepublish[""]; ok {
+		return v
+	}
+
+	return LiveRepublishReject
+}
+
+// 发布的流路径是不是主备输入. 是的话返回播放的流路径, backup 表示是备用输入.
+func Failover(streamPath string) (path string, backup bool, ok bool) {
+	for k, v := range LiveFailover {
+		if v[0] == streamPath {
+			return k, false, true
+		}
+
+		if v[1] == streamPath {
+			return k, true, true
+		}
+	}
+
+	return
+}
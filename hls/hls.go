@@ -12,6 +12,7 @@ import (
 
 const (
 	HLS_KEY_METHOD_AES_128 = "AES-128"
+	HLS_DEFAULT_BANDWIDTH  = 2000000 // EXT-X-STREAM-INF BANDWIDTH 是必须的,不知道码率的时候用这个值
 )
 
 // https://datatracker.ietf.org/doc/draft-pantos-http-live-streaming/
@@ -43,8 +44,48 @@ type PlaylistKey struct {
 }
 
 type PlaylistInf struct {
-	Duration float64
-	Title    string
+	Duration      float64
+	Title         string
+	Discontinuity bool // 和前面的媒体段不连续, 前面加上 #EXT-X-DISCONTINUITY (4.3.2.3)
+}
+
+func (inf PlaylistInf) String() (ss string) {
+	if inf.Discontinuity {
+		ss = "#EXT-X-DISCONTINUITY\n"
+	}
+
+	ss += fmt.Sprintf("#EXTINF:%.3f,\n"+
+		"%s\n", inf.Duration, inf.Title)
+
+	return
+}
+
+// Master Playlist 里面的一路流. (4.3.4.2)
+type PlaylistStreamInf struct {
+	Bandwidth int    // peak segment bit rate, 必须.
+	Codecs    string // RFC 6381, 比如 "avc1.64001f,mp4a.40.2", "hvc1.1.6.L93.B0,mp4a.40.2"
+	Uri       string // media playlist
+}
+
+func WriteMasterPlaylist(filename string, infs []PlaylistStreamInf) (err error) {
+	var file *os.File
+	file, err = os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	ss := "#EXTM3U\n"
+	for _, inf := range infs {
+		ss += fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"%s\"\n"+
+			"%s\n", inf.Bandwidth, inf.Codecs, inf.Uri)
+	}
+
+	if _, err = file.WriteString(ss); err != nil {
+		return
+	}
+
+	return
 }
 
 func (this *Playlist) Init(filename string) (err error) {
@@ -96,10 +137,7 @@ func (this *Playlist) WriteInf(filename string, inf PlaylistInf) (err error) {
 	}
 	defer file.Close()
 
-	ss := fmt.Sprintf("#EXTINF:%.3f,\n"+
-		"%s\n", inf.Duration, inf.Title)
-
-	if _, err = file.WriteString(ss); err != nil {
+	if _, err = file.WriteString(inf.String()); err != nil {
 		return
 	}
 
@@ -150,8 +188,13 @@ func (this *Playlist) UpdateInf(filename string, tmpFilename string, inf Playlis
 			ls[i] = newSeqStr
 		}
 
+		// 第一个媒体段前面的 #EXT-X-DISCONTINUITY 一起删掉, #EXT-X-DISCONTINUITY-SEQUENCE 加一 (4.3.3.3)
 		if strings.Contains(v, "#EXTINF") {
-			oldContent = append(ls[0:i], ls[i+2:]...)
+			if i > 0 && ls[i-1] == "#EXT-X-DISCONTINUITY" {
+				oldContent = this.nextDiscontinuity(append(ls[0:i-1], ls[i+2:]...))
+			} else {
+				oldContent = append(ls[0:i], ls[i+2:]...)
+			}
 			break
 		}
 	}
@@ -160,10 +203,7 @@ func (this *Playlist) UpdateInf(filename string, tmpFilename string, inf Playlis
 		newContent += v + "\n"
 	}
 
-	ss := fmt.Sprintf("#EXTINF:%.3f,\n"+
-		"%s\n", inf.Duration, inf.Title)
-
-	newContent += ss
+	newContent += inf.String()
 
 	if _, err = tmpFile.WriteString(newContent); err != nil {
 		return
@@ -184,6 +224,28 @@ func (this *Playlist) UpdateInf(filename string, tmpFilename string, inf Playlis
 	return
 }
 
+// #EXT-X-DISCONTINUITY-SEQUENCE 加一, 没有的时候加在 #EXT-X-MEDIA-SEQUENCE 后面
+func (this *Playlist) nextDiscontinuity(ls []string) []string {
+	this.Discontinuity++
+
+	tag := "#EXT-X-DISCONTINUITY-SEQUENCE:" + strconv.Itoa(this.Discontinuity)
+
+	for i, v := range ls {
+		if strings.HasPrefix(v, "#EXT-X-DISCONTINUITY-SEQUENCE") {
+			ls[i] = tag
+			return ls
+		}
+	}
+
+	for i, v := range ls {
+		if strings.HasPrefix(v, "#EXT-X-MEDIA-SEQUENCE") {
+			return append(ls[:i+1], append([]string{tag}, ls[i+1:]...)...)
+		}
+	}
+
+	return ls
+}
+
 func (this *Playlist) GetInfCount(filename string) (num int, err error) {
 	var ls []string
 	if ls, err = util.ReadFileLines(filename); err != nil {
@@ -7,6 +7,7 @@ import (
 	"syscall"
 	//"fmt"
 	//"os"
+	"crypto/tls"
 	"encoding/hex"
 	"net/http"
 	"sync"
@@ -14,6 +15,7 @@ import (
 
 	"github.com/sevenzoe/gortmp/config"
 	"github.com/sevenzoe/gortmp/rtmp"
+	"github.com/sevenzoe/gortmp/util"
 	//"github.com/sevenzoe/gortmp/avformat"
 	//"github.com/sevenzoe/gortmp/mpegts"
 )
@@ -24,8 +26,9 @@ const (
 )
 
 var (
-	tracRv *os.File
-	wsPool = NewWsPool()
+	tracRv    *os.File
+	wsPool    = NewWsPool()
+	flvServer = newServer("", nil) // WebSocket FLV 的发布者(/publish/), 和 RTMP 的发布者用同样的 Handler
 )
 
 type ServerHandler struct {
@@ -56,19 +59,29 @@ func (p *ServerHandler) OnRecvFrame(frame *rtmp.NetFrame) {
 
 	//收到网络数据帧事件
 	p.frameCnt++
-	wsPool.PushRtmpNetFrame(frame)
+	frame.Refs(0)
 }
 
 var handler rtmp.ServerHandler = &ServerHandler{}
 
 func ListenAndServe(addr string) error {
-	s := rtmp.Server{
-		Addr:        addr,                            // 服务器的IP地址和端口信息
-		Handler:     handler,                         // 请求处理函数的路由复用器
-		ReadTimeout: time.Duration(time.Second * 15), // timeout
-		WriteTimout: time.Duration(time.Second * 15), // timeout
-		Lock:        new(sync.Mutex)}                 // lock
-	return s.ListenAndServer()
+	return ListenAndServeTLS(addr, nil)
+}
+
+// tlsConfig 不为 nil 的时候是 RTMPS
+func ListenAndServeTLS(addr string, tlsConfig *tls.Config) error {
+	return newServer(addr, tlsConfig).ListenAndServer()
+}
+
+func newServer(addr string, tlsConfig *tls.Config) *rtmp.Server {
+	return &rtmp.Server{
+		Addr:        addr,                                 // 服务器的IP地址和端口信息
+		Handler:     handler,                              // 请求处理函数的路由复用器
+		ReadTimeout: time.Duration(time.Second * 15),      // timeout
+		WriteTimout: time.Duration(time.Second * 15),      // timeout
+		TLSConfig:   tlsConfig,                            // RTMPS
+		NoFrameTap:  !isTracFrameData && !isTracFrameInfo, // 只有跟踪的时候才需要 OnRecvFrame
+		Lock:        new(sync.Mutex)}                      // lock
 }
 
 func main() {
@@ -86,10 +99,36 @@ func main() {
 	}
 
 	http.HandleFunc("/", serveHome)
-	http.HandleFunc("/live/", liveWs)
-	http.HandleFunc("/live/ws", serveWs)
+	http.HandleFunc("/live/", liveWs)       // WebSocket FLV: /live/{app}/{stream}
+	http.HandleFunc("/publish/", publishWs) // WebSocket FLV: /publish/{app}/{stream}
 	http.Handle("/js/", http.FileServer(http.Dir("./")))
 	//	http.HandleFunc("/js/", pathJs)
+
+	// RTMPT(RTMP over HTTP)
+	tunnel := newServer("", nil).Tunnel()
+	for _, path := range []string{"/open/", "/send/", "/idle/", "/close/"} {
+		http.Handle(path, tunnel)
+	}
+
+	// RTMPS 和 HTTPS 用同样的证书, 按照 SNI 选择, 证书文件修改之后重新加载
+	if config.TLSEnabled {
+		certs, err := util.NewCertificates(config.TLSCertificates, time.Duration(config.TLSReloadInterval)*time.Second)
+		if err != nil {
+			panic(err)
+		}
+
+		if err = ListenAndServeTLS(config.TLSRtmpsAddr, certs.TLSConfig()); err != nil {
+			panic(err)
+		}
+
+		go func() {
+			hs := &http.Server{Addr: config.TLSHttpsAddr, TLSConfig: certs.TLSConfig()}
+			if err := hs.ListenAndServeTLS("", ""); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
 	if err := http.ListenAndServe(*addr, nil); err != nil {
 		panic(err)
 	}
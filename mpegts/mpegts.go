@@ -59,6 +59,7 @@ const (
 	TABLE_ISO_IEC_14496_ODC = 0x05
 	TABLE_MS                = 0x06
 	TABLE_IPMP_CIS          = 0x07
+	TABLE_SDT_ACTUAL        = 0x42 // ETSI EN 300 468, service_description_section - actual_transport_stream
 	// 0x06 - 0x37 ITU-T Rec. H.222.0 | ISO/IEC 13818-1 reserved
 	// 0x38 - 0x3F Defined in ISO/IEC 13818-6
 	// 0x40 - 0xFE User private
@@ -66,6 +67,16 @@ const (
 
 	STREAM_TYPE_H264 = 0x1B
 	STREAM_TYPE_AAC  = 0X0F
+	STREAM_TYPE_MP3  = 0x03
+	STREAM_TYPE_H265 = 0x24
+
+	// Descriptor Tag
+	DESCRIPTOR_TAG_ISO_639_LANGUAGE = 0x0A // ios13818-1, ISO_639_language_descriptor
+	DESCRIPTOR_TAG_SERVICE          = 0x48 // ETSI EN 300 468, service_descriptor
+
+	// Service Type (ETSI EN 300 468)
+	SERVICE_TYPE_DIGITAL_TV    = 0x01
+	SERVICE_TYPE_DIGITAL_RADIO = 0x02
 
 	// 1110 xxxx
 	// 110x xxxx
@@ -593,8 +604,6 @@ func (s *MpegTsStream) TestWrite(fileName string) error {
 			videoFrame++
 		}
 
-		fmt.Sprintf("%s", tsPesPkt)
-
 		// if err := WritePESPacket(file, tsPesPkt.TsPkt.Header, tsPesPkt.PesPkt); err != nil {
 		// 	return err
 		// }
@@ -0,0 +1,385 @@
+package mpegts
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/sevenzoe/gortmp/util"
+)
+
+//
+// Muxer
+//
+// PAT + SDT + PMT(1..N) + PES
+// 一个TS流(multiplex)里面可以有多个节目(program),每个节目有自己的PMT,以及多个ES流(视频,音频)
+//
+
+const (
+	MUXER_DEFAULT_TRANSPORT_STREAM_ID = 0x0001
+	MUXER_DEFAULT_ORIGINAL_NETWORK_ID = 0xff01
+	MUXER_DEFAULT_PROGRAM_NUMBER      = 0x0001
+	MUXER_DEFAULT_PMT_PID             = 0x1001
+	MUXER_DEFAULT_VIDEO_PID           = 0x0101
+	MUXER_DEFAULT_AUDIO_PID           = 0x0102
+)
+
+// 节目里面的一路ES流
+type MuxerStream struct {
+	StreamType byte               // PMT 中的 stream_type, 比如 STREAM_TYPE_H264, STREAM_TYPE_AAC
+	Pid        uint16             // elementary_PID
+	StreamID   byte               // PES 中的 stream_id, 视频 0xE0 ~ 0xEF, 音频 0xC0 ~ 0xDF
+	Descriptor []MpegTsDescriptor // ES_info 描述符,比如语言描述符
+	cc         byte               // ContinuityCounter
+}
+
+// 一个节目,对应PAT中的一项,SDT中的一个业务,以及一个PMT
+type MuxerProgram struct {
+	ProgramNumber uint16             // program_number, 同时也是SDT中的service_id
+	PmtPid        uint16             // program_map_PID
+	PcrPid        uint16             // PCR_PID, 默认为第一个添加的视频流(没有视频的时候为第一个流)
+	ServiceType   byte               // SDT service_type
+	ServiceName   string             // SDT 业务名称
+	ProviderName  string             // SDT 提供商名称
+	Descriptor    []MpegTsDescriptor // program_info 描述符
+	Stream        []*MuxerStream
+	cc            byte
+}
+
+type Muxer struct {
+	TransportStreamID uint16
+	OriginalNetworkID uint16
+	VersionNumber     byte // 5 bits, 节目或者流发生变化的时候需要加1
+	Program           []*MuxerProgram
+	patCC             byte
+	sdtCC             byte
+}
+
+func NewMuxer() (m *Muxer) {
+	m = new(Muxer)
+	m.TransportStreamID = MUXER_DEFAULT_TRANSPORT_STREAM_ID
+	m.OriginalNetworkID = MUXER_DEFAULT_ORIGINAL_NETWORK_ID
+	return
+}
+
+// ISO_639_language_descriptor: ISO_639_language_code(24) + audio_type(8)
+// audioType: 0 -> Undefined, 1 -> Clean effects, 2 -> Hearing impaired, 3 -> Visual impaired commentary
+func NewLanguageDescriptor(language string, audioType byte) (desc MpegTsDescriptor, err error) {
+	if len(language) != 3 {
+		err = errors.New(fmt.Sprintf("%s, language=%s", "ISO 639 language code must be 3 bytes", language))
+		return
+	}
+
+	desc.Tag = DESCRIPTOR_TAG_ISO_639_LANGUAGE
+	desc.Data = append([]byte(language), audioType)
+	desc.Length = byte(len(desc.Data))
+
+	return
+}
+
+func (m *Muxer) AddProgram(programNumber, pmtPid uint16, serviceName, providerName string) (p *MuxerProgram, err error) {
+	// program_number == 0 是NIT
+	if programNumber == 0 {
+		err = errors.New("program number 0 is reserved for NIT")
+		return
+	}
+
+	for _, v := range m.Program {
+		if v.ProgramNumber == programNumber {
+			err = errors.New(fmt.Sprintf("%s, program=%d", "program number already exists", programNumber))
+			return
+		}
+	}
+
+	if err = m.checkPid(pmtPid); err != nil {
+		return
+	}
+
+	p = &MuxerProgram{
+		ProgramNumber: programNumber,
+		PmtPid:        pmtPid,
+		ServiceType:   SERVICE_TYPE_DIGITAL_TV,
+		ServiceName:   serviceName,
+		ProviderName:  providerName,
+	}
+
+	m.Program = append(m.Program, p)
+	m.VersionNumber = (m.VersionNumber + 1) % 32
+
+	return
+}
+
+func (m *Muxer) AddStream(p *MuxerProgram, streamType byte, pid uint16, descs ...MpegTsDescriptor) (s *MuxerStream, err error) {
+	if err = m.checkPid(pid); err != nil {
+		return
+	}
+
+	s = &MuxerStream{
+		StreamType: streamType,
+		Pid:        pid,
+		Descriptor: descs,
+	}
+
+	// 同一个节目里面,同类型的流, stream_id 依次加1
+	var n byte
+	isVideo := isVideoStreamType(streamType)
+	for _, v := range p.Stream {
+		if isVideoStreamType(v.StreamType) == isVideo {
+			n++
+		}
+	}
+
+	if isVideo {
+		s.StreamID = STREAM_ID_VIDEO + n%16
+	} else {
+		s.StreamID = STREAM_ID_AUDIO + n%32
+	}
+
+	// PCR 优先放在视频流上
+	if p.PcrPid == 0 || (isVideo && !p.hasVideo()) {
+		p.PcrPid = pid
+	}
+
+	p.Stream = append(p.Stream, s)
+	m.VersionNumber = (m.VersionNumber + 1) % 32
+
+	return
+}
+
+func (m *Muxer) FindStream(pid uint16) (p *MuxerProgram, s *MuxerStream) {
+	for _, p := range m.Program {
+		for _, s := range p.Stream {
+			if s.Pid == pid {
+				return p, s
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func (m *Muxer) checkPid(pid uint16) (err error) {
+	// 0x0000 - 0x000F 保留, 0x0010 - 0x001F DVB SI 使用, 0x1FFF 空包
+	if pid < 0x0020 || pid >= 0x1fff {
+		err = errors.New(fmt.Sprintf("%s, pid=0x%x", "pid out of range", pid))
+		return
+	}
+
+	for _, p := range m.Program {
+		if p.PmtPid == pid {
+			err = errors.New(fmt.Sprintf("%s, pid=0x%x", "pid already used by pmt", pid))
+			return
+		}
+
+		for _, s := range p.Stream {
+			if s.Pid == pid {
+				err = errors.New(fmt.Sprintf("%s, pid=0x%x", "pid already used by stream", pid))
+				return
+			}
+		}
+	}
+
+	return
+}
+
+func (p *MuxerProgram) hasVideo() bool {
+	for _, s := range p.Stream {
+		if isVideoStreamType(s.StreamType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isVideoStreamType(streamType byte) bool {
+	switch streamType {
+	case 0x01, 0x02, 0x10, STREAM_TYPE_H264, STREAM_TYPE_H265:
+		return true
+	}
+
+	return false
+}
+
+// 写入 PAT + SDT + 每个节目的PMT, 每个切片(或者每隔一段时间)开头都需要写一次
+func (m *Muxer) WriteTables(w io.Writer) (err error) {
+	if len(m.Program) == 0 {
+		err = errors.New("muxer has no program")
+		return
+	}
+
+	if err = m.WritePAT(w); err != nil {
+		return
+	}
+
+	if err = m.WriteSDT(w); err != nil {
+		return
+	}
+
+	for _, p := range m.Program {
+		if err = m.WritePMT(w, p); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (m *Muxer) WritePAT(w io.Writer) (err error) {
+	pat := MpegTsPAT{
+		TableID:                TABLE_PAS,
+		SectionSyntaxIndicator: 1,
+		TransportStreamID:      m.TransportStreamID,
+		VersionNumber:          m.VersionNumber,
+		CurrentNextIndicator:   1,
+	}
+
+	for _, p := range m.Program {
+		pat.Program = append(pat.Program, MpegTsPATProgram{
+			ProgramNumber: p.ProgramNumber,
+			ProgramMapPID: p.PmtPid,
+		})
+	}
+
+	bw := &bytes.Buffer{}
+	if err = WritePAT(bw, pat); err != nil {
+		return
+	}
+
+	return writePSIPackets(w, PID_PAT, &m.patCC, bw.Bytes())
+}
+
+func (m *Muxer) WriteSDT(w io.Writer) (err error) {
+	sdt := MpegTsSDT{
+		TableID:                TABLE_SDT_ACTUAL,
+		SectionSyntaxIndicator: 1,
+		TransportStreamID:      m.TransportStreamID,
+		VersionNumber:          m.VersionNumber,
+		CurrentNextIndicator:   1,
+		OriginalNetworkID:      m.OriginalNetworkID,
+	}
+
+	for _, p := range m.Program {
+		var desc MpegTsDescriptor
+		if desc, err = NewServiceDescriptor(p.ServiceType, p.ProviderName, p.ServiceName); err != nil {
+			return
+		}
+
+		sdt.Service = append(sdt.Service, MpegTsSDTService{
+			ServiceID:     p.ProgramNumber,
+			RunningStatus: 4,
+			Descriptor:    []MpegTsDescriptor{desc},
+		})
+	}
+
+	bw := &bytes.Buffer{}
+	if err = WriteSDT(bw, sdt); err != nil {
+		return
+	}
+
+	return writePSIPackets(w, PID_SDT_BAT_ST, &m.sdtCC, bw.Bytes())
+}
+
+func (m *Muxer) WritePMT(w io.Writer, p *MuxerProgram) (err error) {
+	pmt := MpegTsPMT{
+		TableID:                TABLE_TSPMS,
+		SectionSyntaxIndicator: 1,
+		ProgramNumber:          p.ProgramNumber,
+		VersionNumber:          m.VersionNumber,
+		CurrentNextIndicator:   1,
+		PcrPID:                 p.PcrPid,
+		ProgramInfoDescriptor:  p.Descriptor,
+	}
+
+	// 没有流的时候, PCR_PID 为 0x1FFF
+	if pmt.PcrPID == 0 {
+		pmt.PcrPID = 0x1fff
+	}
+
+	for _, s := range p.Stream {
+		pmt.Stream = append(pmt.Stream, MpegTsPmtStream{
+			StreamType:    s.StreamType,
+			ElementaryPID: s.Pid,
+			Descriptor:    s.Descriptor,
+		})
+	}
+
+	bw := &bytes.Buffer{}
+	if err = WritePMT(bw, pmt); err != nil {
+		return
+	}
+
+	return writePSIPackets(w, p.PmtPid, &p.cc, bw.Bytes())
+}
+
+// 将PES包写到对应PID的流里面, PES中的stream_id会被替换成该流的stream_id.
+// 只有PCR_PID上的关键帧才会带上PCR, PCR由DTS(没有DTS的时候用PTS)推算
+func (m *Muxer) WritePES(w io.Writer, pid uint16, isKeyFrame bool, packet MpegTsPESPacket) (err error) {
+	p, s := m.FindStream(pid)
+	if s == nil {
+		err = errors.New(fmt.Sprintf("%s, pid=0x%x", "muxer stream not found", pid))
+		return
+	}
+
+	packet.Header.StreamID = s.StreamID
+
+	frame := new(MpegtsPESFrame)
+	frame.Pid = pid
+	frame.IsKeyFrame = isKeyFrame && pid == p.PcrPid
+	frame.ContinuityCounter = s.cc
+
+	if packet.Header.PtsDtsFlags&0x40 != 0 {
+		frame.ProgramClockReferenceBase = DtsToPcr(packet.Header.Dts)
+	} else {
+		frame.ProgramClockReferenceBase = DtsToPcr(packet.Header.Pts)
+	}
+
+	if err = WritePESPacket(w, frame, packet); err != nil {
+		return
+	}
+
+	s.cc = frame.ContinuityCounter
+
+	return
+}
+
+// PSI (pointer_field + section) 可能大于 184 个字节,需要拆分成多个TS包
+func writePSIPackets(w io.Writer, pid uint16, cc *byte, data []byte) (err error) {
+	for i := 0; len(data) > 0; i++ {
+		tsHeader := MpegTsHeader{
+			SyncByte:             0x47,
+			Pid:                  pid,
+			AdaptionFieldControl: 1,
+			ContinuityCounter:    *cc,
+		}
+
+		if i == 0 {
+			tsHeader.PayloadUnitStartIndicator = 1
+		}
+
+		*cc = (*cc + 1) % 16
+
+		bw := &bytes.Buffer{}
+		if _, err = WriteTsHeader(bw, tsHeader); err != nil {
+			return
+		}
+
+		n := TS_PACKET_SIZE - bw.Len()
+		if n > len(data) {
+			n = len(data)
+		}
+
+		bw.Write(data[:n])
+		data = data[n:]
+
+		// Stuffing Bytes
+		bw.Write(util.GetFillBytes(0xff, TS_PACKET_SIZE-bw.Len()))
+
+		if _, err = w.Write(bw.Bytes()); err != nil {
+			return
+		}
+	}
+
+	return
+}
@@ -108,6 +108,30 @@ type MpegtsPESFrame struct {
 	ProgramClockReferenceBase uint64
 }
 
+const (
+	// PTS/DTS/PCR base 都是33 bits, 90kHz时钟,大约26.5个小时回绕一次
+	PTS_DTS_MASK = 0x1FFFFFFFF
+
+	// PCR 要比 DTS 早一点到达解码器,否则解码器缓冲区会下溢(单位:90kHz)
+	PCR_DTS_DELAY = 90 * 300
+)
+
+// 将毫秒时间戳(可以为负数,比如 dts + cts)转换成33 bits的90kHz时钟,超出部分回绕
+func MillisecondToPtsDts(ms int64) uint64 {
+	return uint64(ms*90) & PTS_DTS_MASK
+}
+
+// 由DTS推算PCR, PCR = DTS - PCR_DTS_DELAY.
+// 开始的时候(DTS < PCR_DTS_DELAY)PCR 取0, 不能回绕到33 bits的最大值附近, 否则 PCR 跑到 DTS 后面很远
+func DtsToPcr(dts uint64) uint64 {
+	dts &= PTS_DTS_MASK
+	if dts < PCR_DTS_DELAY {
+		return 0
+	}
+
+	return dts - PCR_DTS_DELAY
+}
+
 func ReadPESHeader(r io.Reader) (header MpegTsPESHeader, err error) {
 	var flags uint8
 	var length uint
@@ -0,0 +1,27 @@
+package mpegts
+
+import (
+	"testing"
+)
+
+// PCR 不能在 DTS 的后面, DTS 从0开始的时候 PCR 也是0
+func TestDtsToPcr(t *testing.T) {
+	for dts, pcr := range map[uint64]uint64{
+		0:                  0,
+		PCR_DTS_DELAY - 1:  0,
+		PCR_DTS_DELAY:      0,
+		PCR_DTS_DELAY + 90: 90,
+		PTS_DTS_MASK:       PTS_DTS_MASK - PCR_DTS_DELAY,
+	} {
+		if got := DtsToPcr(dts); got != pcr {
+			t.Fatalf("dts %v: pcr %v, want %v", dts, got, pcr)
+		}
+	}
+
+	for ms := int64(0); ms < 1000; ms += 10 {
+		dts := MillisecondToPtsDts(ms)
+		if pcr := DtsToPcr(dts); pcr > dts {
+			t.Fatalf("dts %v: pcr %v", dts, pcr)
+		}
+	}
+}
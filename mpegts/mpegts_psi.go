@@ -1,6 +1,7 @@
 package mpegts
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -20,6 +21,7 @@ const (
 	PSI_TYPE_CAT      = 4
 	PSI_TYPE_TST      = 5
 	PSI_TYPE_IPMP_CIT = 6
+	PSI_TYPE_SDT      = 7
 )
 
 type MpegTsPSI struct {
@@ -27,8 +29,10 @@ type MpegTsPSI struct {
 	// PMT
 	// CAT
 	// NIT
+	// SDT
 	Pat MpegTsPAT
 	Pmt MpegTsPMT
+	Sdt MpegTsSDT
 }
 
 // 当传输流包有效载荷包含 PSI 数据时,payload_unit_start_indicator 具有以下意义:
@@ -151,7 +155,7 @@ func WritePSI(w io.Writer, pt uint32, psi MpegTsPSI, data []byte) (err error) {
 			tableId = psi.Pat.TableID
 			sectionSyntaxIndicatorAndSectionLength = uint16(psi.Pat.SectionSyntaxIndicator)<<15 | 3<<12 | psi.Pat.SectionLength
 			transportStreamIdOrProgramNumber = psi.Pat.TransportStreamID
-			versionNumberAndCurrentNextIndicator = psi.Pat.VersionNumber<<1 | psi.Pat.CurrentNextIndicator
+			versionNumberAndCurrentNextIndicator = 3<<6 | psi.Pat.VersionNumber<<1 | psi.Pat.CurrentNextIndicator
 			sectionNumber = psi.Pat.SectionNumber
 			lastSectionNumber = psi.Pat.LastSectionNumber
 		}
@@ -165,10 +169,25 @@ func WritePSI(w io.Writer, pt uint32, psi MpegTsPSI, data []byte) (err error) {
 			tableId = psi.Pmt.TableID
 			sectionSyntaxIndicatorAndSectionLength = uint16(psi.Pmt.SectionSyntaxIndicator)<<15 | 3<<12 | psi.Pmt.SectionLength
 			transportStreamIdOrProgramNumber = psi.Pmt.ProgramNumber
-			versionNumberAndCurrentNextIndicator = psi.Pmt.VersionNumber<<1 | psi.Pmt.CurrentNextIndicator
+			versionNumberAndCurrentNextIndicator = 3<<6 | psi.Pmt.VersionNumber<<1 | psi.Pmt.CurrentNextIndicator
 			sectionNumber = psi.Pmt.SectionNumber
 			lastSectionNumber = psi.Pmt.LastSectionNumber
 		}
+	case PSI_TYPE_SDT:
+		{
+			if psi.Sdt.TableID != TABLE_SDT_ACTUAL {
+				err = errors.New(fmt.Sprintf("%s, id=%d", "write sdt table id != 0x42", psi.Sdt.TableID))
+				return
+			}
+
+			// SDT: sectionSyntaxIndicator(1) + reservedFutureUse(1) + reserved1(2)
+			tableId = psi.Sdt.TableID
+			sectionSyntaxIndicatorAndSectionLength = uint16(psi.Sdt.SectionSyntaxIndicator)<<15 | 7<<12 | psi.Sdt.SectionLength
+			transportStreamIdOrProgramNumber = psi.Sdt.TransportStreamID
+			versionNumberAndCurrentNextIndicator = 3<<6 | psi.Sdt.VersionNumber<<1 | psi.Sdt.CurrentNextIndicator
+			sectionNumber = psi.Sdt.SectionNumber
+			lastSectionNumber = psi.Sdt.LastSectionNumber
+		}
 	}
 
 	// pointer field(8)
@@ -176,7 +195,8 @@ func WritePSI(w io.Writer, pt uint32, psi MpegTsPSI, data []byte) (err error) {
 		return
 	}
 
-	cw := &util.Crc32Writer{W: w, Crc32: 0xffffffff}
+	// crc32 是从 table id 开始计算,一直到 data 结束
+	cw := &bytes.Buffer{}
 
 	// table id(8)
 	if err = util.WriteUint8ToByte(cw, tableId); err != nil {
@@ -217,9 +237,12 @@ func WritePSI(w io.Writer, pt uint32, psi MpegTsPSI, data []byte) (err error) {
 		return
 	}
 
-	// crc32
-	crc32 := util.BigLittleSwap(uint(cw.Crc32))
-	if err = util.WriteUint32ToByte(cw, uint32(crc32), true); err != nil {
+	// crc32 (MPEG-2 CRC32, 多项式 0x04C11DB7)
+	if err = util.WriteUint32ToByte(cw, GetCRC32(cw.Bytes()), true); err != nil {
+		return
+	}
+
+	if _, err = w.Write(cw.Bytes()); err != nil {
 		return
 	}
 
@@ -0,0 +1,138 @@
+package mpegts
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/sevenzoe/gortmp/util"
+)
+
+// ETSI EN 300 468 5.2.3
+//
+// SDT
+//
+
+// Service Description Table (业务描述表), PID = 0x0011
+// 机顶盒通过SDT来获取节目的名称和提供商,没有SDT的流,很多IPTV机顶盒会拒绝播放
+type MpegTsSDT struct {
+	// PSI
+	TableID                byte   // 8 bits 0x42->actual_transport_stream, 0x46->other_transport_stream
+	SectionSyntaxIndicator byte   // 1 bit  段语法标志位,固定为1
+	ReservedFutureUse1     byte   // 1 bit  1
+	Reserved1              byte   // 2 bits 保留位
+	SectionLength          uint16 // 12 bits 头两比特必为'00',剩余 10 比特指定该分段的字节数,紧随 section_length 字段开始,并包括 CRC
+	TransportStreamID      uint16 // 16 bits 与PAT中的TransportStreamID一致
+	Reserved2              byte   // 2 bits  保留位
+	VersionNumber          byte   // 5 bits  范围0-31,表示SDT的版本号
+	CurrentNextIndicator   byte   // 1 bit  发送的SDT是当前有效还是下一个SDT有效
+	SectionNumber          byte   // 8 bits  分段的号码
+	LastSectionNumber      byte   // 8 bits  最后一个分段的号码
+
+	OriginalNetworkID  uint16 // 16 bits 原始网络ID
+	ReservedFutureUse2 byte   // 8 bits  0xff
+
+	// N Loop
+	Service []MpegTsSDTService // SDT表里面所有的业务信息
+
+	Crc32 uint32 // 32 bits
+}
+
+type MpegTsSDTService struct {
+	ServiceID               uint16 // 16 bits 与PMT中的ProgramNumber一致
+	ReservedFutureUse       byte   // 6 bits
+	EITScheduleFlag         byte   // 1 bit  1->当前TS中存在该业务的EIT schedule信息
+	EITPresentFollowingFlag byte   // 1 bit  1->当前TS中存在该业务的EIT_present_following信息
+	RunningStatus           byte   // 3 bits 4->running
+	FreeCAMode              byte   // 1 bit  0->未加扰
+	DescriptorsLoopLength   uint16 // 12 bits 紧随其后的描述符的字节数
+
+	// N Loop Descriptors
+	Descriptor []MpegTsDescriptor
+}
+
+// service_descriptor:
+// service_type(8) + service_provider_name_length(8) + provider(n) + service_name_length(8) + name(n)
+func NewServiceDescriptor(serviceType byte, providerName, serviceName string) (desc MpegTsDescriptor, err error) {
+	// descriptor_length 只有 8 bits: service_type + 两个长度 + 两个名字
+	if 3+len(providerName)+len(serviceName) > 0xff {
+		err = errors.New("service descriptor name too long")
+		return
+	}
+
+	desc.Tag = DESCRIPTOR_TAG_SERVICE
+	desc.Data = append(desc.Data, serviceType)
+	desc.Data = append(desc.Data, byte(len(providerName)))
+	desc.Data = append(desc.Data, providerName...)
+	desc.Data = append(desc.Data, byte(len(serviceName)))
+	desc.Data = append(desc.Data, serviceName...)
+	desc.Length = byte(len(desc.Data))
+
+	return
+}
+
+func WriteSDTBody(w io.Writer, sdt MpegTsSDT) (err error) {
+	// originalNetworkID(16)
+	if err = util.WriteUint16ToByte(w, sdt.OriginalNetworkID, true); err != nil {
+		return
+	}
+
+	// reservedFutureUse(8)
+	if err = util.WriteUint8ToByte(w, 0xff); err != nil {
+		return
+	}
+
+	for _, service := range sdt.Service {
+		// serviceID(16)
+		if err = util.WriteUint16ToByte(w, service.ServiceID, true); err != nil {
+			return
+		}
+
+		// reservedFutureUse(6) + EITScheduleFlag(1) + EITPresentFollowingFlag(1)
+		if err = util.WriteUint8ToByte(w, 0xfc|service.EITScheduleFlag<<1|service.EITPresentFollowingFlag); err != nil {
+			return
+		}
+
+		// descriptor 业务描述,字节数不能确定
+		bw := &bytes.Buffer{}
+		if err = WritePMTDescriptor(bw, service.Descriptor); err != nil {
+			return
+		}
+
+		service.DescriptorsLoopLength = uint16(bw.Len())
+
+		// runningStatus(3) + freeCAMode(1) + descriptorsLoopLength(12)
+		if err = util.WriteUint16ToByte(w, uint16(service.RunningStatus)<<13|uint16(service.FreeCAMode)<<12|service.DescriptorsLoopLength, true); err != nil {
+			return
+		}
+
+		// descriptor
+		if _, err = w.Write(bw.Bytes()); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func WriteSDT(w io.Writer, sdt MpegTsSDT) (err error) {
+	bw := &bytes.Buffer{}
+
+	if err = WriteSDTBody(bw, sdt); err != nil {
+		return
+	}
+
+	if sdt.SectionLength == 0 {
+		sdt.SectionLength = 2 + 3 + 4 + uint16(len(bw.Bytes()))
+	}
+
+	psi := MpegTsPSI{}
+
+	psi.Sdt = sdt
+
+	if err = WritePSI(w, PSI_TYPE_SDT, psi, bw.Bytes()); err != nil {
+		return
+	}
+
+	return
+}
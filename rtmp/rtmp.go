@@ -1,7 +1,10 @@
 package rtmp
 
 import (
-//"fmt"
+	"errors"
+	"fmt"
+
+	"github.com/sevenzoe/gortmp/config"
 )
 
 const (
@@ -33,10 +36,57 @@ const (
 
 	RTMP_MSG_AGGREGATE = 22
 
+	RTMP_AGGREGATE_HEADER_SIZE = 11 // 聚集消息子消息的头, 和FLV Tag Header一样
+
+	RTMP_DEFAULT_ACK_WINDOW = 2500000 // 对端没有发送 Window Acknowledgement Size 的时候, 每收到这么多字节发送一次确认
+	RTMP_SERVER_ACK_WINDOW  = 512 << 10
+
+	// Set Peer Bandwidth Limit Type
+	RTMP_LIMIT_HARD    = 0 // 输出带宽限制为窗口大小
+	RTMP_LIMIT_SOFT    = 1 // 输出带宽限制为窗口大小和当前限制中较小的一个
+	RTMP_LIMIT_DYNAMIC = 2 // 之前的限制是 Hard 的时候当作 Hard, 否则忽略
+
+	RTMP_PING_INTERVAL = 10 // 秒, 发送 PingRequest 的间隔
+	RTMP_PING_TIMEOUT  = 30 // 秒, 超过这个时间没有收到对端的任何数据(包括 PingResponse), 认为对端已经断开
+
 	RTMP_DEFAULT_CHUNK_SIZE = 128
 	RTMP_MAX_CHUNK_SIZE     = 65536
 	RTMP_MAX_CHUNK_HEADER   = 18
 
+	// 接收数据的默认限制, 防止对端发送恶意的数据让服务器分配过多的内存
+	RTMP_MAX_MESSAGE_SIZE    = 8 << 20  // 一个消息的最大长度
+	RTMP_MAX_PENDING_SIZE    = 16 << 20 // 所有块流正在组装的消息的总长度
+	RTMP_MIN_PEER_CHUNK_SIZE = 128      // 对端 Set Chunk Size 的最小值
+	RTMP_MAX_PEER_CHUNK_SIZE = 0xffffff // 对端 Set Chunk Size 的最大值, 块不会比消息的最大长度更大
+	RTMP_MAX_CHUNK_STREAMS   = 64       // 同时正在组装消息的块流个数
+	RTMP_MAX_AMF_DEPTH       = 32       // AMF 对象嵌套的最大深度
+	RTMP_MAX_NET_STREAMS     = 64       // 一个连接上 createStream 创建的流的个数
+
+	// play 命令的 start 和 duration 参数(秒)
+	RTMP_PLAY_START_LIVE_OR_RECORDED = -2 // 先找直播流, 没有的话播放录制的流
+	RTMP_PLAY_START_LIVE             = -1 // 只播放直播流
+	RTMP_PLAY_DURATION_ALL           = -1 // 直播流一直播放, 录制的流播放到结束
+
+	// 重复发布同一个流名字的策略(config.Republish)
+	RTMP_REPUBLISH_REJECT   = config.LiveRepublishReject   // 返回 NetStream.Publish.BadName
+	RTMP_REPUBLISH_TAKEOVER = config.LiveRepublishTakeover // 踢掉正在发布的发布者, 订阅者无缝切换到新的发布者
+	RTMP_REPUBLISH_BACKUP   = config.LiveRepublishBackup   // 作为备用, 正在发布的发布者停止之后切换过去
+
+	RTMP_TIMELINE_GAP    = 40  // 毫秒, 切换发布者之后新的关键帧和已经发送的最后一帧之间的时间间隔
+	RTMP_PUBLISH_TIMEOUT = 100 // 秒, 发布者超过这个时间没有音视频, 关闭发布者
+
+	// RTMPT(RTMP over HTTP)
+	RTMPT_CONTENT_TYPE    = "application/x-fcs"
+	RTMPT_SESSION_TIMEOUT = 30      // 秒, 客户端超过这个时间没有请求, 关闭会话
+	RTMPT_MAX_SEND_SIZE   = 1 << 20 // 一个 send 请求的最大长度
+	RTMPT_MAX_POLL_SIZE   = 1 << 18 // 一个 send 或者 idle 返回的服务器数据的最大长度, 剩下的下一次轮询取走
+	RTMPT_MAX_OUT_SIZE    = 4 << 20 // 服务器发送还没有被取走的数据的最大长度, 满了之后 Write 阻塞
+	RTMPT_MAX_PENDING     = 64      // 等待前面的请求(seq 小的)的请求个数, 超过了关闭会话
+
+	// WebSocket FLV 播放
+	RTMP_GOP_CACHE_SIZE = 1024 // 广播缓存的最近一个 GOP 的最大包数, 超过了新的订阅者等下一个关键帧
+	RTMP_FLV_QUEUE_SIZE = 2048 // FLV 订阅者还没有发送的 Tag 数, 满了之后丢掉直到下一个关键帧
+
 	// User Control Event
 	RTMP_USER_STREAM_BEGIN       = 0
 	RTMP_USER_STREAM_EOF         = 1
@@ -54,9 +104,53 @@ const (
 	// Chunk Stream ID == 1, (第三个byte) * 256 + 第二个byte + 64
 	// Chunk Stream ID == 2.
 	// 2 < Chunk Stream ID < 64(2的6次方)
-	RTMP_CSID_CONTROL = 0X02
+	RTMP_CSID_CONTROL = 0x02
 	RTMP_CSID_COMMAND = 0x03
 	RTMP_CSID_AUDIO   = 0x06
-	RTMP_CSID_DATA    = 0x05
+	RTMP_CSID_DATA    = 0x04 // 数据消息用完整的消息头发送, 不能和视频共用一个块流, 否则会影响视频的时间戳增量
 	RTMP_CSID_VIDEO   = 0x05
+
+	// 流ID大于1的流, 音视频和数据消息的块流ID往后偏移, 每个流的时间戳增量不会混在一起
+	RTMP_CSID_STREAM_STEP = 3
+)
+
+// 流ID为0和1的时候使用默认的块流ID, 和以前一样
+func streamChunkStreamID(csid uint32, streamID uint32) uint32 {
+	if streamID <= 1 {
+		return csid
+	}
+
+	return csid + (streamID-1)*RTMP_CSID_STREAM_STEP
+}
+
+var (
+	ErrMessageTooLarge     = errors.New("message too large")
+	ErrChunkSize           = errors.New("invalid chunk size")
+	ErrTooManyChunkStreams = errors.New("too many chunk streams")
+	ErrAMFDepth            = errors.New("amf nesting too deep")
+	ErrMalformedMessage    = errors.New("malformed message")
+	ErrHandshake           = errors.New("handshake error")
+	ErrTooManyStreams      = errors.New("too many net streams")
 )
+
+// 找不到直播流. OnPlaying 返回这个错误的时候, start 为 -2 的 play 接着找录制的流.
+var ErrStreamNotFound = errors.New(NetStream_Play_StreamNotFound)
+
+// 对端发送的数据违反了协议或者超过了限制. 读消息的时候返回这个错误, 连接会被关闭.
+// Err 是上面的 ErrXxx 之一, 可以用 errors.Is 判断.
+type ProtocolError struct {
+	Err    error
+	Detail string
+}
+
+func newProtocolError(err error, format string, args ...interface{}) *ProtocolError {
+	return &ProtocolError{Err: err, Detail: fmt.Sprintf(format, args...)}
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Err.Error() + ", " + e.Detail
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
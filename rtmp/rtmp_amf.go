@@ -5,7 +5,9 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"reflect"
 
+	amfcodec "github.com/sevenzoe/gortmp/amf"
 	"github.com/sevenzoe/gortmp/util"
 )
 
@@ -77,6 +79,12 @@ type AMFObject interface{}
 
 type AMFObjects map[string]AMFObject
 
+// AMF3 有类名的对象(typed object), 匿名对象解码成 AMFObjects
+type AMF3TypedObject struct {
+	ClassName string
+	Object    AMFObjects
+}
+
 func newAMFObjects() AMFObjects {
 	return make(AMFObjects, 0)
 }
@@ -91,6 +99,12 @@ func decodeAMFObject(obj interface{}, key string) interface{} {
 type AMF struct {
 	out *bytes.Buffer
 	in  *bytes.Buffer
+
+	// AMF 对象嵌套的最大深度, 防止恶意的数据导致解码的时候栈溢出.
+	// 连接上收到的消息用 Limits.MaxAMFDepth.
+	maxDepth int
+	depth    int  // 当前解码的嵌套深度
+	tooDeep  bool // 嵌套超过了 maxDepth, 停止解码
 }
 
 func newAMFEncoder() (amf *AMF) {
@@ -102,6 +116,7 @@ func newAMFEncoder() (amf *AMF) {
 func newAMFDecoder(b []byte) (amf *AMF) {
 	amf = new(AMF)
 	amf.in = bytes.NewBuffer(b)
+	amf.maxDepth = RTMP_MAX_AMF_DEPTH
 	return amf
 }
 
@@ -138,13 +153,19 @@ func (amf *AMF) writeObjects(obj []AMFObject) error {
 			{
 				amf.encodeObject(data)
 			}
+		case []AMFObject:
+			{
+				amf.writeStrictArray(data)
+			}
 		case nil:
 			{
 				amf.writeNull()
 			}
 		default:
 			{
-				fmt.Println("unknow type")
+				if err := amf.writeValue(data); err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -153,6 +174,14 @@ func (amf *AMF) writeObjects(obj []AMFObject) error {
 }
 
 func (amf *AMF) decodeObject() (obj AMFObject, err error) {
+	if amf.tooDeep || amf.depth >= amf.maxDepth {
+		amf.tooDeep = true
+		return nil, ErrAMFDepth
+	}
+
+	amf.depth++
+	defer func() { amf.depth-- }()
+
 	buf := amf.in
 
 	if buf.Len() == 0 {
@@ -242,7 +271,17 @@ func (amf *AMF) decodeObject() (obj AMFObject, err error) {
 		}
 	case AMF0_AVMPLUS_OBJECT:
 		{
-			fmt.Println("AMF0_AVMPLUS_OBJECT")
+			// 切换到AMF3编码, 后面跟着一个AMF3的值, 引用表重新开始. 用 amf 包解码, 深度接着算
+			dec := amfcodec.NewDecoder(buf)
+			dec.SetMaxDepth(amf.maxDepth - amf.depth + 1)
+
+			var v interface{}
+			if v, err = dec.DecodeValue(); err == amfcodec.ErrDepth {
+				amf.tooDeep = true
+				err = ErrAMFDepth
+			}
+
+			return fromAMFValue(v, make(map[uintptr]AMFObject)), err
 		}
 	default:
 		{
@@ -322,6 +361,11 @@ func (amf *AMF) encodeObject(t AMFObjects) (err error) {
 			if err != nil {
 				break
 			}
+		} else if vvv, ok := vv.([]AMFObject); ok {
+			err = amf.writeObjectStrictArray(k, vvv)
+			if err != nil {
+				break
+			}
 		}
 	}
 
@@ -335,6 +379,10 @@ func (amf *AMF) readDate() (t uint64, err error) {
 
 	buf.ReadByte()              // 取出第一个字节 8 Bit == 1 Byte. buf - 1.
 	b, err := readBytes(buf, 8) // 在取出8个字节,并且读到b中. buf - 8
+	if err != nil {
+		return
+	}
+
 	t = util.BigEndian.Uint64(b)
 	b, err = readBytes(buf, 2)
 
@@ -347,6 +395,9 @@ func (amf *AMF) readStrictArray() (list []AMFObject, err error) {
 
 	buf.ReadByte()
 	b, err := readBytes(buf, 4)
+	if err != nil {
+		return
+	}
 
 	size := int(util.BigEndian.Uint32(b))
 	for i := 0; i < size; i++ {
@@ -367,6 +418,10 @@ func (amf *AMF) readECMAArray() (m AMFObjects, err error) {
 
 	buf.ReadByte()
 	b, err := readBytes(buf, 4)
+	if err != nil {
+		return
+	}
+
 	size := int(util.BigEndian.Uint32(b))
 
 	for i := 0; i < size; i++ {
@@ -393,8 +448,12 @@ func (amf *AMF) readECMAArray() (m AMFObjects, err error) {
 func (amf *AMF) readString() (str string, err error) {
 	buf := amf.in
 
-	buf.ReadByte()                  // 取出第一个字节 8 Bit == 1 Byte. buf - 1.
-	b, err := readBytes(buf, 2)     // 在取出2个字节,并且读到b中. buf - 2
+	buf.ReadByte()              // 取出第一个字节 8 Bit == 1 Byte. buf - 1.
+	b, err := readBytes(buf, 2) // 在取出2个字节,并且读到b中. buf - 2
+	if err != nil {
+		return
+	}
+
 	l := util.BigEndian.Uint16(b)   // 大端
 	b, err = readBytes(buf, int(l)) // 读取全部数据,读取长度为l,因为这两个字节(l变量)保存的是数据长度
 
@@ -405,6 +464,10 @@ func (amf *AMF) readString1() (str string, err error) {
 	buf := amf.in
 
 	b, err := readBytes(buf, 2)
+	if err != nil {
+		return
+	}
+
 	l := util.BigEndian.Uint16(b)
 	b, err = readBytes(buf, int(l))
 
@@ -416,6 +479,10 @@ func (amf *AMF) readLongString() (str string, err error) {
 
 	buf.ReadByte()
 	b, err := readBytes(buf, 4)
+	if err != nil {
+		return
+	}
+
 	l := util.BigEndian.Uint32(b)
 	b, err = readBytes(buf, int(l))
 
@@ -423,7 +490,10 @@ func (amf *AMF) readLongString() (str string, err error) {
 }
 
 func (amf *AMF) readNull() (AMFObject, error) {
-	amf.in.ReadByte()
+	// AMF3 命令消息里面的 null 可能是 AMF0_AVMPLUS_OBJECT + AMF3_NULL
+	if b, _ := amf.in.ReadByte(); b == AMF0_AVMPLUS_OBJECT {
+		amf.in.ReadByte()
+	}
 	return nil, nil
 }
 
@@ -477,6 +547,11 @@ func (amf *AMF) readObject() (m AMFObjects, err error) {
 }
 
 func readBytes(buf *bytes.Buffer, length int) (b []byte, err error) {
+	// 长度字段可能是对端随便填的, 先检查剩下的数据够不够, 再分配内存
+	if length < 0 || length > buf.Len() {
+		return nil, errors.New(fmt.Sprintf("not enough bytes,%v/%v", buf.Len(), length))
+	}
+
 	b = make([]byte, length)
 
 	i, err := buf.Read(b)
@@ -603,6 +678,116 @@ func (amf *AMF) writeObjectNumber(key string, value float64) error {
 	return amf.writeNumber(value)
 }
 
+func (amf *AMF) writeStrictArray(list []AMFObject) error {
+	buf := amf.out
+
+	err := buf.WriteByte(byte(AMF0_STRICT_ARRAY))
+	if err != nil {
+		return err
+	}
+
+	b := make([]byte, 4)
+	util.BigEndian.PutUint32(b, uint32(len(list)))
+	_, err = buf.Write(b)
+	if err != nil {
+		return err
+	}
+
+	return amf.writeObjects(list)
+}
+
+func (amf *AMF) writeObjectStrictArray(key string, list []AMFObject) error {
+	buf := amf.out
+	b := make([]byte, 2)
+
+	util.BigEndian.PutUint16(b, uint16(len([]byte(key))))
+
+	_, err := buf.Write(b)
+	if err != nil {
+		return err
+	}
+
+	_, err = buf.Write([]byte(key))
+	if err != nil {
+		return err
+	}
+
+	return amf.writeStrictArray(list)
+}
+
+// 任意类型的值(包括嵌套的对象, struct, map)用 amf 包编码
+func (amf *AMF) writeValue(v AMFObject) error {
+	b, err := amfcodec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = amf.out.Write(b)
+
+	return err
+}
+
+// 和 writeValue 一样, 值用AMF3编码: AMF0_AVMPLUS_OBJECT + AMF3的值
+func (amf *AMF) writeAVMPlusValue(v AMFObject) error {
+	return amf.writeValue(amfcodec.AVMPlus{Value: v})
+}
+
+// amf 包解码出来的值换成这里用的类型: 对象和关联数组 -> AMFObjects, 有类名的对象 -> *AMF3TypedObject,
+// 数组 -> []AMFObject, undefined -> nil. AMF3 的对象可以引用自己, seen 记录已经转换的对象.
+func fromAMFValue(v interface{}, seen map[uintptr]AMFObject) AMFObject {
+	switch t := v.(type) {
+	case amfcodec.Object:
+		{
+			return fromAMFObject(t, seen, nil)
+		}
+	case amfcodec.ECMAArray:
+		{
+			return fromAMFObject(t, seen, nil)
+		}
+	case *amfcodec.TypedObject:
+		{
+			return fromAMFObject(t.Object, seen, func(obj AMFObjects) AMFObject {
+				return &AMF3TypedObject{ClassName: t.ClassName, Object: obj}
+			})
+		}
+	case []interface{}:
+		{
+			list := make([]AMFObject, len(t))
+			for i, e := range t {
+				list[i] = fromAMFValue(e, seen)
+			}
+			return list
+		}
+	case amfcodec.Undefined:
+		{
+			return nil
+		}
+	}
+
+	return v
+}
+
+func fromAMFObject(m map[string]interface{}, seen map[uintptr]AMFObject, typed func(AMFObjects) AMFObject) AMFObject {
+	p := reflect.ValueOf(m).Pointer()
+	if v, ok := seen[p]; ok {
+		return v
+	}
+
+	obj := make(AMFObjects, len(m))
+
+	var v AMFObject = obj
+	if typed != nil {
+		v = typed(obj)
+	}
+
+	seen[p] = v
+	for k, e := range m {
+		obj[k] = fromAMFValue(e, seen)
+	}
+
+	return v
+}
+
 func (amf *AMF) writeObjectEnd() error {
 	buf := amf.out
 
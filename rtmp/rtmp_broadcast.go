@@ -1,8 +1,9 @@
 package rtmp
 
 import (
-	//"github.com/sevenzoe/gortmp/config"
+	"github.com/sevenzoe/gortmp/config"
 	//"github.com/sevenzoe/gortmp/util"
+	"errors"
 	"fmt"
 	//"strings"
 	//"os"
@@ -11,18 +12,32 @@ import (
 )
 
 var (
-	broadcasts = make(map[string]*Broadcast)
+	broadcasts     = make(map[string]*Broadcast)
+	broadcastsLock = new(sync.Mutex) // 广播结束的时候在广播的 goroutine 里面删除
 )
 
 // 一个Broadcast代表着服务器已经在发布一个流,如果有多个客户端推流上来,那么服务器会有多个Broadcast.
 // 客户端订阅的时候,会选择订阅哪个Broadcast.然后通过Broadcast将订阅者和发布者联系起来.
 
+// 发布者停止发布之后广播不马上结束, 订阅者收到 NetStream.Play.UnpublishNotify 之后等待.
+// 等待的时间内重新发布, 订阅者收到 NetStream.Play.PublishNotify 接着播放; 超时广播结束, 订阅者收到 NetStream.Play.Stop.
+
+// 主备输入(config.LiveFailover)的广播: 两个输入发布到同一个广播, 主输入用 publishing, 备用输入用 backup.
+// 订阅者看到的是正在用的输入, 另一个输入作为备用. 主输入恢复的时候切换回来, 正在用的输入停止或者卡住的时候切换到备用输入.
 type Broadcast struct {
-	lock       *sync.Mutex               // lock
-	publisher  *RtmpNetStream            // 发布者
-	subscriber map[string]*RtmpNetStream // 订阅者
-	streamPath string                    // 发布者发布的流路径
-	control    chan interface{}          // 订阅者的控制,包括play,stop...
+	lock       *sync.Mutex           // lock
+	publisher  *RtmpNetStream        // 发布者, 只在广播的 goroutine 里面修改. 停止发布之后是上一个发布者
+	publishing *RtmpNetStream        // 正在发布的流, lock 保护. 停止发布之后为 nil
+	backup     *RtmpNetStream        // 备用的发布者(RTMP_REPUBLISH_BACKUP), lock 保护. 正在发布的流停止之后切换过去
+	ended      bool                  // 广播已经结束, lock 保护
+	inputs     []string              // 主备输入的流路径, 不是主备输入的广播为 nil
+	subscriber map[string]subscriber // 订阅者
+	gop        []*AVPacket           // 最近的一个关键帧开始的音视频, 新的 FLV 订阅者从这里开始播放. 只在广播的 goroutine 里面使用
+	streamPath string                // 发布者发布的流路径
+	control    chan interface{}      // 订阅者的控制,包括play,stop...
+	done       chan struct{}         // 广播结束(finish)或者 goroutine 退出的时候关闭, 之后不再读 control
+	closed     bool                  // done 已经关闭, lock 保护
+	senders    sync.WaitGroup        // 正在 send 的调用, 关闭 done 之后等它们返回再处理 control 里面剩下的
 }
 
 type AVChannel struct {
@@ -32,32 +47,60 @@ type AVChannel struct {
 }
 
 func find_broadcast(path string) (*Broadcast, bool) {
+	broadcastsLock.Lock()
+	defer broadcastsLock.Unlock()
+
 	v, ok := broadcasts[path]
 	return v, ok
 }
 
-func start_broadcast(publisher *RtmpNetStream, vl, al int) {
+func attach_channels(publisher *RtmpNetStream, vl, al int) {
 	av := &AVChannel{
 		id:    publisher.conn.remoteAddr,
 		audio: make(chan *AVPacket, al), // 开辟一个音频通道
 		video: make(chan *AVPacket, vl)} // 开辟一个视频通道
 
 	publisher.AttachAudio(av.audio) // 发布者发布的音频全部流入这个通道
-	publisher.AttachVideo(av.video) // 发布者发布的视频全部流入这个通道
+	publisher.AttachVideo(av.video) // 发布者发布的视频全部流入这个通道, 数据消息也在这里(没有视频的时候在音频的通道)
+}
+
+// 发布的流路径对应的广播的流路径, 主备输入发布到 config.LiveFailover 配置的广播
+func broadcast_path(streamPath string) string {
+	if path, _, ok := config.Failover(streamPath); ok {
+		return path
+	}
+
+	return streamPath
+}
+
+func start_broadcast(publisher *RtmpNetStream, vl, al int) {
+	attach_channels(publisher, vl, al)
+
+	path := broadcast_path(publisher.streamPath)
 
 	b := &Broadcast{
-		streamPath: publisher.streamPath,               // 发布者的流路径
-		lock:       new(sync.Mutex),                    // lock
-		publisher:  publisher,                          // 发布者信息, *RtmpNetStream
-		subscriber: make(map[string]*RtmpNetStream, 0), // 订阅者信息, map[string]*RtmpNetStream
-		control:    make(chan interface{}, 10)}         // 订阅者的控制
+		streamPath: path,                           // 发布者的流路径
+		lock:       new(sync.Mutex),                // lock
+		publisher:  publisher,                      // 发布者信息, *RtmpNetStream
+		publishing: publisher,                      // 正在发布
+		inputs:     config.LiveFailover[path],      // 主备输入
+		subscriber: make(map[string]subscriber, 0), // 订阅者信息, map[string]subscriber
+		control:    make(chan interface{}, 10),     // 订阅者的控制
+		done:       make(chan struct{})}            // 广播的 goroutine 退出
+
+	if b.inputs != nil && publisher.streamPath == b.inputs[1] {
+		b.publishing, b.backup = nil, publisher
+	}
 
-	broadcasts[publisher.streamPath] = b // 添加广播
+	broadcastsLock.Lock()
+	broadcasts[path] = b // 添加广播
+	broadcastsLock.Unlock()
 
 	b.start()
 }
 
-func (b *Broadcast) addSubscriber(s *RtmpNetStream) {
+// 返回 false 表示广播已经结束了
+func (b *Broadcast) addSubscriber(s *RtmpNetStream) bool {
 	// Broadcast 其实就是一个发布者发布的广播.
 	// RtmpNetStream 其实就是一个订阅者.
 	// broadcasts 就是装载着所有发布的广播.
@@ -66,22 +109,275 @@ func (b *Broadcast) addSubscriber(s *RtmpNetStream) {
 	// 订阅者s订阅的广播是b
 	// 广播b接受订阅者s的控制
 	s.broadcast = b
-	b.control <- s // 这里会添加订阅者
+	return b.send(s) // 这里会添加订阅者
+}
+
+// 广播的订阅者: RTMP 的播放者(*RtmpNetStream), FLV 的播放者(*FlvSubscriber). 方法都在广播的 goroutine 里面调用.
+type subscriber interface {
+	id() string
+	SendAudio(audio *AVPacket) error
+	SendVideo(video *AVPacket) error
+	SendData(data *AVPacket) error
+	rebaseTimeline()        // 切换了发布者, 时间戳接着以前的, 从新的发布者的关键帧开始
+	publishNotify() error   // 停止发布之后重新发布
+	unpublishNotify() error // 发布者停止发布, 等待重新发布
+	finishLive(streamPath string)
+	onError(err error)
+}
+
+// 取消订阅, 流不一定关闭(比如 play 的 duration 到了, 接着播放播放列表里面的下一项)
+type unsubscribe struct {
+	s subscriber
+}
+
+// 广播已经结束的时候不用取消订阅, 不等待
+func (b *Broadcast) removeSubscriber(s subscriber) {
+	b.send(unsubscribe{s})
+}
+
+// 发布者开始发布和停止发布, 在广播的 goroutine 里面通知订阅者.
+// publish 是切换到新的发布者(重新发布, 接管, 备用切换), standby 是备用的发布者, 数据读出来丢掉(主备输入在关键帧切换过去).
+type publish struct {
+	s *RtmpNetStream
+}
+
+type unpublish struct {
+	s *RtmpNetStream
 }
 
-func (b *Broadcast) removeSubscriber(s *RtmpNetStream) {
-	s.closed = true
-	b.control <- s
+type standby struct {
+	s *RtmpNetStream
 }
 
-func (b *Broadcast) stop() {
-	delete(broadcasts, b.streamPath)
-	b.control <- "stop"
+// 发送给广播的 goroutine, 不能拿着 lock 调用(广播的 goroutine 在 end 里面要拿 lock).
+// 广播已经结束的时候丢掉, 返回 false. 返回 true 的时候广播的 goroutine 一定会处理 obj(包括 finish 里面).
+func (b *Broadcast) send(obj interface{}) bool {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return false
+	}
+	b.senders.Add(1)
+	b.lock.Unlock()
+
+	defer b.senders.Done()
+
+	// done 关闭之后 control 还有空间的时候两个都可以选, 放进去的由 finish 处理
+	select {
+	case b.control <- obj:
+		{
+			return true
+		}
+	case <-b.done:
+		{
+			return false
+		}
+	}
+}
+
+// 关闭 done, 之后 send 都返回 false. 可以调用多次.
+func (b *Broadcast) close_done() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+	}
+}
+
+// 已经存在的广播上发布. 返回 ended 表示广播已经结束了, 需要重新开始广播.
+// 停止发布的广播上重新发布; 正在发布的广播按照 policy 处理, 不能发布的时候返回 NetStream.Publish.BadName.
+func (b *Broadcast) republish(s *RtmpNetStream, policy string, vl, al int) (ended bool, err error) {
+	b.lock.Lock()
+
+	if b.ended {
+		b.lock.Unlock()
+		return true, nil
+	}
+
+	if b.inputs != nil {
+		return b.publishInput(s, policy, vl, al)
+	}
+
+	if !b.acceptable(policy) {
+		b.lock.Unlock()
+		return false, errors.New(NetStream_Publish_BadName)
+	}
+
+	attach_channels(s, vl, al)
+
+	if b.publishing != nil && policy == RTMP_REPUBLISH_BACKUP {
+		b.backup = s
+		b.lock.Unlock()
+
+		b.send(standby{s})
+		return false, nil
+	}
+
+	old := b.publishing
+	b.publishing = s
+	b.lock.Unlock()
+
+	b.send(publish{s})
+
+	// 被踢掉的发布者一般是网络断开之后还没有超时的连接, 关闭连接. OnClosed 里面 unpublish 什么也不做.
+	if old != nil {
+		fmt.Println("Broadcast :", b.streamPath, "taken over, close publisher :", old.conn.remoteAddr)
+		old.Close()
+	}
+
+	return false, nil
+}
+
+// 主备输入发布, lock 保护, 返回之前 unlock. 同一个输入正在发布的时候只能接管.
+// 输入都先作为备用, 在广播的 goroutine 里面收到关键帧的时候切换过去.
+func (b *Broadcast) publishInput(s *RtmpNetStream, policy string, vl, al int) (ended bool, err error) {
+	input := b.input(s.streamPath)
+	if input == nil || (*input != nil && policy != RTMP_REPUBLISH_TAKEOVER) {
+		b.lock.Unlock()
+		return false, errors.New(NetStream_Publish_BadName)
+	}
+
+	attach_channels(s, vl, al)
+
+	old := *input
+	*input = s
+	b.lock.Unlock()
+
+	b.send(standby{s})
+
+	if old != nil {
+		fmt.Println("Broadcast :", b.streamPath, "taken over, close publisher :", old.conn.remoteAddr)
+		old.Close()
+	}
+
+	return false, nil
+}
+
+// 主备输入的流路径对应的 publishing 或者 backup, 不是主备输入的时候为 nil
+func (b *Broadcast) input(streamPath string) **RtmpNetStream {
+	if b.inputs == nil {
+		return nil
+	}
+
+	switch streamPath {
+	case b.inputs[0]:
+		{
+			return &b.publishing
+		}
+	case b.inputs[1]:
+		{
+			return &b.backup
+		}
+	}
+
+	return nil
+}
+
+// 发布者停止发布, 有备用的发布者的时候切换过去. 不是正在发布的流的时候什么也不做.
+// 主备输入停止发布的时候在广播的 goroutine 里面切换.
+func (b *Broadcast) unpublish(s *RtmpNetStream) {
+	if obj := b.unpublishing(s); obj != nil {
+		b.send(obj)
+	}
+}
+
+// 停止发布之后的状态, lock 保护. 返回发送给广播的 goroutine 的 publish 或者 unpublish, nil 表示什么也不做.
+func (b *Broadcast) unpublishing(s *RtmpNetStream) interface{} {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if input := b.input(s.streamPath); input != nil {
+		if *input == s {
+			*input = nil
+			return unpublish{s}
+		}
+
+		return nil
+	}
+
+	if b.backup == s {
+		b.backup = nil
+		return unpublish{s}
+	}
+
+	if b.publishing != s {
+		return nil
+	}
+
+	b.publishing = b.backup
+	b.backup = nil
+
+	if b.publishing != nil {
+		return publish{b.publishing}
+	}
+
+	return unpublish{s}
+}
+
+// 能不能再发布一个流, lock 保护
+func (b *Broadcast) acceptable(policy string) bool {
+	if b.publishing == nil {
+		return true
+	}
+
+	switch policy {
+	case RTMP_REPUBLISH_TAKEOVER:
+		{
+			return true
+		}
+	case RTMP_REPUBLISH_BACKUP:
+		{
+			return b.backup == nil
+		}
+	}
+
+	return false
+}
+
+// FCPublish 的时候检查能不能发布 streamPath
+func (b *Broadcast) canPublish(streamPath string, policy string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.ended {
+		return true
+	}
+
+	if b.inputs != nil {
+		input := b.input(streamPath)
+		return input != nil && (*input == nil || policy == RTMP_REPUBLISH_TAKEOVER)
+	}
+
+	return b.acceptable(policy)
+}
+
+// 停止发布之后等待超时, 广播结束. 返回 false 表示已经重新发布了.
+func (b *Broadcast) end() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.publishing != nil || b.backup != nil {
+		return false
+	}
+
+	b.ended = true
+
+	broadcastsLock.Lock()
+	if v, ok := broadcasts[b.streamPath]; ok && v == b {
+		delete(broadcasts, b.streamPath)
+	}
+	broadcastsLock.Unlock()
+
+	return true
 }
 
 func (b *Broadcast) start() {
 	go func(b *Broadcast) {
 		defer func() {
+			b.close_done()
+
 			if e := recover(); e != nil {
 				fmt.Println(e)
 			}
@@ -114,71 +410,393 @@ func (b *Broadcast) start() {
 		b.publisher.vstreamToFile = true
 		b.publisher.rtmpFile = newRtmpFile()
 
+		// 停止发布之后通道为 nil, 不再读取; idle 是等待重新发布的超时
+		// alive 是正在用的输入最后收到音视频的时间, notified 表示订阅者收到了 NetStream.Play.UnpublishNotify
+		audiochan, videochan := b.publisher.audiochan, b.publisher.videochan
+		var idle <-chan time.Time
+		var notified bool
+		alive := time.Now()
+
+		// 备用的发布者的数据读出来丢掉, 切换的时候从备用的发布者的关键帧开始
+		var backup *RtmpNetStream
+		var baudiochan, bvideochan chan *AVPacket
+
+		// 主备输入切换到备用的输入, 正在用的输入没有停止发布的时候作为备用
+		failover := func() {
+			s := backup
+			if audiochan != nil {
+				backup = b.publisher
+			} else {
+				backup = nil
+			}
+
+			audiochan, videochan, baudiochan, bvideochan = baudiochan, bvideochan, audiochan, videochan
+			idle = nil
+			alive = time.Now()
+
+			b.switch_publisher(s, notified)
+			notified = false
+		}
+
+		// 发布者没有音视频的超时, 定时器重复使用, 到期的时候按照 alive 检查
+		timeout := time.NewTimer(RTMP_PUBLISH_TIMEOUT * time.Second)
+		defer timeout.Stop()
+
 		// SendAudio(),函数接收的参数是(audio *AVPacket)
 		// 如果不拷贝一份数据传递过去,那么如果在SendAudio()函数内部,如果改变了audio这个参数的值,将会影响数据的正确性
 		for {
 			select {
-			case amsg := <-b.publisher.audiochan: // 取出发布者中的音频数据
+			case amsg := <-audiochan: // 取出发布者中的音频数据
 				{
-					for _, s := range b.subscriber { // 订阅者
-						err := s.SendAudio(amsg.Clone()) // 给订阅者发送音频数据
-						if err != nil {
-							s.serverHandler.OnError(s, err)
-						}
+					alive = time.Now()
+					b.send_packet(amsg)
+				}
+			case vmsg := <-videochan: // 取出发布者中的视频数据
+				{
+					alive = time.Now()
+					b.send_packet(vmsg)
+				}
+			case amsg := <-baudiochan:
+				{
+					if b.failover(backup, amsg, audiochan != nil, alive) {
+						failover()
+						b.send_packet(amsg)
+					} else {
+						amsg.release()
 					}
-
-					// write file
-					if b.publisher.astreamToFile {
-						err := b.publisher.WriteAudio(nil, amsg.Clone(), RTMP_FILE_TYPE_HLS_TS)
-						if err != nil {
-							// handler error
-							fmt.Println("wirte audio file error :", err)
-						}
+				}
+			case vmsg := <-bvideochan:
+				{
+					if b.failover(backup, vmsg, audiochan != nil, alive) {
+						failover()
+						b.send_packet(vmsg)
+					} else {
+						vmsg.release()
 					}
 				}
-			case vmsg := <-b.publisher.videochan: // 取出发布者中的视频数据
+			case obj := <-b.control: // 订阅者的控制.例如订阅者开始播放,或者取消播放都会到这里先处理.会打印消费者信息.
 				{
-					for _, s := range b.subscriber { // 订阅者
-						err := s.SendVideo(vmsg.Clone()) // 给订阅者发送视频数据
-						if err != nil {
-							s.serverHandler.OnError(s, err)
+					if u, ok := obj.(unsubscribe); ok {
+						delete(b.subscriber, u.s.id())
+						fmt.Println("Subscriber Closed, Broadcast :", b.streamPath, "\nSubscribe :", len(b.subscriber))
+					} else if c, ok := obj.(subscriber); ok {
+						b.subscriber[c.id()] = c                                                                      // 添加订阅者
+						fmt.Println("Subscriber Open, Broadcast :", b.streamPath, "\nSubscribe :", len(b.subscriber)) // 打印信息
+
+						// FLV 的订阅者不等下一个关键帧, 从最近的关键帧开始发送
+						if f, ok := c.(*FlvSubscriber); ok && audiochan != nil {
+							b.replay(f)
+						}
+					} else if p, ok := obj.(standby); ok {
+						// 主备输入接管正在用的输入, 直接切换过去, 订阅者等新的输入的关键帧
+						if b.inputs != nil && audiochan != nil && p.s.streamPath == b.publisher.streamPath {
+							audiochan, videochan = p.s.audiochan, p.s.videochan
+							alive = time.Now()
+
+							b.switch_publisher(p.s, false)
+							continue
 						}
-					}
 
-					// write file
-					if b.publisher.vstreamToFile {
-						err := b.publisher.WriteVideo(nil, vmsg.Clone(), RTMP_FILE_TYPE_HLS_TS)
-						if err != nil {
-							// handler error
-							fmt.Println("wirte video file error :", err)
+						// 没有正在用的输入的时候, 以前的备用的输入直接切换过去
+						if b.inputs != nil && audiochan == nil && backup != nil {
+							failover()
 						}
+
+						backup = p.s
+						baudiochan, bvideochan = backup.audiochan, backup.videochan
+
+						fmt.Println("Broadcast :", b.streamPath, "backup publisher :", backup.conn.remoteAddr)
+					} else if p, ok := obj.(unpublish); ok && p.s == backup {
+						backup = nil
+						baudiochan, bvideochan = nil, nil
+					} else if p, ok := obj.(unpublish); ok && p.s == b.publisher {
+						// 发布者停止发布, 没有读取的音视频丢弃. 订阅者不断开, 等待重新发布.
+						// 主备输入还有备用的输入的时候, 等待备用的输入的关键帧切换过去.
+						audiochan, videochan = nil, nil
+						b.clear_gop()
+
+						if backup != nil {
+							fmt.Println("Broadcast :", b.streamPath, "input unpublished, wait for backup :", backup.streamPath)
+							continue
+						}
+
+						idle = time.After(time.Duration(config.LiveUnpublishTimeout) * time.Second)
+						notified = true
+
+						fmt.Println("Broadcast :", b.streamPath, "unpublished, Subscribe :", len(b.subscriber))
+
+						for _, ss := range b.subscriber {
+							if err := ss.unpublishNotify(); err != nil {
+								ss.onError(err)
+							}
+						}
+					} else if p, ok := obj.(publish); ok {
+						// 切换到新的发布者, 订阅者从新的发布者的关键帧开始播放, 时间戳接着以前的.
+						// 停止发布之后重新发布的时候通知订阅者, 接管和备用切换的时候订阅者无缝切换.
+						if p.s == backup {
+							backup = nil
+							baudiochan, bvideochan = nil, nil
+						}
+
+						audiochan, videochan = p.s.audiochan, p.s.videochan
+						idle = nil
+						alive = time.Now()
+
+						b.switch_publisher(p.s, notified)
+						notified = false
 					}
 				}
-			case obj := <-b.control: // 订阅者的控制.例如订阅者开始播放,或者取消播放都会到这里先处理.会打印消费者信息.
+			case <-idle:
 				{
-					if c, ok := obj.(*RtmpNetStream); ok {
-						if c.closed {
-							delete(b.subscriber, c.conn.remoteAddr)
-							fmt.Println("Subscriber Closed, Broadcast :", b.streamPath, "\nSubscribe :", len(b.subscriber))
-						} else {
-							b.subscriber[c.conn.remoteAddr] = c                                                           // 添加订阅者
-							fmt.Println("Subscriber Open, Broadcast :", b.streamPath, "\nSubscribe :", len(b.subscriber)) // 打印信息
-						}
-					} else if v, ok := obj.(string); ok && "stop" == v {
-						for k, ss := range b.subscriber { // k == string, ss = RtmpNetStream
-							delete(b.subscriber, k) // 删除订阅者
-							ss.Close()              // 关闭RtmpNetStream
-						}
+					if !b.end() {
+						idle = nil // 已经重新发布了, publish 或者 standby 在 control 里面
+						continue
 					}
+
+					b.finish()
+					return
 				}
-			case <-time.After(time.Second * 100):
+			case <-timeout.C:
 				{
+					wait := RTMP_PUBLISH_TIMEOUT*time.Second - time.Since(alive)
+					if audiochan == nil || wait > 0 {
+						if wait <= 0 {
+							wait = RTMP_PUBLISH_TIMEOUT * time.Second
+						}
+
+						timeout.Reset(wait)
+						continue
+					}
+
+					// 发布者没有数据, 关闭发布者. 停止发布之后按照上面的流程等待重新发布.
 					fmt.Println("Broadcast " + b.streamPath + " Video | Audio Buffer Empty,Timeout 100s")
-					b.stop()
-					b.publisher.Close()
-					return
+					go b.publisher.Close()
+
+					timeout.Reset(RTMP_PUBLISH_TIMEOUT * time.Second)
 				}
 			}
 		}
 	}(b)
 }
+
+// 主备输入: 备用的输入 s 收到 pkt 的时候切换不切换过去, 在关键帧切换(没有视频的输入在音频切换).
+// 主输入恢复的时候切换回来; 正在用的输入停止发布(active 为 false)或者 config.LiveFailoverStall 毫秒没有数据的时候切换到备用的输入.
+func (b *Broadcast) failover(s *RtmpNetStream, pkt *AVPacket, active bool, alive time.Time) bool {
+	if b.inputs == nil {
+		return false
+	}
+
+	if pkt.Type != RTMP_MSG_AUDIO && pkt.Type != RTMP_MSG_VIDEO {
+		return false
+	}
+
+	if pkt.Type == RTMP_MSG_VIDEO && (!pkt.isKeyFrame() || pkt.isVideoSequenceHeader()) {
+		return false
+	}
+
+	// 备用的发布者的视频Tag在它的消息循环里面设置, 用 tags 读
+	if videoTag, _ := s.tags(); pkt.Type == RTMP_MSG_AUDIO && videoTag != nil {
+		return false
+	}
+
+	if !active || s.streamPath == b.inputs[0] {
+		return true
+	}
+
+	return time.Since(alive) > time.Duration(config.LiveFailoverStall)*time.Millisecond
+}
+
+// 切换到发布者 s (在广播的 goroutine 里面), 订阅者从 s 的关键帧开始播放, 时间戳接着以前的.
+// notify 表示订阅者收到了 NetStream.Play.UnpublishNotify, 发送 NetStream.Play.PublishNotify.
+// hls 接着写以前的文件, 下一个切片前面加上 #EXT-X-DISCONTINUITY.
+func (b *Broadcast) switch_publisher(s *RtmpNetStream, notify bool) {
+	file := b.publisher.rtmpFile
+
+	b.publisher = s
+	b.clear_gop()
+	b.publisher.astreamToFile = true
+	b.publisher.vstreamToFile = true
+	b.publisher.rtmpFile = file
+
+	if err := file.discontinue(s.tags()); err != nil {
+		fmt.Println("Broadcast :", b.streamPath, "hls discontinue error :", err)
+		b.publisher.rtmpFile = newRtmpFile()
+	}
+
+	fmt.Println("Broadcast :", b.streamPath, "publisher :", s.streamPath, s.conn.remoteAddr, "Subscribe :", len(b.subscriber))
+
+	for _, ss := range b.subscriber {
+		var err error
+		if notify {
+			err = ss.publishNotify()
+		} else {
+			ss.rebaseTimeline()
+		}
+
+		if err != nil {
+			ss.onError(err)
+		}
+	}
+}
+
+// 数据消息和音视频在同一个通道里面, 按照发布的顺序发送.
+// 订阅者和 hls 用的是 Clone, 用完就 release, 发送完之后广播 release 发布者的包.
+func (b *Broadcast) send_packet(pkt *AVPacket) {
+	defer pkt.release()
+
+	switch pkt.Type {
+	case RTMP_MSG_AUDIO:
+		{
+			b.send_audio(pkt)
+		}
+	case RTMP_MSG_VIDEO:
+		{
+			b.send_video(pkt)
+		}
+	default:
+		{
+			b.send_data(pkt)
+		}
+	}
+}
+
+// 给订阅者发送数据消息(在广播的 goroutine 里面)
+func (b *Broadcast) send_data(dmsg *AVPacket) {
+	for _, s := range b.subscriber { // 订阅者
+		pkt := dmsg.Clone()
+		err := s.SendData(pkt) // 给订阅者发送数据消息
+		pkt.release()
+		if err != nil {
+			s.onError(err)
+		}
+	}
+}
+
+// 给订阅者发送音频, 写 hls (在广播的 goroutine 里面)
+func (b *Broadcast) send_audio(amsg *AVPacket) {
+	if len(b.gop) > 0 {
+		b.cache(amsg)
+	}
+
+	for _, s := range b.subscriber { // 订阅者
+		pkt := amsg.Clone()
+		err := s.SendAudio(pkt) // 给订阅者发送音频数据
+		pkt.release()
+		if err != nil {
+			s.onError(err)
+		}
+	}
+
+	// write file
+	if b.publisher.astreamToFile {
+		pkt := amsg.Clone()
+		err := b.publisher.WriteAudio(nil, pkt, RTMP_FILE_TYPE_HLS_TS)
+		pkt.release()
+		if err != nil {
+			// handler error
+			fmt.Println("wirte audio file error :", err)
+		}
+	}
+}
+
+// 给订阅者发送视频, 写 hls (在广播的 goroutine 里面)
+func (b *Broadcast) send_video(vmsg *AVPacket) {
+	if vmsg.isVideoSequenceHeader() {
+		b.clear_gop() // 编码参数变了, 以前的 GOP 不能用了
+	} else if vmsg.isKeyFrame() {
+		b.clear_gop()
+		b.gop = append(b.gop, vmsg.Clone())
+	} else if len(b.gop) > 0 {
+		b.cache(vmsg)
+	}
+
+	for _, s := range b.subscriber { // 订阅者
+		pkt := vmsg.Clone()
+		err := s.SendVideo(pkt) // 给订阅者发送视频数据
+		pkt.release()
+		if err != nil {
+			s.onError(err)
+		}
+	}
+
+	// write file
+	if b.publisher.vstreamToFile {
+		pkt := vmsg.Clone()
+		err := b.publisher.WriteVideo(nil, pkt, RTMP_FILE_TYPE_HLS_TS)
+		pkt.release()
+		if err != nil {
+			// handler error
+			fmt.Println("wirte video file error :", err)
+		}
+	}
+}
+
+// GOP 太长的时候不缓存了, 新的订阅者等下一个关键帧
+func (b *Broadcast) cache(pkt *AVPacket) {
+	if len(b.gop) >= RTMP_GOP_CACHE_SIZE {
+		b.clear_gop()
+		return
+	}
+
+	b.gop = append(b.gop, pkt.Clone())
+}
+
+// 缓存的包 release 之后负载的缓冲区才能重复使用
+func (b *Broadcast) clear_gop() {
+	for i, pkt := range b.gop {
+		pkt.release()
+		b.gop[i] = nil
+	}
+
+	b.gop = b.gop[:0]
+}
+
+// 新的 FLV 订阅者从最近的关键帧开始播放
+func (b *Broadcast) replay(f *FlvSubscriber) {
+	for _, pkt := range b.gop {
+		var err error
+		pkt = pkt.Clone()
+		if pkt.Type == RTMP_MSG_VIDEO {
+			err = f.SendVideo(pkt)
+		} else {
+			err = f.SendAudio(pkt)
+		}
+
+		pkt.release()
+
+		if err != nil {
+			f.onError(err)
+			return
+		}
+	}
+}
+
+// 广播结束, 订阅者的直播流播放完了, 接着播放播放列表里面的下一项或者发送 NetStream.Play.Stop.
+// 广播已经不在 broadcasts 里面了, 还在 control 里面的订阅者也要处理.
+// 先关闭 done 并且等正在 send 的调用返回, 之后 control 里面不会再有新的订阅者.
+func (b *Broadcast) finish() {
+	b.close_done()
+	b.senders.Wait()
+
+	for {
+		select {
+		case obj := <-b.control:
+			{
+				if u, ok := obj.(unsubscribe); ok {
+					delete(b.subscriber, u.s.id())
+				} else if c, ok := obj.(subscriber); ok {
+					b.subscriber[c.id()] = c
+				}
+			}
+		default:
+			{
+				for k, ss := range b.subscriber {
+					delete(b.subscriber, k)
+					ss.finishLive(b.streamPath)
+				}
+
+				return
+			}
+		}
+	}
+}
@@ -2,10 +2,9 @@ package rtmp
 
 import (
 	//"fmt"
-	"bytes"
-	"errors"
-
-	"github.com/sevenzoe/gortmp/util"
+	"math/bits"
+	"sync"
+	"sync/atomic"
 )
 
 // RTMP协议中基本的数据单元称为消息(Message).
@@ -34,6 +33,8 @@ type Chunk struct {
 
 type ChunkBody struct {
 	Payload []byte
+
+	buffer *payloadBuffer // 音视频消息的负载从池里面分配, 交给 AVPacket
 }
 
 type ChunkHeader struct {
@@ -77,122 +78,295 @@ type ChunkExtendedTimestamp struct {
 // 8  -> ChunkBasicHeader(1) + ChunkMessgaeHeader(7)
 // 12 -> ChunkBasicHeader(1) + ChunkMessgaeHeader(11)
 
-func encodeChunk12(head *RtmpHeader, payload []byte, size int) (mark []byte, need []byte, err error) {
-	if size > RTMP_MAX_CHUNK_SIZE || payload == nil || len(payload) == 0 {
-		return nil, nil, errors.New("chunk error")
+// 块流的写状态. 记录每个块流上一个消息的头, 下一个消息和它比较, 选择最小的块类型:
+// Type 0(12) -> 第一个消息, 消息流ID不同, 时间戳回退
+// Type 1(8)  -> 消息流ID相同, 长度或者类型不同
+// Type 2(4)  -> 消息流ID, 长度, 类型都相同
+// Type 3(1)  -> 时间戳增量也相同
+type chunkState struct {
+	timestamp  uint32 // 上一个消息的绝对时间戳
+	delta      uint32 // 上一个消息的时间戳增量
+	deltaValid bool   // 上一个消息头是 Type 1 或者 Type 2, delta 可以被 Type 3 使用. Type 0 之后的 Type 3, 有的实现会把绝对时间戳当作增量
+	length     uint32 // 上一个消息的长度
+	typeID     byte   // 上一个消息的类型
+	streamID   uint32 // 上一个消息的消息流ID
+	extended   bool   // 上一个消息头带有 Extended Timestamp, 后面的 Type 3 块也要带上
+}
+
+// 块流ID: 2 ~ 63 一个字节, 64 ~ 319 两个字节, 320 ~ 65599 三个字节
+func appendChunkBasicHeader(b []byte, chunkType byte, csid uint32) []byte {
+	switch {
+	case csid < 64:
+		{
+			return append(b, chunkType|byte(csid))
+		}
+	case csid < 320:
+		{
+			return append(b, chunkType, byte(csid-64))
+		}
 	}
 
-	buf := new(bytes.Buffer)
+	csid -= 64
+	return append(b, chunkType|1, byte(csid), byte(csid>>8))
+}
+
+// 选择块类型, 编码第一个块的头(Basic Header + Message Header + Extended Timestamp), 并更新块流的状态.
+// timestamp 是消息的绝对时间戳, force 为 true 的时候使用 Type 0.
+func (state *chunkState) appendHeader(b []byte, head *RtmpHeader, timestamp uint32, force bool) []byte {
+	csid := head.ChunkBasicHeader.ChunkStreamID
+	length := head.ChunkMessgaeHeader.MessageLength
+	typeID := head.ChunkMessgaeHeader.MessageTypeID
+	streamID := head.ChunkMessgaeHeader.MessageStreamID
 
-	chunkBasicHead := byte(RTMP_CHUNK_HEAD_12 + head.ChunkBasicHeader.ChunkStreamID)
-	buf.WriteByte(chunkBasicHead)
+	chunkType := byte(RTMP_CHUNK_HEAD_12)
+	var delta uint32
 
-	b := make([]byte, 3)
-	util.BigEndian.PutUint24(b, head.ChunkMessgaeHeader.Timestamp)
-	buf.Write(b)
+	if !force && state.typeID != 0 && streamID == state.streamID && timestamp >= state.timestamp {
+		delta = timestamp - state.timestamp
+		chunkType = RTMP_CHUNK_HEAD_8
 
-	util.BigEndian.PutUint24(b, head.ChunkMessgaeHeader.MessageLength)
-	buf.Write(b)
+		if length == state.length && typeID == state.typeID {
+			chunkType = RTMP_CHUNK_HEAD_4
 
-	buf.WriteByte(head.ChunkMessgaeHeader.MessageTypeID)
+			if state.deltaValid && delta == state.delta {
+				chunkType = RTMP_CHUNK_HEAD_1
+			}
+		}
+	}
+
+	b = appendChunkBasicHeader(b, chunkType, csid)
+
+	// Type 0 的时间字段是绝对时间戳, Type 1 和 Type 2 是时间戳增量
+	field := delta
+	if chunkType == RTMP_CHUNK_HEAD_12 {
+		field = timestamp
+	}
 
-	b = make([]byte, 4)
-	util.LittleEndian.PutUint32(b, uint32(head.ChunkMessgaeHeader.MessageStreamID))
-	buf.Write(b)
+	if chunkType != RTMP_CHUNK_HEAD_1 {
+		state.extended = field >= 0xffffff
+	}
 
-	if head.ChunkMessgaeHeader.Timestamp == 0xffffff {
-		b := make([]byte, 4)
-		util.LittleEndian.PutUint32(b, head.ChunkExtendedTimestamp.ExtendTimestamp)
-		buf.Write(b)
+	switch chunkType {
+	case RTMP_CHUNK_HEAD_12:
+		{
+			b = appendUint24(b, field)
+			b = appendUint24(b, length)
+			b = append(b, typeID)
+			b = append(b, byte(streamID), byte(streamID>>8), byte(streamID>>16), byte(streamID>>24)) // 小端
+		}
+	case RTMP_CHUNK_HEAD_8:
+		{
+			b = appendUint24(b, field)
+			b = appendUint24(b, length)
+			b = append(b, typeID)
+		}
+	case RTMP_CHUNK_HEAD_4:
+		{
+			b = appendUint24(b, field)
+		}
 	}
 
-	if len(payload) > size {
-		buf.Write(payload[0:size])
-		need = payload[size:]
-	} else {
-		buf.Write(payload)
+	if state.extended {
+		b = append(b, byte(field>>24), byte(field>>16), byte(field>>8), byte(field))
 	}
 
-	mark = buf.Bytes()
+	state.timestamp = timestamp
+	state.delta = delta
+	state.deltaValid = chunkType != RTMP_CHUNK_HEAD_12
+	state.length = length
+	state.typeID = typeID
+	state.streamID = streamID
 
-	return
+	return b
 }
 
-func encodeChunk8(head *RtmpHeader, payload []byte, size int) (mark []byte, need []byte, err error) {
-	if size > RTMP_MAX_CHUNK_SIZE || payload == nil || len(payload) == 0 {
-		return nil, nil, errors.New("chunk error")
+// 超过 0xffffff 的时候写 0xffffff, 真正的值在 Extended Timestamp
+func appendUint24(b []byte, v uint32) []byte {
+	if v >= 0xffffff {
+		v = 0xffffff
 	}
 
-	buf := new(bytes.Buffer)
+	return append(b, byte(v>>16), byte(v>>8), byte(v))
+}
 
-	chunkBasicHead := byte(RTMP_CHUNK_HEAD_8 + head.ChunkBasicHeader.ChunkStreamID)
-	buf.WriteByte(chunkBasicHead)
+// Extended Timestamp 的值, 只有 extended 为 true 的时候有效
+func (state *chunkState) extendedTimestamp() uint32 {
+	if state.deltaValid {
+		return state.delta
+	}
 
-	b := make([]byte, 3)
-	util.BigEndian.PutUint24(b, head.ChunkMessgaeHeader.Timestamp)
-	buf.Write(b)
+	return state.timestamp
+}
 
-	util.BigEndian.PutUint24(b, head.ChunkMessgaeHeader.MessageLength)
-	buf.Write(b)
+// 消息的负载按块大小分割, 块之间插入 Type 3 的块头(Basic Header + Extended Timestamp).
+// 第一个块的头和连接的块流状态有关, 不在这里编码. 负载只有一个块的时候不拷贝.
+// 同一个块流, 同样的块大小, 编码的结果是一样的, 可以被多个连接共享.
+func appendChunkBody(b []byte, csid uint32, payload []byte, size int, extended bool, ext uint32) []byte {
+	if len(payload) <= size {
+		if b == nil {
+			return payload
+		}
 
-	buf.WriteByte(head.ChunkMessgaeHeader.MessageTypeID)
+		return append(b, payload...)
+	}
 
-	if len(payload) > size {
-		buf.Write(payload[0:size])
-		need = payload[size:]
-	} else {
-		buf.Write(payload)
+	for len(payload) > 0 {
+		n := size
+		if n > len(payload) {
+			n = len(payload)
+		}
+
+		b = append(b, payload[:n]...)
+		payload = payload[n:]
+
+		if len(payload) > 0 {
+			b = appendChunkBasicHeader(b, RTMP_CHUNK_HEAD_1, csid)
+			if extended {
+				b = append(b, byte(ext>>24), byte(ext>>16), byte(ext>>8), byte(ext))
+			}
+		}
 	}
 
-	mark = buf.Bytes()
+	return b
+}
+
+// 编码之后的块, 音视频包在广播的时候被拷贝给每个订阅者, 共享同一个 chunkCache.
+// 块大小, 块流ID 一样的订阅者使用同一份编码, 只需要编码一次.
+// 每个音视频包一个 chunkCache, 锁不单独分配.
+type chunkCache struct {
+	lock    sync.Mutex
+	entries []chunkCacheEntry
+}
+
+type chunkCacheEntry struct {
+	csid     uint32
+	size     int
+	extended bool
+	ext      uint32
+	payload  *byte // 负载的地址和长度, 订阅者可能会转换负载(例如 Enhanced RTMP 转换为传统格式)
+	length   int
+	body     []byte
+}
 
-	return
+func newChunkCache() *chunkCache {
+	return new(chunkCache)
 }
 
-func encodeChunk4(head *RtmpHeader, payload []byte, size int) (mark []byte, need []byte, err error) {
-	if size > RTMP_MAX_CHUNK_SIZE || payload == nil || len(payload) == 0 {
-		return nil, nil, errors.New("chunk error")
+func (c *chunkCache) body(csid uint32, payload []byte, size int, extended bool, ext uint32) []byte {
+	if c == nil || len(payload) <= size {
+		return appendChunkBody(nil, csid, payload, size, extended, ext)
 	}
 
-	buf := new(bytes.Buffer)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, e := range c.entries {
+		if e.csid == csid && e.size == size && e.extended == extended && e.ext == ext && e.payload == &payload[0] && e.length == len(payload) {
+			return e.body
+		}
+	}
 
-	chunkBasicHead := byte(RTMP_CHUNK_HEAD_4 + head.ChunkBasicHeader.ChunkStreamID)
-	buf.WriteByte(chunkBasicHead)
+	e := chunkCacheEntry{
+		csid:     csid,
+		size:     size,
+		extended: extended,
+		ext:      ext,
+		payload:  &payload[0],
+		length:   len(payload),
+		body:     appendChunkBody(make([]byte, 0, len(payload)+len(payload)/size*5), csid, payload, size, extended, ext),
+	}
 
-	b := make([]byte, 3)
-	util.BigEndian.PutUint24(b, head.ChunkMessgaeHeader.Timestamp)
-	buf.Write(b)
+	c.entries = append(c.entries, e)
 
-	if len(payload) > size {
-		buf.Write(payload[0:size])
-		need = payload[size:]
-	} else {
-		buf.Write(payload)
+	return e.body
+}
+
+// 块流的读状态. 块头可以省略和上一个块一样的字段, 因此需要保存上一个块的头.
+type chunkReadState struct {
+	header   RtmpHeader     // 上一个块的头
+	payload  []byte         // 正在组装的消息, 长度为 MessageLength, nil 表示没有正在组装的消息
+	buffer   *payloadBuffer // payload 从池里面分配的时候不为 nil
+	read     uint32         // 已经读了多少字节
+	used     uint64         // 最后一个块是连接上的第几个块
+	extended bool           // 上一个消息头带有 Extended Timestamp, 后面的 Type 3 块也会带上
+}
+
+func (state *chunkReadState) reset() {
+	state.payload = nil
+	state.buffer = nil
+	state.read = 0
+}
+
+// 协议控制消息(类型1-7)很小, 而且在 recvMessage 里面处理完就不再使用, 负载的缓冲区重复使用.
+// 音视频消息的负载按照大小分级从池里面分配, 见 payloadBuffer. 其他消息的负载每个消息分配一次.
+const controlPayloadSize = 16
+
+var controlPayloadPool = sync.Pool{New: func() interface{} { return make([]byte, controlPayloadSize) }}
+
+func newChunkPayload(typeID byte, length uint32) ([]byte, *payloadBuffer) {
+	if RTMP_MSG_CHUNK_SIZE <= typeID && typeID <= RTMP_MSG_EDGE && length <= controlPayloadSize {
+		return controlPayloadPool.Get().([]byte)[:length], nil
 	}
 
-	mark = buf.Bytes()
+	if typeID == RTMP_MSG_AUDIO || typeID == RTMP_MSG_VIDEO {
+		if buffer := newPayloadBuffer(length); buffer != nil {
+			return buffer.buf[:length], buffer
+		}
+	}
 
-	return
+	return make([]byte, length), nil
 }
 
-func encodeChunk1(head *RtmpHeader, payload []byte, size int) (mark []byte, need []byte, err error) {
-	if size > RTMP_MAX_CHUNK_SIZE || payload == nil || len(payload) == 0 {
-		return nil, nil, errors.New("chunk error")
+func putControlPayload(b []byte) {
+	if cap(b) == controlPayloadSize {
+		controlPayloadPool.Put(b[:controlPayloadSize])
 	}
+}
 
-	buf := new(bytes.Buffer)
+// 音视频包的负载. 广播, GOP 缓存和播放者共享同一个负载(AVPacket.Clone 增加引用计数),
+// 最后一个引用 release 之后放回池里面. 没有 release 的引用只是让缓冲区不能重复使用, 由 GC 回收.
+type payloadBuffer struct {
+	refs int32
+	buf  []byte
+}
 
-	chunkBasicHead := byte(RTMP_CHUNK_HEAD_1 + head.ChunkBasicHeader.ChunkStreamID)
-	buf.WriteByte(chunkBasicHead)
+// 按照2的幂分级, 512 字节到 4M. 更大的消息直接分配.
+const (
+	payloadMinClass = 9
+	payloadMaxClass = 22
+)
 
-	if len(payload) > size {
-		buf.Write(payload[0:size])
-		need = payload[size:]
-	} else {
-		buf.Write(payload)
+var payloadPools [payloadMaxClass + 1]sync.Pool
+
+func newPayloadBuffer(length uint32) *payloadBuffer {
+	if length == 0 {
+		return nil
+	}
+
+	class := bits.Len32(length - 1)
+	if class > payloadMaxClass {
+		return nil
 	}
 
-	mark = buf.Bytes()
+	if class < payloadMinClass {
+		class = payloadMinClass
+	}
+
+	buffer, _ := payloadPools[class].Get().(*payloadBuffer)
+	if buffer == nil {
+		buffer = &payloadBuffer{buf: make([]byte, 1<<uint(class))}
+	}
 
-	return
+	buffer.refs = 1
+	return buffer
+}
+
+func (buffer *payloadBuffer) retain() {
+	atomic.AddInt32(&buffer.refs, 1)
+}
+
+func (buffer *payloadBuffer) release() {
+	if atomic.AddInt32(&buffer.refs, -1) == 0 {
+		payloadPools[bits.Len(uint(cap(buffer.buf)))-1].Put(buffer)
+	}
 }
@@ -0,0 +1,246 @@
+package rtmp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// 记录 Write 的次数, 不是 *net.TCPConn 的时候 IOVecWriter 每个内存块调用一次 Write,
+// 是 *net.TCPConn 的时候一次 Flush 的所有内存块用一次 writev 写出去.
+type countConn struct {
+	writes int
+	bytes  int
+}
+
+func (c *countConn) Read(b []byte) (int, error)         { return 0, io.EOF }
+func (c *countConn) Write(b []byte) (int, error)        { c.writes++; c.bytes += len(b); return len(b), nil }
+func (c *countConn) Close() error                       { return nil }
+func (c *countConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *countConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *countConn) SetDeadline(t time.Time) error      { return nil }
+func (c *countConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *countConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func newBenchViewer(conn net.Conn) *RtmpNetConnection {
+	c := newRtmpNetConnect(conn, nil)
+	c.writeChunkSize = 512
+	return c
+}
+
+func newBenchVideo(size int, shared bool) *AVPacket {
+	pkt := new(AVPacket)
+	pkt.Type = RTMP_MSG_VIDEO
+	pkt.Timestamp = 40
+	pkt.Payload = make([]byte, size)
+	pkt.Payload[0] = 0x27 // 非关键帧, AVC
+
+	if shared {
+		pkt.chunks = newChunkCache()
+	}
+
+	return pkt
+}
+
+// 一个视频包发给所有的播放者, 和广播一样每个播放者一个 Clone.
+// shared 的时候播放者共享分块之后的负载, 否则每个播放者各自分块.
+func benchmarkSendVideo(b *testing.B, viewers int, shared bool, newConn func() net.Conn) {
+	conns := make([]*RtmpNetConnection, viewers)
+	for i := range conns {
+		conns[i] = newBenchViewer(newConn())
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(32 * 1024 * viewers))
+
+	var ms0, ms1 runtime.MemStats
+	runtime.ReadMemStats(&ms0)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		pkt := newBenchVideo(32*1024, shared)
+
+		for _, c := range conns {
+			if err := sendAVMessage(c, 1, pkt.Clone(), false, i == 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.StopTimer()
+	runtime.ReadMemStats(&ms1)
+
+	n := float64(b.N * viewers)
+	b.ReportMetric(float64(ms1.Mallocs-ms0.Mallocs)/n, "allocs/viewer")
+
+	writes := 0
+	for _, c := range conns {
+		if cc, ok := c.conn.(*countConn); ok {
+			writes += cc.writes
+		}
+	}
+
+	if writes > 0 {
+		b.ReportMetric(float64(writes)/n, "writes/viewer")
+	}
+}
+
+func BenchmarkSendVideo(b *testing.B) {
+	for _, viewers := range []int{1, 10, 100} {
+		for _, shared := range []bool{true, false} {
+			name := fmt.Sprintf("viewers=%v/shared=%v", viewers, shared)
+			b.Run(name, func(b *testing.B) {
+				benchmarkSendVideo(b, viewers, shared, func() net.Conn { return new(countConn) })
+			})
+		}
+	}
+}
+
+// 真实的 TCP 连接, 一个消息的块头和负载用一次 writev 写出去
+func BenchmarkSendVideoTCP(b *testing.B) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Skip(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go io.Copy(ioutil.Discard, c)
+		}
+	}()
+
+	for _, viewers := range []int{1, 10} {
+		b.Run(fmt.Sprintf("viewers=%v", viewers), func(b *testing.B) {
+			var conns []net.Conn
+			defer func() {
+				for _, c := range conns {
+					c.Close()
+				}
+			}()
+
+			benchmarkSendVideo(b, viewers, true, func() net.Conn {
+				c, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				conns = append(conns, c)
+				return c
+			})
+		})
+	}
+}
+
+// 循环读同一段数据, 写的数据丢掉(确认消息)
+type loopConn struct {
+	countConn
+	data []byte
+	off  int
+}
+
+func (c *loopConn) Read(b []byte) (n int, err error) {
+	n = copy(b, c.data[c.off:])
+	c.off = (c.off + n) % len(c.data)
+	return
+}
+
+// 一个完整的视频消息(Type 0 块头)分块之后的数据
+func encodeBenchVideo(size, chunkSize int) []byte {
+	w := &bytes.Buffer{}
+	conn := newRtmpNetConnect(&bufConn{w}, nil)
+	conn.writeChunkSize = chunkSize
+
+	if err := sendAVMessage(conn, 1, newBenchVideo(size, false), false, true); err != nil {
+		panic(err)
+	}
+
+	return w.Bytes()
+}
+
+type bufConn struct {
+	*bytes.Buffer
+}
+
+func (c *bufConn) Close() error                       { return nil }
+func (c *bufConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *bufConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *bufConn) SetDeadline(t time.Time) error      { return nil }
+func (c *bufConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *bufConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// 发布者的视频消息读出来. release 表示负载用完之后放回池里面(广播和播放者都 release 了),
+// 否则和保存下来的包一样每个消息分配一次.
+func benchmarkReadChunk(b *testing.B, size int, release bool) {
+	chunkSize := 4096
+	conn := newRtmpNetConnect(&loopConn{data: encodeBenchVideo(size, chunkSize)}, nil)
+	conn.readChunkSize = chunkSize
+
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		msg, err := readChunk(conn)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if len(msg.Body().Payload) != size {
+			b.Fatal("payload length", len(msg.Body().Payload))
+		}
+
+		if buffer := msg.Body().buffer; release && buffer != nil {
+			buffer.release()
+		}
+	}
+}
+
+func BenchmarkReadChunk(b *testing.B) {
+	for _, size := range []int{4 * 1024, 64 * 1024, 1024 * 1024} {
+		for _, release := range []bool{true, false} {
+			b.Run(fmt.Sprintf("size=%v/release=%v", size, release), func(b *testing.B) {
+				benchmarkReadChunk(b, size, release)
+			})
+		}
+	}
+}
+
+func TestPayloadBuffer(t *testing.T) {
+	for _, length := range []uint32{1, 512, 513, 4096, 1 << payloadMaxClass} {
+		buffer := newPayloadBuffer(length)
+		if buffer == nil || len(buffer.buf) < int(length) || len(buffer.buf) > int(length)*2 && len(buffer.buf) != 1<<payloadMinClass {
+			t.Fatalf("length %v, buffer %v", length, buffer)
+		}
+	}
+
+	if newPayloadBuffer(0) != nil || newPayloadBuffer(1<<payloadMaxClass+1) != nil {
+		t.Fatal("buffer not nil")
+	}
+
+	// 所有的 Clone release 之后才能重复使用
+	pkt := &AVPacket{Type: RTMP_MSG_VIDEO, buffer: newPayloadBuffer(1000)}
+	pkt.Payload = pkt.buffer.buf[:1000]
+	buffer := pkt.buffer
+
+	clone := pkt.Clone()
+	pkt.release()
+	if buffer.refs != 1 || clone.Payload == nil || pkt.Payload != nil {
+		t.Fatalf("refs %v", buffer.refs)
+	}
+
+	clone.release()
+	if buffer.refs != 0 {
+		t.Fatalf("refs %v", buffer.refs)
+	}
+}
@@ -7,6 +7,15 @@ const (
 	Response_Result   = "_result"
 	Response_Error    = "_error"
 
+	Response_OnFCPublish   = "onFCPublish"   // FCPublish 的回复, FMLE 等推流端等这个消息
+	Response_OnFCUnpublish = "onFCUnpublish" // FCUnpublish 的回复
+
+	/* Data Message */
+	Data_SetDataFrame   = "@setDataFrame"   // 推流端发送的元数据前面加上 @setDataFrame, 服务器去掉之后保存并转发给播放者
+	Data_ClearDataFrame = "@clearDataFrame" // 清除服务器保存的元数据
+	Data_OnMetaData     = "onMetaData"
+	Data_OnPlayStatus   = "onPlayStatus" // 播放列表切换和播放完成的通知, 是数据消息
+
 	/* Level */
 	Level_Status  = "status"
 	Level_Error   = "error"
@@ -20,8 +29,11 @@ const (
 	NetStream_Play_Stop           = "NetStream.Play.Stop"           // "status" 播放已结束
 	NetStream_Play_Failed         = "NetStream.Play.Failed"         // "error"  出于此表中列出的原因之外的某一原因(例如订阅者没有读取权限),播放发生了错误
 
-	NetStream_Play_Switch   = "NetStream.Play.Switch"
-	NetStream_Play_Complete = "NetStream.Play.Switch"
+	NetStream_Play_Switch   = "NetStream.Play.Switch"   // "status" 播放列表切换到下一个流(onPlayStatus)
+	NetStream_Play_Complete = "NetStream.Play.Complete" // "status" 录制的流播放完了(onPlayStatus)
+
+	NetStream_Play_PublishNotify   = "NetStream.Play.PublishNotify"   // "status" 发布者开始发布(重新发布), 播放者接着播放
+	NetStream_Play_UnpublishNotify = "NetStream.Play.UnpublishNotify" // "status" 发布者停止发布, 播放者不断开, 等待重新发布
 
 	NetStream_Data_Start = "NetStream.Data.Start"
 
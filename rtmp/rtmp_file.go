@@ -2,7 +2,7 @@ package rtmp
 
 import (
 	"github.com/sevenzoe/gortmp/avformat"
-	//"github.com/sevenzoe/gortmp/config"
+	"github.com/sevenzoe/gortmp/config"
 	"bytes"
 	"errors"
 
@@ -29,23 +29,28 @@ const (
 )
 
 type RtmpFile struct {
-	ftype             int                                    // file type
-	atwrite           bool                                   // audio tag
-	vtwrite           bool                                   // video tag
-	awrite_time       uint32                                 // write audio time
-	vwrite_time       uint32                                 // write video time
-	audio_cc          uint16                                 // audio ContinuityCounter(mpegts)
-	video_cc          uint16                                 // video ContinuityCounter(mpegts)
-	avc               avformat.AVCDecoderConfigurationRecord // AVCDecoderConfigurationRecord(mpegts)
-	asc               avformat.AudioSpecificConfig           // AudioSpecificConfig(mpegts)
-	hls_path          string                                 // hls ts file path
-	hls_m3u8_name     string                                 // hls m3u8 name
-	hls_playlist      hls.Playlist                           // hls play list
-	hls_fragment      int64                                  // hls fragment
-	hls_segment_count uint32                                 // hls segment count
-	hls_segment_data  *bytes.Buffer                          // hls segment
-	timeout           time.Duration                          // timeout
-	control           chan interface{}                       // control
+	ftype             int                                     // file type
+	atwrite           bool                                    // audio tag
+	vtwrite           bool                                    // video tag
+	awrite_time       uint32                                  // write audio time
+	vwrite_time       uint32                                  // write video time
+	ts_muxer          *mpegts.Muxer                           // PAT/SDT/PMT + PES(mpegts)
+	vcodec            byte                                    // video codec id(FLV CodecID, 7 -> AVC, 12 -> HEVC)
+	avc               avformat.AVCDecoderConfigurationRecord  // AVCDecoderConfigurationRecord(mpegts)
+	hevc              avformat.HEVCDecoderConfigurationRecord // HEVCDecoderConfigurationRecord(mpegts)
+	asc               avformat.AudioSpecificConfig            // AudioSpecificConfig(mpegts)
+	hls_path          string                                  // hls ts file path
+	hls_m3u8_name     string                                  // hls m3u8 name
+	hls_master_name   string                                  // hls master m3u8 name
+	hls_playlist      hls.Playlist                            // hls play list
+	hls_fragment      int64                                   // hls fragment
+	hls_segment_count uint32                                  // hls segment count
+	hls_segment_data  *bytes.Buffer                           // hls segment
+	hls_switched      bool                                    // 切换了输入, 下一个关键帧开始新的切片
+	hls_discontinuity bool                                    // 当前的切片和前面的切片不连续(#EXT-X-DISCONTINUITY)
+	vlast_time        uint32                                  // 最后写的视频的时间戳
+	timeout           time.Duration                           // timeout
+	control           chan interface{}                        // control
 }
 
 func newRtmpFile() (rf *RtmpFile) {
@@ -55,6 +60,124 @@ func newRtmpFile() (rf *RtmpFile) {
 	return
 }
 
+// 广播切换了输入(主备切换, 接管, 重新发布), 接着写这个文件. 按照新的输入的序列头解码, hls 在下一个关键帧开始新的切片.
+func (rf *RtmpFile) discontinue(videoTag, audioTag *AVPacket) (err error) {
+	if !rf.vtwrite {
+		return
+	}
+
+	if videoTag != nil {
+		if err = rf.decodeVideoConfig(videoTag.Clone()); err != nil {
+			return
+		}
+	}
+
+	if audioTag != nil && rf.atwrite {
+		if rf.asc, err = decodeAudioSpecificConfig(audioTag.Clone()); err != nil {
+			return
+		}
+	}
+
+	rf.hls_switched = true
+
+	return
+}
+
+// 根据配置创建TS Muxer: 一个节目, 视频(H264或者H265) + AAC音频
+func newRtmpTsMuxer(videoStreamType byte) (muxer *mpegts.Muxer, err error) {
+	var program *mpegts.MuxerProgram
+
+	muxer = mpegts.NewMuxer()
+
+	if program, err = muxer.AddProgram(uint16(config.TSProgramNumber), uint16(config.TSPmtPID), config.TSServiceName, config.TSProviderName); err != nil {
+		return
+	}
+
+	if _, err = muxer.AddStream(program, videoStreamType, uint16(config.TSVideoPID)); err != nil {
+		return
+	}
+
+	var descs []mpegts.MpegTsDescriptor
+	if config.TSAudioLanguage != "" {
+		var desc mpegts.MpegTsDescriptor
+		if desc, err = mpegts.NewLanguageDescriptor(config.TSAudioLanguage, 0); err != nil {
+			return
+		}
+
+		descs = append(descs, desc)
+	}
+
+	if _, err = muxer.AddStream(program, mpegts.STREAM_TYPE_AAC, uint16(config.TSAudioPID), descs...); err != nil {
+		return
+	}
+
+	return
+}
+
+// 根据视频Tag(sequence header)解析出 AVCDecoderConfigurationRecord 或者 HEVCDecoderConfigurationRecord
+func (rf *RtmpFile) decodeVideoConfig(tag *AVPacket) (err error) {
+	rf.vcodec = tag.VideoCodecID
+
+	switch rf.vcodec {
+	case avformat.FLV_CODECID_AVC:
+		{
+			rf.avc, err = decodeAVCDecoderConfigurationRecord(tag)
+		}
+	case avformat.FLV_CODECID_HEVC:
+		{
+			rf.hevc, err = decodeHEVCDecoderConfigurationRecord(tag)
+		}
+	default:
+		{
+			err = errors.New("unsupport video codec.")
+		}
+	}
+
+	return
+}
+
+func (rf *RtmpFile) videoPacketToPES(video *AVPacket) (packet mpegts.MpegTsPESPacket, err error) {
+	if rf.vcodec == avformat.FLV_CODECID_HEVC {
+		return rtmpHEVCVideoPacketToPES(video, rf.hevc)
+	}
+
+	return rtmpVideoPacketToPES(video, rf.avc)
+}
+
+func (rf *RtmpFile) videoStreamType() byte {
+	if rf.vcodec == avformat.FLV_CODECID_HEVC {
+		return mpegts.STREAM_TYPE_H265
+	}
+
+	return mpegts.STREAM_TYPE_H264
+}
+
+// HLS EXT-X-STREAM-INF CODECS
+func (rf *RtmpFile) codecs(hasAudio bool) string {
+	var codecs string
+	if rf.vcodec == avformat.FLV_CODECID_HEVC {
+		codecs = avformat.HEVCCodecString(rf.hevc)
+	} else {
+		codecs = avformat.AVCCodecString(rf.avc)
+	}
+
+	if hasAudio {
+		codecs += "," + avformat.AACCodecString(rf.asc)
+	}
+
+	return codecs
+}
+
+// sequence header 和 Enhanced RTMP metadata 不写入TS.
+// 推流端重新发送 sequence header 的时候, 编码参数可能发生了变化, 需要重新解析.
+func (rf *RtmpFile) skipVideoPacket(video *AVPacket) (skip bool, err error) {
+	if video.isVideoSequenceHeader() {
+		return true, rf.decodeVideoConfig(video)
+	}
+
+	return video.isVideoMetadata(), nil
+}
+
 func rtmpAudioPacketToPESPreprocess(audio *AVPacket, aac_asc avformat.AudioSpecificConfig) (data []byte, err error) {
 	// SoundFormat, AACPacketType
 	if _, err = CheckIsAAC(audio); err != nil {
@@ -87,6 +210,20 @@ func rtmpVideoPacketToPESPreprocess(video *AVPacket, avc_dcr avformat.AVCDecoder
 	return
 }
 
+func rtmpHEVCVideoPacketToPESPreprocess(video *AVPacket, hevc_dcr avformat.HEVCDecoderConfigurationRecord) (data []byte, err error) {
+	// frameType, codecID(or FourCC), packetType
+	if _, err = CheckIsHEVC(video); err != nil {
+		return
+	}
+
+	// nalu array
+	if data, err = rtmpHEVCVideoPacketSplitNaluAndAppendAudVPSSPSPPS(video, &hevc_dcr, uint32(hevc_dcr.LengthSizeMinusOne+1)); err != nil {
+		return
+	}
+
+	return
+}
+
 func rtmpAudioPacketToPES(audio *AVPacket, aac_asc avformat.AudioSpecificConfig) (packet mpegts.MpegTsPESPacket, err error) {
 	var data []byte
 
@@ -101,7 +238,7 @@ func rtmpAudioPacketToPES(audio *AVPacket, aac_asc avformat.AudioSpecificConfig)
 	packet.Header.ConstTen = 0x80
 	packet.Header.StreamID = mpegts.STREAM_ID_AUDIO
 	packet.Header.PesPacketLength = uint16(pktLength)
-	packet.Header.Pts = uint64(audio.Timestamp) * 90
+	packet.Header.Pts = mpegts.MillisecondToPtsDts(int64(audio.Timestamp))
 	packet.Header.PtsDtsFlags = 0x80
 	packet.Header.PesHeaderDataLength = 5
 
@@ -118,32 +255,39 @@ func rtmpVideoPacketToPES(video *AVPacket, avc_dcr avformat.AVCDecoderConfigurat
 		return
 	}
 
+	return newVideoPESPacket(video, data)
+}
+
+func rtmpHEVCVideoPacketToPES(video *AVPacket, hevc_dcr avformat.HEVCDecoderConfigurationRecord) (packet mpegts.MpegTsPESPacket, err error) {
+	var data []byte
+
+	// H265 和 H264 一样,需要分割nalu,并且打上vps,sps,pps,nalu_aud信息.
+	if data, err = rtmpHEVCVideoPacketToPESPreprocess(video, hevc_dcr); err != nil {
+		return
+	}
+
+	return newVideoPESPacket(video, data)
+}
+
+func newVideoPESPacket(video *AVPacket, data []byte) (packet mpegts.MpegTsPESPacket, err error) {
 	pktLength := len(data) + 10 + 3
 	if pktLength > 0xffff {
 		pktLength = 0
 	}
 
 	// cts = (pts - dts) / 90
-	var cts uint32
-	var avcPktType uint32
-	if avcPktType, err = util.ByteToUint32N(video.Payload[1:2]); err != nil {
+	var cts int32
+	if cts, err = rtmpVideoPacketCompositionTime(video); err != nil {
 		return
 	}
 
-	if avcPktType == 1 {
-		if cts, err = util.ByteToUint32N(video.Payload[2:5]); err != nil {
-			return
-		}
-	}
-
-	//cts = ((cts & 0x00FF0000) >> 16) | ((cts & 0x000000FF) << 16) | (cts & 0x0000FF00)
-
 	packet.Header.PacketStartCodePrefix = 0x000001
 	packet.Header.ConstTen = 0x80
 	packet.Header.StreamID = mpegts.STREAM_ID_VIDEO
 	packet.Header.PesPacketLength = uint16(pktLength)
-	packet.Header.Pts = uint64(video.Timestamp+cts) * 90
-	packet.Header.Dts = uint64(video.Timestamp) * 90
+	// PTS = DTS + CTS, 有B帧的时候CTS不为0
+	packet.Header.Dts = mpegts.MillisecondToPtsDts(int64(video.Timestamp))
+	packet.Header.Pts = mpegts.MillisecondToPtsDts(int64(video.Timestamp) + int64(cts))
 	packet.Header.PtsDtsFlags = 0xC0
 	packet.Header.PesHeaderDataLength = 10
 
@@ -152,7 +296,75 @@ func rtmpVideoPacketToPES(video *AVPacket, avc_dcr avformat.AVCDecoderConfigurat
 	return
 }
 
-func writeHlsTsSegmentFile(filename string, data []byte) (err error) {
+// 视频包头:
+// 传统FLV: FrameType(4) + CodecID(4) + AVCPacketType(8) + CompositionTime(24), 一共5个字节. CompositionTime是有符号数(SI24)
+// Enhanced RTMP: IsExHeader(1) + FrameType(3) + PacketType(4) + FourCC(32) + CompositionTime(24, 只有PacketType为CodedFrames的时候才有)
+// packetType 统一转换成 AVCPacketType(0: sequence header, 1: nalu, 2: end of sequence), index 为视频数据开始的位置
+func rtmpVideoPacketHeader(video *AVPacket) (packetType byte, cts int32, index int, err error) {
+	if len(video.Payload) < 5 {
+		err = errors.New("video packet length < 5")
+		return
+	}
+
+	if video.Payload[0]&avformat.FLV_VIDEO_EX_HEADER == 0 {
+		packetType = video.Payload[1]
+		index = 5
+
+		// AVCPacketType != 1 的时候, CompositionTime 为 0
+		if packetType == avformat.AVC_PACKET_TYPE_NALU {
+			cts = rtmpVideoPacketReadCompositionTime(video.Payload[2:5])
+		}
+
+		return
+	}
+
+	switch video.Payload[0] & 0x0f {
+	case avformat.FLV_EX_PACKET_TYPE_SEQUENCE_START:
+		{
+			packetType = avformat.AVC_PACKET_TYPE_SEQUENCE_HEADER
+			index = 5
+		}
+	case avformat.FLV_EX_PACKET_TYPE_CODED_FRAMES:
+		{
+			if len(video.Payload) < 8 {
+				err = errors.New("video packet length < 8")
+				return
+			}
+
+			packetType = avformat.AVC_PACKET_TYPE_NALU
+			cts = rtmpVideoPacketReadCompositionTime(video.Payload[5:8])
+			index = 8
+		}
+	case avformat.FLV_EX_PACKET_TYPE_CODED_FRAMES_X:
+		{
+			packetType = avformat.AVC_PACKET_TYPE_NALU
+			index = 5
+		}
+	case avformat.FLV_EX_PACKET_TYPE_SEQUENCE_END:
+		{
+			packetType = avformat.AVC_PACKET_TYPE_END_OF_SEQUENCE
+			index = 5
+		}
+	default:
+		{
+			err = errors.New("unsupport enhanced rtmp video packet type.")
+		}
+	}
+
+	return
+}
+
+// 24 bits 有符号数扩展成 32 bits
+func rtmpVideoPacketReadCompositionTime(b []byte) int32 {
+	return int32(util.BigEndian.Uint24(b)<<8) >> 8
+}
+
+func rtmpVideoPacketCompositionTime(video *AVPacket) (cts int32, err error) {
+	_, cts, _, err = rtmpVideoPacketHeader(video)
+	return
+}
+
+func writeHlsTsSegmentFile(filename string, muxer *mpegts.Muxer, data []byte) (err error) {
 	var file *os.File
 
 	file, err = os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0644)
@@ -161,11 +373,7 @@ func writeHlsTsSegmentFile(filename string, data []byte) (err error) {
 	}
 	defer file.Close()
 
-	if err = mpegts.WriteDefaultPATPacket(file); err != nil {
-		return
-	}
-
-	if err = mpegts.WriteDefaultPMTPacket(file); err != nil {
+	if err = muxer.WriteTables(file); err != nil {
 		return
 	}
 
@@ -179,11 +387,13 @@ func writeHlsTsSegmentFile(filename string, data []byte) (err error) {
 }
 
 func writeFLVTag(w io.Writer, data *AVPacket) (err error) {
+	// 时间戳的低 24 位和高 8 位分开写
 	tag := avformat.FLVTag{
-		TagType:   data.Type,
-		DataSize:  uint32(len(data.Payload)),
-		Timestamp: data.Timestamp,
-		Data:      *bytes.NewBuffer(data.Payload),
+		TagType:           data.Type,
+		DataSize:          uint32(len(data.Payload)),
+		Timestamp:         data.Timestamp & 0xffffff,
+		TimestampExtended: uint8(data.Timestamp >> 24),
+		Data:              *bytes.NewBuffer(data.Payload),
 	}
 
 	bw := &bytes.Buffer{}
@@ -198,6 +408,20 @@ func writeFLVTag(w io.Writer, data *AVPacket) (err error) {
 	return
 }
 
+// FLV Script Tag 只支持 AMF0, AMF3 数据消息去掉第一个字节
+func writeFLVScriptTag(w io.Writer, data *AVPacket) (err error) {
+	if data.Type == RTMP_MSG_AMF3_METADATA {
+		if len(data.Payload) <= 1 {
+			return
+		}
+
+		data.Type = RTMP_MSG_AMF0_METADATA
+		data.Payload = data.Payload[1:]
+	}
+
+	return writeFLVTag(w, data)
+}
+
 func writeMP4File(w io.Writer) (err error) {
 	//ftypBox := avformat.NewFileTypeBox()
 	return
@@ -252,7 +476,8 @@ func rtmpVideoPacketSplitNaluAndAppendAudSPSPPS(video *AVPacket, avc *avformat.A
 			return
 		}
 
-		if prevIndex+naluSize+length > uint32(len(video.Payload)) {
+		// 长度字段是对端填的, 用减法比较防止溢出
+		if length == 0 || length > uint32(len(video.Payload))-prevIndex-naluSize {
 			return nil, errors.New("rtmpVideoPacketAppendNaluAUD error 2!")
 		}
 
@@ -276,6 +501,7 @@ func rtmpVideoPacketSplitNaluAndAppendAudSPSPPS(video *AVPacket, avc *avformat.A
 
 		// 7-9, ignore, @see: ngx_rtmp_hls_video
 		if nalu_type >= 7 && nalu_type <= 9 {
+			prevIndex = prevIndex + naluSize + length
 			continue
 		}
 
@@ -318,6 +544,83 @@ func rtmpVideoPacketSplitNaluAndAppendAudSPSPPS(video *AVPacket, avc *avformat.A
 	return
 }
 
+// 和 rtmpVideoPacketSplitNaluAndAppendAudSPSPPS 一样, H265 的 NALU 也是 nalu_length + nalu_data
+// 每一帧前面打上 HEVC AUD, IRAP 帧前面打上 VPS + SPS + PPS
+func rtmpHEVCVideoPacketSplitNaluAndAppendAudVPSSPSPPS(video *AVPacket, hevc *avformat.HEVCDecoderConfigurationRecord, naluSize uint32) (naluArray []byte, err error) {
+	var index int
+	var aud_sent bool
+	var vps_sps_pps_sent bool
+	var prevIndex, length uint32
+
+	if _, _, index, err = rtmpVideoPacketHeader(video); err != nil {
+		return
+	}
+
+	prevIndex = uint32(index)
+
+	for prevIndex < uint32(len(video.Payload)) {
+		if prevIndex+naluSize > uint32(len(video.Payload)) {
+			return nil, errors.New("rtmpHEVCVideoPacketSplitNalu error 1!")
+		}
+
+		if length, err = util.ByteToUint32N(video.Payload[prevIndex : prevIndex+naluSize]); err != nil {
+			return
+		}
+
+		if length < 2 || length > uint32(len(video.Payload))-prevIndex-naluSize {
+			return nil, errors.New("rtmpHEVCVideoPacketSplitNalu error 2!")
+		}
+
+		nalu_data := video.Payload[prevIndex+naluSize : prevIndex+naluSize+length]
+		nalu_type := avformat.HEVCNALUType(nalu_data)
+
+		prevIndex = prevIndex + naluSize + length
+
+		// VPS, SPS, PPS, AUD 由我们自己来打
+		if nalu_type >= avformat.HEVC_NALU_VPS && nalu_type <= avformat.HEVC_NALU_AUD {
+			continue
+		}
+
+		// 一帧数据只会Append一个NALU_AUD
+		if !aud_sent {
+			naluArray = append(naluArray, avformat.HEVC_NALU_AUD_BYTE...)
+			aud_sent = true
+		}
+
+		if avformat.HEVCNALUIsIRAP(nalu_type) && !vps_sps_pps_sent {
+			vps_sps_pps_sent = true
+
+			for _, t := range []byte{avformat.HEVC_NALU_VPS, avformat.HEVC_NALU_SPS, avformat.HEVC_NALU_PPS} {
+				for _, nalu := range hevc.NALUnits(t) {
+					naluArray = append(naluArray, avformat.NALU_Delimiter2...)
+					naluArray = append(naluArray, nalu...)
+				}
+			}
+		}
+
+		naluArray = append(naluArray, avformat.NALU_Delimiter2...)
+		naluArray = append(naluArray, nalu_data...)
+	}
+
+	return
+}
+
+func decodeHEVCDecoderConfigurationRecord(video *AVPacket) (hevc_dcr avformat.HEVCDecoderConfigurationRecord, err error) {
+	var packetType byte
+	var index int
+
+	if packetType, _, index, err = rtmpVideoPacketHeader(video); err != nil {
+		return
+	}
+
+	if packetType != avformat.AVC_PACKET_TYPE_SEQUENCE_HEADER {
+		err = errors.New("decodeHEVCDecoderConfigurationRecord error : this packet is not HEVC sequence header")
+		return
+	}
+
+	return avformat.ReadHEVCDecoderConfigurationRecord(video.Payload[index:])
+}
+
 func decodeAVCDecoderConfigurationRecord(video *AVPacket) (avc_dcr avformat.AVCDecoderConfigurationRecord, err error) {
 	if len(video.Payload) < 13 {
 		err = errors.New("decodeAVCDecoderConfigurationRecord error 1")
@@ -403,6 +706,12 @@ func CheckIsH264(pkt *AVPacket) (bl bool, err error) {
 		return
 	}
 
+	if len(pkt.Payload) < 2 {
+		bl = false
+		err = errors.New("frame isn't AVC NALU.(payload too short)")
+		return
+	}
+
 	avcPacketType := pkt.Payload[1]
 	if avcPacketType != 1 && avcPacketType != 2 {
 		bl = false
@@ -415,6 +724,30 @@ func CheckIsH264(pkt *AVPacket) (bl bool, err error) {
 	return
 }
 
+func CheckIsHEVC(pkt *AVPacket) (bl bool, err error) {
+	if pkt.VideoCodecID != avformat.FLV_CODECID_HEVC {
+		bl = false
+		err = errors.New("frame isn't HEVC.(codec id != 12 and fourcc != hvc1)")
+		return
+	}
+
+	var packetType byte
+	if packetType, _, _, err = rtmpVideoPacketHeader(pkt); err != nil {
+		bl = false
+		return
+	}
+
+	if packetType != avformat.AVC_PACKET_TYPE_NALU && packetType != avformat.AVC_PACKET_TYPE_END_OF_SEQUENCE {
+		bl = false
+		err = errors.New("frame isn't HEVC NALU or HEVC end of sequence.")
+		return
+	}
+
+	bl = true
+
+	return
+}
+
 func CheckIsAAC(pkt *AVPacket) (bl bool, err error) {
 	if pkt.SoundFormat != 10 {
 		bl = false
@@ -422,6 +755,12 @@ func CheckIsAAC(pkt *AVPacket) (bl bool, err error) {
 		return
 	}
 
+	if len(pkt.Payload) < 2 {
+		bl = false
+		err = errors.New("frame isn't AAC raw.(payload too short)")
+		return
+	}
+
 	AACPacketType := pkt.Payload[1]
 	if AACPacketType != 1 {
 		bl = false
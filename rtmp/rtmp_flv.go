@@ -0,0 +1,441 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/sevenzoe/gortmp/avformat"
+	"github.com/sevenzoe/gortmp/util"
+)
+
+// 用 FLV 播放一个直播流(比如 WebSocket FLV), 订阅广播之后 Tags 依次收到:
+// FLV Header, onMetaData, 视频和音频的 sequence header, 最近的 GOP, 之后是直播的音视频.
+// 时间戳从 0 开始, 切换发布者之后接着以前的.
+//
+// 每个订阅者有自己的队列, 广播不会因为一个慢的订阅者阻塞. 队列满了之后丢掉数据, 从下一个关键帧重新开始.
+// 播放结束的时候 Done 关闭, 调用者停止发送之后要调用 Close.
+//
+// 比如:
+//
+//	sub, err := rtmp.SubscribeFLV("live/mystream", r.RemoteAddr)
+//	defer sub.Close()
+//	for {
+//		select {
+//		case tag := <-sub.Tags():
+//			// 发送 tag
+//		case <-sub.Done():
+//			return
+//		}
+//	}
+type FlvSubscriber struct {
+	streamPath string
+	remoteAddr string
+	broadcast  *Broadcast
+	tags       chan []byte
+	done       chan struct{}
+	closeOnce  *sync.Once
+
+	// 下面的只在广播的 goroutine 里面使用
+	headerSent bool   // 已经发送了 FLV Header
+	started    bool   // 已经从关键帧开始发送, 队列满了之后重新等关键帧
+	based      bool   // base_time 有效
+	base_time  uint32 // 发布者时间线上和 rebase 对应的时间戳
+	rebase     uint32 // 切换发布者之后播放者时间线的起点
+	last       uint32 // 最后发送的时间戳
+}
+
+func newFlvSubscriber(streamPath, remoteAddr string) *FlvSubscriber {
+	return &FlvSubscriber{
+		streamPath: streamPath,
+		remoteAddr: remoteAddr,
+		tags:       make(chan []byte, RTMP_FLV_QUEUE_SIZE),
+		done:       make(chan struct{}),
+		closeOnce:  new(sync.Once)}
+}
+
+// 订阅一个正在发布的直播流, 没有的时候返回 NetStream.Play.StreamNotFound
+func SubscribeFLV(streamPath, remoteAddr string) (f *FlvSubscriber, err error) {
+	b, ok := find_broadcast(streamPath)
+	if !ok {
+		err = ErrStreamNotFound
+		return
+	}
+
+	f = newFlvSubscriber(streamPath, remoteAddr)
+	f.broadcast = b
+
+	// 这里会添加订阅者, 广播已经结束的时候和没有找到一样
+	if !b.send(f) {
+		return nil, ErrStreamNotFound
+	}
+
+	return
+}
+
+func (f *FlvSubscriber) StreamPath() string {
+	return f.streamPath
+}
+
+// 一个 Tag 或者几个连续的 Tag(开始播放的时候 Header 和 sequence header 在一起)
+func (f *FlvSubscriber) Tags() <-chan []byte {
+	return f.tags
+}
+
+// 广播结束或者订阅者关闭
+func (f *FlvSubscriber) Done() <-chan struct{} {
+	return f.done
+}
+
+// 取消订阅, 可以调用多次
+func (f *FlvSubscriber) Close() {
+	f.closeOnce.Do(func() {
+		close(f.done)
+
+		if b, ok := find_broadcast(f.streamPath); ok && b == f.broadcast {
+			b.removeSubscriber(f)
+		}
+	})
+}
+
+func (f *FlvSubscriber) id() string {
+	return "flv/" + f.remoteAddr
+}
+
+// 播放者时间线上的时间戳, 第一个发送的包的时间戳为0
+func (f *FlvSubscriber) timeline(timestamp uint32) uint32 {
+	if !f.based {
+		f.based = true
+		f.base_time = timestamp
+	}
+
+	if timestamp > f.base_time {
+		f.last = f.rebase + timestamp - f.base_time
+	} else {
+		f.last = f.rebase
+	}
+
+	return f.last
+}
+
+func (f *FlvSubscriber) rebaseTimeline() {
+	if f.based {
+		f.rebase = f.last + RTMP_TIMELINE_GAP
+	}
+
+	f.based = false
+	f.started = false
+}
+
+// 不阻塞广播, 队列满了之后等下一个关键帧
+func (f *FlvSubscriber) push(data []byte) {
+	select {
+	case f.tags <- data:
+	default:
+		{
+			f.started = false
+		}
+	}
+}
+
+// 从关键帧(没有视频的时候从音频)开始: FLV Header, onMetaData, sequence header 和这一帧的时间戳一样
+func (f *FlvSubscriber) start(pkt *AVPacket) (err error) {
+	publisher := f.broadcast.publisher
+	videoTag, audioTag := publisher.tags()
+	w := &bytes.Buffer{}
+
+	if !f.headerSent {
+		header := avformat.FLVHeader{
+			SignatureF: 0x46,
+			SignatureL: 0x4C,
+			SignatureV: 0x56,
+			Version:    0x01,
+			DataOffse:  9,
+		}
+
+		if audioTag != nil {
+			header.TypeFlagsAudio = 1
+		}
+
+		if videoTag != nil {
+			header.TypeFlagsVideo = 1
+		}
+
+		if err = avformat.WriteFLVHeader(w, header); err != nil {
+			return
+		}
+
+		// PreviousTagSize0 == 0x00000000
+		if err = util.WriteUint32ToByte(w, 0x00000000, true); err != nil {
+			return
+		}
+	}
+
+	timestamp := f.timeline(pkt.Timestamp)
+
+	if meta := publisher.metadata(); meta != nil {
+		meta.Timestamp = timestamp
+
+		if err = writeFLVScriptTag(w, meta); err != nil {
+			return
+		}
+	}
+
+	if videoTag != nil {
+		vTag := videoTag.Clone()
+		vTag.Timestamp = timestamp
+
+		if err = writeFLVTag(w, vTag); err != nil {
+			return
+		}
+	}
+
+	if audioTag != nil {
+		aTag := audioTag.Clone()
+		aTag.Timestamp = timestamp
+
+		if err = writeFLVTag(w, aTag); err != nil {
+			return
+		}
+	}
+
+	pkt.Timestamp = timestamp
+	if err = writeFLVTag(w, pkt); err != nil {
+		return
+	}
+
+	select {
+	case f.tags <- w.Bytes():
+		{
+			f.headerSent = true
+			f.started = true
+		}
+	default:
+	}
+
+	return
+}
+
+func (f *FlvSubscriber) send(pkt *AVPacket) (err error) {
+	pkt.Timestamp = f.timeline(pkt.Timestamp)
+
+	w := &bytes.Buffer{}
+	if pkt.Type == RTMP_MSG_AMF0_METADATA || pkt.Type == RTMP_MSG_AMF3_METADATA {
+		err = writeFLVScriptTag(w, pkt)
+	} else {
+		err = writeFLVTag(w, pkt)
+	}
+
+	if err != nil {
+		return
+	}
+
+	f.push(w.Bytes())
+	return
+}
+
+func (f *FlvSubscriber) SendVideo(video *AVPacket) error {
+	if f.started {
+		return f.send(video)
+	}
+
+	// sequence header 在开始的时候发送发布者最新的
+	if !video.isKeyFrame() || video.isVideoSequenceHeader() {
+		return nil
+	}
+
+	return f.start(video)
+}
+
+func (f *FlvSubscriber) SendAudio(audio *AVPacket) error {
+	if f.started {
+		return f.send(audio)
+	}
+
+	// 有视频的时候从关键帧开始
+	if videoTag, _ := f.broadcast.publisher.tags(); videoTag != nil || audio.isAACSequenceHeader() {
+		return nil
+	}
+
+	return f.start(audio)
+}
+
+// 开始播放之前的数据消息不发送, onMetaData 在开始播放的时候发送最新的
+func (f *FlvSubscriber) SendData(data *AVPacket) error {
+	if !f.started {
+		return nil
+	}
+
+	return f.send(data)
+}
+
+func (f *FlvSubscriber) publishNotify() error {
+	f.rebaseTimeline()
+	return nil
+}
+
+func (f *FlvSubscriber) unpublishNotify() error {
+	f.started = false
+	return nil
+}
+
+// 广播结束, 已经不在广播的订阅者里面了
+func (f *FlvSubscriber) finishLive(streamPath string) {
+	f.closeOnce.Do(func() {
+		close(f.done)
+	})
+}
+
+// 在广播的 goroutine 里面, 取消订阅不能等广播处理
+func (f *FlvSubscriber) onError(err error) {
+	go f.Close()
+}
+
+// 用 FLV 发布一个直播流(比如浏览器用 MediaRecorder 和 JS 封装成 FLV, 通过 WebSocket 发送).
+// 和 RTMP 的发布者一样经过 ServerHandler.OnPublishing 开始广播, RTMP, HLS 和 FLV 的播放者都可以播放.
+// 重复发布的策略(config.Republish)和主备输入也一样, 被接管的时候关闭 conn.
+//
+// 比如:
+//
+//	pub, err := s.PublishFLV(conn, "live", "mystream")
+//	if err != nil {
+//		conn.Close()
+//		return
+//	}
+//	err = pub.Serve(r)
+type FlvPublisher struct {
+	stream *RtmpNetStream
+}
+
+// conn 是发布者的连接(比如 WebSocket 下面的 TCP 连接), 只用来取地址和关闭, 数据由 Serve 读.
+// OnPublishing 返回错误的时候不关闭 conn.
+func (s *Server) PublishFLV(conn net.Conn, appName, name string) (p *FlvPublisher, err error) {
+	c := newRtmpNetConnect(conn, s)
+	c.appName = appName
+	c.connected = true
+
+	ns := newNetStream(c, s.Handler)
+	ns.streamID = 1
+	ns.streamPath = joinStreamPath(appName, name)
+	c.addStream(ns)
+
+	if err = s.Handler.OnPublishing(ns); err != nil {
+		return nil, err
+	}
+
+	ns.mode = 1
+
+	return &FlvPublisher{stream: ns}, nil
+}
+
+func (p *FlvPublisher) StreamPath() string {
+	return p.stream.streamPath
+}
+
+// 读 FLV Header 和 Tag, 直到 r 结束或者出错. 返回的时候停止发布, 关闭连接.
+// Tag 超过 Server.Limits 的 MaxMessageSize 的时候返回 *ProtocolError.
+func (p *FlvPublisher) Serve(r io.Reader) (err error) {
+	defer p.Close()
+
+	br := bufio.NewReader(r)
+
+	header, err := avformat.ReadFLVHeader(br)
+	if err != nil {
+		return
+	}
+
+	// FLV Header 后面可能有扩展的数据, 然后是 PreviousTagSize0
+	skip := 4
+	if header.DataOffse > 9 {
+		skip += int(header.DataOffse) - 9
+	}
+
+	if _, err = br.Discard(skip); err != nil {
+		return
+	}
+
+	for {
+		// 和 RTMP 的消息一样限制长度, 读 Tag 之前检查, 不分配超过限制的内存
+		var h []byte
+		if h, err = br.Peek(11); err != nil {
+			break
+		}
+
+		if size := uint32(h[1])<<16 | uint32(h[2])<<8 | uint32(h[3]); size > p.stream.conn.limits.MaxMessageSize {
+			err = newProtocolError(ErrMessageTooLarge, "flv tag type %v, length %v/%v", h[0], size, p.stream.conn.limits.MaxMessageSize)
+			break
+		}
+
+		var tag avformat.FLVTag
+		if tag, err = avformat.ReadFLVTag(br); err != nil {
+			break
+		}
+
+		p.publish(&tag)
+
+		if _, err = br.Discard(4); err != nil { // PreviousTagSize
+			break
+		}
+	}
+
+	if err == io.EOF {
+		err = nil
+	}
+
+	return
+}
+
+// 停止发布, 关闭连接. 可以调用多次
+func (p *FlvPublisher) Close() {
+	p.stream.Close()
+}
+
+// 一个 Tag 和 RTMP 的一个音视频或者数据消息一样处理, FLV 的时间戳是绝对时间戳
+func (p *FlvPublisher) publish(tag *avformat.FLVTag) {
+	s := p.stream
+	payload := tag.Data.Bytes()
+	if len(payload) == 0 {
+		return
+	}
+
+	timestamp := uint32(tag.TimestampExtended)<<24 | tag.Timestamp
+	s.total_duration = timestamp
+
+	switch tag.TagType {
+	case RTMP_MSG_AUDIO, RTMP_MSG_VIDEO:
+		{
+			pkt, err := newVodPacket(tag.TagType, timestamp, payload)
+			if err != nil {
+				fmt.Println("flv tag header decode error :", err)
+				return
+			}
+
+			pkt.chunks = newChunkCache()
+
+			if tag.TagType == RTMP_MSG_AUDIO {
+				s.publishAudio(pkt)
+			} else {
+				s.publishVideo(pkt)
+			}
+		}
+	case RTMP_MSG_AMF0_METADATA:
+		{
+			mete := newMetadataMessage()
+			mete.RtmpHeader.ChunkMessgaeHeader.MessageTypeID = RTMP_MSG_AMF0_METADATA
+			mete.RtmpBody.Payload = payload
+
+			if name, _ := newAMFDecoder(payload).decodeObject(); name != nil {
+				mete.Name, _ = name.(string)
+			}
+
+			metadataMessageHandle(s, mete)
+		}
+	default:
+		{
+			fmt.Println("unknown flv tag type :", tag.TagType)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package rtmp
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// 一个 FLV Tag 的类型, 时间戳和负载
+type flvTestTag struct {
+	typ       byte
+	timestamp uint32
+	data      []byte
+}
+
+// 拆分订阅者收到的数据, 开头的 FLV Header 和 PreviousTagSize0 跳过
+func parseFLVTags(t *testing.T, b []byte) (tags []flvTestTag) {
+	if bytes.HasPrefix(b, []byte("FLV")) {
+		b = b[9+4:]
+	}
+
+	for len(b) > 0 {
+		if len(b) < 11 {
+			t.Fatalf("short tag header %v", len(b))
+		}
+
+		size := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+		timestamp := uint32(b[7])<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+
+		if len(b) < 11+size+4 {
+			t.Fatalf("short tag %v, size %v", len(b), size)
+		}
+
+		tags = append(tags, flvTestTag{typ: b[0], timestamp: timestamp, data: b[11 : 11+size]})
+		b = b[11+size+4:]
+	}
+
+	return
+}
+
+func newTestVideo(timestamp uint32, payload ...byte) *AVPacket {
+	pkt := &AVPacket{Type: RTMP_MSG_VIDEO, Timestamp: timestamp, Payload: payload}
+	if err := pkt.decodeVideoTagHeader(); err != nil {
+		panic(err)
+	}
+
+	return pkt
+}
+
+func newTestAudio(timestamp uint32, payload ...byte) *AVPacket {
+	return &AVPacket{Type: RTMP_MSG_AUDIO, Timestamp: timestamp, Payload: payload, SoundFormat: payload[0] >> 4}
+}
+
+// 广播不启动 goroutine, 直接调用 send_packet 和 replay
+func newTestBroadcast() *Broadcast {
+	publisher := newNetStream(newRtmpNetConnect(&bufConn{&bytes.Buffer{}}, nil), nil)
+	publisher.videoTag = newTestVideo(0, 0x17, 0x00, 0, 0, 0, 0x01)
+	publisher.audioTag = newTestAudio(0, 0xaf, 0x00, 0x12, 0x10)
+	publisher.metaData = &AVPacket{Type: RTMP_MSG_AMF0_METADATA, Payload: []byte{0x02, 0, 1, 'x'}}
+
+	return &Broadcast{
+		lock:       new(sync.Mutex),
+		publisher:  publisher,
+		publishing: publisher,
+		subscriber: make(map[string]subscriber),
+		control:    make(chan interface{}, 10),
+		done:       make(chan struct{})}
+}
+
+func subscribeTest(b *Broadcast, queue int) *FlvSubscriber {
+	f := newFlvSubscriber(b.streamPath, "test")
+	f.broadcast = b
+	f.tags = make(chan []byte, queue)
+
+	b.subscriber[f.id()] = f
+	b.replay(f)
+
+	return f
+}
+
+// 订阅者收到的 Tag, 没有的时候返回
+func receiveTags(t *testing.T, f *FlvSubscriber) (tags []flvTestTag) {
+	for {
+		select {
+		case data := <-f.tags:
+			{
+				tags = append(tags, parseFLVTags(t, data)...)
+			}
+		default:
+			{
+				return
+			}
+		}
+	}
+}
+
+func checkTags(t *testing.T, tags []flvTestTag, want []flvTestTag) {
+	if len(tags) != len(want) {
+		t.Fatalf("%v tags, want %v", len(tags), len(want))
+	}
+
+	for i := range want {
+		if tags[i].typ != want[i].typ || tags[i].timestamp != want[i].timestamp || tags[i].data[0] != want[i].data[0] || tags[i].data[1] != want[i].data[1] {
+			t.Fatalf("tag %v: type %v, timestamp %v, data % x, want type %v, timestamp %v, data % x",
+				i, tags[i].typ, tags[i].timestamp, tags[i].data[:2], want[i].typ, want[i].timestamp, want[i].data[:2])
+		}
+	}
+}
+
+// FLV Header, onMetaData, 视频和音频的 sequence header, 最近的 GOP, 之后是直播的音视频
+func TestFlvSubscriberTagOrder(t *testing.T) {
+	b := newTestBroadcast()
+
+	b.send_packet(newTestVideo(1000, 0x27, 0x01, 0, 0, 0)) // GOP 之前的帧不缓存
+	b.send_packet(newTestVideo(1040, 0x17, 0x01, 0, 0, 0))
+	b.send_packet(newTestAudio(1050, 0xaf, 0x01, 0x21))
+	b.send_packet(newTestVideo(1080, 0x27, 0x01, 0, 0, 0))
+
+	f := subscribeTest(b, RTMP_FLV_QUEUE_SIZE)
+	defer b.clear_gop()
+
+	b.send_packet(newTestVideo(1120, 0x27, 0x01, 0, 0, 0))
+
+	data := <-f.tags
+	if !bytes.HasPrefix(data, []byte("FLV")) || data[4] != 0x05 {
+		t.Fatalf("FLV header % x", data[:5])
+	}
+
+	tags := append(parseFLVTags(t, data), receiveTags(t, f)...)
+
+	checkTags(t, tags, []flvTestTag{
+		{typ: RTMP_MSG_AMF0_METADATA, timestamp: 0, data: []byte{0x02, 0}},
+		{typ: RTMP_MSG_VIDEO, timestamp: 0, data: []byte{0x17, 0x00}},
+		{typ: RTMP_MSG_AUDIO, timestamp: 0, data: []byte{0xaf, 0x00}},
+		{typ: RTMP_MSG_VIDEO, timestamp: 0, data: []byte{0x17, 0x01}},
+		{typ: RTMP_MSG_AUDIO, timestamp: 10, data: []byte{0xaf, 0x01}},
+		{typ: RTMP_MSG_VIDEO, timestamp: 40, data: []byte{0x27, 0x01}},
+		{typ: RTMP_MSG_VIDEO, timestamp: 80, data: []byte{0x27, 0x01}},
+	})
+}
+
+// 队列满了之后丢掉数据, 从下一个关键帧重新开始: 不再发送 FLV Header, 先发送 onMetaData 和 sequence header, 时间戳接着以前的
+func TestFlvSubscriberQueueFull(t *testing.T) {
+	b := newTestBroadcast()
+	b.send_packet(newTestVideo(0, 0x17, 0x01, 0, 0, 0))
+
+	f := subscribeTest(b, 2)
+	defer b.clear_gop()
+
+	b.send_packet(newTestVideo(40, 0x27, 0x01, 0, 0, 0))
+	b.send_packet(newTestVideo(80, 0x27, 0x01, 0, 0, 0)) // 队列满了, 丢掉
+
+	if f.started {
+		t.Fatal("started after queue full")
+	}
+
+	tags := receiveTags(t, f)
+	if len(tags) != 5 {
+		t.Fatalf("%v tags before queue full", len(tags))
+	}
+
+	b.send_packet(newTestVideo(120, 0x27, 0x01, 0, 0, 0)) // 等关键帧
+	b.send_packet(newTestAudio(130, 0xaf, 0x01, 0x21))
+	b.send_packet(newTestVideo(160, 0x17, 0x01, 0, 0, 0))
+	b.send_packet(newTestVideo(200, 0x27, 0x01, 0, 0, 0))
+
+	data := <-f.tags
+	if bytes.HasPrefix(data, []byte("FLV")) {
+		t.Fatal("FLV header sent again")
+	}
+
+	tags = append(parseFLVTags(t, data), receiveTags(t, f)...)
+
+	checkTags(t, tags, []flvTestTag{
+		{typ: RTMP_MSG_AMF0_METADATA, timestamp: 160, data: []byte{0x02, 0}},
+		{typ: RTMP_MSG_VIDEO, timestamp: 160, data: []byte{0x17, 0x00}},
+		{typ: RTMP_MSG_AUDIO, timestamp: 160, data: []byte{0xaf, 0x00}},
+		{typ: RTMP_MSG_VIDEO, timestamp: 160, data: []byte{0x17, 0x01}},
+		{typ: RTMP_MSG_VIDEO, timestamp: 200, data: []byte{0x27, 0x01}},
+	})
+}
+
+// 广播结束之后订阅和取消订阅都不阻塞
+func TestSubscribeEndedBroadcast(t *testing.T) {
+	b := newTestBroadcast()
+	b.streamPath = "test/ended"
+	b.control = make(chan interface{})
+	b.close_done()
+
+	broadcastsLock.Lock()
+	broadcasts[b.streamPath] = b
+	broadcastsLock.Unlock()
+
+	defer func() {
+		broadcastsLock.Lock()
+		delete(broadcasts, b.streamPath)
+		broadcastsLock.Unlock()
+	}()
+
+	if _, err := SubscribeFLV(b.streamPath, "test"); err != ErrStreamNotFound {
+		t.Fatalf("error %v", err)
+	}
+
+	f := newFlvSubscriber(b.streamPath, "test")
+	f.broadcast = b
+	f.Close()
+}
+
+// 订阅和广播结束同时发生: 订阅成功(send 返回 true)的订阅者都要收到 finishLive, 不能留在 control 里面
+func TestSubscribeWhileFinish(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		b := newTestBroadcast()
+
+		subscribers := make([]*FlvSubscriber, 20)
+		added := make([]bool, len(subscribers))
+
+		var wg sync.WaitGroup
+		for j := range subscribers {
+			subscribers[j] = newFlvSubscriber(b.streamPath, fmt.Sprint(j))
+			wg.Add(1)
+
+			go func(j int) {
+				defer wg.Done()
+				added[j] = b.send(subscribers[j])
+			}(j)
+		}
+
+		// 广播的 goroutine 一边处理订阅一边结束
+		for j := 0; j < i%len(subscribers); j++ {
+			if c, ok := (<-b.control).(subscriber); ok {
+				b.subscriber[c.id()] = c
+			}
+		}
+
+		b.finish()
+		wg.Wait()
+
+		for j, f := range subscribers {
+			select {
+			case <-f.done:
+				{
+					if !added[j] {
+						t.Fatalf("subscriber %v finished but not added", j)
+					}
+				}
+			default:
+				{
+					if added[j] {
+						t.Fatalf("subscriber %v added but not finished", j)
+					}
+				}
+			}
+		}
+
+		if b.send(newFlvSubscriber(b.streamPath, "late")) {
+			t.Fatal("subscribed after finish")
+		}
+	}
+}
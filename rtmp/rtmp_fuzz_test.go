@@ -0,0 +1,99 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// 读 data, 写的数据丢掉
+type readConn struct {
+	countConn
+	r *bytes.Reader
+}
+
+func (c *readConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func FuzzHandshake(f *testing.F) {
+	c0c1 := make([]byte, 1+C1S1_SIZE)
+	c0c1[0] = RTMP_HANDSHAKE_VERSION
+	f.Add(append(c0c1, make([]byte, C1S1_SIZE)...))
+
+	c0c1 = append([]byte{}, c0c1...)
+	c0c1[1+4] = 9 // Zero 不为0, complex handshake
+	f.Add(append(c0c1, make([]byte, C1S1_SIZE)...))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		brw := bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(data)), bufio.NewWriter(ioutil.Discard))
+		handshake(brw)
+	})
+}
+
+func FuzzReadChunk(f *testing.F) {
+	// 一个视频消息, 一个 connect 命令, 一个聚集消息
+	f.Add(encodeBenchVideo(300, 128))
+
+	connect := newConnectMessage()
+	connect.CommandName = "connect"
+	connect.TransactionId = 1
+	connect.Object = AMFObjects{"app": "live", "tcUrl": "rtmp://localhost/live"}
+	connect.Encode0()
+	f.Add(encodeFuzzMessage(RTMP_MSG_AMF0_COMMAND, connect.RtmpBody.Payload))
+
+	sub := []byte{RTMP_MSG_AUDIO, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0xaf, 0x01, 0, 0, 0, 13}
+	f.Add(encodeFuzzMessage(RTMP_MSG_AGGREGATE, sub))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := newRtmpNetConnect(&readConn{r: bytes.NewReader(data)}, nil)
+		conn.limits.MaxMessageSize = 1 << 16
+		conn.limits.MaxPendingSize = 1 << 18
+
+		for i := 0; i < 64; i++ {
+			msg, err := readChunk(conn)
+			if err != nil {
+				return
+			}
+
+			if aggregate, ok := msg.(*AggregateMessage); ok {
+				aggregate.subMessages(conn.limits.MaxAMFDepth)
+			}
+
+			if buffer := msg.Body().buffer; buffer != nil {
+				buffer.release()
+			}
+		}
+	})
+}
+
+// 一个完整的消息(Type 0 块头)分块之后的数据
+func encodeFuzzMessage(typeID byte, payload []byte) []byte {
+	w := &bytes.Buffer{}
+	conn := newRtmpNetConnect(&bufConn{w}, nil)
+
+	head := newRtmpHeader(RTMP_CSID_COMMAND, 0, uint32(len(payload)), typeID, 0, 0)
+	if err := conn.writeChunks(head, payload, 0, true, nil); err != nil {
+		panic(err)
+	}
+
+	return w.Bytes()
+}
+
+func FuzzAMFDecode(f *testing.F) {
+	amf := newAMFEncoder()
+	amf.writeString("onMetaData")
+	amf.encodeObject(AMFObjects{"width": float64(1280), "height": float64(720), "encoder": "x"})
+	amf.writeAVMPlusValue(AMFObjects{"list": []AMFObject{float64(1), "a", nil}})
+	f.Add(amf.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		amf := newAMFDecoder(data)
+		amf.readObjects()
+
+		if amf.depth != 0 {
+			t.Fatalf("depth %v after decode", amf.depth)
+		}
+	})
+}
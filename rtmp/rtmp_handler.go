@@ -3,6 +3,8 @@ package rtmp
 import (
 	"errors"
 	"fmt"
+
+	"github.com/sevenzoe/gortmp/config"
 )
 
 type ServerHandler interface {
@@ -23,8 +25,18 @@ func (p *DefaultServerHandler) OnRecvFrame(frame *NetFrame) {
 // 发布者成功发布流后,就启动广播
 func (p *DefaultServerHandler) OnPublishing(s *RtmpNetStream) error {
 	// 在广播中发现这个广播已经存在,那么就认为这个广播是无效的.(例如已经发布ip/myapp/mystream这个广播,再次发布ip/app/mystream,就认为这个广播是无效的)
-	if _, ok := find_broadcast(s.streamPath); ok {
-		return errors.New("NetStream.Publish.BadName")
+	// 发布者停止发布之后, 等待重新发布的广播可以接着发布, 订阅者不断开.
+	// 正在发布的时候按照 app 的重复发布策略(config.Republish)拒绝, 接管或者作为备用.
+	// 主备输入(config.Failover)发布到同一个广播, 不能直接发布这个广播的流路径.
+	if _, ok := config.LiveFailover[s.streamPath]; ok {
+		return errors.New(NetStream_Publish_BadName)
+	}
+
+	if d, ok := find_broadcast(broadcast_path(s.streamPath)); ok {
+		ended, err := d.republish(s, config.Republish(s.conn.appName), 5, 5)
+		if err != nil || !ended {
+			return err
+		}
 	}
 
 	start_broadcast(s, 5, 5)
@@ -35,12 +47,11 @@ func (p *DefaultServerHandler) OnPublishing(s *RtmpNetStream) error {
 // 订阅者成功订阅流后,就将订阅者添加进广播中
 func (p *DefaultServerHandler) OnPlaying(s *RtmpNetStream) error {
 	// 根据订阅者(s)提供的信息,来查找订阅者需要订阅的广播,如果找到了,那么就让这个广播添加这个订阅者
-	if d, ok := find_broadcast(s.streamPath); ok {
-		d.addSubscriber(s)
+	if d, ok := find_broadcast(s.streamPath); ok && d.addSubscriber(s) {
 		return nil
 	}
 
-	return errors.New("NetStream.Play.StreamNotFound")
+	return ErrStreamNotFound
 }
 
 func (dsh *DefaultServerHandler) OnClosed(s *RtmpNetStream) {
@@ -55,14 +66,15 @@ func (dsh *DefaultServerHandler) OnClosed(s *RtmpNetStream) {
 
 	fmt.Printf("NetStream OnClosed, remoteAddr : %v\npath : %v\nmode : %v\n", s.conn.remoteAddr, s.streamPath, mode)
 
-	if d, ok := find_broadcast(s.streamPath); ok {
+	// 发布者停止发布, 订阅者等待重新发布(rtmp_broadcast.go)
+	if d, ok := find_broadcast(broadcast_path(s.streamPath)); ok {
 		if s.mode == 1 {
-			d.stop()
+			d.unpublish(s)
 		} else if s.mode == 2 {
 			d.removeSubscriber(s)
 		} else if s.mode == 2|1 {
 			d.removeSubscriber(s)
-			d.stop()
+			d.unpublish(s)
 		}
 	}
 }
@@ -70,10 +70,24 @@ func ReadBuf(r io.Reader, length int) (buf []byte) {
 	return
 }
 
+// 握手的数据长度是固定的, 读不够就是错误
+func readHandshake(r io.Reader, length int) (buf []byte, err error) {
+	buf = make([]byte, length)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return nil, newProtocolError(ErrHandshake, "read %v bytes, %v", length, err)
+	}
+
+	return
+}
+
 func handshake(brw *bufio.ReadWriter) error {
-	C0C1 := ReadBuf(brw, 1536+1)
+	C0C1, err := readHandshake(brw, 1536+1)
+	if err != nil {
+		return err
+	}
+
 	if C0C1[0] != RTMP_HANDSHAKE_VERSION {
-		return errors.New("C0 Error")
+		return newProtocolError(ErrHandshake, "C0 version %v", C0C1[0])
 	}
 
 	if len(C0C1[1:]) != 1536 {
@@ -105,10 +119,12 @@ func simple_handshake(brw *bufio.ReadWriter, C1 []byte) error {
 	buf.Write(S2)
 
 	brw.Write(buf.Bytes())
-	brw.Flush() // Don't forget to flush
+	if err := brw.Flush(); err != nil { // Don't forget to flush
+		return err
+	}
 
-	ReadBuf(brw, 1536)
-	return nil
+	_, err := readHandshake(brw, 1536)
+	return err
 }
 
 func complex_handshake(brw *bufio.ReadWriter, C1 []byte) error {
@@ -170,10 +186,12 @@ func complex_handshake(brw *bufio.ReadWriter, C1 []byte) error {
 	buffer.Write(S2_Digest)
 
 	brw.Write(buffer.Bytes())
-	brw.Flush()
+	if err = brw.Flush(); err != nil {
+		return err
+	}
 
-	ReadBuf(brw, 1536)
-	return nil
+	_, err = readHandshake(brw, 1536)
+	return err
 }
 
 func validateClient(C1 []byte) (scheme int, challenge []byte, digest []byte, ok bool, err error) {
@@ -3,6 +3,7 @@ package rtmp
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/sevenzoe/gortmp/util"
@@ -106,6 +107,13 @@ func (h *RtmpHeader) Clone() *RtmpHeader {
 }
 
 func GetRtmpMessage(head *RtmpHeader, body *RtmpBody) RtmpMessage {
+	msg, _ := decodeRtmpMessage(head, body, RTMP_MAX_AMF_DEPTH)
+	return msg
+}
+
+// 解析消息, AMF 的值只在这里解码一次, 嵌套超过了 maxDepth 的时候返回 ErrAMFDepth.
+// 共享对象消息的事件也在这里解码, 格式错误的时候返回错误.
+func decodeRtmpMessage(head *RtmpHeader, body *RtmpBody, maxDepth int) (RtmpMessage, error) {
 	switch head.ChunkMessgaeHeader.MessageTypeID {
 	case RTMP_MSG_CHUNK_SIZE: // RTMP消息类型ID=1,设置块大小.
 		{
@@ -113,7 +121,7 @@ func GetRtmpMessage(head *RtmpHeader, body *RtmpBody) RtmpMessage {
 			m.RtmpHeader = head
 			m.RtmpBody = body
 			m.ChunkSize = util.BigEndian.Uint32(body.Payload)
-			return m
+			return m, nil
 		}
 	case RTMP_MSG_ABORT: // RTMP消息类型ID=2,取消消息,用于通知正在等待接收块以完成消息的对等端,丢弃一个块流中已经接收的部分并且取消对该消息的处理.
 		{
@@ -121,7 +129,7 @@ func GetRtmpMessage(head *RtmpHeader, body *RtmpBody) RtmpMessage {
 			m.RtmpHeader = head
 			m.RtmpBody = body
 			m.ChunkStreamId = util.BigEndian.Uint32(body.Payload)
-			return m
+			return m, nil
 		}
 	case RTMP_MSG_ACK: // RTMP消息类型ID=3,确认(致谢).Acknowledgement.在数据通信传输中,接收站发给发送站的一种传输控制字符.它表示确认发来的数据已经接收无误.
 		{
@@ -129,7 +137,7 @@ func GetRtmpMessage(head *RtmpHeader, body *RtmpBody) RtmpMessage {
 			m.RtmpHeader = head
 			m.RtmpBody = body
 			m.SequenceNumber = util.BigEndian.Uint32(body.Payload)
-			return m
+			return m, nil
 		}
 	case RTMP_MSG_USER_CONTROL: // RTMP消息类型ID=4, 用户控制消息.客户端或服务端发送本消息通知对方用户的控制事件.
 		{
@@ -147,7 +155,7 @@ func GetRtmpMessage(head *RtmpHeader, body *RtmpBody) RtmpMessage {
 						//服务端在成功地从客户端接收连接命令之后发送本事件,事件ID为0.事件数据是表示开始起作用的流的ID.
 						m.StreamID = util.BigEndian.Uint32(eventdata)
 					}
-					return m
+					return m, nil
 				}
 			case RTMP_USER_STREAM_EOF: // 服务端向客户端发送本事件通知客户端,数据回放完成.果没有发行额外的命令,就不再发送数据.客户端丢弃从流中接收的消息.4字节的事件数据表示,回放结束的流的ID.
 				{
@@ -158,7 +166,7 @@ func GetRtmpMessage(head *RtmpHeader, body *RtmpBody) RtmpMessage {
 					m.EventData = eventdata
 					//服务端通知客户端流结束,4字节的事件数据表示,回放结束的流的ID
 					m.StreamID = util.BigEndian.Uint32(eventdata)
-					return m
+					return m, nil
 				}
 			case RTMP_USER_STREAM_DRY: // 服务端向客户端发送本事件通知客户端,流中没有更多的数据.如果服务端在一定周期内没有探测到更多的数据,就可以通知客户端流枯竭.4字节的事件数据表示枯竭流的ID.
 				{
@@ -169,7 +177,7 @@ func GetRtmpMessage(head *RtmpHeader, body *RtmpBody) RtmpMessage {
 					m.EventData = eventdata
 					//服务端通知客户端流枯竭,4字节的事件数据表示枯竭流的ID
 					m.StreamID = util.BigEndian.Uint32(eventdata)
-					return m
+					return m, nil
 				}
 			case RTMP_USER_SET_BUFFLEN: // 客户端向服务端发送本事件,告知对方自己存储一个流的数据的缓存的长度(毫秒单位).当服务端开始处理一个流得时候发送本事件.事件数据的头四个字节表示流ID,后4个字节表示缓存长度(毫秒单位).
 				{
@@ -180,7 +188,7 @@ func GetRtmpMessage(head *RtmpHeader, body *RtmpBody) RtmpMessage {
 					m.EventData = eventdata
 					m.StreamID = util.BigEndian.Uint32(eventdata)
 					m.Millisecond = util.BigEndian.Uint32(eventdata[4:])
-					return m
+					return m, nil
 				}
 			case RTMP_USER_STREAM_IS_RECORDED: // 服务端发送本事件通知客户端,该流是一个录制流.4字节的事件数据表示录制流的.
 				{
@@ -190,7 +198,7 @@ func GetRtmpMessage(head *RtmpHeader, body *RtmpBody) RtmpMessage {
 					m.EventType = eventtype
 					m.EventData = eventdata
 					m.StreamID = util.BigEndian.Uint32(eventdata)
-					return m
+					return m, nil
 				}
 			case RTMP_USER_PING_REQUEST: // 服务端通过本事件测试客户端是否可达.事件数据是4个字节的事件戳.代表服务调用本命令的本地时间.客户端在接收到kMsgPingRequest之后返回kMsgPingResponse事件
 				{
@@ -200,16 +208,19 @@ func GetRtmpMessage(head *RtmpHeader, body *RtmpBody) RtmpMessage {
 					m.EventType = eventtype
 					m.EventData = eventdata
 					m.Timestamp = util.BigEndian.Uint32(eventdata)
-					return m
+					return m, nil
 				}
 			case RTMP_USER_PING_RESPONSE: // 客户端向服务端发送本消息响应ping请求.事件数据是接kMsgPingRequest请求的时间.
 				{
-					m := newPingResponseMessage() // UserControlMessage
+					m := newPingResponseMessage() // UserControlMessage + Timestamp(4 Bytes)
 					m.RtmpHeader = head
 					m.RtmpBody = body
 					m.EventType = eventtype
 					m.EventData = eventdata
-					return m
+					if len(eventdata) >= 4 {
+						m.Timestamp = util.BigEndian.Uint32(eventdata)
+					}
+					return m, nil
 				}
 			case RTMP_USER_EMPTY:
 				{
@@ -218,14 +229,14 @@ func GetRtmpMessage(head *RtmpHeader, body *RtmpBody) RtmpMessage {
 					m.RtmpBody = body
 					m.EventType = eventtype
 					m.EventData = eventdata
-					return m
+					return m, nil
 				}
 			default:
 				{
 					m := newUnknowRtmpMessage()
 					m.RtmpHeader = head
 					m.RtmpBody = body
-					return m
+					return m, nil
 				}
 			}
 		}
@@ -235,7 +246,7 @@ func GetRtmpMessage(head *RtmpHeader, body *RtmpBody) RtmpMessage {
 			m.RtmpHeader = head
 			m.RtmpBody = body
 			m.AcknowledgementWindowsize = util.BigEndian.Uint32(body.Payload)
-			return m
+			return m, nil
 		}
 	case RTMP_MSG_BANDWIDTH: // RTMP消息类型ID=6, 置对等端带宽.客户端或服务端发送本消息更新对等端的输出带宽.
 		{
@@ -246,78 +257,85 @@ func GetRtmpMessage(head *RtmpHeader, body *RtmpBody) RtmpMessage {
 			if len(body.Payload) > 4 {
 				m.LimitType = body.Payload[4]
 			}
-			return m
+			return m, nil
 		}
 	case RTMP_MSG_EDGE: // RTMP消息类型ID=7, 用于边缘服务与源服务器.
 		{
 			m := newEdegMessage()
 			m.RtmpHeader = head
 			m.RtmpBody = body
-			return m
+			return m, nil
 		}
 	case RTMP_MSG_AUDIO: // RTMP消息类型ID=8, 音频数据.客户端或服务端发送本消息用于发送音频数据.
 		{
 			m := newAudioMessage()
 			m.RtmpHeader = head
 			m.RtmpBody = body
-			return m
+			return m, nil
 		}
 	case RTMP_MSG_VIDEO: // RTMP消息类型ID=9, 视频数据.客户端或服务端发送本消息用于发送视频数据.
 		{
 			m := newVideoMessage()
 			m.RtmpHeader = head
 			m.RtmpBody = body
-			return m
+			return m, nil
 		}
 	case RTMP_MSG_AMF3_METADATA: // RTMP消息类型ID=15, 数据消息.用AMF3编码.
 		{
 			m := newMetadataMessage()
 			m.RtmpHeader = head
 			m.RtmpBody = body
-			return m
+			m.Name = decodeDataMessageName(body.Payload, true)
+			props, err := decodeMetadataProperties(body.Payload, true, maxDepth)
+			m.Proterties = props
+			return m, err
 		}
 	case RTMP_MSG_AMF3_SHARED: // RTMP消息类型ID=16, 共享对象消息.用AMF3编码.
 		{
 			m := newSharedObjectMessage()
 			m.RtmpHeader = head
 			m.RtmpBody = body
-			return m
+			m.ObjectEncoding = 3
+			return m, m.decode(maxDepth)
 		}
 	case RTMP_MSG_AMF3_COMMAND: // RTMP消息类型ID=17, 命令消息.用AMF3编码.
 		{
-			return decodeCommandAMF3(head, body)
+			return decodeCommandAMF3(head, body, maxDepth)
 		}
 	case RTMP_MSG_AMF0_METADATA: // RTMP消息类型ID=18, 数据消息.用AMF0编码.
 		{
 			m := newMetadataMessage()
 			m.RtmpHeader = head
 			m.RtmpBody = body
-			return m
+			m.Name = decodeDataMessageName(body.Payload, false)
+			props, err := decodeMetadataProperties(body.Payload, false, maxDepth)
+			m.Proterties = props
+			return m, err
 		}
 	case RTMP_MSG_AMF0_SHARED: // RTMP消息类型ID=19, 共享对象消息.用AMF0编码.
 		{
 			m := newSharedObjectMessage()
 			m.RtmpHeader = head
 			m.RtmpBody = body
-			return m
+			return m, m.decode(maxDepth)
 		}
 	case RTMP_MSG_AMF0_COMMAND: // RTMP消息类型ID=20, 命令消息.用AMF0编码.
 		{
-			return decodeCommandAMF0(head, body) // 解析具体的命令消息
+			return decodeCommandAMF0(head, body, maxDepth) // 解析具体的命令消息
 		}
 	case RTMP_MSG_AGGREGATE:
 		{
 			m := newAggregateMessage()
 			m.RtmpHeader = head
 			m.RtmpBody = body
-			return m
+			return m, nil
 		} // RTMP消息类型ID=22, 聚集消息.多个RTMP子消息的集合
 	default:
 		{
 			m := newUnknowRtmpMessage()
 			m.RtmpHeader = head
 			m.RtmpBody = body
-			return m
+			return m, nil
 		}
 	}
 }
@@ -340,9 +358,20 @@ func GetRtmpMessage(head *RtmpHeader, body *RtmpBody) RtmpMessage {
 
 // object类型要复杂点.
 // 第一个byte是03表示object,其后跟的是N个(key+value).最后以00 00 09表示object结束
-func decodeCommandAMF0(head *RtmpHeader, body *RtmpBody) RtmpMessage {
+func decodeCommandAMF0(head *RtmpHeader, body *RtmpBody, maxDepth int) (RtmpMessage, error) {
 	amf := newAMFDecoder(body.Payload) // rtmp_amf.go, amf 是 bytes类型, 将rtmp body(payload)放到bytes.Buffer(amf)中去.
-	cmd := readString(amf)             // rtmp_amf.go, 将payload的bytes类型转换成string类型.
+	amf.maxDepth = maxDepth
+
+	msg := decodeCommand(head, body, amf)
+	if amf.tooDeep {
+		return msg, ErrAMFDepth
+	}
+
+	return msg, nil
+}
+
+func decodeCommand(head *RtmpHeader, body *RtmpBody, amf *AMF) RtmpMessage {
+	cmd := readString(amf) // rtmp_amf.go, 将payload的bytes类型转换成string类型.
 	switch cmd {
 	case "connect":
 		{
@@ -386,9 +415,9 @@ func decodeCommandAMF0(head *RtmpHeader, body *RtmpBody) RtmpMessage {
 			m.TransactionId = readTransactionId(amf)
 			amf.readNull()
 			m.StreamName = readString(amf)
-			m.Start = readNumber(amf)
-			m.Duration = readNumber(amf)
-			m.Rest = readBool(amf)
+			m.Start = readOptionalNumber(amf, RTMP_PLAY_START_LIVE_OR_RECORDED)
+			m.Duration = readOptionalNumber(amf, RTMP_PLAY_DURATION_ALL)
+			m.Rest = readOptionalBool(amf, true)
 			return m
 		}
 	case "play2":
@@ -470,7 +499,7 @@ func decodeCommandAMF0(head *RtmpHeader, body *RtmpBody) RtmpMessage {
 			m.CommandName = cmd
 			m.TransactionId = readTransactionId(amf)
 			amf.readNull()
-			m.StreamId = uint32(readNumber(amf))
+			m.StreamName = readString(amf)
 			return m
 		}
 	case "receiveAudio":
@@ -531,6 +560,9 @@ func decodeCommandAMF0(head *RtmpHeader, body *RtmpBody) RtmpMessage {
 			m.RtmpHeader = head
 			m.RtmpBody = body
 			m.CommandName = cmd
+			m.TransactionId = readTransactionId(amf)
+			amf.readNull()
+			m.StreamName = readString(amf)
 			return m
 		}
 	case "FCUnpublish":
@@ -539,46 +571,202 @@ func decodeCommandAMF0(head *RtmpHeader, body *RtmpBody) RtmpMessage {
 			m.RtmpHeader = head
 			m.RtmpBody = body
 			m.CommandName = cmd
+			m.TransactionId = readTransactionId(amf)
+			amf.readNull()
+			m.StreamName = readString(amf)
 			return m
 		}
 	default:
 		{
-			fmt.Println("decode command amf0 cmd:", cmd)
-			m := newUnknowRtmpMessage()
+			// 自定义命令, NetConnection.call(cmd, responder, args...)
+			// 命令名 + 事务ID + 命令对象(一般为null) + 参数
+			m := newCallMessage()
 			m.RtmpHeader = head
 			m.RtmpBody = body
+			m.CommandName = cmd
+			m.TransactionId = readTransactionId(amf)
+
+			objs, _ := amf.readObjects()
+			if len(objs) > 0 {
+				m.Object = objs[0]
+				m.Arguments = objs[1:]
+			}
+
 			return m
 		}
 	}
 }
 
-func decodeCommandAMF3(head *RtmpHeader, body *RtmpBody) RtmpMessage {
-	body.Payload = body.Payload[1:]
-	return decodeCommandAMF0(head, body)
+// AMF3 命令消息: 第一个字节为0, 后面和AMF0一样, 值可能是 AMF0_AVMPLUS_OBJECT(切换到AMF3编码)
+func decodeCommandAMF3(head *RtmpHeader, body *RtmpBody, maxDepth int) (RtmpMessage, error) {
+	if len(body.Payload) > 0 {
+		body.Payload = body.Payload[1:]
+	}
+	return decodeCommandAMF0(head, body, maxDepth)
+}
+
+// 下一个值是 AMF0_AVMPLUS_OBJECT 的时候, 用AMF3解码
+func readAVMPlusObject(amf *AMF) (v AMFObject, ok bool) {
+	if b := amf.in.Bytes(); len(b) == 0 || b[0] != AMF0_AVMPLUS_OBJECT {
+		return nil, false
+	}
+
+	v, _ = amf.decodeObject()
+	return v, true
 }
 
 func readTransactionId(amf *AMF) uint64 {
-	v, _ := amf.readNumber()
-	return uint64(v)
+	return readNumber(amf)
 }
 func readString(amf *AMF) string {
+	if obj, ok := readAVMPlusObject(amf); ok {
+		v, _ := obj.(string)
+		return v
+	}
 	v, _ := amf.readString()
 	return v
 }
 func readNumber(amf *AMF) uint64 {
+	if obj, ok := readAVMPlusObject(amf); ok {
+		v, _ := obj.(float64)
+		return uint64(v)
+	}
 	v, _ := amf.readNumber()
 	return uint64(v)
 }
 func readBool(amf *AMF) bool {
+	if obj, ok := readAVMPlusObject(amf); ok {
+		v, _ := obj.(bool)
+		return v
+	}
 	v, _ := amf.readBool()
 	return v
 }
 
+// 可选的数字参数, 没有的时候(或者是 null)返回默认值. 可以是负数.
+func readOptionalNumber(amf *AMF, def float64) float64 {
+	if amf.in.Len() == 0 {
+		return def
+	}
+
+	if v, err := amf.decodeObject(); err == nil {
+		if n, ok := v.(float64); ok {
+			return n
+		}
+	}
+
+	return def
+}
+
+// 可选的布尔参数, 也可以是数字(非0为true), 没有的时候返回默认值.
+func readOptionalBool(amf *AMF, def bool) bool {
+	if amf.in.Len() == 0 {
+		return def
+	}
+
+	if v, err := amf.decodeObject(); err == nil {
+		switch t := v.(type) {
+		case bool:
+			{
+				return t
+			}
+		case float64:
+			{
+				return t != 0
+			}
+		}
+	}
+
+	return def
+}
+
 func readObject(amf *AMF) AMFObjects {
+	if obj, ok := readAVMPlusObject(amf); ok {
+		switch v := obj.(type) {
+		case AMFObjects:
+			{
+				return v
+			}
+		case *AMF3TypedObject:
+			{
+				return v.Object
+			}
+		}
+		return nil
+	}
 	v, _ := amf.readObject()
 	return v
 }
 
+// 数据消息: @setDataFrame(可选) + onMetaData + ECMA Array(或者 Object)
+// AMF3 数据消息第一个字节为0, 后面和AMF0一样
+func decodeMetadataProperties(payload []byte, amf3 bool, maxDepth int) (props map[string]interface{}, err error) {
+	if amf3 && len(payload) > 0 {
+		payload = payload[1:]
+	}
+
+	amf := newAMFDecoder(payload)
+	amf.maxDepth = maxDepth
+
+	objs, _ := amf.readObjects()
+	if amf.tooDeep {
+		err = ErrAMFDepth
+		return
+	}
+
+	for _, v := range objs {
+		var obj AMFObjects
+
+		switch tt := v.(type) {
+		case AMFObjects:
+			{
+				obj = tt
+			}
+		case *AMF3TypedObject:
+			{
+				obj = tt.Object
+			}
+		default:
+			{
+				continue
+			}
+		}
+
+		props = make(map[string]interface{})
+		for k, vv := range obj {
+			props[k] = vv
+		}
+
+		return
+	}
+
+	return
+}
+
+// 数据消息的第一个值是处理函数名(onMetaData, onTextData, onCuePoint, @setDataFrame ...)
+func decodeDataMessageName(payload []byte, amf3 bool) (name string) {
+	if amf3 && len(payload) > 0 {
+		payload = payload[1:]
+	}
+
+	name, _ = readDataMessageString(payload)
+	return
+}
+
+// AMF0 String: 0x02 + 长度(2 bytes) + 字符串, 返回字符串和占用的字节数
+func readDataMessageString(payload []byte) (s string, n int) {
+	if len(payload) < 3 || payload[0] != AMF0_STRING {
+		return "", 0
+	}
+
+	length := int(util.BigEndian.Uint16(payload[1:3]))
+	if len(payload) < 3+length {
+		return "", 0
+	}
+
+	return string(payload[3 : 3+length]), 3 + length
+}
+
 /* Control Message */
 type ControlMessage struct {
 	RtmpHeader *RtmpHeader
@@ -927,6 +1115,7 @@ func (msg *VideoMessage) String() string {
 type MetadataMessage struct {
 	RtmpHeader *RtmpHeader
 	RtmpBody   *RtmpBody
+	Name       string                 // 处理函数名, onMetaData, onTextData, onCuePoint, @setDataFrame ...
 	Proterties map[string]interface{} `json:",omitempty"`
 }
 
@@ -942,6 +1131,32 @@ func (msg *MetadataMessage) Body() *RtmpBody {
 	return msg.RtmpBody
 }
 
+// @setDataFrame + onMetaData + ECMA Array, 去掉 @setDataFrame 之后是播放者需要的 onMetaData + ECMA Array.
+// 不是 @setDataFrame 的时候原样返回.
+func (msg *MetadataMessage) unwrapDataFrame() (name string, payload []byte) {
+	payload = msg.RtmpBody.Payload
+	if msg.Name != Data_SetDataFrame {
+		return msg.Name, payload
+	}
+
+	amf3 := msg.RtmpHeader.ChunkMessgaeHeader.MessageTypeID == RTMP_MSG_AMF3_METADATA
+
+	var prefix []byte
+	if amf3 && len(payload) > 0 {
+		prefix, payload = payload[:1], payload[1:]
+	}
+
+	_, n := readDataMessageString(payload)
+	payload = payload[n:]
+	name, _ = readDataMessageString(payload)
+
+	if prefix != nil {
+		payload = append(append([]byte{}, prefix...), payload...)
+	}
+
+	return
+}
+
 func (msg *MetadataMessage) String() string {
 	if b, err := json.Marshal(*msg); err == nil {
 		return fmt.Sprintf("MetadataMessage [length:%d]: %v", len(msg.RtmpBody.Payload), string(b))
@@ -954,8 +1169,13 @@ func (msg *MetadataMessage) String() string {
 // that are in synchronization across multiple clients, instances, and so on. The message types 19 for AMF0 and 16 for AMF3
 // are reserved for shared object events. Each message can contain multiple events.
 type SharedObjectMessage struct {
-	RtmpHeader *RtmpHeader
-	RtmpBody   *RtmpBody
+	RtmpHeader     *RtmpHeader
+	RtmpBody       *RtmpBody
+	ObjectEncoding float64             // 0 -> AMF0(19), 3 -> AMF3(16), AMF3 的时候 Payload 第一个字节为0, 事件里面的值用AMF3编码
+	Name           string              // 共享对象的名字
+	Version        uint32              // 共享对象的版本
+	Persistent     bool                // 是否是永久共享对象
+	Events         []SharedObjectEvent // 事件列表
 }
 
 func newSharedObjectMessage() *SharedObjectMessage {
@@ -1017,6 +1237,83 @@ func (msg *AggregateMessage) String() string {
 	}
 }
 
+// 聚集消息的子消息和FLV Tag的格式一样:
+// Header(11 bytes) = MessageType(1) + PayloadLength(3) + Timestamp(3) + TimestampExtended(1) + StreamID(3)
+// Header + Payload + BackPointer(4), BackPointer = 11 + PayloadLength
+//
+// 子消息的时间戳是绝对时间, 第一个子消息的时间戳对应聚集消息的时间戳, 后面的子消息按照和第一个子消息的差值计算.
+// 返回的子消息的时间戳和聚集消息一样是相对时间(第一个为聚集消息的时间戳, 后面的为和上一个子消息的差值).
+func (msg *AggregateMessage) SubMessages() (msgs []RtmpMessage, err error) {
+	return msg.subMessages(RTMP_MAX_AMF_DEPTH)
+}
+
+// 子消息和单独收到的消息一样检查长度, AMF 对象嵌套的深度不能超过 maxDepth, 不符合的时候返回 *ProtocolError.
+// 长度为0的子消息跳过.
+func (msg *AggregateMessage) subMessages(maxDepth int) (msgs []RtmpMessage, err error) {
+	payload := msg.RtmpBody.Payload
+
+	delta := msg.RtmpHeader.ChunkMessgaeHeader.Timestamp
+	if delta == 0xffffff {
+		delta = msg.RtmpHeader.ChunkExtendedTimestamp.ExtendTimestamp
+	}
+
+	var last uint32
+	for index := 0; index < len(payload); {
+		if index+RTMP_AGGREGATE_HEADER_SIZE > len(payload) {
+			err = errors.New(fmt.Sprintf("aggregate message header error, %v/%v", index, len(payload)))
+			return
+		}
+
+		typeID := payload[index]
+		length := int(util.BigEndian.Uint24(payload[index+1:]))
+		timestamp := util.BigEndian.Uint24(payload[index+4:]) | uint32(payload[index+7])<<24
+
+		index += RTMP_AGGREGATE_HEADER_SIZE
+
+		if index+length > len(payload) {
+			err = errors.New(fmt.Sprintf("aggregate message payload error, %v/%v", index+length, len(payload)))
+			return
+		}
+
+		data := payload[index : index+length]
+		index += length
+
+		// BackPointer, 有些服务器最后一个子消息没有写
+		if index+4 <= len(payload) {
+			index += 4
+		}
+
+		// 时间戳回退的时候不改变时间
+		if len(msgs) == 0 {
+			last = timestamp
+		} else if timestamp >= last {
+			delta, last = timestamp-last, timestamp
+		} else {
+			delta = 0
+		}
+
+		// 子消息的 StreamID 有的编码器写0, 用聚集消息的 StreamID
+		head := newRtmpHeader(msg.RtmpHeader.ChunkBasicHeader.ChunkStreamID, delta, uint32(length), typeID, msg.RtmpHeader.ChunkMessgaeHeader.MessageStreamID, 0)
+		if delta >= 0xffffff {
+			head.ChunkMessgaeHeader.Timestamp = 0xffffff
+			head.ChunkExtendedTimestamp.ExtendTimestamp = delta
+		}
+
+		if length == 0 {
+			continue
+		}
+
+		var m RtmpMessage
+		if m, err = newRtmpMessage(head, &RtmpBody{Payload: data}, maxDepth); err != nil {
+			return
+		}
+
+		msgs = append(msgs, m)
+	}
+
+	return
+}
+
 // Unknow Rtmp Message
 type UnknowRtmpMessage struct {
 	RtmpHeader *RtmpHeader
@@ -1123,8 +1420,9 @@ func (msg *ConnectMessage) String() string {
 // The called RPC name is passed as a parameter to the call command.
 type CallMessage struct {
 	CommandMessage
-	Object   interface{} `json:",omitempty"`
-	Optional interface{} `json:",omitempty"`
+	Object    interface{} `json:",omitempty"`
+	Optional  interface{} `json:",omitempty"`
+	Arguments []AMFObject `json:",omitempty"` // 自定义命令(NetConnection.call)的参数
 }
 
 func newCallMessage() *CallMessage {
@@ -1242,9 +1540,9 @@ type PlayMessage struct {
 	CommandMessage
 	Object     interface{} `json:",omitempty"`
 	StreamName string
-	Start      uint64
-	Duration   uint64
-	Rest       bool
+	Start      float64 // 秒, -2: 直播或者录制, -1: 只播放直播, >=0: 从这个位置播放录制的流
+	Duration   float64 // 秒, -1: 一直播放, 0: 只播放一帧, >0: 播放这么长时间
+	Rest       bool    // 是否清空以前的播放列表
 }
 
 func newPlayMessage() *PlayMessage {
@@ -1265,14 +1563,8 @@ func (msg *PlayMessage) Encode0() {
 	amf.writeNumber(float64(msg.TransactionId))
 	amf.writeNull()
 	amf.writeString(msg.StreamName)
-
-	if msg.Start > 0 {
-		amf.writeNumber(float64(msg.Start))
-	}
-	if msg.Duration > 0 {
-		amf.writeNumber(float64(msg.Duration))
-	}
-
+	amf.writeNumber(msg.Start)
+	amf.writeNumber(msg.Duration)
 	amf.writeBool(msg.Rest)
 	msg.RtmpBody.Payload = amf.Bytes()
 }
@@ -1568,11 +1860,11 @@ func (msg *PauseMessage) String() string {
 }
 
 // Release Stream Message
-// TODO: Release
+// 命令名 + 事务ID + null + 流名字. 推流端 publish 之前释放这个流名字.
 type ReleaseStreamMessage struct {
 	CommandMessage
-	Object   interface{}
-	StreamId uint32
+	Object     interface{}
+	StreamName string
 }
 
 func newReleaseStreamMessage() *ReleaseStreamMessage {
@@ -1599,9 +1891,10 @@ func (msg *ReleaseStreamMessage) String() string {
 }
 
 // FCPublish Message
-
+// 命令名 + 事务ID + null + 流名字. 推流端 publish 之前通知服务器要发布这个流名字, 等待 onFCPublish.
 type FCPublishMessage struct {
 	CommandMessage
+	StreamName string
 }
 
 func newFCPublishMessage() *FCPublishMessage {
@@ -1628,9 +1921,10 @@ func (msg *FCPublishMessage) String() string {
 }
 
 // FCUnpublish Message
-
+// 命令名 + 事务ID + null + 流名字. 推流端停止发布之前通知服务器, 等待 onFCUnpublish.
 type FCUnpublishMessage struct {
 	CommandMessage
+	StreamName string
 }
 
 func newFCUnpublishMessage() *FCUnpublishMessage {
@@ -1688,9 +1982,22 @@ func (msg *ResponseConnectMessage) Encode0() {
 	msg.RtmpBody.Payload = amf.Bytes()
 }
 
-/*
+// AMF3: 第一个字节为0, 命令名和传输ID用AMF0编码, 对象用AMF3编码(AMF0_AVMPLUS_OBJECT)
 func (msg *ResponseConnectMessage) Encode3() {
-}*/
+	amf := newAMFEncoder()
+	amf.out.WriteByte(0)
+	amf.writeString(msg.CommandName)
+	amf.writeNumber(float64(msg.TransactionId))
+
+	if msg.Properties != nil {
+		amf.writeAVMPlusValue(msg.Properties)
+	}
+	if msg.Infomation != nil {
+		amf.writeAVMPlusValue(msg.Infomation)
+	}
+
+	msg.RtmpBody.Payload = amf.Bytes()
+}
 
 func (msg *ResponseConnectMessage) Header() *RtmpHeader {
 	return msg.RtmpHeader
@@ -1721,6 +2028,7 @@ func newResponseCallMessage() *ResponseCallMessage {
 	return &ResponseCallMessage{CommandMessage: CommandMessage{RtmpHeader: &RtmpHeader{}, RtmpBody: &RtmpBody{}}}
 }
 
+// 命令名 + 事务ID + 命令对象(没有的时候为null) + 返回值(任意类型)
 func (msg *ResponseCallMessage) Encode0() {
 	amf := newAMFEncoder()
 	amf.writeString(msg.CommandName)
@@ -1728,17 +2036,35 @@ func (msg *ResponseCallMessage) Encode0() {
 
 	if msg.Object != nil {
 		amf.encodeObject(msg.Object.(AMFObjects))
+	} else {
+		amf.writeNull()
 	}
-	if msg.Response != nil {
-		amf.encodeObject(msg.Response.(AMFObjects))
+
+	if err := amf.writeValue(msg.Response); err != nil {
+		fmt.Println("response call message encode error :", err)
 	}
 
 	msg.RtmpBody.Payload = amf.Bytes()
 }
 
-/*
 func (msg *ResponseCallMessage) Encode3() {
-}*/
+	amf := newAMFEncoder()
+	amf.out.WriteByte(0)
+	amf.writeString(msg.CommandName)
+	amf.writeNumber(float64(msg.TransactionId))
+
+	if msg.Object != nil {
+		amf.writeAVMPlusValue(msg.Object)
+	} else {
+		amf.writeNull()
+	}
+
+	if err := amf.writeAVMPlusValue(msg.Response); err != nil {
+		fmt.Println("response call message encode error :", err)
+	}
+
+	msg.RtmpBody.Payload = amf.Bytes()
+}
 
 func (msg *ResponseCallMessage) Header() *RtmpHeader {
 	return msg.RtmpHeader
@@ -1778,9 +2104,15 @@ func (msg *ResponseCreateStreamMessage) Encode0() {
 	msg.RtmpBody.Payload = amf.Bytes()
 }
 
-/*
 func (msg *ResponseCreateStreamMessage) Encode3() {
-}*/
+	amf := newAMFEncoder()
+	amf.out.WriteByte(0)
+	amf.writeString(msg.CommandName)
+	amf.writeNumber(float64(msg.TransactionId))
+	amf.writeNull()
+	amf.writeNumber(float64(msg.StreamId))
+	msg.RtmpBody.Payload = amf.Bytes()
+}
 
 func (msg *ResponseCreateStreamMessage) Decode0(head *RtmpHeader, body RtmpBody) {
 	amf := newAMFDecoder(body.Payload)
@@ -1843,9 +2175,18 @@ func (msg *ResponsePlayMessage) Encode0() {
 	msg.RtmpBody.Payload = amf.Bytes()
 }
 
-/*
 func (msg *ResponsePlayMessage) Encode3() {
-}*/
+	amf := newAMFEncoder()
+	amf.out.WriteByte(0)
+	amf.writeString(msg.CommandName)
+	amf.writeNumber(float64(msg.TransactionId))
+	amf.writeNull()
+	if msg.Object != nil {
+		amf.writeAVMPlusValue(msg.Object)
+	}
+	amf.writeString(msg.Description)
+	msg.RtmpBody.Payload = amf.Bytes()
+}
 
 func (msg *ResponsePlayMessage) Decode0(head *RtmpHeader, body RtmpBody) {
 	amf := newAMFDecoder(body.Payload)
@@ -1919,9 +2260,22 @@ func (msg *ResponsePublishMessage) Encode0() {
 	msg.RtmpBody.Payload = amf.Bytes()
 }
 
-/*
 func (msg *ResponsePublishMessage) Encode3() {
-}*/
+	amf := newAMFEncoder()
+	amf.out.WriteByte(0)
+	amf.writeString(msg.CommandName)
+	amf.writeNumber(float64(msg.TransactionId))
+	amf.writeNull()
+
+	if msg.Properties != nil {
+		amf.writeAVMPlusValue(msg.Properties)
+	}
+	if msg.Infomation != nil {
+		amf.writeAVMPlusValue(msg.Infomation)
+	}
+
+	msg.RtmpBody.Payload = amf.Bytes()
+}
 
 func (msg *ResponsePublishMessage) Header() *RtmpHeader {
 	return msg.RtmpHeader
@@ -2284,6 +2638,7 @@ func (msg *PingRequestMessage) String() string {
 // a 4-byte timestamp, which was received with the PingRequest request.
 type PingResponseMessage struct {
 	UserControlMessage
+	Timestamp uint32
 }
 
 func newPingResponseMessage() *PingResponseMessage {
@@ -2291,8 +2646,9 @@ func newPingResponseMessage() *PingResponseMessage {
 }
 
 func (msg *PingResponseMessage) Encode() {
-	msg.RtmpBody.Payload = make([]byte, 2)
+	msg.RtmpBody.Payload = make([]byte, 6)
 	util.BigEndian.PutUint16(msg.RtmpBody.Payload, msg.EventType)
+	util.BigEndian.PutUint32(msg.RtmpBody.Payload[2:], msg.Timestamp)
 	msg.EventData = msg.RtmpBody.Payload[2:]
 }
 
@@ -2,9 +2,13 @@ package rtmp
 
 import (
 	"bufio"
+	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/sevenzoe/gortmp/util"
 )
 
 // http://help.adobe.com/zh_CN/FlashPlatform/reference/actionscript/3/flash/net/NetConnection.html
@@ -18,37 +22,55 @@ type NetConnection interface {
 }
 
 type RtmpNetConnection struct {
-	hand1er            NetFramer
-	remoteAddr         string
-	url                string
-	appName            string
-	server             *Server
-	readChunkSize      int
-	writeChunkSize     int
-	createTime         string
-	bandwidth          uint32
-	readSeqNum         uint32                      // 当前读的字节
-	writeSeqNum        uint32                      // 当前写的字节
-	totalWrite         uint32                      // 总共写了多少字节
-	totalRead          uint32                      // 总共读了多少字节
-	objectEncoding     float64                     // NetConnection对象的默认对象编码
-	conn               net.Conn                    // conn
-	br                 *bufio.Reader               // Read
-	bw                 *bufio.Writer               // Write
-	brw                *bufio.ReadWriter           // Read and Write,用来握手
-	lock               *sync.Mutex                 // lock
-	incompleteRtmpBody map[uint32][]byte           // 完整的RtmpBody,在网络上是被分成一块一块的,需要将其组装起来
-	rtmpHeader         map[uint32]*RtmpHeader      // RtmpHeader
-	connected          bool                        // 连接是否完成
-	nextStreamID       func(chunkid uint32) uint32 // 下一个流ID
-	streamID           uint32                      // 流ID
-}
-
-var gstreamid = uint32(64)
-
-func gen_next_stream_id(chunkid uint32) uint32 {
-	gstreamid += 1
-	return gstreamid
+	lastActive int64  // 最后一次收到数据的时间(UnixNano), 原子操作, 放在前面保证64位对齐
+	totalWrite uint64 // 总共写了多少字节, 原子操作
+	totalRead  uint64 // 总共读了多少字节, 原子操作
+
+	hand1er           NetFramer
+	remoteAddr        string
+	url               string
+	appName           string
+	server            *Server
+	readChunkSize     int
+	writeChunkSize    int
+	createTime        string
+	readSeqNum        uint32                     // 读的序列号(收到的字节数, 超过 0xffffffff 的时候回绕)
+	readAckSeqNum     uint32                     // 上一次发送确认的时候的读序列号
+	readAckWindow     uint32                     // 对端的 Window Acknowledgement Size, 每收到这么多字节发送一次确认. 下面的统计都是原子操作, Stats 在其他的 goroutine 里面读
+	writeSeqNum       uint32                     // 写的序列号(发送的字节数, 超过 0xffffffff 的时候回绕)
+	writeAckSeqNum    uint32                     // 对端确认的写序列号
+	writeAckWindow    uint32                     // 发送给对端的 Window Acknowledgement Size
+	peerBandwidth     uint32                     // 对端 Set Peer Bandwidth 限制的输出带宽, 0 表示没有限制. 只用来设置确认窗口, 不限制发送的速度
+	peerLimitType     uint32                     // 对端 Set Peer Bandwidth 的限制类型
+	acksSent          uint32                     // 发送的确认消息的个数
+	acksReceived      uint32                     // 收到的确认消息的个数
+	objectEncoding    float64                    // NetConnection对象的默认对象编码
+	fourCcList        []string                   // Enhanced RTMP, 客户端 connect 时声明支持的 FourCC, nil 表示不支持 Enhanced RTMP
+	conn              net.Conn                   // conn
+	br                *bufio.Reader              // Read
+	bw                *bufio.Writer              // Write
+	brw               *bufio.ReadWriter          // Read and Write,用来握手
+	lock              *sync.Mutex                // lock
+	wlock             *sync.Mutex                // 写锁, 音视频, 命令, Ping 可能在不同的 goroutine 里面发送
+	iow               *util.IOVecWriter          // 聚集写, 一个消息的块头和负载一次系统调用写出去
+	writeChunkStreams map[uint32]*chunkState     // 每个块流上一个消息的头, 用来选择最小的块类型
+	wheader           []byte                     // 块头的缓冲区, 重复使用
+	wbody             []byte                     // 不共享的消息负载分块的缓冲区, 重复使用
+	pingLock          *sync.Mutex                // 保护下面的 ping 字段
+	pingTimestamp     uint32                     // 还没有收到响应的 PingRequest 的时间戳
+	pingSendTime      time.Time                  // 还没有收到响应的 PingRequest 的发送时间, 零值表示没有
+	rtt               time.Duration              // 平滑的往返时间(RTT)
+	done              chan struct{}              // 连接关闭的时候关闭
+	closeOnce         *sync.Once                 // 只关闭一次 done
+	startTime         time.Time                  // 连接的开始时间, PingRequest 的时间戳从这里开始计算
+	readChunkStreams  map[uint32]*chunkReadState // 每个块流的读状态, 上一个块的头和正在组装的消息(消息在网络上是被分成一块一块的,需要将其组装起来)
+	rheader           []byte                     // 块头的缓冲区, 重复使用
+	readPending       uint32                     // 所有块流正在组装的消息的总长度
+	readChunks        uint64                     // 读了多少个块, 找最久没有用的块流
+	limits            Limits                     // 接收数据的限制
+	connected         bool                       // 连接是否完成
+	streams           map[uint32]*RtmpNetStream  // 连接上的流, key 为流ID. 0 是 NetConnection 自己, 其他的由 createStream 创建
+	tasks             chan func()                // 其他的 goroutine 交给消息循环执行的函数(播放下一项 ...), 和命令在同一个 goroutine 里面处理
 }
 
 func newRtmpNetConnect(conn net.Conn, s *Server) (c *RtmpNetConnection) {
@@ -58,19 +80,245 @@ func newRtmpNetConnect(conn net.Conn, s *Server) (c *RtmpNetConnection) {
 	c.brw = bufio.NewReadWriter(c.br, c.bw)
 	c.conn = conn
 	c.lock = new(sync.Mutex)
+	c.wlock = new(sync.Mutex)
+	c.iow = util.NewIOVecWriter(conn)
+	c.writeChunkStreams = make(map[uint32]*chunkState)
+	c.wheader = make([]byte, 0, RTMP_MAX_CHUNK_HEADER)
+	c.pingLock = new(sync.Mutex)
+	c.done = make(chan struct{})
+	c.closeOnce = new(sync.Once)
+	c.startTime = time.Now()
+	c.lastActive = c.startTime.UnixNano()
 	c.server = s
-	c.bandwidth = RTMP_MAX_CHUNK_SIZE * 8
+	c.readAckWindow = RTMP_DEFAULT_ACK_WINDOW
 	c.createTime = time.Now().String()
 	c.remoteAddr = conn.RemoteAddr().String()
-	c.nextStreamID = gen_next_stream_id
+	c.streams = make(map[uint32]*RtmpNetStream)
+	c.tasks = make(chan func(), 8)
 	c.readChunkSize = RTMP_DEFAULT_CHUNK_SIZE
 	c.writeChunkSize = RTMP_DEFAULT_CHUNK_SIZE
-	c.rtmpHeader = make(map[uint32]*RtmpHeader)
-	c.incompleteRtmpBody = make(map[uint32][]byte)
+	c.readChunkStreams = make(map[uint32]*chunkReadState)
+	c.rheader = make([]byte, 0, RTMP_MAX_CHUNK_HEADER)
+	c.limits = s.limits()
 	c.objectEncoding = 0
 	return
 }
 
+// Enhanced RTMP, "*" 表示支持所有的 FourCC
+func (c *RtmpNetConnection) supportFourCC(fourcc [4]byte) bool {
+	for _, v := range c.fourCcList {
+		if v == "*" || v == string(fourcc[:]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 连接的收发统计
+type ConnectionStats struct {
+	BytesRead      uint64        // 总共读了多少字节
+	BytesWritten   uint64        // 总共写了多少字节
+	ReadAckWindow  uint32        // 对端的确认窗口, 每收到这么多字节发送一次确认
+	WriteAckWindow uint32        // 发送给对端的确认窗口
+	Unacknowledged uint32        // 已经发送, 对端还没有确认的字节数
+	PeerBandwidth  uint32        // 对端限制的输出带宽, 0 表示没有限制. 服务器不按照这个带宽限制发送, 只是把确认窗口设置成这个大小
+	PeerLimitType  byte          // 对端限制输出带宽的类型, 0 - Hard, 1 - Soft, 2 - Dynamic
+	AcksSent       uint32        // 发送的确认消息的个数
+	AcksReceived   uint32        // 收到的确认消息的个数
+	RTT            time.Duration // 平滑的往返时间, 还没有测量的时候为0
+}
+
+// 可以在其他的 goroutine 里面调用, 各个字段分别原子读取, 不是同一时刻的快照
+func (c *RtmpNetConnection) Stats() ConnectionStats {
+	return ConnectionStats{
+		BytesRead:      atomic.LoadUint64(&c.totalRead),
+		BytesWritten:   atomic.LoadUint64(&c.totalWrite),
+		ReadAckWindow:  atomic.LoadUint32(&c.readAckWindow),
+		WriteAckWindow: atomic.LoadUint32(&c.writeAckWindow),
+		Unacknowledged: atomic.LoadUint32(&c.writeSeqNum) - atomic.LoadUint32(&c.writeAckSeqNum),
+		PeerBandwidth:  atomic.LoadUint32(&c.peerBandwidth),
+		PeerLimitType:  byte(atomic.LoadUint32(&c.peerLimitType)),
+		AcksSent:       atomic.LoadUint32(&c.acksSent),
+		AcksReceived:   atomic.LoadUint32(&c.acksReceived),
+		RTT:            c.RTT(),
+	}
+}
+
+func (c *RtmpNetConnection) RTT() time.Duration {
+	c.pingLock.Lock()
+	defer c.pingLock.Unlock()
+
+	return c.rtt
+}
+
+func (c *RtmpNetConnection) active() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+// 定时发送 PingRequest, 超过 timeout 没有收到对端的任何数据就关闭连接.
+// 关闭连接之后读消息出错, NetStream 会调用 OnError 和 OnClosed, 释放发布的流.
+func (c *RtmpNetConnection) keepalive(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			{
+				return
+			}
+		case now := <-ticker.C:
+			{
+				idle := now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+				if idle > timeout {
+					fmt.Println("keepalive timeout :", c.remoteAddr, "no response for", idle)
+					c.Close()
+					return
+				}
+
+				if err := c.ping(now); err != nil {
+					fmt.Println("send ping request error :", err)
+					c.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
+// 一次只有一个 PingRequest 等待响应, 上一个没有响应的时候用新的时间戳覆盖
+func (c *RtmpNetConnection) ping(now time.Time) error {
+	c.pingLock.Lock()
+	c.pingTimestamp = uint32(now.Sub(c.startTime) / time.Millisecond)
+	c.pingSendTime = now
+	timestamp := c.pingTimestamp
+	c.pingLock.Unlock()
+
+	return sendMessage(c, SEND_PING_REQUEST_MESSAGE, timestamp)
+}
+
+// PingResponse 的时间戳和发送的 PingRequest 一样的时候, 计算 RTT. 平滑算法和 TCP 一样: srtt = 7/8 * srtt + 1/8 * rtt
+func (c *RtmpNetConnection) pingResponse(timestamp uint32) {
+	c.pingLock.Lock()
+	defer c.pingLock.Unlock()
+
+	if c.pingSendTime.IsZero() || timestamp != c.pingTimestamp {
+		return
+	}
+
+	sample := time.Since(c.pingSendTime)
+	c.pingSendTime = time.Time{}
+
+	if c.rtt == 0 {
+		c.rtt = sample
+	} else {
+		c.rtt = (7*c.rtt + sample) / 8
+	}
+}
+
+// 发送一个消息: 第一个块的头 + 分块之后的负载(块之间有 Type 3 的块头), 一次写出去. 调用者持有 wlock.
+// cache 不为 nil 的时候, 分块之后的负载在共享同一个 cache 的连接之间共享.
+func (c *RtmpNetConnection) writeChunks(head *RtmpHeader, payload []byte, timestamp uint32, force bool, cache *chunkCache) (err error) {
+	csid := head.ChunkBasicHeader.ChunkStreamID
+	head.ChunkMessgaeHeader.MessageLength = uint32(len(payload))
+
+	state, ok := c.writeChunkStreams[csid]
+	if !ok {
+		state = new(chunkState)
+		c.writeChunkStreams[csid] = state
+	}
+
+	c.wheader = state.appendHeader(c.wheader[:0], head, timestamp, force)
+
+	var body []byte
+	if cache != nil {
+		body = cache.body(csid, payload, c.writeChunkSize, state.extended, state.extendedTimestamp())
+	} else if len(payload) <= c.writeChunkSize {
+		body = payload
+	} else {
+		c.wbody = appendChunkBody(c.wbody[:0], csid, payload, c.writeChunkSize, state.extended, state.extendedTimestamp())
+		body = c.wbody
+	}
+
+	c.iow.Write(c.wheader)
+	c.iow.Write(body)
+
+	n := c.iow.Buffered()
+	if err = c.iow.Flush(); err != nil {
+		return
+	}
+
+	c.countWrite(n)
+
+	return
+}
+
+func (c *RtmpNetConnection) countRead(n int) {
+	c.readSeqNum += uint32(n)
+	atomic.AddUint64(&c.totalRead, uint64(n))
+}
+
+func (c *RtmpNetConnection) countWrite(n int) {
+	atomic.AddUint32(&c.writeSeqNum, uint32(n))
+	atomic.AddUint64(&c.totalWrite, uint64(n))
+}
+
+// 收到的字节数超过对端的确认窗口的时候, 发送确认消息. 序列号回绕的时候差值仍然正确.
+func (c *RtmpNetConnection) acknowledge() error {
+	if c.readAckWindow == 0 || c.readSeqNum-c.readAckSeqNum < c.readAckWindow {
+		return nil
+	}
+
+	c.readAckSeqNum = c.readSeqNum
+	atomic.AddUint32(&c.acksSent, 1)
+
+	return sendMessage(c, SEND_ACK_MESSAGE, c.readSeqNum)
+}
+
+// Set Peer Bandwidth: 根据限制类型更新输出带宽, 窗口大小和上一次发送给对端的不一样的时候, 发送 Window Acknowledgement Size.
+// 输出带宽只用来设置确认窗口, 发送的时候不按照这个带宽限制速度(直播的数据不能等), 也不等对端的确认.
+func (c *RtmpNetConnection) setPeerBandwidth(size uint32, limitType byte) error {
+	bandwidth := c.peerBandwidth
+	limit := byte(c.peerLimitType)
+
+	switch limitType {
+	case RTMP_LIMIT_HARD:
+		{
+			bandwidth = size
+			limit = limitType
+		}
+	case RTMP_LIMIT_SOFT:
+		{
+			if bandwidth == 0 || size < bandwidth {
+				bandwidth = size
+			}
+			limit = limitType
+		}
+	case RTMP_LIMIT_DYNAMIC:
+		{
+			if limit != RTMP_LIMIT_HARD || bandwidth == 0 {
+				return nil
+			}
+
+			bandwidth = size
+		}
+	default:
+		{
+			return nil
+		}
+	}
+
+	atomic.StoreUint32(&c.peerBandwidth, bandwidth)
+	atomic.StoreUint32(&c.peerLimitType, uint32(limit))
+
+	if bandwidth == atomic.LoadUint32(&c.writeAckWindow) {
+		return nil
+	}
+
+	return sendMessage(c, SEND_ACK_WINDOW_SIZE_MESSAGE, bandwidth)
+}
+
 func (c *RtmpNetConnection) Connect(command string, args ...interface{}) error {
 	return nil
 }
@@ -92,8 +340,112 @@ func (c *RtmpNetConnection) Close() {
 	defer c.lock.Unlock()
 	c.conn.Close()
 	c.connected = false
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+// 交给消息循环执行, 不阻塞调用者(广播的 goroutine, 读文件的 goroutine). 连接关闭之后不再执行.
+func (c *RtmpNetConnection) post(f func()) {
+	select {
+	case c.tasks <- f:
+		{
+			return
+		}
+	default:
+		{
+		}
+	}
+
+	go func() {
+		select {
+		case c.tasks <- f:
+			{
+			}
+		case <-c.done:
+			{
+			}
+		}
+	}()
+}
+
+// 流ID在连接内分配, 从1开始, deleteStream 之后的流ID可以重复使用
+func (c *RtmpNetConnection) createStream(sh ServerHandler) (s *RtmpNetStream, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.streams) > RTMP_MAX_NET_STREAMS {
+		return nil, newProtocolError(ErrTooManyStreams, "%v/%v", len(c.streams)-1, RTMP_MAX_NET_STREAMS)
+	}
+
+	id := uint32(1)
+	for c.streams[id] != nil {
+		id++
+	}
+
+	s = newNetStream(c, sh)
+	s.streamID = id
+	c.streams[id] = s
+
+	return s, nil
+}
+
+func (c *RtmpNetConnection) addStream(s *RtmpNetStream) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.streams[s.streamID] = s
+}
+
+func (c *RtmpNetConnection) stream(id uint32) *RtmpNetStream {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.streams[id]
+}
+
+func (c *RtmpNetConnection) removeStream(s *RtmpNetStream) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.streams[s.streamID] == s {
+		delete(c.streams, s.streamID)
+	}
+}
+
+// 连接上发布这个流路径的流, FCUnpublish 用流名字找到要停止发布的流
+func (c *RtmpNetConnection) publishingStream(streamPath string) *RtmpNetStream {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, s := range c.streams {
+		if s.mode&1 != 0 && s.streamPath == streamPath {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// 连接关闭的时候取出所有的流
+func (c *RtmpNetConnection) removeStreams() (streams []*RtmpNetStream) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for id, s := range c.streams {
+		streams = append(streams, s)
+		delete(c.streams, id)
+	}
+
+	return
 }
 
 func (c *RtmpNetConnection) URL() string {
 	return c.url
 }
+
+func (c *RtmpNetConnection) AppName() string {
+	return c.appName
+}
+
+func (c *RtmpNetConnection) RemoteAddr() string {
+	return c.remoteAddr
+}
@@ -45,7 +45,8 @@ type NetStream interface {
 // 定义了传输通道,通过这个通道,音频流、视频流以及数据消息流可以通过连接客户端到服务端的NetConnection传输.
 type RtmpNetStream struct {
 	conn           *RtmpNetConnection // NetConnection
-	metaData       *AVPacket          // metedata
+	streamID       uint32             // 流ID, createStream 分配. 0 是 NetConnection 自己, 兼容在流0上面 publish 和 play 的客户端
+	metaData       *AVPacket          // metedata, 最新的 onMetaData(已经去掉 @setDataFrame), 播放者开始播放的时候先发送. lock 保护, 用 metadata() 读
 	videoTag       *AVPacket          // 每个视频包都是这样的结构,区别在于Payload的大小.FMS在发送AVC sequence header,需要加上 VideoTags,这个tag 1个字节(8bits)的数据
 	audioTag       *AVPacket          // 每个音频包都是这样的结构,区别在于Payload的大小.FMS在发送AAC sequence header,需要加上 AudioTags,这个tag 1个字节(8bits)的数据
 	videoKeyFrame  *AVPacket          // keyframe (for AVC, a seekableframe)（关键帧）
@@ -65,8 +66,16 @@ type RtmpNetStream struct {
 	broadcast      *Broadcast         // Broadcast, 装载着需要广播的对象.(也即是具体的发布者)
 	total_duration uint32             // media total duration 存放音频或者视频的时间戳累加.就是一个绝对时间戳. 当前绝对时间戳 = 上一个绝对时间戳 + 当前相对时间戳
 	vsend_time     uint32             // 上一个视频的绝对时间戳
+	base_time      uint32             // 发送给播放者的第一个关键帧的绝对时间戳, 数据消息的时间戳以它为起点
+	based          bool               // base_time 已经确定, 暂停之后恢复的时候时间戳接着以前的
+	rebase         uint32             // 切换发布者之后, 新的发布者的第一个关键帧发送给播放者的时间戳
 	asend_time     uint32             // 上一个音频的绝对时间戳
 	closed         bool               // 是否关闭
+	playing        *playItem          // 正在播放的流
+	playlist       []*playItem        // 排队等待播放的流(play 命令的 reset 为 false)
+	paused         bool               // 暂停播放(pause)
+	noAudio        bool               // 不接收音频(receiveAudio false)
+	noVideo        bool               // 不接收视频(receiveVideo false)
 	rtmpFile       *RtmpFile          // netstream write file
 }
 
@@ -83,6 +92,24 @@ func newNetStream(conn *RtmpNetConnection, sh ServerHandler) (s *RtmpNetStream)
 	return
 }
 
+func (s *RtmpNetStream) StreamID() uint32 {
+	return s.streamID
+}
+
+// 广播里面订阅者的 key, 一个连接上可以有多个流
+func (s *RtmpNetStream) id() string {
+	return s.conn.remoteAddr + "/" + strconv.Itoa(int(s.streamID))
+}
+
+func (s *RtmpNetStream) onError(err error) {
+	s.serverHandler.OnError(s, err)
+}
+
+// 发送这个流上的消息, 消息流ID为 s.streamID
+func (s *RtmpNetStream) sendMessage(message string, args interface{}) error {
+	return sendStreamMessage(s.conn, s.streamID, message, args)
+}
+
 func (s *RtmpNetStream) AttachVideo(video chan *AVPacket) {
 	s.videochan = video
 }
@@ -91,70 +118,177 @@ func (s *RtmpNetStream) AttachAudio(audio chan *AVPacket) {
 	s.audiochan = audio
 }
 
+// 暂停播放, 发送 NetStream.Pause.Notify
+func (s *RtmpNetStream) Pause() {
+	s.pause(true)
+}
+
+// 恢复播放, 发送 NetStream.Unpause.Notify. 直播流从下一个关键帧开始发送.
+func (s *RtmpNetStream) Resume() {
+	s.pause(false)
+}
+
+func (s *RtmpNetStream) TogglePause() {
+	paused, _, _ := s.receiving()
+	s.pause(!paused)
+}
+
+// 录制的流 seek 到和 offset(毫秒)最接近的关键帧, 直播流发送 NetStream.Seek.Failed
+func (s *RtmpNetStream) Seek(offset uint64) {
+	s.seek(uint32(offset))
+}
+
+func (s *RtmpNetStream) ReceiveAudio(flag bool) {
+	s.receive(true, flag)
+}
+
+func (s *RtmpNetStream) ReceiveVideo(flag bool) {
+	s.receive(false, flag)
+}
+
+// 播放者时间线上的时间戳, 第一个发送的包的时间戳为0
+func (s *RtmpNetStream) timeline(timestamp uint32) uint32 {
+	if !s.based {
+		s.based = true
+		s.base_time = timestamp
+	}
+
+	if timestamp > s.base_time {
+		return s.rebase + timestamp - s.base_time
+	}
+
+	return s.rebase
+}
+
+// 切换发布者(重新发布, 接管, 备用切换)之后, 新的发布者的时间戳从0开始或者跳变.
+// 播放者的时间戳接着已经发送的最后一帧, 从新的发布者的关键帧开始发送. 在广播的 goroutine 里面调用.
+func (s *RtmpNetStream) rebaseTimeline() {
+	if s.based {
+		last := s.vsend_time
+		if s.asend_time > last {
+			last = s.asend_time
+		}
+
+		if last > s.base_time {
+			s.rebase += last - s.base_time
+		}
+
+		s.rebase += RTMP_TIMELINE_GAP
+	}
+
+	s.based = false
+	s.vkfsended = false
+	s.akfsended = false
+	s.vsend_time = 0
+	s.asend_time = 0
+}
+
 // 先发送关键帧(Tag),之后就不断发送数据
 func (s *RtmpNetStream) SendVideo(video *AVPacket) error {
 	// 这里发送时间戳的依据是,当发送第一个包和Tag的时候,需要发送Chunk12的头
 	// 因此这里TimeStamp我们简单的设置为0(指明一个时间而已)
 	// 到了这里,不在需要再发送Chunk12的头,只需要发送Chunk4或者Chunk8的头.
 	// 因此这里的时间戳,应该是一个TimeStamp Delta,记录与上一个Chunk的时间差值.
+	// 暂停或者不接收视频的时候不发送, 恢复的时候从下一个关键帧开始发送
+	if paused, _, receive := s.receiving(); paused || !receive {
+		s.vkfsended = false
+		return nil
+	}
+
+	// 播放者不支持 Enhanced RTMP 的时候, hvc1 转换成传统的 CodecID(12) 格式
+	if video.VideoIsExHeader && !s.conn.supportFourCC(video.VideoFourCC) {
+		var err error
+		if video, err = video.toLegacyVideoPacket(); err != nil {
+			return err
+		}
+	}
+
 	if s.vkfsended {
 		video.Timestamp -= s.vsend_time - uint32(s.bufferTime)
 		s.vsend_time += video.Timestamp
 		//fmt.Println("time stamp:", video.Timestamp)
 		//fmt.Println("video send time:", s.vsend_time)
-		return sendMessage(s.conn, SEND_VIDEO_MESSAGE, video)
+		if err := s.sendMessage(SEND_VIDEO_MESSAGE, video); err != nil {
+			return err
+		}
+
+		s.played(s.timeline(s.vsend_time))
+		return nil
 	}
 
 	if !video.isKeyFrame() {
 		return nil
 	}
 
-	vTag := s.broadcast.publisher.videoTag // 从发布者发布的数据中,拿出视频Tag.
+	vTag, _ := s.broadcast.publisher.tags() // 从发布者发布的数据中,拿出视频Tag.
 	if vTag == nil {
 		fmt.Println("Video Tag nil")
 		return nil
 	}
 
-	vTag.Timestamp = 0
-
-	// 如果视频的格式是AVC(H.264)的话,VideoTagHeader(1个字节)会多出4个字节的信息.AVCPacketType(1Bytes)和 CompositionTime(3 Bytes).
-	// AVCPacketType表示接下来VIDEODATA(AVCVIDEOPACKET)的内容.
-	// if AVCPacketType == 0 -> AVCDecoderConfigurationRecord 并且 frametype 必须为1.
-	// AVCDecoderConfigurationRecord
-	// AVC sequence header就是AVCDecoderConfigurationRecord结构，该结构在标准文档“ISO-14496-15 AVC file format”中有详细说明
-	version := vTag.Payload[4+1]                                            // configurationVersion, 8bit. 版本号 1
-	avcPfofile := vTag.Payload[4+2]                                         // AVCProfileIndication, 8bit. sps[1]
-	profileCompatibility := vTag.Payload[4+3]                               // profile_compatibility, 8bit. sps[2]
-	avcLevel := vTag.Payload[4+4]                                           // AVCLevelIndication, 8bit. sps[3]
-	reserved := vTag.Payload[4+5] >> 2                                      // reserved, 6bit. reserved 111111
-	lengthSizeMinusOne := vTag.Payload[4+5] & 0x03                          // lengthSizeMinusOne, 2bit. H.264 视频中 NALU 的长度,一般为3
-	reserved2 := vTag.Payload[4+6] >> 5                                     // reserved, 3bit. reserved 111
-	numOfSPS := vTag.Payload[4+6] & 31                                      // numOfSequenceParameterSets, 5bit. sps个数,一般为1
-	spsLength := util.BigEndian.Uint16(vTag.Payload[4+7:])                  // sequenceParameterSetLength, 16bit, sps长度.
-	sps := vTag.Payload[4+9 : 4+9+int(spsLength)]                           // sps
-	numOfPPS := vTag.Payload[4+9+int(spsLength)]                            // numOfPictureParameterSets, 8bit, pps个数,一般为1
-	ppsLength := util.BigEndian.Uint16(vTag.Payload[4+9+int(spsLength)+1:]) // pictureParameterSetLength, 16bit, pps长度
-	pps := vTag.Payload[4+9+int(spsLength)+1+2:]                            // pps
-
-	// AVCDecoderConfigurationRecord 后面就是 NALUs.
-	fmt.Sprintf("ConfigurationVersion:%v\nAVCProfileIndication:%v\nprofile_compatibility/%v\nAVCLevelIndication/%v\nreserved/%v\nlengthSizeMinusOne/%v\nreserved2/%v\nNumOfSequenceParameterSets/%v\nSequenceParameterSetLength/%v\nSPS/%02x\nNumOfPictureParameterSets/%v\nPictureParameterSetLength/%v\nPPS/%02x\n",
-		version, avcPfofile, profileCompatibility, avcLevel, reserved, lengthSizeMinusOne, reserved2, numOfSPS, spsLength, sps, numOfPPS, ppsLength, pps)
-
-	err := sendMessage(s.conn, SEND_FULL_VDIEO_MESSAGE, vTag)
+	if vTag.VideoIsExHeader && !s.conn.supportFourCC(vTag.VideoFourCC) {
+		var err error
+		if vTag, err = vTag.toLegacyVideoPacket(); err != nil {
+			return err
+		}
+	}
+
+	// 恢复播放的时候时间戳接着以前的, sequence header 和关键帧的时间戳一样
+	timestamp := s.timeline(video.Timestamp)
+
+	vTag = vTag.Clone()
+	vTag.Timestamp = timestamp
+
+	// 播放者先收到 onMetaData, 才能显示时长和分辨率
+	if meta := s.broadcast.publisher.metadata(); meta != nil {
+		meta.Timestamp = timestamp
+
+		if err := s.sendMessage(SEND_DATA_MESSAGE, meta); err != nil {
+			return err
+		}
+	}
+
+	// 视频Tag就是 sequence header (AVCDecoderConfigurationRecord 或者 HEVCDecoderConfigurationRecord),
+	// 这里不需要解析,直接转发给播放者.
+
+	err := s.sendMessage(SEND_FULL_VDIEO_MESSAGE, vTag)
 	if err != nil {
 		return err
 	}
 
 	s.vkfsended = true
 	s.vsend_time = video.Timestamp
-	video.Timestamp = 0
+	video.Timestamp = timestamp
+
+	if err = s.sendMessage(SEND_FULL_VDIEO_MESSAGE, video); err != nil {
+		return err
+	}
 
-	return sendMessage(s.conn, SEND_FULL_VDIEO_MESSAGE, video)
+	s.played(timestamp)
+	return nil
+}
+
+// 数据消息(onMetaData, onTextData, onCuePoint ...)用完整的消息头发送, 时间戳和视频对齐.
+// 开始播放之前的数据消息不发送, onMetaData 在开始播放的时候发送最新的.
+func (s *RtmpNetStream) SendData(data *AVPacket) error {
+	if paused, _, _ := s.receiving(); paused || !s.based {
+		return nil
+	}
+
+	data.Timestamp = s.timeline(data.Timestamp)
+
+	return s.sendMessage(SEND_DATA_MESSAGE, data)
 }
 
 // 先发送关键帧(Tag),之后就不断发送数据
 func (s *RtmpNetStream) SendAudio(audio *AVPacket) error {
-	if !s.vkfsended { // 先发送视频才开始发送音频
+	paused, receive, video := s.receiving()
+	if paused || !receive {
+		s.akfsended = false
+		return nil
+	}
+
+	if !s.vkfsended && video { // 先发送视频才开始发送音频, 不接收视频的时候直接发送音频
 		return nil
 	}
 
@@ -167,27 +301,44 @@ func (s *RtmpNetStream) SendAudio(audio *AVPacket) error {
 	if s.akfsended {
 		audio.Timestamp -= s.asend_time - uint32(s.bufferTime) // 当前音频相对时间戳 == 当前音频绝对时间戳 - 上一个音频绝对时间戳.buffer time == 0, asend_time总是保存的是上一个音频绝对时间戳.
 		s.asend_time += audio.Timestamp                        // 当前音频的绝对时间戳 = 上一个音频的绝对时间戳 + 当前音频的相对时间戳. audio.Timestamp 总是保存当前音频的相对时间戳
-		return sendMessage(s.conn, SEND_AUDIO_MESSAGE, audio)  // 这里发送的时间戳是相对时间戳
+
+		// 这里发送的时间戳是相对时间戳
+		if err := s.sendMessage(SEND_AUDIO_MESSAGE, audio); err != nil {
+			return err
+		}
+
+		s.played(s.timeline(s.asend_time))
+		return nil
 	}
 
 	// FMS推送H264和AAC直播流,需要首先发送"AVC sequence header"和"AAC sequence header",这两项数据包含的是重要的编码信息,没有它们,解码器将无法解码.
 	// 在发送这两个header需要在前面分别加上 VideoTags、AudioTags  这两个个tags都是1个字节（8bits）的数据
 	// Audio Tag == SoundFormat(4 Bit) + SoundRate(2 Bit) + SoundSize(1 Bit) + SoundTypet(1 Bit)
-	aTag := s.broadcast.publisher.audioTag // 从发布者发布的数据中,拿出音频Tag.
-	aTag.Timestamp = 0
+	_, aTag := s.broadcast.publisher.tags() // 从发布者发布的数据中,拿出音频Tag.
+	aTag = aTag.Clone()
+	aTag.Timestamp = s.timeline(audio.Timestamp)
 
-	err := sendMessage(s.conn, SEND_FULL_AUDIO_MESSAGE, aTag) // 发送音频Tag.
+	err := s.sendMessage(SEND_FULL_AUDIO_MESSAGE, aTag) // 发送音频Tag.
 	if err != nil {
 		return err
 	}
 
-	s.akfsended = true                                         // 标示第一个完整的包已经发送
-	s.asend_time = audio.Timestamp                             // 音频发送时间,接收到客户端的音频消息中,会获取该值
-	audio.Timestamp = 0                                        // 音频时间戳,初始化为0
-	return sendMessage(s.conn, SEND_FULL_AUDIO_MESSAGE, audio) // 发送第一个完整的音频包
+	s.akfsended = true               // 标示第一个完整的包已经发送
+	s.asend_time = audio.Timestamp   // 音频发送时间,接收到客户端的音频消息中,会获取该值
+	audio.Timestamp = aTag.Timestamp // 音频时间戳,和视频在同一个时间线上
+
+	// 发送第一个完整的音频包
+	if err = s.sendMessage(SEND_FULL_AUDIO_MESSAGE, audio); err != nil {
+		return err
+	}
+
+	s.played(audio.Timestamp)
+	return nil
 }
 
 func (s *RtmpNetStream) WriteVideo(w io.Writer, video *AVPacket, fileType int) (err error) {
+	videoTag, audioTag := s.tags()
+
 	switch fileType {
 	case RTMP_FILE_TYPE_ES_H264:
 		{
@@ -199,7 +350,7 @@ func (s *RtmpNetStream) WriteVideo(w io.Writer, video *AVPacket, fileType int) (
 				return nil
 			}
 
-			if _, err = w.Write(s.videoTag.Payload); err != nil {
+			if _, err = w.Write(videoTag.Payload); err != nil {
 				return
 			}
 
@@ -208,34 +359,32 @@ func (s *RtmpNetStream) WriteVideo(w io.Writer, video *AVPacket, fileType int) (
 	case RTMP_FILE_TYPE_TS:
 		{
 			if s.rtmpFile.vtwrite {
-				var packet mpegts.MpegTsPESPacket
-				if packet, err = rtmpVideoPacketToPES(video, s.rtmpFile.avc); err != nil {
+				var skip bool
+				if skip, err = s.rtmpFile.skipVideoPacket(video); skip || err != nil {
 					return
 				}
 
-				frame := new(mpegts.MpegtsPESFrame)
-				frame.Pid = 0x101
-				frame.IsKeyFrame = video.isKeyFrame()
-				frame.ContinuityCounter = byte(s.rtmpFile.video_cc % 16)
-				frame.ProgramClockReferenceBase = uint64(video.Timestamp) * 90
-				if err = mpegts.WritePESPacket(w, frame, packet); err != nil {
+				var packet mpegts.MpegTsPESPacket
+				if packet, err = s.rtmpFile.videoPacketToPES(video); err != nil {
 					return
 				}
 
-				s.rtmpFile.video_cc = uint16(frame.ContinuityCounter)
+				if err = s.rtmpFile.ts_muxer.WritePES(w, uint16(config.TSVideoPID), video.isKeyFrame(), packet); err != nil {
+					return
+				}
 
 				return nil
 			}
 
-			if s.rtmpFile.avc, err = decodeAVCDecoderConfigurationRecord(s.videoTag.Clone()); err != nil {
+			if err = s.rtmpFile.decodeVideoConfig(videoTag.Clone()); err != nil {
 				return
 			}
 
-			if err = mpegts.WriteDefaultPATPacket(w); err != nil {
+			if s.rtmpFile.ts_muxer, err = newRtmpTsMuxer(s.rtmpFile.videoStreamType()); err != nil {
 				return
 			}
 
-			if err = mpegts.WriteDefaultPMTPacket(w); err != nil {
+			if err = s.rtmpFile.ts_muxer.WriteTables(w); err != nil {
 				return
 			}
 
@@ -244,58 +393,48 @@ func (s *RtmpNetStream) WriteVideo(w io.Writer, video *AVPacket, fileType int) (
 	case RTMP_FILE_TYPE_HLS_TS:
 		{
 			if s.rtmpFile.vtwrite {
+				var skip bool
+				if skip, err = s.rtmpFile.skipVideoPacket(video); skip || err != nil {
+					return
+				}
+
 				var packet mpegts.MpegTsPESPacket
-				if packet, err = rtmpVideoPacketToPES(video, s.rtmpFile.avc); err != nil {
+				if packet, err = s.rtmpFile.videoPacketToPES(video); err != nil {
 					return
 				}
 
 				if video.isKeyFrame() {
-					// 当前的时间戳减去上一个ts切片的时间戳
-					if int64(video.Timestamp-s.rtmpFile.vwrite_time) >= s.rtmpFile.hls_fragment {
-						//fmt.Println("time :", video.Timestamp, tsSegmentTimestamp)
-
-						tsFilename := strings.Split(s.streamPath, "/")[1] + "-" + strconv.FormatInt(time.Now().Unix(), 10) + ".ts"
-
-						if err = writeHlsTsSegmentFile(s.rtmpFile.hls_path+"/"+tsFilename, s.rtmpFile.hls_segment_data.Bytes()); err != nil {
-							return
-						}
-
-						inf := hls.PlaylistInf{
-							Duration: float64((video.Timestamp - s.rtmpFile.vwrite_time) / 1000),
-							Title:    tsFilename,
-						}
-
-						if s.rtmpFile.hls_segment_count >= uint32(config.HLSWindow) {
-							if err = s.rtmpFile.hls_playlist.UpdateInf(s.rtmpFile.hls_m3u8_name, s.rtmpFile.hls_m3u8_name+".tmp", inf); err != nil {
-								return
-							}
-						} else {
-							if err = s.rtmpFile.hls_playlist.WriteInf(s.rtmpFile.hls_m3u8_name, inf); err != nil {
+					if s.rtmpFile.hls_switched {
+						// 切换了输入, 以前的切片到上一个输入的最后一帧为止, 新的切片和以前的不连续
+						if s.rtmpFile.hls_segment_data.Len() > 0 {
+							if err = s.writeHlsSegment(s.rtmpFile.vlast_time); err != nil {
 								return
 							}
 						}
 
-						s.rtmpFile.hls_segment_count++
+						s.rtmpFile.hls_switched = false
+						s.rtmpFile.hls_discontinuity = true
+						s.rtmpFile.vwrite_time = video.Timestamp
+					} else if int64(video.Timestamp-s.rtmpFile.vwrite_time) >= s.rtmpFile.hls_fragment {
+						// 当前的时间戳减去上一个ts切片的时间戳
+						if err = s.writeHlsSegment(video.Timestamp); err != nil {
+							return
+						}
+
 						s.rtmpFile.vwrite_time = video.Timestamp
-						s.rtmpFile.hls_segment_data.Reset()
 					}
 				}
 
-				frame := new(mpegts.MpegtsPESFrame)
-				frame.Pid = 0x101
-				frame.IsKeyFrame = video.isKeyFrame()
-				frame.ContinuityCounter = byte(s.rtmpFile.video_cc % 16)
-				frame.ProgramClockReferenceBase = uint64(video.Timestamp) * 90
-				if err = mpegts.WritePESPacket(s.rtmpFile.hls_segment_data, frame, packet); err != nil {
+				if err = s.rtmpFile.ts_muxer.WritePES(s.rtmpFile.hls_segment_data, uint16(config.TSVideoPID), video.isKeyFrame(), packet); err != nil {
 					return
 				}
 
-				s.rtmpFile.video_cc = uint16(frame.ContinuityCounter)
+				s.rtmpFile.vlast_time = video.Timestamp
 
 				return nil
 			}
 
-			if s.rtmpFile.avc, err = decodeAVCDecoderConfigurationRecord(s.videoTag.Clone()); err != nil {
+			if err = s.rtmpFile.decodeVideoConfig(videoTag.Clone()); err != nil {
 				return
 			}
 
@@ -313,6 +452,7 @@ func (s *RtmpNetStream) WriteVideo(w io.Writer, video *AVPacket, fileType int) (
 
 			s.rtmpFile.hls_path = config.HLSPath + "/" + strings.Split(s.streamPath, "/")[0]
 			s.rtmpFile.hls_m3u8_name = s.rtmpFile.hls_path + "/mystream.m3u8"
+			s.rtmpFile.hls_master_name = s.rtmpFile.hls_path + "/index.m3u8"
 
 			if !util.Exist(s.rtmpFile.hls_path) {
 				if err = os.Mkdir(s.rtmpFile.hls_path, os.ModePerm); err != nil {
@@ -325,6 +465,27 @@ func (s *RtmpNetStream) WriteVideo(w io.Writer, video *AVPacket, fileType int) (
 				return
 			}
 
+			// master playlist, 播放器根据 CODECS 判断是否支持(比如 H265)
+			if audioTag != nil {
+				if s.rtmpFile.asc, err = decodeAudioSpecificConfig(audioTag.Clone()); err != nil {
+					return
+				}
+			}
+
+			streamInf := hls.PlaylistStreamInf{
+				Bandwidth: hls.HLS_DEFAULT_BANDWIDTH,
+				Codecs:    s.rtmpFile.codecs(audioTag != nil),
+				Uri:       "mystream.m3u8",
+			}
+
+			if err = hls.WriteMasterPlaylist(s.rtmpFile.hls_master_name, []hls.PlaylistStreamInf{streamInf}); err != nil {
+				return
+			}
+
+			if s.rtmpFile.ts_muxer, err = newRtmpTsMuxer(s.rtmpFile.videoStreamType()); err != nil {
+				return
+			}
+
 			s.rtmpFile.hls_segment_data = &bytes.Buffer{}
 			s.rtmpFile.hls_segment_count = 0
 
@@ -359,7 +520,15 @@ func (s *RtmpNetStream) WriteVideo(w io.Writer, video *AVPacket, fileType int) (
 				return
 			}
 
-			if err = writeFLVTag(w, s.videoTag.Clone()); err != nil {
+			if meta := s.metadata(); meta != nil {
+				meta.Timestamp = videoTag.Timestamp
+
+				if err = writeFLVScriptTag(w, meta); err != nil {
+					return
+				}
+			}
+
+			if err = writeFLVTag(w, videoTag.Clone()); err != nil {
 				return
 			}
 
@@ -378,7 +547,43 @@ func (s *RtmpNetStream) WriteVideo(w io.Writer, video *AVPacket, fileType int) (
 	return nil
 }
 
+// 写一个 hls 切片, 从 vwrite_time 到 timestamp. 超过 HLS_Window 的时候删掉第一个切片.
+func (s *RtmpNetStream) writeHlsSegment(timestamp uint32) (err error) {
+	//fmt.Println("time :", timestamp, s.rtmpFile.vwrite_time)
+
+	// 切换输入的时候一秒钟之内可能有两个切片, 名字加上切片的序号
+	tsFilename := strings.Split(s.streamPath, "/")[1] + "-" + strconv.FormatInt(time.Now().Unix(), 10) + "-" + strconv.FormatUint(uint64(s.rtmpFile.hls_segment_count), 10) + ".ts"
+
+	if err = writeHlsTsSegmentFile(s.rtmpFile.hls_path+"/"+tsFilename, s.rtmpFile.ts_muxer, s.rtmpFile.hls_segment_data.Bytes()); err != nil {
+		return
+	}
+
+	inf := hls.PlaylistInf{
+		Duration:      float64((timestamp - s.rtmpFile.vwrite_time) / 1000),
+		Title:         tsFilename,
+		Discontinuity: s.rtmpFile.hls_discontinuity,
+	}
+
+	if s.rtmpFile.hls_segment_count >= uint32(config.HLSWindow) {
+		if err = s.rtmpFile.hls_playlist.UpdateInf(s.rtmpFile.hls_m3u8_name, s.rtmpFile.hls_m3u8_name+".tmp", inf); err != nil {
+			return
+		}
+	} else {
+		if err = s.rtmpFile.hls_playlist.WriteInf(s.rtmpFile.hls_m3u8_name, inf); err != nil {
+			return
+		}
+	}
+
+	s.rtmpFile.hls_segment_count++
+	s.rtmpFile.hls_discontinuity = false
+	s.rtmpFile.hls_segment_data.Reset()
+
+	return
+}
+
 func (s *RtmpNetStream) WriteAudio(w io.Writer, audio *AVPacket, fileType int) (err error) {
+	_, audioTag := s.tags()
+
 	switch fileType {
 	case RTMP_FILE_TYPE_ES_AAC:
 		{
@@ -390,7 +595,7 @@ func (s *RtmpNetStream) WriteAudio(w io.Writer, audio *AVPacket, fileType int) (
 				return nil
 			}
 
-			if _, err = w.Write(s.audioTag.Payload); err != nil {
+			if _, err = w.Write(audioTag.Payload); err != nil {
 				return
 			}
 
@@ -408,21 +613,14 @@ func (s *RtmpNetStream) WriteAudio(w io.Writer, audio *AVPacket, fileType int) (
 					return
 				}
 
-				frame := new(mpegts.MpegtsPESFrame)
-				frame.Pid = 0x102
-				frame.IsKeyFrame = false
-				frame.ContinuityCounter = byte(s.rtmpFile.audio_cc % 16)
-				//frame.ProgramClockReferenceBase = 0
-				if err = mpegts.WritePESPacket(w, frame, packet); err != nil {
+				if err = s.rtmpFile.ts_muxer.WritePES(w, uint16(config.TSAudioPID), false, packet); err != nil {
 					return
 				}
 
-				s.rtmpFile.audio_cc = uint16(frame.ContinuityCounter)
-
 				return nil
 			}
 
-			if s.rtmpFile.asc, err = decodeAudioSpecificConfig(s.audioTag.Clone()); err != nil {
+			if s.rtmpFile.asc, err = decodeAudioSpecificConfig(audioTag.Clone()); err != nil {
 				return
 			}
 
@@ -440,21 +638,14 @@ func (s *RtmpNetStream) WriteAudio(w io.Writer, audio *AVPacket, fileType int) (
 					return
 				}
 
-				frame := new(mpegts.MpegtsPESFrame)
-				frame.Pid = 0x102
-				frame.IsKeyFrame = false
-				frame.ContinuityCounter = byte(s.rtmpFile.audio_cc % 16)
-				//frame.ProgramClockReferenceBase = 0
-				if err = mpegts.WritePESPacket(s.rtmpFile.hls_segment_data, frame, packet); err != nil {
+				if err = s.rtmpFile.ts_muxer.WritePES(s.rtmpFile.hls_segment_data, uint16(config.TSAudioPID), false, packet); err != nil {
 					return
 				}
 
-				s.rtmpFile.audio_cc = uint16(frame.ContinuityCounter)
-
 				return nil
 			}
 
-			if s.rtmpFile.asc, err = decodeAudioSpecificConfig(s.audioTag.Clone()); err != nil {
+			if s.rtmpFile.asc, err = decodeAudioSpecificConfig(audioTag.Clone()); err != nil {
 				return
 			}
 
@@ -474,7 +665,7 @@ func (s *RtmpNetStream) WriteAudio(w io.Writer, audio *AVPacket, fileType int) (
 				return nil
 			}
 
-			if err = writeFLVTag(w, s.audioTag.Clone()); err != nil {
+			if err = writeFLVTag(w, audioTag.Clone()); err != nil {
 				return
 			}
 
@@ -493,17 +684,65 @@ func (s *RtmpNetStream) WriteAudio(w io.Writer, audio *AVPacket, fileType int) (
 	return nil
 }
 
+// 关闭连接, 连接上所有的流都会关闭
 func (s *RtmpNetStream) Close() {
+	s.conn.Close()
+
+	for _, ns := range s.conn.removeStreams() {
+		ns.release()
+	}
+
+	s.release()
+}
+
+// 停止流上的发布或者播放, 返回 false 表示已经停止过了. 连接和连接上的其他流不受影响.
+func (s *RtmpNetStream) release() bool {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
 	if s.closed {
-		return
+		return false
 	}
 
-	s.conn.Close()
 	s.closed = true
+
+	// 停止播放列表, 直播流在 OnClosed 里面取消订阅
+	if s.playing != nil {
+		close(s.playing.stop)
+		s.playing = nil
+	}
+	s.playlist = nil
+
 	s.serverHandler.OnClosed(s)
+
+	return true
+}
+
+// closeStream: 停止流上的发布或者播放, 流ID保留, 客户端可以在这个流上面重新 publish 或者 play.
+// 发布者回复 NetStream.Unpublish.Success.
+func (s *RtmpNetStream) closeStream() error {
+	if !s.release() {
+		return nil
+	}
+
+	ns := newNetStream(s.conn, s.serverHandler)
+	ns.streamID = s.streamID
+	s.conn.addStream(ns)
+
+	if s.mode&1 == 0 {
+		return nil
+	}
+
+	prmd := newPublishResponseMessageData(s.streamID, NetStream_Unpublish_Success, Level_Status)
+	prmd["description"] = s.streamPath + " is now unpublished."
+
+	return s.sendMessage(SEND_UNPUBLISH_RESPONSE_MESSAGE, prmd)
+}
+
+// deleteStream: 停止流上的发布或者播放, 释放流ID.
+func (s *RtmpNetStream) deleteStream() {
+	s.release()
+	s.conn.removeStream(s)
 }
 
 // Client publish -> FFmpeg
@@ -539,11 +778,38 @@ func (s *RtmpNetStream) Close() {
 // 4) Wait for a response from the ingest server. A response code of NetStream.Unpublish.Success indicates that the stream was successfully unpublished. The stream resources have been deallocated by the server, and the client can proceed to remove its local stream resources.
 
 func (s *RtmpNetStream) msgLoopProc() {
+	defer releaseSharedObjects(s.conn)
+
+	msgs := make(chan RtmpMessage)
+	errs := make(chan error, 1)
+	stopped := make(chan struct{})
+	defer close(stopped)
+
+	go recvMessages(s.conn, msgs, errs, stopped)
+
 	for {
-		msg, err := recvMessage(s.conn)
-		if err != nil {
-			s.serverHandler.OnError(s, err)
-			break
+		var msg RtmpMessage
+
+		// 读消息在另外的 goroutine 里面, 这里同时处理其他的 goroutine 交过来的函数(播放下一项 ...)
+		select {
+		case msg = <-msgs:
+			{
+			}
+		case err := <-errs:
+			{
+				s.serverHandler.OnError(s, err)
+
+				// 对端违反了协议或者超过了限制, 不管 OnError 怎么处理都关闭连接
+				if _, ok := err.(*ProtocolError); ok {
+					s.Close()
+				}
+				return
+			}
+		case f := <-s.conn.tasks:
+			{
+				f()
+				continue
+			}
 		}
 
 		if msg.Header().ChunkMessgaeHeader.MessageLength <= 0 {
@@ -559,19 +825,50 @@ func (s *RtmpNetStream) msgLoopProc() {
 			}
 		}
 
+		// 按照消息流ID找到对应的流. s 是流0(NetConnection 自己), 处理连接上的命令.
+		streamID := msg.Header().ChunkMessgaeHeader.MessageStreamID
+		ns := s.conn.stream(streamID)
+		if ns == nil {
+			fmt.Println("Unknown Stream ID :", streamID, msg.String())
+			continue
+		}
+
 		switch v := msg.(type) {
 		case *AudioMessage:
 			{
-				audioMessageHandle(s, v)
+				audioMessageHandle(ns, v)
 			}
 		case *VideoMessage:
 			{
-				videoMessageHandle(s, v)
+				videoMessageHandle(ns, v)
 			}
 		case *MetadataMessage:
 			{
-				metadataMessageHandle(s, v)
-				//decodeMetadataMessage(s.metaData)
+				metadataMessageHandle(ns, v)
+				//decodeMetadataMessage(ns.metaData)
+			}
+		case *AggregateMessage:
+			{
+				// 子消息违反了协议或者超过了限制, 和上面一样关闭连接
+				if err := aggregateMessageHandle(ns, v); err != nil {
+					s.serverHandler.OnError(s, err)
+					s.Close()
+					return
+				}
+			}
+		case *CallMessage:
+			{
+				if err := callMessageHandle(s, v); err != nil {
+					s.serverHandler.OnError(s, err)
+					return
+				}
+			}
+		case *SharedObjectMessage:
+			{
+				if err := sharedObjectMessageHandle(s, v); err != nil {
+					s.serverHandler.OnError(s, err)
+					return
+				}
 			}
 		case *CreateStreamMessage:
 			{
@@ -580,41 +877,74 @@ func (s *RtmpNetStream) msgLoopProc() {
 					return
 				}
 			}
+		case *DeleteStreamMessage:
+			{
+				deleteStreamMessageHandle(s, v)
+			}
 		case *PublishMessage:
 			{
-				if err := publishMessageHandle(s, v); err != nil {
-					s.serverHandler.OnError(s, err)
+				if err := publishMessageHandle(ns, v); err != nil {
+					s.serverHandler.OnError(ns, err)
 					return
 				}
 			}
 		case *PlayMessage:
 			{
-				if err := playMessageHandle(s, v); err != nil {
-					s.serverHandler.OnError(s, err)
+				if err := playMessageHandle(ns, v); err != nil {
+					s.serverHandler.OnError(ns, err)
 					return
 				}
 			}
+		case *PauseMessage:
+			{
+				if err := ns.pause(v.Pause); err != nil {
+					s.serverHandler.OnError(ns, err)
+					return
+				}
+			}
+		case *SeekMessage:
+			{
+				if err := ns.seek(uint32(v.Milliseconds)); err != nil {
+					s.serverHandler.OnError(ns, err)
+					return
+				}
+			}
+		case *ReceiveAudioMessage:
+			{
+				ns.ReceiveAudio(v.BoolFlag)
+			}
+		case *ReceiveVideoMessage:
+			{
+				ns.ReceiveVideo(v.BoolFlag)
+			}
 		case *ReleaseStreamMessage:
 			{
-				// TODO:
+				if err := releaseStreamMessageHandle(s, v); err != nil {
+					s.serverHandler.OnError(s, err)
+					return
+				}
 			}
 		case *CloseStreamMessage:
 			{
-				s.Close()
+				// 只停止消息所在的流, 连接和其他的流不受影响
+				if err := ns.closeStream(); err != nil {
+					s.serverHandler.OnError(ns, err)
+					return
+				}
 			}
 		case *FCPublishMessage:
 			{
-				// // TODO
-				// if err := fcPublishMessageHandle(s, v); err != nil {
-				// 	return
-				// }
+				if err := fcPublishMessageHandle(s, v); err != nil {
+					s.serverHandler.OnError(s, err)
+					return
+				}
 			}
 		case *FCUnpublishMessage:
 			{
-				// // TODO
-				// if err := fcUnPublishMessageHandle(s, v); err != nil {
-				// 	return
-				// }
+				if err := fcUnPublishMessageHandle(s, v); err != nil {
+					s.serverHandler.OnError(s, err)
+					return
+				}
 			}
 		default:
 			{
@@ -624,20 +954,52 @@ func (s *RtmpNetStream) msgLoopProc() {
 	}
 }
 
-func audioMessageHandle(s *RtmpNetStream, audio *AudioMessage) {
-	pkt := new(AVPacket)
-	if audio.RtmpHeader.ChunkMessgaeHeader.Timestamp == 0xffffff {
-		s.total_duration += audio.RtmpHeader.ChunkExtendedTimestamp.ExtendTimestamp
-		pkt.Timestamp = s.total_duration
+// 一直读消息交给消息循环, 出错或者消息循环退出的时候退出
+func recvMessages(conn *RtmpNetConnection, msgs chan<- RtmpMessage, errs chan<- error, stopped <-chan struct{}) {
+	for {
+		msg, err := recvMessage(conn)
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		select {
+		case msgs <- msg:
+			{
+			}
+		case <-stopped:
+			{
+				if buffer := msg.Body().buffer; buffer != nil {
+					buffer.release()
+				}
+				return
+			}
+		}
+	}
+}
+
+// 发布者的消息的时间戳. 消息头的时间戳是和上一个消息的时间差, 累加成绝对时间戳.
+// 音视频和数据消息都用这个时间戳, 在同一个时间线上.
+func (s *RtmpNetStream) recvTimestamp(head *RtmpHeader) uint32 {
+	if head.ChunkMessgaeHeader.Timestamp == 0xffffff {
+		s.total_duration += head.ChunkExtendedTimestamp.ExtendTimestamp
 	} else {
-		s.total_duration += audio.RtmpHeader.ChunkMessgaeHeader.Timestamp // 绝对时间戳
-		pkt.Timestamp = s.total_duration                                  // 当前时间戳(用绝对时间戳做当前音频包的时间戳)
+		s.total_duration += head.ChunkMessgaeHeader.Timestamp
 	}
 
+	return s.total_duration
+}
+
+func audioMessageHandle(s *RtmpNetStream, audio *AudioMessage) {
+	pkt := new(AVPacket)
+	pkt.chunks = newChunkCache()
+	pkt.Timestamp = s.recvTimestamp(audio.RtmpHeader) // 当前时间戳(用绝对时间戳做当前音频包的时间戳)
+
 	//fmt.Println("recv audio time stamp:", pkt.Timestamp)
 
 	pkt.Type = audio.RtmpHeader.ChunkMessgaeHeader.MessageTypeID
 	pkt.Payload = audio.RtmpBody.Payload
+	pkt.buffer = audio.RtmpBody.buffer
 
 	tmp := pkt.Payload[0]             // 第一个字节保存着音频的相关信息
 	pkt.SoundFormat = tmp >> 4        // 音频格式 AAC或者其他.客户端在发送的时候,会左移4位,因此接收到后,右移4位
@@ -645,83 +1007,268 @@ func audioMessageHandle(s *RtmpNetStream, audio *AudioMessage) {
 	pkt.SoundSize = (tmp & 0x02) >> 1 // 采样精度 0 = 8-bit samples or 1 = 16-bit samples
 	pkt.SoundType = tmp & 0x01        // 音频类型 0 = Mono sound or 1 = Stereo sound
 
+	s.publishAudio(pkt)
+}
+
+// 发布者的视频Tag和音频Tag. 在发布者的消息循环里面设置, 在广播的 goroutine 里面读(备用的发布者和正在发布的一起收消息), lock 保护.
+func (s *RtmpNetStream) tags() (videoTag, audioTag *AVPacket) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.videoTag, s.audioTag
+}
+
+func (s *RtmpNetStream) setVideoTag(pkt *AVPacket) {
+	s.lock.Lock()
+	s.videoTag = pkt
+	s.lock.Unlock()
+}
+
+// 发布者最新的 onMetaData 的副本, 播放者的 goroutine 会读, 调用者可以修改时间戳. 没有的时候返回 nil.
+func (s *RtmpNetStream) metadata() *AVPacket {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.metaData == nil {
+		return nil
+	}
+
+	return s.metaData.Clone()
+}
+
+func (s *RtmpNetStream) setMetadata(pkt *AVPacket) {
+	s.lock.Lock()
+	s.metaData = pkt
+	s.lock.Unlock()
+}
+
+// 发布者的音频, RTMP 和 FLV(PublishFLV) 的发布者一样处理
+func (s *RtmpNetStream) publishAudio(pkt *AVPacket) {
 	if s.audioTag == nil { // (AAC Header(2 Bytes) + AAC sequence Header(2 Bytes))
+		s.lock.Lock()
 		s.audioTag = pkt
+		s.lock.Unlock()
 	} else {
-		s.audiochan <- pkt
+		s.push(s.audiochan, pkt)
 	}
 }
 
 func videoMessageHandle(s *RtmpNetStream, video *VideoMessage) {
 	pkt := new(AVPacket)
-	if video.RtmpHeader.ChunkMessgaeHeader.Timestamp == 0xffffff {
-		s.total_duration += video.RtmpHeader.ChunkExtendedTimestamp.ExtendTimestamp
-		pkt.Timestamp = s.total_duration
-	} else {
-		s.total_duration += video.RtmpHeader.ChunkMessgaeHeader.Timestamp
-		pkt.Timestamp = s.total_duration
-	}
+	pkt.chunks = newChunkCache()
+	pkt.Timestamp = s.recvTimestamp(video.RtmpHeader)
 
 	pkt.Type = video.RtmpHeader.ChunkMessgaeHeader.MessageTypeID
 	pkt.Payload = video.RtmpBody.Payload
+	pkt.buffer = video.RtmpBody.buffer
 
 	//fmt.Println("recv video time stamp:", pkt.Timestamp)
 
 	// Video = Tag + Payload
 	// Video Tag (1 byte) == FrameType(4 bits) + CodecID(4 bits),发送为avc数据,所以CodecID为7.
 	// Video Payload = AVCPacketType(1 Byte) + CompositionTime(3 Byte) + AVCDecoderConfigurationRecord
+	// Enhanced RTMP: IsExHeader(1) + FrameType(3) + PacketType(4) + FourCC(32) + ...
 	// NALU类型 & 0001 1111 == 5 就是I帧
 	// NALU类型在 00 00 00 01 分割之后的下一个字节
-	tmp := pkt.Payload[0]         // 第一个字节保存着视频的相关信息.
-	pkt.VideoFrameType = tmp >> 4 // 帧类型 4Bit, H264一般为1或者2
-	pkt.VideoCodecID = tmp & 0x0f // 编码类型ID 4Bit, JPEG, H263, AVC...
+	if err := pkt.decodeVideoTagHeader(); err != nil {
+		fmt.Println("video tag header decode error :", err)
+		pkt.release()
+		return
+	}
+
+	s.publishVideo(pkt)
+}
+
+// 发布者的视频, RTMP 和 FLV(PublishFLV) 的发布者一样处理
+func (s *RtmpNetStream) publishVideo(pkt *AVPacket) {
+	// sequence header 作为视频Tag, 播放者开始播放的时候先发送视频Tag.
+	// 编码参数变化的时候推流端会重新发送 sequence header, 需要转发给已经在播放的播放者.
+	if pkt.isVideoSequenceHeader() {
+		first := s.videoTag == nil
+		s.setVideoTag(pkt)
+
+		if !first {
+			s.push(s.videochan, pkt.Clone())
+		}
+
+		return
+	}
 
 	if s.videoTag == nil {
-		s.videoTag = pkt
+		s.setVideoTag(pkt)
 	} else {
 		if pkt.VideoFrameType == 1 { // 关键帧
-			s.videoKeyFrame = pkt
+			if s.videoKeyFrame != nil {
+				s.videoKeyFrame.release()
+			}
+
+			s.videoKeyFrame = pkt.Clone()
 		}
 
-		s.videochan <- pkt
+		s.push(s.videochan, pkt)
+	}
+}
+
+// 聚集消息拆分成子消息之后, 和单独的音视频消息一样处理.
+// 子消息不符合 Limits 的时候返回 *ProtocolError, 和单独收到的消息一样关闭连接.
+func aggregateMessageHandle(s *RtmpNetStream, aggregate *AggregateMessage) error {
+	msgs, err := aggregate.subMessages(s.conn.limits.MaxAMFDepth)
+	if _, ok := err.(*ProtocolError); ok {
+		return err
+	} else if err != nil {
+		fmt.Println("aggregate message decode error :", err)
+	}
+
+	for _, msg := range msgs {
+		switch v := msg.(type) {
+		case *AudioMessage:
+			{
+				audioMessageHandle(s, v)
+			}
+		case *VideoMessage:
+			{
+				videoMessageHandle(s, v)
+			}
+		case *MetadataMessage:
+			{
+				metadataMessageHandle(s, v)
+			}
+		default:
+			{
+				fmt.Println("Other Aggregate Sub Message :", v)
+			}
+		}
 	}
+	return nil
 }
 
+// 数据消息转发给播放者, 时间戳是数据消息自己的时间戳, 和音视频在同一个通道里面保持顺序.
+// @setDataFrame 去掉之后保存为最新的 onMetaData, @clearDataFrame 清除保存的 onMetaData.
 func metadataMessageHandle(s *RtmpNetStream, mete *MetadataMessage) {
-	pkt := new(AVPacket)
-	pkt.Timestamp = mete.RtmpHeader.ChunkMessgaeHeader.Timestamp
+	name, payload := mete.unwrapDataFrame()
+	timestamp := s.recvTimestamp(mete.RtmpHeader)
 
-	if mete.RtmpHeader.ChunkMessgaeHeader.Timestamp == 0xffffff {
-		pkt.Timestamp = mete.RtmpHeader.ChunkExtendedTimestamp.ExtendTimestamp
+	if mete.Name == Data_ClearDataFrame {
+		s.setMetadata(nil)
+		return
+	}
+
+	if len(payload) == 0 {
+		return
 	}
 
+	pkt := new(AVPacket)
+	pkt.Timestamp = timestamp
 	pkt.Type = mete.RtmpHeader.ChunkMessgaeHeader.MessageTypeID
-	pkt.Payload = mete.RtmpBody.Payload
+	pkt.Payload = payload
 
-	if s.metaData == nil {
-		s.metaData = pkt
+	if name == Data_OnMetaData {
+		s.setMetadata(pkt)
+	}
+
+	// 没有视频的时候和音频在同一个通道里面
+	if s.videoTag != nil {
+		s.push(s.videochan, pkt)
+	} else {
+		s.push(s.audiochan, pkt)
+	}
+}
+
+// 发布者的音视频和数据消息发给广播. 发布者被接管之后广播不再读取, 连接关闭的时候不再等待.
+func (s *RtmpNetStream) push(ch chan *AVPacket, pkt *AVPacket) {
+	if ch == nil {
+		pkt.release()
+		return
+	}
+
+	select {
+	case ch <- pkt:
+		{
+		}
+	case <-s.conn.done:
+		{
+			pkt.release()
+		}
 	}
 }
 
+// 自定义命令, 调用注册的处理函数, 返回 _result 或者 _error. 事务ID为0的命令不需要回复.
+// 没有注册的命令回复 _error(Method not found), 客户端的 responder 不会一直等.
+func callMessageHandle(s *RtmpNetStream, call *CallMessage) error {
+	var result AMFObject
+	var err error
+
+	if h, ok := s.conn.server.callHandler(call.CommandName); ok {
+		result, err = invokeCallHandler(h, s.conn, call.Arguments)
+	} else {
+		err = errors.New(fmt.Sprintf("Method not found (%v)", call.CommandName))
+	}
+
+	if call.TransactionId == 0 {
+		return nil
+	}
+
+	m := newResponseCallMessage()
+	m.TransactionId = call.TransactionId
+
+	if err != nil {
+		info := newAMFObjects()
+		info["level"] = Level_Error
+		info["code"] = NetConnection_Call_Failed
+		info["description"] = err.Error()
+
+		m.CommandName = Response_Error
+		m.Response = info
+	} else {
+		m.CommandName = Response_Result
+		m.Response = result
+	}
+
+	return sendMessage(s.conn, SEND_CALL_RESPONSE_MESSAGE, m)
+}
+
+// 处理函数 panic 的时候返回 error, 不影响连接
+func invokeCallHandler(h CallHandler, conn *RtmpNetConnection, args []AMFObject) (result AMFObject, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = errors.New(fmt.Sprintf("%v", e))
+		}
+	}()
+
+	return h(conn, args)
+}
+
+// 在连接上创建一个新的流, 流ID在 _result 里面返回给客户端. 之后这个流上的消息的消息流ID都是这个流ID.
 func createStreamMessageHandle(s *RtmpNetStream, csmsg *CreateStreamMessage) error {
-	s.conn.streamID = s.conn.nextStreamID(csmsg.RtmpHeader.ChunkBasicHeader.ChunkStreamID)
-	return sendMessage(s.conn, SEND_CREATE_STREAM_RESPONSE_MESSAGE, csmsg.TransactionId)
+	ns, err := s.conn.createStream(s.serverHandler)
+	if err != nil {
+		return err
+	}
+
+	return sendStreamMessage(s.conn, ns.streamID, SEND_CREATE_STREAM_RESPONSE_MESSAGE, csmsg.TransactionId)
+}
+
+// deleteStream 在流0上面发送, 参数是要删除的流ID. 只删除这个流, 流0不能删除.
+func deleteStreamMessageHandle(s *RtmpNetStream, dsmsg *DeleteStreamMessage) {
+	if dsmsg.StreamId == 0 {
+		return
+	}
+
+	if ns := s.conn.stream(dsmsg.StreamId); ns != nil {
+		ns.deleteStream()
+	}
 }
 
 // 当发布者成功发布流后,服务器会接收到发布流的消息,然后进行消息广播
 func publishMessageHandle(s *RtmpNetStream, pbmsg *PublishMessage) error {
-	if strings.HasSuffix(s.conn.appName, "/") { // appName == "myapp"
-		s.streamPath = s.conn.appName + strings.Split(pbmsg.PublishingName, "?")[0] // PublishingName ==  myapp/mystream
-	} else {
-		s.streamPath = s.conn.appName + "/" + strings.Split(pbmsg.PublishingName, "?")[0] // s.streamPath == myapp/mystream
-	}
+	s.streamPath = joinStreamPath(s.conn.appName, pbmsg.PublishingName)
 
 	err := s.serverHandler.OnPublishing(s)
 	if err != nil {
 
-		prmdErr := newPublishResponseMessageData(s.conn.streamID, "error", err.Error())
+		prmdErr := newPublishResponseMessageData(s.streamID, err.Error(), Level_Error)
 
-		err = sendMessage(s.conn, SEND_PUBLISH_RESPONSE_MESSAGE, prmdErr) // 服务器端发送publish的响应消息.
+		err = s.sendMessage(SEND_PUBLISH_RESPONSE_MESSAGE, prmdErr) // 服务器端发送publish的响应消息.
 		if err != nil {
 			return err
 		}
@@ -729,14 +1276,14 @@ func publishMessageHandle(s *RtmpNetStream, pbmsg *PublishMessage) error {
 		return nil
 	}
 
-	err = sendMessage(s.conn, SEND_STREAM_BEGIN_MESSAGE, nil) // 服务器端发送另一个协议消息(用户控制),这一消息包含 'StreamBegin' 事件,来指示发送给客户端的流的起点
+	err = s.sendMessage(SEND_STREAM_BEGIN_MESSAGE, nil) // 服务器端发送另一个协议消息(用户控制),这一消息包含 'StreamBegin' 事件,来指示发送给客户端的流的起点
 	if err != nil {
 		return err
 	}
 
-	prmdStart := newPublishResponseMessageData(s.conn.streamID, NetStream_Publish_Start, Level_Status)
+	prmdStart := newPublishResponseMessageData(s.streamID, NetStream_Publish_Start, Level_Status)
 
-	err = sendMessage(s.conn, SEND_PUBLISH_START_MESSAGE, prmdStart) // 服务器端发送publish start的消息.
+	err = s.sendMessage(SEND_PUBLISH_START_MESSAGE, prmdStart) // 服务器端发送publish start的消息.
 	if err != nil {
 		return err
 	}
@@ -751,82 +1298,115 @@ func publishMessageHandle(s *RtmpNetStream, pbmsg *PublishMessage) error {
 }
 
 // 当订阅者成功订阅流后,服务器会接收到订阅流的消息
+// reset 为 true 的时候清空播放列表, 停止正在播放的流, 马上播放这个流.
+// reset 为 false 的时候排在播放列表后面, 前面的流播放完了再播放(rtmp_play.go).
 func playMessageHandle(s *RtmpNetStream, plmsg *PlayMessage) error {
-	if strings.HasSuffix(s.conn.appName, "/") { // appName == "myapp"
-		s.streamPath = s.conn.appName + strings.Split(plmsg.StreamName, "?")[0] // StreamName ==  myapp/mystream
-	} else {
-		s.streamPath = s.conn.appName + "/" + strings.Split(plmsg.StreamName, "?")[0] // s.streamPath == myapp/mystream
-	}
-
-	fmt.Println("stream path:", s.streamPath)
+	item := newPlayItem(s.conn.appName, strings.Split(plmsg.StreamName, "?")[0], plmsg.Start, plmsg.Duration)
 
 	s.conn.writeChunkSize = 512 //RTMP_MAX_CHUNK_SIZE
-	err := s.serverHandler.OnPlaying(s)
-	if err != nil {
-		prmdErr := newPlayResponseMessageData(s.conn.streamID, "error", err.Error())
 
-		err = sendMessage(s.conn, SEND_PLAY_RESPONSE_MESSAGE, prmdErr) // 服务器端发送play response的消息
-		if err != nil {
-			return err
-		}
-	}
-
-	err = sendMessage(s.conn, SEND_CHUNK_SIZE_MESSAGE, uint32(s.conn.writeChunkSize)) // 服务器端发送设置块大小的消息
+	err := sendMessage(s.conn, SEND_CHUNK_SIZE_MESSAGE, uint32(s.conn.writeChunkSize)) // 服务器端发送设置块大小的消息
 	if err != nil {
 		return err
 	}
 
-	err = sendMessage(s.conn, SEND_STREAM_IS_RECORDED_MESSAGE, nil) // 服务器端发送另一个协议消息(用户控制),这个消息中定义了 'StreamIsRecorded' 事件和流 ID.消息在前两个字节中保存事件类型,在后四个字节中保存流 ID
-	if err != nil {
-		return err
+	if !plmsg.Rest {
+		if s.queue(item) {
+			return s.play(item)
+		}
+
+		fmt.Println("stream path:", item.streamPath, "queued")
+		return nil
 	}
 
-	sendMessage(s.conn, SEND_STREAM_BEGIN_MESSAGE, nil) // 服务器端发送另一个协议消息(用户控制),这一消息包含 'StreamBegin' 事件,来指示发送给客户端的流的起点
-	if err != nil {
-		return err
+	if old := s.resetPlaylist(item); old != nil {
+		s.stopItem(old)
 	}
 
-	prmdReset := newPlayResponseMessageData(s.conn.streamID, NetStream_Play_Reset, Level_Status)
+	prmdReset := newPlayStatusData(s.streamID, NetStream_Play_Reset, Level_Status, "Playing and resetting "+item.name, item.name)
 
-	err = sendMessage(s.conn, SEND_PLAY_RESPONSE_MESSAGE, prmdReset) // 服务端发送Play Reset消息,服务端发送只有当客户端发送的播放命令设置了reset命令的条件下,服务端才发送NetStream.Play.reset消息.
+	err = s.sendMessage(SEND_PLAY_RESPONSE_MESSAGE, prmdReset) // 服务端发送Play Reset消息,服务端发送只有当客户端发送的播放命令设置了reset命令的条件下,服务端才发送NetStream.Play.reset消息.
 	if err != nil {
 		return err
 	}
 
-	prmdStart := newPlayResponseMessageData(s.conn.streamID, NetStream_Play_Start, Level_Status)
+	return s.play(item)
+}
 
-	err = sendMessage(s.conn, SEND_PLAY_RESPONSE_MESSAGE, prmdStart) // 服务端发送Play Start消息
-	if err != nil {
-		return err
+// 流路径 appName/name, name 去掉 ? 后面的参数. 例如 rtmp://192.168.2.1/myapp/mystream, 流路径是 myapp/mystream
+func joinStreamPath(appName, name string) string {
+	name = strings.Split(name, "?")[0]
+
+	if strings.HasSuffix(appName, "/") { // appName == "myapp/"
+		return appName + name
 	}
 
-	if s.mode == 0 {
-		s.mode = 2
-	} else {
-		s.mode = s.mode | 2
+	return appName + "/" + name
+}
+
+// releaseStream, FCPublish, FCUnpublish 的事务ID不为0的时候回复 _result(null, null)
+func sendCommandResult(s *RtmpNetStream, tid uint64) error {
+	if tid == 0 {
+		return nil
 	}
 
-	return nil
+	m := newResponseCallMessage()
+	m.CommandName = Response_Result
+	m.TransactionId = tid
+
+	return sendMessage(s.conn, SEND_CALL_RESPONSE_MESSAGE, m)
+}
+
+// 推流端 publish 之前释放这个流名字. 正在发布的流不能被释放(停止发布用 FCUnpublish), 只回复 _result.
+func releaseStreamMessageHandle(s *RtmpNetStream, rsmsg *ReleaseStreamMessage) error {
+	return sendCommandResult(s, rsmsg.TransactionId)
 }
 
 // 客户端应该在发送FCPublishMessage消息的时候,就指定一个回调函数onFCPublish,来处理服务器返回的信息.
 // 如果服务器发送NetStream.Publish.Start的消息给客户端,那么客户端可以开始推流了.
 // 反之,如果发送NetStream.Publish.BadName的消息给客户端,那么客户端应该在回调函数onFCPublish中作出相应的处理.
 func fcPublishMessageHandle(s *RtmpNetStream, fcpmsg *FCPublishMessage) (err error) {
-	return
+	if err = sendCommandResult(s, fcpmsg.TransactionId); err != nil {
+		return
+	}
+
+	resData := newAMFObjects()
+	resData["code"] = NetStream_Publish_Start
+	resData["description"] = fcpmsg.StreamName
+
+	// 别人正在发布这个流并且不能接管或者作为备用, publish 的时候也会返回 NetStream.Publish.BadName
+	streamPath := joinStreamPath(s.conn.appName, fcpmsg.StreamName)
+	if _, ok := config.LiveFailover[streamPath]; ok {
+		resData["code"] = NetStream_Publish_BadName
+		resData["level"] = Level_Error
+	} else if d, ok := find_broadcast(broadcast_path(streamPath)); ok && !d.canPublish(streamPath, config.Republish(s.conn.appName)) {
+		resData["code"] = NetStream_Publish_BadName
+		resData["level"] = Level_Error
+	}
+
+	return sendMessage(s.conn, SEND_FCPUBLISH_RESPONSE_MESSAGE, resData)
 }
 
 // 客户端应该在发送FCUnpublishMessage消息的时候,就指定一个回调函数onFCUnpublish,来处理服务器返回的信息.
 // 如果服务器发送NetStream.Unpublish.Success的消息给客户端,表示服务器已经取消了该流的发布.客户端可以继续进行其他操作了.
+// 连接上发布这个流的流停止发布(和 closeStream 一样), 播放者收到 NetStream.Play.UnpublishNotify.
 func fcUnPublishMessageHandle(s *RtmpNetStream, fcunpmsg *FCUnpublishMessage) (err error) {
-	// resData := newAMFObjects()
-	// resData["code"] = NetStream_Unpublish_Success
-	// resData["level"] = Level_Status
-	// resData["streamid"] = conn.streamID
-	// err = sendMessage(conn, SEND_UNPUBLISH_RESPONSE_MESSAGE, resData)
-	// if err != nil {
-	// 	return
-	// }
+	if err = sendCommandResult(s, fcunpmsg.TransactionId); err != nil {
+		return
+	}
+
+	resData := newAMFObjects()
+	resData["code"] = NetStream_Unpublish_Success
+	resData["description"] = fcunpmsg.StreamName
+
+	err = sendMessage(s.conn, SEND_FCUNPUBLISH_RESPONSE_MESSAGE, resData)
+	if err != nil {
+		return
+	}
+
+	if ns := s.conn.publishingStream(joinStreamPath(s.conn.appName, fcunpmsg.StreamName)); ns != nil {
+		return ns.closeStream()
+	}
 
 	return
 }
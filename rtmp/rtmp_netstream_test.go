@@ -0,0 +1,83 @@
+package rtmp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// 处理一个自定义命令, 返回服务器回复的命令名, 事务ID 和返回值. 没有回复的时候 name 为空.
+func callTest(t *testing.T, srv *Server, command string, tid uint64, args ...AMFObject) (name string, id float64, response AMFObject) {
+	w := &bytes.Buffer{}
+	s := newNetStream(newRtmpNetConnect(&bufConn{w}, srv), new(DefaultServerHandler))
+
+	call := newCallMessage()
+	call.CommandName = command
+	call.TransactionId = tid
+	call.Arguments = args
+
+	if err := callMessageHandle(s, call); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Len() == 0 {
+		return
+	}
+
+	msg, err := readChunk(newRtmpNetConnect(&bufConn{w}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 命令名 + 事务ID + null + 返回值
+	objs, err := newAMFDecoder(msg.Body().Payload).readObjects()
+	if err != nil || len(objs) != 4 {
+		t.Fatalf("response %v, error %v", objs, err)
+	}
+
+	name, _ = objs[0].(string)
+	id, _ = objs[1].(float64)
+	return name, id, objs[3]
+}
+
+func TestCallMessageResult(t *testing.T) {
+	srv := new(Server)
+	srv.HandleCall("add", func(conn *RtmpNetConnection, args []AMFObject) (AMFObject, error) {
+		return args[0].(float64) + args[1].(float64), nil
+	})
+
+	name, id, response := callTest(t, srv, "add", 5, float64(1), float64(2))
+	if name != Response_Result || id != 5 || response != float64(3) {
+		t.Fatalf("%v %v %v", name, id, response)
+	}
+
+	// 事务ID为0的时候不回复
+	if name, _, _ = callTest(t, srv, "add", 0, float64(1), float64(2)); name != "" {
+		t.Fatalf("response %v to transaction 0", name)
+	}
+}
+
+func TestCallMessageError(t *testing.T) {
+	srv := new(Server)
+	srv.HandleCall("fail", func(conn *RtmpNetConnection, args []AMFObject) (AMFObject, error) {
+		return nil, errors.New("failed")
+	})
+
+	name, id, response := callTest(t, srv, "fail", 6)
+	info, _ := response.(AMFObjects)
+	if name != Response_Error || id != 6 || info["code"] != NetConnection_Call_Failed || info["description"] != "failed" {
+		t.Fatalf("%v %v %v", name, id, response)
+	}
+}
+
+func TestCallMessageUnknown(t *testing.T) {
+	name, id, response := callTest(t, new(Server), "unknown", 7)
+	info, _ := response.(AMFObjects)
+	if name != Response_Error || id != 7 || info["code"] != NetConnection_Call_Failed || info["description"] != "Method not found (unknown)" {
+		t.Fatalf("%v %v %v", name, id, response)
+	}
+
+	if name, _, _ = callTest(t, new(Server), "unknown", 0); name != "" {
+		t.Fatalf("response %v to transaction 0", name)
+	}
+}
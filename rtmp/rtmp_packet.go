@@ -1,6 +1,8 @@
 package rtmp
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 
 	"github.com/sevenzoe/gortmp/avformat"
@@ -12,8 +14,11 @@ type AVPacket struct {
 	Type      byte //8 audio,9 video
 
 	// Video
-	VideoFrameType byte //4bit
-	VideoCodecID   byte //4bit
+	VideoFrameType  byte    //4bit, Enhanced RTMP 为3bit
+	VideoCodecID    byte    //4bit, Enhanced RTMP 没有CodecID, hvc1 转换成 12(HEVC)
+	VideoIsExHeader bool    //1bit, Enhanced RTMP
+	VideoPacketType byte    //AVCPacketType(8bit), Enhanced RTMP 为 PacketType(4bit)
+	VideoFourCC     [4]byte //Enhanced RTMP FourCC, av01, vp09, hvc1
 
 	// Audio
 	SoundFormat byte //4bit
@@ -22,6 +27,9 @@ type AVPacket struct {
 	SoundType   byte //1bit
 
 	Payload []byte
+
+	chunks *chunkCache    // 分块之后的负载, Clone 之后共享
+	buffer *payloadBuffer // Payload 从池里面分配的时候不为 nil, Clone 之后共享
 }
 
 func (av *AVPacket) Clone() *AVPacket {
@@ -32,6 +40,9 @@ func (av *AVPacket) Clone() *AVPacket {
 	// Video
 	pkt.VideoFrameType = av.VideoFrameType
 	pkt.VideoCodecID = av.VideoCodecID
+	pkt.VideoIsExHeader = av.VideoIsExHeader
+	pkt.VideoPacketType = av.VideoPacketType
+	pkt.VideoFourCC = av.VideoFourCC
 
 	// Auido
 	pkt.SoundFormat = av.SoundFormat
@@ -40,13 +51,31 @@ func (av *AVPacket) Clone() *AVPacket {
 	pkt.SoundType = av.SoundType
 
 	pkt.Payload = av.Payload
+	pkt.chunks = av.chunks
+	pkt.buffer = av.buffer
+
+	if pkt.buffer != nil {
+		pkt.buffer.retain()
+	}
 
 	return pkt
 }
 
+// 不再使用 Payload 的时候调用, 所有 Clone 都 release 之后负载的缓冲区放回池里面.
+// 保存下来的包(例如 sequence header)不调用, 缓冲区由 GC 回收.
+func (av *AVPacket) release() {
+	if av.buffer != nil {
+		av.buffer.release()
+		av.buffer = nil
+		av.Payload = nil
+	}
+}
+
 func (av *AVPacket) String() string {
 	if av.Type == RTMP_MSG_AUDIO {
 		return fmt.Sprintf("Audio Packet Timestamp/%v Type/%v SoundFormat/%v SoundRate/%v SoundSize/%v SoundTypet/%v Payload/%v", av.Timestamp, av.Type, avformat.SoundFormat[av.SoundFormat], avformat.SoundRate[av.SoundRate], avformat.SoundSize[av.SoundSize], avformat.SoundType[av.SoundType], len(av.Payload))
+	} else if av.Type == RTMP_MSG_VIDEO && av.VideoIsExHeader {
+		return fmt.Sprintf("Video Packet Timestamp/%v Type/%v VideoFrameType/%v FourCC/%v PacketType/%v Payload/%v", av.Timestamp, av.Type, avformat.FrameType[av.VideoFrameType], avformat.VideoFourCC[av.VideoFourCC], avformat.VideoPacketType[av.VideoPacketType], len(av.Payload))
 	} else if av.Type == RTMP_MSG_VIDEO {
 		return fmt.Sprintf("Video Packet Timestamp/%v Type/%v VideoFrameType/%v VideoCodecID/%v Payload/%v", av.Timestamp, av.Type, avformat.FrameType[av.VideoFrameType], avformat.CodecID[av.VideoCodecID], len(av.Payload))
 	}
@@ -57,3 +86,104 @@ func (av *AVPacket) String() string {
 func (av *AVPacket) isKeyFrame() bool {
 	return av.VideoFrameType == 1 || av.VideoFrameType == 4
 }
+
+// Video Tag Header:
+// 传统FLV: FrameType(4) + CodecID(4) + AVCPacketType(8, 只有AVC和HEVC才有)
+// Enhanced RTMP: IsExHeader(1) + FrameType(3) + PacketType(4) + FourCC(32)
+func (av *AVPacket) decodeVideoTagHeader() (err error) {
+	if len(av.Payload) < 1 {
+		err = errors.New("video packet length < 1")
+		return
+	}
+
+	tmp := av.Payload[0] // 第一个字节保存着视频的相关信息.
+
+	if tmp&avformat.FLV_VIDEO_EX_HEADER == 0 {
+		av.VideoFrameType = tmp >> 4 // 帧类型 4Bit, H264一般为1或者2
+		av.VideoCodecID = tmp & 0x0f // 编码类型ID 4Bit, JPEG, H263, AVC...
+
+		if (av.VideoCodecID == avformat.FLV_CODECID_AVC || av.VideoCodecID == avformat.FLV_CODECID_HEVC) && len(av.Payload) > 1 {
+			av.VideoPacketType = av.Payload[1]
+		}
+
+		return
+	}
+
+	if len(av.Payload) < 5 {
+		err = errors.New("enhanced rtmp video packet length < 5")
+		return
+	}
+
+	av.VideoIsExHeader = true
+	av.VideoFrameType = (tmp >> 4) & 0x07
+	av.VideoPacketType = tmp & 0x0f
+	copy(av.VideoFourCC[:], av.Payload[1:5])
+
+	switch av.VideoFourCC {
+	case avformat.FOURCC_HEVC:
+		{
+			av.VideoCodecID = avformat.FLV_CODECID_HEVC
+		}
+	case avformat.FOURCC_AV1, avformat.FOURCC_VP9:
+		{
+			av.VideoCodecID = 0
+		}
+	default:
+		{
+			err = errors.New(fmt.Sprintf("%s, fourcc=%q", "unsupport enhanced rtmp video fourcc", av.VideoFourCC[:]))
+		}
+	}
+
+	return
+}
+
+// AVC/HEVC sequence header 或者 Enhanced RTMP SequenceStart
+func (av *AVPacket) isVideoSequenceHeader() bool {
+	if av.VideoIsExHeader {
+		return av.VideoPacketType == avformat.FLV_EX_PACKET_TYPE_SEQUENCE_START
+	}
+
+	return (av.VideoCodecID == avformat.FLV_CODECID_AVC || av.VideoCodecID == avformat.FLV_CODECID_HEVC) &&
+		av.VideoPacketType == avformat.AVC_PACKET_TYPE_SEQUENCE_HEADER
+}
+
+// Enhanced RTMP MetadataFrame(比如 HDR colorInfo), AMF编码, 不是视频帧
+func (av *AVPacket) isVideoMetadata() bool {
+	return av.VideoIsExHeader && av.VideoPacketType == avformat.FLV_EX_PACKET_TYPE_METADATA
+}
+
+// AAC sequence header (AudioSpecificConfig), AACPacketType == 0
+func (av *AVPacket) isAACSequenceHeader() bool {
+	return av.SoundFormat == 10 && len(av.Payload) > 1 && av.Payload[1] == 0
+}
+
+// 把 Enhanced RTMP 的 hvc1 视频包转换成传统的 CodecID(12) 格式, 给不支持 Enhanced RTMP 的播放者.
+// 其他 FourCC 没有对应的传统格式, 原样返回.
+func (av *AVPacket) toLegacyVideoPacket() (pkt *AVPacket, err error) {
+	if !av.VideoIsExHeader || av.VideoFourCC != avformat.FOURCC_HEVC || av.isVideoMetadata() {
+		return av, nil
+	}
+
+	var packetType byte
+	var cts int32
+	var index int
+
+	if packetType, cts, index, err = rtmpVideoPacketHeader(av); err != nil {
+		return
+	}
+
+	bw := &bytes.Buffer{}
+	bw.WriteByte(av.VideoFrameType<<4 | avformat.FLV_CODECID_HEVC)
+	bw.WriteByte(packetType)
+	bw.Write([]byte{byte(cts >> 16), byte(cts >> 8), byte(cts)})
+	bw.Write(av.Payload[index:])
+
+	pkt = av.Clone()
+	pkt.release() // 转换之后的负载是新分配的
+	pkt.VideoIsExHeader = false
+	pkt.VideoPacketType = packetType
+	pkt.VideoFourCC = [4]byte{}
+	pkt.Payload = bw.Bytes()
+
+	return
+}
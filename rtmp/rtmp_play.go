@@ -0,0 +1,449 @@
+package rtmp
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/sevenzoe/gortmp/config"
+	"github.com/sevenzoe/gortmp/util"
+)
+
+// 播放列表里面的一项, 每个 play 命令一项.
+// reset 为 false 的 play 命令排在播放列表后面, 前面的流播放完了(duration 到了或者录制的流播放完了)再播放.
+type playItem struct {
+	name       string           // 流名字, 去掉了 ? 后面的参数
+	streamPath string           // appName/name, 和发布者的流路径一样
+	start      float64          // 秒, -2: 直播或者录制, -1: 只播放直播, >=0: 从这个位置播放录制的流
+	duration   float64          // 秒, <0: 一直播放, 0: 只播放一帧, >0: 播放这么长时间
+	live       bool             // 播放的是直播流, 停止的时候从广播里面取消订阅
+	ended      bool             // 直播流播放了 duration, 等消息循环播放下一项, 不再发送音视频
+	stop       chan struct{}    // 停止播放, 录制的流停止读文件
+	done       chan struct{}    // 录制的流读文件的 goroutine 退出的时候关闭, nil 表示没有读文件
+	control    chan playControl // 录制的流的暂停和 seek, 在读文件的 goroutine 里面处理
+}
+
+// 播放者的控制, 发送给读文件的 goroutine. 直播流不需要, 发送音视频的时候检查 paused, noAudio, noVideo.
+type playControl struct {
+	kind   string // "pause", "seek"
+	flag   bool   // pause: true 暂停, false 恢复
+	offset uint32 // seek: 毫秒
+}
+
+func newPlayItem(appName, name string, start, duration float64) (item *playItem) {
+	item = new(playItem)
+	item.name = name
+	item.start = start
+	item.duration = duration
+	item.stop = make(chan struct{})
+	item.control = make(chan playControl, 4)
+	item.streamPath = joinStreamPath(appName, name)
+
+	return
+}
+
+// 录制的流是 ResourceVodPath 下面的 FLV 文件, 没有扩展名的时候加上 .flv
+func (item *playItem) file() string {
+	name := path.Clean("/" + strings.TrimPrefix(item.name, "flv:")) // 不能访问 vod 目录外面的文件
+	if path.Ext(name) == "" {
+		name += ".flv"
+	}
+
+	return config.ResourceVodPath + name
+}
+
+func (item *playItem) recorded() bool {
+	return util.Exist(item.file())
+}
+
+// 毫秒
+func (item *playItem) limit() uint32 {
+	return uint32(item.duration * 1000)
+}
+
+func newPlayStatusData(streamid uint32, code, level, description, details string) (amfobj AMFObjects) {
+	amfobj = newPlayResponseMessageData(streamid, code, level)
+	amfobj["description"] = description
+	amfobj["details"] = details
+
+	return
+}
+
+// 清空播放列表, item 马上开始播放. 返回正在播放的流, 需要停止.
+func (s *RtmpNetStream) resetPlaylist(item *playItem) (old *playItem) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	old = s.playing
+	s.playing = item
+	s.playlist = nil
+	s.paused = false
+
+	return
+}
+
+// 排在播放列表后面. 返回 true 表示现在没有在播放, item 马上开始播放.
+func (s *RtmpNetStream) queue(item *playItem) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.playing == nil && !s.closed {
+		s.playing = item
+		return true
+	}
+
+	s.playlist = append(s.playlist, item)
+	return false
+}
+
+// item 播放完了, 从播放列表里面取出下一项. 返回 false 表示 item 已经停止了(reset, closeStream ...)
+func (s *RtmpNetStream) next(item *playItem) (next *playItem, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.playing != item {
+		return nil, false
+	}
+
+	if len(s.playlist) > 0 {
+		next = s.playlist[0]
+		s.playlist = s.playlist[1:]
+	}
+
+	s.playing = next
+	return next, true
+}
+
+// 停止播放. 直播流从广播里面取消订阅, 录制的流停止读文件, 等读文件的 goroutine 退出之后才返回.
+func (s *RtmpNetStream) stopItem(item *playItem) {
+	close(item.stop)
+
+	s.lock.Lock()
+	done := item.done
+	s.lock.Unlock()
+
+	if done != nil {
+		<-done
+	}
+
+	if item.live {
+		if d, ok := find_broadcast(item.streamPath); ok {
+			d.removeSubscriber(s)
+		}
+	}
+}
+
+// 播放一项. -2 和 -1 先找直播流, -2 没有直播流的时候播放录制的流, >=0 只播放录制的流.
+func (s *RtmpNetStream) play(item *playItem) (err error) {
+	fmt.Println("stream path:", item.streamPath, "start:", item.start, "duration:", item.duration)
+
+	s.streamPath = item.streamPath
+	s.vkfsended = false // 每一项都从关键帧开始发送, 时间戳从0开始
+	s.akfsended = false
+	s.based = false
+	s.rebase = 0
+
+	if s.mode == 0 {
+		s.mode = 2
+	} else {
+		s.mode = s.mode | 2
+	}
+
+	if item.start < 0 {
+		if err = s.serverHandler.OnPlaying(s); err == nil {
+			s.lock.Lock()
+			item.live = true
+			s.lock.Unlock()
+
+			return s.startItem(item)
+		}
+
+		// 只有找不到直播流的时候才播放录制的流, 其他的错误(比如没有权限)不能绕过
+		if item.start == RTMP_PLAY_START_LIVE || !errors.Is(err, ErrStreamNotFound) || !item.recorded() {
+			return s.playFailed(item, err)
+		}
+	} else if !item.recorded() {
+		return s.playFailed(item, ErrStreamNotFound)
+	}
+
+	err = s.sendMessage(SEND_STREAM_IS_RECORDED_MESSAGE, nil) // 服务器端发送另一个协议消息(用户控制),这个消息中定义了 'StreamIsRecorded' 事件和流 ID.消息在前两个字节中保存事件类型,在后四个字节中保存流 ID
+	if err != nil {
+		return err
+	}
+
+	if err = s.startItem(item); err != nil {
+		return err
+	}
+
+	// 已经停止了(连接关闭)就不读文件了
+	s.lock.Lock()
+	select {
+	case <-item.stop:
+		{
+			s.lock.Unlock()
+			return nil
+		}
+	default:
+		{
+			item.done = make(chan struct{})
+		}
+	}
+	s.lock.Unlock()
+
+	go s.playFile(item)
+
+	return nil
+}
+
+// 开始播放: StreamBegin, NetStream.Play.Start. 直播流的 duration 在发送音视频的时候检查(played).
+func (s *RtmpNetStream) startItem(item *playItem) (err error) {
+	err = s.sendMessage(SEND_STREAM_BEGIN_MESSAGE, nil) // 服务器端发送另一个协议消息(用户控制),这一消息包含 'StreamBegin' 事件,来指示发送给客户端的流的起点
+	if err != nil {
+		return err
+	}
+
+	prmdStart := newPlayStatusData(s.streamID, NetStream_Play_Start, Level_Status, "Started playing "+item.name, item.name)
+
+	err = s.sendMessage(SEND_PLAY_RESPONSE_MESSAGE, prmdStart) // 服务端发送Play Start消息
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// 直播流发送了 timestamp(毫秒, 播放者的时间线)的音视频, duration 到了就停止发送,
+// 在流的消息循环里面播放下一项. duration 为 0 的时候只发送一帧. 在广播的 goroutine 里面调用.
+func (s *RtmpNetStream) played(timestamp uint32) {
+	s.lock.Lock()
+	item := s.playing
+	end := item != nil && item.live && !item.ended && item.duration >= 0 && timestamp >= item.limit()
+	if end {
+		item.ended = true
+	}
+	s.lock.Unlock()
+
+	if end {
+		s.conn.post(func() { s.finishItem(item) })
+	}
+}
+
+// 播放失败(比如 StreamNotFound), 接着播放播放列表里面的下一项
+func (s *RtmpNetStream) playFailed(item *playItem, e error) (err error) {
+	code := e.Error()
+	if !strings.HasPrefix(code, "NetStream.Play.") {
+		code = NetStream_Play_Failed
+	}
+
+	prmdErr := newPlayStatusData(s.streamID, code, Level_Error, e.Error(), item.name)
+
+	err = s.sendMessage(SEND_PLAY_RESPONSE_MESSAGE, prmdErr) // 服务器端发送play response的消息
+	if err != nil {
+		return err
+	}
+
+	next, ok := s.next(item)
+	if !ok {
+		return nil
+	}
+
+	s.stopItem(item)
+
+	if next != nil {
+		return s.play(next)
+	}
+
+	return nil
+}
+
+// item 播放完了(duration 到了, 录制的流读完了), 接着播放播放列表里面的下一项, 播放列表空了就发送 NetStream.Play.Stop
+func (s *RtmpNetStream) finishItem(item *playItem) {
+	next, ok := s.next(item)
+	if !ok {
+		return
+	}
+
+	s.stopItem(item)
+
+	if err := s.endItem(item, next); err != nil {
+		s.serverHandler.OnError(s, err)
+	}
+}
+
+func (s *RtmpNetStream) endItem(item, next *playItem) (err error) {
+	if !item.live {
+		complete := newPlayStatusData(s.streamID, NetStream_Play_Complete, Level_Status, "", item.name)
+		if err = s.sendMessage(SEND_PLAY_STATUS_MESSAGE, complete); err != nil {
+			return
+		}
+	}
+
+	if next != nil {
+		switched := newPlayStatusData(s.streamID, NetStream_Play_Switch, Level_Status, "", next.name)
+		if err = s.sendMessage(SEND_PLAY_STATUS_MESSAGE, switched); err != nil {
+			return
+		}
+
+		return s.play(next)
+	}
+
+	if err = s.sendMessage(SEND_STREAM_EOF_MESSAGE, nil); err != nil {
+		return
+	}
+
+	prmdStop := newPlayStatusData(s.streamID, NetStream_Play_Stop, Level_Status, "Stopped playing "+item.name, item.name)
+
+	return s.sendMessage(SEND_PLAY_RESPONSE_MESSAGE, prmdStop)
+}
+
+// 直播流的广播结束了(发布者停止发布之后没有重新发布), 和播放完了一样. 在广播的 goroutine 里面调用, 在流的消息循环里面播放下一项.
+func (s *RtmpNetStream) finishLive(streamPath string) {
+	s.lock.Lock()
+	item := s.playing
+	live := item != nil && item.live
+	s.lock.Unlock()
+
+	if live && item.streamPath == streamPath {
+		s.conn.post(func() { s.finishItem(item) })
+	}
+}
+
+// 发布者停止发布: StreamEOF, NetStream.Play.UnpublishNotify. 在广播的 goroutine 里面调用.
+func (s *RtmpNetStream) unpublishNotify() (err error) {
+	s.vkfsended = false
+	s.akfsended = false
+
+	if err = s.sendMessage(SEND_STREAM_EOF_MESSAGE, nil); err != nil {
+		return
+	}
+
+	name := s.playingName()
+	prmd := newPlayStatusData(s.streamID, NetStream_Play_UnpublishNotify, Level_Status, name+" is now unpublished.", name)
+
+	return s.sendMessage(SEND_PLAY_RESPONSE_MESSAGE, prmd)
+}
+
+// 重新发布: StreamBegin, NetStream.Play.PublishNotify. 从新的发布者的关键帧开始发送, 时间戳接着以前的.
+func (s *RtmpNetStream) publishNotify() (err error) {
+	s.rebaseTimeline()
+
+	if err = s.sendMessage(SEND_STREAM_BEGIN_MESSAGE, nil); err != nil {
+		return
+	}
+
+	name := s.playingName()
+	prmd := newPlayStatusData(s.streamID, NetStream_Play_PublishNotify, Level_Status, name+" is now published.", name)
+
+	return s.sendMessage(SEND_PLAY_RESPONSE_MESSAGE, prmd)
+}
+
+func (s *RtmpNetStream) playingName() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.playing != nil {
+		return s.playing.name
+	}
+
+	return ""
+}
+
+// 播放录制的流, 播放完了在流的消息循环里面播放播放列表里面的下一项
+func (s *RtmpNetStream) playFile(item *playItem) {
+	err := s.sendFile(item)
+	close(item.done)
+
+	if err != nil {
+		s.serverHandler.OnError(s, err)
+		return
+	}
+
+	s.conn.post(func() { s.finishItem(item) })
+}
+
+// 暂停的时候直播流不发送, 恢复的时候从下一个关键帧开始发送. 录制的流暂停的时候停止读文件.
+func (s *RtmpNetStream) pause(pause bool) (err error) {
+	s.lock.Lock()
+	s.paused = pause
+	item := s.playing
+	s.lock.Unlock()
+
+	var name string
+	if item != nil {
+		name = item.name
+		s.control(item, playControl{kind: "pause", flag: pause})
+	}
+
+	prmd := newPlayStatusData(s.streamID, NetStream_Unpause_Notify, Level_Status, "Unpausing "+name, name)
+	if pause {
+		prmd = newPlayStatusData(s.streamID, NetStream_Pause_Notify, Level_Status, "Pausing "+name, name)
+	}
+
+	return s.sendMessage(SEND_PLAY_RESPONSE_MESSAGE, prmd)
+}
+
+// 录制的流 seek 到最接近的关键帧, 在读文件的 goroutine 里面发送 NetStream.Seek.Notify. 直播流不能 seek.
+func (s *RtmpNetStream) seek(offset uint32) (err error) {
+	s.lock.Lock()
+	item := s.playing
+	live := item != nil && item.live
+	s.lock.Unlock()
+
+	if item != nil && !live && s.control(item, playControl{kind: "seek", offset: offset}) {
+		return nil
+	}
+
+	var name string
+	if item != nil {
+		name = item.name
+	}
+
+	prmdErr := newPlayStatusData(s.streamID, NetStream_Seek_Failed, Level_Error, "Seek is not supported on live streams", name)
+
+	return s.sendMessage(SEND_PLAY_RESPONSE_MESSAGE, prmdErr)
+}
+
+// receiveAudio/receiveVideo, 对所有的播放列表项都有效. 重新接收视频的时候从关键帧开始发送.
+func (s *RtmpNetStream) receive(audio, flag bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if audio {
+		s.noAudio = !flag
+	} else {
+		s.noVideo = !flag
+	}
+}
+
+// 暂停, 是否接收音频, 是否接收视频. 直播流播放了 duration 和暂停一样.
+func (s *RtmpNetStream) receiving() (paused, audio, video bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ended := s.playing != nil && s.playing.ended
+
+	return s.paused || ended, !s.noAudio, !s.noVideo
+}
+
+// 控制发送给录制的流读文件的 goroutine, 返回 false 表示已经停止播放了
+func (s *RtmpNetStream) control(item *playItem, c playControl) bool {
+	s.lock.Lock()
+	live := item.live
+	s.lock.Unlock()
+
+	if live {
+		return true
+	}
+
+	select {
+	case item.control <- c:
+		{
+			return true
+		}
+	case <-item.stop:
+		{
+			return false
+		}
+	}
+}
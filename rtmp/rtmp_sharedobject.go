@@ -0,0 +1,748 @@
+package rtmp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sevenzoe/gortmp/amf"
+	"github.com/sevenzoe/gortmp/config"
+	"github.com/sevenzoe/gortmp/util"
+)
+
+// Remote Shared Object
+//
+// 共享对象消息(16, 19)的格式:
+// (AMF3的时候第一个字节为0) + Name(UTF-8, 2个字节的长度) + Version(4) + Flags(4, 2表示永久共享对象) + Reserved(4) + Events
+// Event = Type(1) + Length(4) + Data
+//
+// Data:
+// Use, Release, Clear, UseSuccess 没有数据
+// RequestChange, Change -> Name(UTF-8) + Value(AMF), 可以有多个
+// Success, Remove, RequestRemove -> Name(UTF-8)
+// SendMessage -> 方法名(AMF String) + 参数(AMF)
+// Status -> Code(UTF-8) + Level(UTF-8)
+//
+// 值用AMF0编码, AMF3(16)的时候用 AMF0_AVMPLUS_OBJECT 切换到AMF3, 和AMF3的命令消息一样.
+
+const (
+	SO_USE            = 1  // 客户端 -> 服务器, 连接共享对象
+	SO_RELEASE        = 2  // 客户端 -> 服务器, 断开共享对象
+	SO_REQUEST_CHANGE = 3  // 客户端 -> 服务器, 修改属性
+	SO_CHANGE         = 4  // 服务器 -> 客户端, 其他客户端修改了属性
+	SO_SUCCESS        = 5  // 服务器 -> 客户端, 修改属性成功
+	SO_SEND_MESSAGE   = 6  // 双向, 调用所有客户端的方法
+	SO_STATUS         = 7  // 服务器 -> 客户端, 错误或者警告
+	SO_CLEAR          = 8  // 服务器 -> 客户端, 清空所有属性
+	SO_REMOVE         = 9  // 服务器 -> 客户端, 删除属性
+	SO_REQUEST_REMOVE = 10 // 客户端 -> 服务器, 删除属性
+	SO_USE_SUCCESS    = 11 // 服务器 -> 客户端, 连接共享对象成功
+
+	SO_FLAG_PERSISTENT = 2
+	SO_HEADER_SIZE     = 12 // Version(4) + Flags(4) + Reserved(4)
+	SO_FILE_EXT        = ".so"
+)
+
+type SharedObjectEvent struct {
+	Type  byte
+	Key   string        // 属性名, SendMessage 的方法名, Status 的 code
+	Value interface{}   // 属性值, Status 的 level
+	Args  []interface{} // SendMessage 的参数
+}
+
+var (
+	sharedObjects     = make(map[string]*SharedObject)
+	sharedObjectsLock = new(sync.Mutex)
+)
+
+// 每个应用(appName)下面的共享对象按名字区分, 所有连接到这个共享对象的客户端共享同一份数据
+type SharedObject struct {
+	lock       *sync.Mutex
+	appName    string
+	name       string
+	persistent bool
+	version    uint32
+	data       map[string]interface{}
+	clients    map[*RtmpNetConnection]bool
+
+	// 写文件不持有 lock, 由 saveLock 保证顺序
+	saveLock     *sync.Mutex
+	saved        bool
+	savedVersion uint32 // 已经保存到文件的版本
+}
+
+// 要保存到文件的版本和编码之后的内容
+type soSnapshot struct {
+	version uint32
+	data    []byte
+}
+
+func newSharedObject(appName, name string, persistent bool) (so *SharedObject) {
+	so = new(SharedObject)
+	so.lock = new(sync.Mutex)
+	so.saveLock = new(sync.Mutex)
+	so.appName = appName
+	so.name = name
+	so.persistent = persistent
+	so.data = make(map[string]interface{})
+	so.clients = make(map[*RtmpNetConnection]bool)
+	return
+}
+
+func sharedObjectKey(appName, name string) string {
+	return appName + "/" + name
+}
+
+func findSharedObject(appName, name string) (so *SharedObject, ok bool) {
+	sharedObjectsLock.Lock()
+	defer sharedObjectsLock.Unlock()
+
+	so, ok = sharedObjects[sharedObjectKey(appName, name)]
+	return
+}
+
+//
+// Decode & Encode
+//
+
+func (msg *SharedObjectMessage) Decode() (err error) {
+	return msg.decode(RTMP_MAX_AMF_DEPTH)
+}
+
+// 连接上收到的共享对象消息在读消息的时候解码, AMF 的值嵌套的深度由 Limits.MaxAMFDepth 限制
+func (msg *SharedObjectMessage) decode(maxDepth int) (err error) {
+	payload := msg.RtmpBody.Payload
+
+	// AMF3 的时候第一个字节为0
+	if msg.ObjectEncoding == 3 {
+		if len(payload) == 0 {
+			return errors.New("shared object message length error")
+		}
+		payload = payload[1:]
+	}
+
+	r := bytes.NewReader(payload)
+
+	if msg.Name, err = readSOString(r); err != nil {
+		return
+	}
+
+	if r.Len() < SO_HEADER_SIZE {
+		return errors.New(fmt.Sprintf("shared object header error, %v/%v", r.Len(), SO_HEADER_SIZE))
+	}
+
+	header := make([]byte, SO_HEADER_SIZE)
+	r.Read(header)
+
+	msg.Version = util.BigEndian.Uint32(header)
+	msg.Persistent = util.BigEndian.Uint32(header[4:]) == SO_FLAG_PERSISTENT
+	msg.Events = nil
+
+	for r.Len() > 0 {
+		if r.Len() < 5 {
+			return errors.New(fmt.Sprintf("shared object event header error, %v/%v", r.Len(), 5))
+		}
+
+		b := make([]byte, 5)
+		r.Read(b)
+
+		t := b[0]
+		length := int(util.BigEndian.Uint32(b[1:]))
+		if length > r.Len() {
+			return errors.New(fmt.Sprintf("shared object event length error, %v/%v", length, r.Len()))
+		}
+
+		data := make([]byte, length)
+		r.Read(data)
+
+		var events []SharedObjectEvent
+		if events, err = decodeSOEvent(t, data, maxDepth); err == amf.ErrDepth {
+			return ErrAMFDepth
+		} else if err != nil {
+			return
+		}
+
+		msg.Events = append(msg.Events, events...)
+	}
+
+	return
+}
+
+func decodeSOEvent(t byte, data []byte, maxDepth int) (events []SharedObjectEvent, err error) {
+	r := bytes.NewReader(data)
+
+	switch t {
+	case SO_REQUEST_CHANGE, SO_CHANGE:
+		{
+			// 可以有多个属性
+			dec := amf.NewDecoder(r)
+			dec.SetMaxDepth(maxDepth)
+
+			for r.Len() > 0 {
+				e := SharedObjectEvent{Type: t}
+
+				if e.Key, err = readSOString(r); err != nil {
+					return
+				}
+
+				if e.Value, err = dec.DecodeValue(); err != nil {
+					return
+				}
+
+				events = append(events, e)
+			}
+
+			return
+		}
+	case SO_SUCCESS, SO_REMOVE, SO_REQUEST_REMOVE:
+		{
+			e := SharedObjectEvent{Type: t}
+			if e.Key, err = readSOString(r); err != nil {
+				return
+			}
+
+			return []SharedObjectEvent{e}, nil
+		}
+	case SO_SEND_MESSAGE:
+		{
+			dec := amf.NewDecoder(r)
+			dec.SetMaxDepth(maxDepth)
+
+			var vs []interface{}
+			for r.Len() > 0 {
+				var v interface{}
+				if v, err = dec.DecodeValue(); err != nil {
+					return
+				}
+
+				vs = append(vs, v)
+			}
+
+			if len(vs) == 0 {
+				err = errors.New("shared object send message no handler name")
+				return
+			}
+
+			e := SharedObjectEvent{Type: t, Args: vs[1:]}
+
+			var ok bool
+			if e.Key, ok = vs[0].(string); !ok {
+				err = errors.New(fmt.Sprintf("shared object send message handler name error, %v", vs[0]))
+				return
+			}
+
+			return []SharedObjectEvent{e}, nil
+		}
+	case SO_STATUS:
+		{
+			e := SharedObjectEvent{Type: t}
+			if e.Key, err = readSOString(r); err != nil {
+				return
+			}
+
+			var level string
+			if level, err = readSOString(r); err != nil {
+				return
+			}
+
+			e.Value = level
+
+			return []SharedObjectEvent{e}, nil
+		}
+	}
+
+	// Use, Release, Clear, UseSuccess
+	return []SharedObjectEvent{{Type: t}}, nil
+}
+
+func (msg *SharedObjectMessage) Encode() (err error) {
+	buf := new(bytes.Buffer)
+
+	// AMF3 的时候第一个字节为0
+	if msg.ObjectEncoding == 3 {
+		buf.WriteByte(0)
+	}
+
+	if err = writeSOString(buf, msg.Name); err != nil {
+		return
+	}
+
+	header := make([]byte, SO_HEADER_SIZE)
+	util.BigEndian.PutUint32(header, msg.Version)
+	if msg.Persistent {
+		util.BigEndian.PutUint32(header[4:], SO_FLAG_PERSISTENT)
+	}
+	buf.Write(header)
+
+	for _, e := range msg.Events {
+		data := new(bytes.Buffer)
+
+		switch e.Type {
+		case SO_REQUEST_CHANGE, SO_CHANGE:
+			{
+				if err = writeSOString(data, e.Key); err != nil {
+					return
+				}
+
+				if err = writeSOValue(data, e.Value, msg.ObjectEncoding); err != nil {
+					return
+				}
+			}
+		case SO_SUCCESS, SO_REMOVE, SO_REQUEST_REMOVE:
+			{
+				if err = writeSOString(data, e.Key); err != nil {
+					return
+				}
+			}
+		case SO_SEND_MESSAGE:
+			{
+				if err = writeSOValue(data, e.Key, 0); err != nil {
+					return
+				}
+
+				for _, v := range e.Args {
+					if err = writeSOValue(data, v, msg.ObjectEncoding); err != nil {
+						return
+					}
+				}
+			}
+		case SO_STATUS:
+			{
+				level, _ := e.Value.(string)
+
+				if err = writeSOString(data, e.Key); err != nil {
+					return
+				}
+
+				if err = writeSOString(data, level); err != nil {
+					return
+				}
+			}
+		}
+
+		b := make([]byte, 5)
+		b[0] = e.Type
+		util.BigEndian.PutUint32(b[1:], uint32(data.Len()))
+		buf.Write(b)
+		buf.Write(data.Bytes())
+	}
+
+	msg.RtmpBody.Payload = buf.Bytes()
+
+	return
+}
+
+func readSOString(r *bytes.Reader) (s string, err error) {
+	if r.Len() < 2 {
+		return "", errors.New(fmt.Sprintf("shared object string length error, %v/%v", r.Len(), 2))
+	}
+
+	b := make([]byte, 2)
+	r.Read(b)
+
+	length := int(util.BigEndian.Uint16(b))
+	if length > r.Len() {
+		return "", errors.New(fmt.Sprintf("shared object string error, %v/%v", length, r.Len()))
+	}
+
+	b = make([]byte, length)
+	r.Read(b)
+
+	return string(b), nil
+}
+
+func writeSOString(buf *bytes.Buffer, s string) error {
+	if len(s) > 0xffff {
+		return errors.New(fmt.Sprintf("shared object string too long, %v", len(s)))
+	}
+
+	b := make([]byte, 2)
+	util.BigEndian.PutUint16(b, uint16(len(s)))
+	buf.Write(b)
+	buf.WriteString(s)
+
+	return nil
+}
+
+func writeSOValue(buf *bytes.Buffer, v interface{}, objectEncoding float64) error {
+	if objectEncoding == 3 {
+		v = amf.AVMPlus{Value: v}
+	}
+
+	return amf.NewEncoder(buf).Encode(v)
+}
+
+//
+// Handle
+//
+
+// 消息在 readChunk 里面已经解码了
+func sharedObjectMessageHandle(s *RtmpNetStream, msg *SharedObjectMessage) (err error) {
+	conn := s.conn
+
+	for _, e := range msg.Events {
+		switch e.Type {
+		case SO_USE:
+			{
+				useSharedObject(conn, msg.Name, msg.Persistent)
+			}
+		case SO_RELEASE:
+			{
+				releaseSharedObject(conn, msg.Name)
+			}
+		case SO_REQUEST_CHANGE:
+			{
+				if so, ok := findSharedObject(conn.appName, msg.Name); ok {
+					so.setAttribute(conn, e.Key, e.Value)
+				}
+			}
+		case SO_REQUEST_REMOVE:
+			{
+				if so, ok := findSharedObject(conn.appName, msg.Name); ok {
+					so.removeAttribute(conn, e.Key)
+				}
+			}
+		case SO_SEND_MESSAGE:
+			{
+				if so, ok := findSharedObject(conn.appName, msg.Name); ok {
+					so.sendMessage(conn, e.Key, e.Args)
+				}
+			}
+		default:
+			{
+				fmt.Println("Other Shared Object Event :", e.Type)
+			}
+		}
+	}
+
+	return
+}
+
+func useSharedObject(conn *RtmpNetConnection, name string, persistent bool) {
+	sharedObjectsLock.Lock()
+
+	key := sharedObjectKey(conn.appName, name)
+
+	so, ok := sharedObjects[key]
+	if !ok {
+		so = newSharedObject(conn.appName, name, persistent)
+		if persistent {
+			if err := so.load(); err != nil {
+				fmt.Println("shared object load error :", err)
+			}
+		}
+
+		sharedObjects[key] = so
+	}
+
+	sharedObjectsLock.Unlock()
+
+	// 已经用其他的永久性标志创建了这个共享对象
+	if so.persistent != persistent {
+		so.lock.Lock()
+		m := so.message(conn, SharedObjectEvent{Type: SO_STATUS, Key: SharedObject_BadPersistence, Value: Level_Error})
+		so.lock.Unlock()
+
+		sendSOMessages(m)
+		return
+	}
+
+	so.addClient(conn)
+}
+
+func releaseSharedObject(conn *RtmpNetConnection, name string) {
+	sharedObjectsLock.Lock()
+	defer sharedObjectsLock.Unlock()
+
+	key := sharedObjectKey(conn.appName, name)
+	if so, ok := sharedObjects[key]; ok {
+		if so.removeClient(conn) {
+			delete(sharedObjects, key)
+		}
+	}
+}
+
+// 连接断开的时候, 断开所有的共享对象
+func releaseSharedObjects(conn *RtmpNetConnection) {
+	sharedObjectsLock.Lock()
+	defer sharedObjectsLock.Unlock()
+
+	for key, so := range sharedObjects {
+		if so.removeClient(conn) {
+			delete(sharedObjects, key)
+		}
+	}
+}
+
+// 发送 UseSuccess + Clear + 所有属性
+func (so *SharedObject) addClient(conn *RtmpNetConnection) {
+	so.lock.Lock()
+
+	so.clients[conn] = true
+
+	events := []SharedObjectEvent{{Type: SO_USE_SUCCESS}, {Type: SO_CLEAR}}
+
+	keys := make([]string, 0, len(so.data))
+	for k := range so.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		events = append(events, SharedObjectEvent{Type: SO_CHANGE, Key: k, Value: so.data[k]})
+	}
+
+	m := so.message(conn, events...)
+	so.lock.Unlock()
+
+	sendSOMessages(m)
+}
+
+// 返回 true 表示这个共享对象已经不需要保存在内存中了
+func (so *SharedObject) removeClient(conn *RtmpNetConnection) bool {
+	so.lock.Lock()
+	defer so.lock.Unlock()
+
+	delete(so.clients, conn)
+
+	if len(so.clients) > 0 {
+		return false
+	}
+
+	// 永久共享对象没有保存到文件的时候, 一直保存在内存中
+	return !so.persistent || config.SOPersistence
+}
+
+// 修改属性的客户端收到 Success, 其他客户端收到 Change
+func (so *SharedObject) setAttribute(conn *RtmpNetConnection, key string, value interface{}) {
+	so.lock.Lock()
+
+	if !so.clients[conn] {
+		so.lock.Unlock()
+		return
+	}
+
+	so.data[key] = value
+	so.version++
+
+	data := so.snapshot()
+
+	ms := make([]*soMessage, 0, len(so.clients))
+	for c := range so.clients {
+		if c == conn {
+			ms = append(ms, so.message(c, SharedObjectEvent{Type: SO_SUCCESS, Key: key}))
+		} else {
+			ms = append(ms, so.message(c, SharedObjectEvent{Type: SO_CHANGE, Key: key, Value: value}))
+		}
+	}
+
+	so.lock.Unlock()
+
+	so.save(data)
+	sendSOMessages(ms...)
+}
+
+func (so *SharedObject) removeAttribute(conn *RtmpNetConnection, key string) {
+	so.lock.Lock()
+
+	if _, ok := so.data[key]; !ok || !so.clients[conn] {
+		so.lock.Unlock()
+		return
+	}
+
+	delete(so.data, key)
+	so.version++
+
+	data := so.snapshot()
+
+	ms := make([]*soMessage, 0, len(so.clients))
+	for c := range so.clients {
+		ms = append(ms, so.message(c, SharedObjectEvent{Type: SO_REMOVE, Key: key}))
+	}
+
+	so.lock.Unlock()
+
+	so.save(data)
+	sendSOMessages(ms...)
+}
+
+// 所有的客户端(包括发送者)都会收到
+func (so *SharedObject) sendMessage(conn *RtmpNetConnection, handler string, args []interface{}) {
+	so.lock.Lock()
+
+	if !so.clients[conn] {
+		so.lock.Unlock()
+		return
+	}
+
+	ms := make([]*soMessage, 0, len(so.clients))
+	for c := range so.clients {
+		ms = append(ms, so.message(c, SharedObjectEvent{Type: SO_SEND_MESSAGE, Key: handler, Args: args}))
+	}
+
+	so.lock.Unlock()
+
+	sendSOMessages(ms...)
+}
+
+// 发给一个客户端的共享对象消息
+type soMessage struct {
+	conn *RtmpNetConnection
+	msg  *SharedObjectMessage
+}
+
+// 调用者需要持有 so.lock, 消息里面是现在的版本. 释放锁之后再用 sendSOMessages 发送, 发送可能会阻塞
+func (so *SharedObject) message(conn *RtmpNetConnection, events ...SharedObjectEvent) *soMessage {
+	m := newSharedObjectMessage()
+	m.ObjectEncoding = conn.objectEncoding
+	m.Name = so.name
+	m.Version = so.version
+	m.Persistent = so.persistent
+	m.Events = events
+
+	return &soMessage{conn: conn, msg: m}
+}
+
+func sendSOMessages(ms ...*soMessage) {
+	for _, m := range ms {
+		if err := sendMessage(m.conn, SEND_SHARED_OBJECT_MESSAGE, m.msg); err != nil {
+			fmt.Println("shared object send error :", err)
+		}
+	}
+}
+
+//
+// Persistence
+//
+
+// resource/so/appName/name.so, 名字里面不能有 "..".
+// 清理之后应用的目录必须在 config.SOPath 下面, 文件必须在应用的目录下面
+func (so *SharedObject) filename() (filename string, err error) {
+	for _, v := range strings.Split(so.appName+"/"+so.name, "/") {
+		if v == ".." {
+			return "", errors.New(fmt.Sprintf("shared object name error, %v/%v", so.appName, so.name))
+		}
+	}
+
+	root := filepath.Clean(config.SOPath)
+	dir := filepath.Join(root, so.appName)
+	filename = filepath.Join(dir, so.name+SO_FILE_EXT)
+
+	if !isSubPath(root, dir) || !isSubPath(dir, filename) {
+		return "", errors.New(fmt.Sprintf("shared object name error, %v/%v", so.appName, so.name))
+	}
+
+	return
+}
+
+func isSubPath(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+
+	return true
+}
+
+// 文件内容: Version(AMF0 Number) + 属性(AMF0 ECMA Array)
+func (so *SharedObject) load() (err error) {
+	if !config.SOPersistence {
+		return
+	}
+
+	var filename string
+	if filename, err = so.filename(); err != nil {
+		return
+	}
+
+	if !util.Exist(filename) {
+		return
+	}
+
+	var b []byte
+	if b, err = ioutil.ReadFile(filename); err != nil {
+		return
+	}
+
+	var vs []interface{}
+	if vs, err = amf.UnmarshalValues(b); err != nil {
+		return
+	}
+
+	if len(vs) != 2 {
+		return errors.New(fmt.Sprintf("shared object file error, %v", filename))
+	}
+
+	version, ok := vs[0].(float64)
+	data, ok1 := vs[1].(amf.ECMAArray)
+	if !ok || !ok1 {
+		return errors.New(fmt.Sprintf("shared object file error, %v", filename))
+	}
+
+	so.version = uint32(version)
+	so.data = data
+	so.saved = true
+	so.savedVersion = so.version
+
+	return
+}
+
+// 调用者需要持有 so.lock, 编码现在的版本和属性, 不需要保存的时候返回 nil
+func (so *SharedObject) snapshot() *soSnapshot {
+	if !so.persistent || !config.SOPersistence {
+		return nil
+	}
+
+	b, err := amf.MarshalValues(float64(so.version), amf.ECMAArray(so.data))
+	if err != nil {
+		fmt.Println("shared object save error :", err)
+		return nil
+	}
+
+	return &soSnapshot{version: so.version, data: b}
+}
+
+// 不持有 so.lock 的时候写文件. 多个 save 同时进行的时候按 saveLock 的顺序写, 旧的版本不会覆盖新的版本
+func (so *SharedObject) save(snapshot *soSnapshot) {
+	if snapshot == nil {
+		return
+	}
+
+	so.saveLock.Lock()
+	defer so.saveLock.Unlock()
+
+	if so.saved && snapshot.version <= so.savedVersion {
+		return
+	}
+
+	filename, err := so.filename()
+	if err != nil {
+		fmt.Println("shared object save error :", err)
+		return
+	}
+
+	if err = os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+		fmt.Println("shared object save error :", err)
+		return
+	}
+
+	// 先写临时文件再改名, 防止写到一半的时候程序退出
+	if err = ioutil.WriteFile(filename+".tmp", snapshot.data, 0644); err != nil {
+		fmt.Println("shared object save error :", err)
+		return
+	}
+
+	if err = os.Rename(filename+".tmp", filename); err != nil {
+		fmt.Println("shared object save error :", err)
+		return
+	}
+
+	so.saved = true
+	so.savedVersion = snapshot.version
+}
@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync/atomic"
 
+	"github.com/sevenzoe/gortmp/avformat"
 	"github.com/sevenzoe/gortmp/config"
 	"github.com/sevenzoe/gortmp/util"
 )
@@ -18,6 +20,7 @@ const (
 	SEND_STREAM_BEGIN_MESSAGE       = "Send Stream Begin Message"
 	SEND_SET_BUFFER_LENGTH_MESSAGE  = "Send Set Buffer Lengh Message"
 	SEND_STREAM_IS_RECORDED_MESSAGE = "Send Stream Is Recorded Message"
+	SEND_STREAM_EOF_MESSAGE         = "Send Stream EOF Message"
 
 	SEND_PING_REQUEST_MESSAGE  = "Send Ping Request Message"
 	SEND_PING_RESPONSE_MESSAGE = "Send Ping Response Message"
@@ -30,16 +33,26 @@ const (
 
 	SEND_PLAY_MESSAGE          = "Send Play Message"
 	SEND_PLAY_RESPONSE_MESSAGE = "Send Play Response Message"
+	SEND_PLAY_STATUS_MESSAGE   = "Send Play Status Message"
 
 	SEND_PUBLISH_RESPONSE_MESSAGE = "Send Publish Response Message"
 	SEND_PUBLISH_START_MESSAGE    = "Send Publish Start Message"
 
 	SEND_UNPUBLISH_RESPONSE_MESSAGE = "Send Unpublish Response Message"
 
+	SEND_FCPUBLISH_RESPONSE_MESSAGE   = "Send FCPublish Response Message"
+	SEND_FCUNPUBLISH_RESPONSE_MESSAGE = "Send FCUnpublish Response Message"
+
 	SEND_AUDIO_MESSAGE      = "Send Audio Message"
 	SEND_FULL_AUDIO_MESSAGE = "Send Full Audio Message"
 	SEND_VIDEO_MESSAGE      = "Send Video Message"
 	SEND_FULL_VDIEO_MESSAGE = "Send Full Video Message"
+
+	SEND_SHARED_OBJECT_MESSAGE = "Send Shared Object Message"
+
+	SEND_CALL_RESPONSE_MESSAGE = "Send Call Response Message"
+
+	SEND_DATA_MESSAGE = "Send Data Message"
 )
 
 func newConnectResponseMessageData(objectEncoding float64) (amfobj AMFObjects) {
@@ -51,6 +64,16 @@ func newConnectResponseMessageData(objectEncoding float64) (amfobj AMFObjects) {
 	amfobj["level"] = Level_Status
 	amfobj["code"] = NetConnection_Connect_Success
 	amfobj["objectEncoding"] = uint64(objectEncoding)
+	amfobj["fourCcList"] = newFourCcList()
+
+	return
+}
+
+// Enhanced RTMP, 服务器支持的视频编码
+func newFourCcList() (list []AMFObject) {
+	for _, fourcc := range [][4]byte{avformat.FOURCC_AV1, avformat.FOURCC_VP9, avformat.FOURCC_HEVC} {
+		list = append(list, string(fourcc[:]))
+	}
 
 	return
 }
@@ -73,74 +96,114 @@ func newPlayResponseMessageData(streamid uint32, code, level string) (amfobj AMF
 	return
 }
 
-func recvMessage(conn *RtmpNetConnection) (msg RtmpMessage, err error) {
-	if conn.readSeqNum >= conn.bandwidth {
-		conn.totalRead += conn.readSeqNum
-		conn.readSeqNum = 0
-		//sendAck(conn, conn.totalRead)
-		sendMessage(conn, SEND_ACK_MESSAGE, conn.totalRead)
-	}
+type amfCommandEncoder interface {
+	Encode0()
+	Encode3()
+}
 
-	msg, err = readChunk(conn)
-	if err != nil {
-		return nil, err
+// objectEncoding == 3 的连接, 命令消息用AMF3编码(消息类型17), 否则用AMF0编码(消息类型20)
+func encodeCommandMessage(conn *RtmpNetConnection, m amfCommandEncoder) byte {
+	if conn.objectEncoding == 3 {
+		m.Encode3()
+		return RTMP_MSG_AMF3_COMMAND
 	}
 
-	// 如果消息是类型是用户控制消息,那么我们就简单做一些相应的处理,
-	// 然后继续读取下一个消息.如果不是用户控制消息,就将消息返回就好.
-	messageType := msg.Header().ChunkMessgaeHeader.MessageTypeID
-	if RTMP_MSG_CHUNK_SIZE <= messageType && messageType <= RTMP_MSG_EDGE {
+	m.Encode0()
+	return RTMP_MSG_AMF0_COMMAND
+}
+
+func recvMessage(conn *RtmpNetConnection) (msg RtmpMessage, err error) {
+	for {
+		msg, err = readChunk(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		// 如果消息是类型是用户控制消息,那么我们就简单做一些相应的处理,
+		// 然后继续读取下一个消息.如果不是用户控制消息,就将消息返回就好.
+		messageType := msg.Header().ChunkMessgaeHeader.MessageTypeID
+		if messageType < RTMP_MSG_CHUNK_SIZE || messageType > RTMP_MSG_EDGE {
+			return msg, nil
+		}
+
 		if config.DebugMode {
 			fmt.Printf("%v\n ", msg.String())
 		}
+
 		switch messageType {
 		case RTMP_MSG_CHUNK_SIZE:
 			{
 				m := msg.(*ChunkSizeMessage)
+
+				// 最高位必须为0. 块大小为0的时候读不到数据, 太小或者太大都可能被用来攻击.
+				if m.ChunkSize&0x80000000 != 0 || m.ChunkSize < conn.limits.MinChunkSize || m.ChunkSize > conn.limits.MaxChunkSize {
+					return nil, newProtocolError(ErrChunkSize, "%v, range [%v, %v]", m.ChunkSize, conn.limits.MinChunkSize, conn.limits.MaxChunkSize)
+				}
+
 				conn.readChunkSize = int(m.ChunkSize)
-				return recvMessage(conn)
 			}
 		case RTMP_MSG_ABORT:
 			{
 				m := msg.(*AbortMessage)
-				delete(conn.incompleteRtmpBody, m.ChunkStreamId)
-				return recvMessage(conn)
+				// 丢弃块流上面已经收到的部分消息
+				if state, ok := conn.readChunkStreams[m.ChunkStreamId]; ok && state.payload != nil {
+					conn.readPending -= uint32(len(state.payload))
+					if state.buffer != nil {
+						state.buffer.release()
+					}
+
+					state.reset()
+				}
 			}
 		case RTMP_MSG_ACK:
 			{
-				return recvMessage(conn)
+				m := msg.(*AcknowledgementMessage)
+				atomic.StoreUint32(&conn.writeAckSeqNum, m.SequenceNumber)
+				atomic.AddUint32(&conn.acksReceived, 1)
 			}
 		case RTMP_MSG_USER_CONTROL:
 			{
-				if _, ok := msg.(*PingRequestMessage); ok {
-					//sendPingResponse(conn)
-					sendMessage(conn, SEND_PING_RESPONSE_MESSAGE, nil)
+				switch m := msg.(type) {
+				case *PingRequestMessage:
+					{
+						// PingResponse 带上 PingRequest 的时间戳
+						sendMessage(conn, SEND_PING_RESPONSE_MESSAGE, m.Timestamp)
+					}
+				case *PingResponseMessage:
+					{
+						conn.pingResponse(m.Timestamp)
+					}
 				}
-				return recvMessage(conn)
 			}
 		case RTMP_MSG_ACK_SIZE:
 			{
 				m := msg.(*WindowAcknowledgementSizeMessage)
-				conn.bandwidth = m.AcknowledgementWindowsize
-				return recvMessage(conn)
+				atomic.StoreUint32(&conn.readAckWindow, m.AcknowledgementWindowsize)
 			}
 		case RTMP_MSG_BANDWIDTH:
 			{
 				m := msg.(*SetPeerBandwidthMessage)
-				conn.bandwidth = m.AcknowledgementWindowsize
-				return recvMessage(conn)
+				if err = conn.setPeerBandwidth(m.AcknowledgementWindowsize, m.LimitType); err != nil {
+					return nil, err
+				}
 			}
 		case RTMP_MSG_EDGE:
 			{
-				return recvMessage(conn)
 			}
 		}
-	}
 
-	return msg, err
+		// 协议控制消息处理完就不再使用, 负载放回池里面
+		putControlPayload(msg.Body().Payload)
+	}
 }
 
 func sendMessage(conn *RtmpNetConnection, message string, args interface{}) error {
+	return sendStreamMessage(conn, 0, message, args)
+}
+
+// 发送流上的消息, 音视频, 数据和用户控制消息使用 streamID.
+// SEND_CREATE_STREAM_RESPONSE_MESSAGE 的 streamID 是新创建的流ID.
+func sendStreamMessage(conn *RtmpNetConnection, streamID uint32, message string, args interface{}) error {
 	switch message {
 	case SEND_CHUNK_SIZE_MESSAGE:
 		{
@@ -177,6 +240,8 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 				return errors.New(SEND_ACK_WINDOW_SIZE_MESSAGE + ", The parameter only one(size uint32)!")
 			}
 
+			atomic.StoreUint32(&conn.writeAckWindow, size)
+
 			m := newWindowAcknowledgementSizeMessage()
 			m.AcknowledgementWindowsize = size
 			m.Encode()
@@ -207,7 +272,7 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 
 			m := newStreamBeginMessage()
 			m.EventType = RTMP_USER_STREAM_BEGIN
-			m.StreamID = conn.streamID
+			m.StreamID = streamID
 			m.Encode()
 			head := newRtmpHeader(RTMP_CSID_CONTROL, 0, uint32(len(m.RtmpBody.Payload)), RTMP_MSG_USER_CONTROL, 0, 0)
 			m.RtmpHeader = head
@@ -221,7 +286,21 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 
 			m := newStreamIsRecordedMessage()
 			m.EventType = RTMP_USER_STREAM_IS_RECORDED
-			m.StreamID = conn.streamID
+			m.StreamID = streamID
+			m.Encode()
+			head := newRtmpHeader(RTMP_CSID_CONTROL, 0, uint32(len(m.RtmpBody.Payload)), RTMP_MSG_USER_CONTROL, 0, 0)
+			m.RtmpHeader = head
+			return writeMessage(conn, m)
+		}
+	case SEND_STREAM_EOF_MESSAGE:
+		{
+			if args != nil {
+				return errors.New(SEND_STREAM_EOF_MESSAGE + ", The parameter is nil")
+			}
+
+			m := newStreamEOFMessage()
+			m.EventType = RTMP_USER_STREAM_EOF
+			m.StreamID = streamID
 			m.Encode()
 			head := newRtmpHeader(RTMP_CSID_CONTROL, 0, uint32(len(m.RtmpBody.Payload)), RTMP_MSG_USER_CONTROL, 0, 0)
 			m.RtmpHeader = head
@@ -235,7 +314,7 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 
 			m := newSetBufferMessage()
 			m.EventType = RTMP_USER_SET_BUFFLEN
-			m.StreamID = conn.streamID
+			m.StreamID = streamID
 			m.Millisecond = 100
 			m.Encode()
 			head := newRtmpHeader(RTMP_CSID_CONTROL, 0, uint32(len(m.RtmpBody.Payload)), RTMP_MSG_USER_CONTROL, 0, 0)
@@ -244,12 +323,14 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 		}
 	case SEND_PING_REQUEST_MESSAGE:
 		{
-			if args != nil {
-				return errors.New(SEND_PING_REQUEST_MESSAGE + ", The parameter is nil")
+			timestamp, ok := args.(uint32)
+			if !ok {
+				return errors.New(SEND_PING_REQUEST_MESSAGE + ", The parameter only one(timestamp uint32)!")
 			}
 
 			m := newPingRequestMessage()
 			m.EventType = RTMP_USER_PING_REQUEST
+			m.Timestamp = timestamp
 			m.Encode()
 			head := newRtmpHeader(RTMP_CSID_CONTROL, 0, uint32(len(m.RtmpBody.Payload)), RTMP_MSG_USER_CONTROL, 0, 0)
 			m.RtmpHeader = head
@@ -257,12 +338,14 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 		}
 	case SEND_PING_RESPONSE_MESSAGE:
 		{
-			if args != nil {
-				return errors.New(SEND_PING_RESPONSE_MESSAGE + ", The parameter is nil")
+			timestamp, ok := args.(uint32)
+			if !ok {
+				return errors.New(SEND_PING_RESPONSE_MESSAGE + ", The parameter only one(timestamp uint32)!")
 			}
 
 			m := newPingResponseMessage()
 			m.EventType = RTMP_USER_PING_RESPONSE
+			m.Timestamp = timestamp
 			m.Encode()
 			head := newRtmpHeader(RTMP_CSID_CONTROL, 0, uint32(len(m.RtmpBody.Payload)), RTMP_MSG_USER_CONTROL, 0, 0)
 			m.RtmpHeader = head
@@ -292,9 +375,9 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 			m := newResponseCreateStreamMessage()
 			m.CommandName = Response_Result
 			m.TransactionId = tid
-			m.StreamId = conn.streamID
-			m.Encode0()
-			head := newRtmpHeader(RTMP_CSID_COMMAND, 0, uint32(len(m.RtmpBody.Payload)), RTMP_MSG_AMF0_COMMAND, 0, 0)
+			m.StreamId = streamID
+			typeID := encodeCommandMessage(conn, m)
+			head := newRtmpHeader(RTMP_CSID_COMMAND, 0, uint32(len(m.RtmpBody.Payload)), typeID, 0, 0)
 			m.RtmpHeader = head
 			return writeMessage(conn, m)
 		}
@@ -306,17 +389,17 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 			}
 
 			var streamName string
-			var start uint64
-			var duration uint64
-			var rest bool
+			var start float64 = RTMP_PLAY_START_LIVE_OR_RECORDED
+			var duration float64 = RTMP_PLAY_DURATION_ALL
+			var rest bool = true
 
 			for i, v := range data {
 				if i == "StreamName" {
 					streamName = v.(string)
 				} else if i == "Start" {
-					start = v.(uint64)
+					start = v.(float64)
 				} else if i == "Duration" {
-					duration = v.(uint64)
+					duration = v.(float64)
 				} else if i == "Rest" {
 					rest = v.(bool)
 				}
@@ -342,7 +425,6 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 			}
 
 			obj := newAMFObjects()
-			var streamID uint32
 
 			for i, v := range data {
 				switch i {
@@ -354,6 +436,10 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 					{
 						obj[i] = v
 					}
+				case "description", "details":
+					{
+						obj[i] = v
+					}
 				case "streamid":
 					{
 						if t, ok := v.(uint32); ok {
@@ -369,8 +455,8 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 			m.CommandName = Response_OnStatus
 			m.TransactionId = 0
 			m.Object = obj
-			m.Encode0()
-			head := newRtmpHeader(RTMP_CSID_COMMAND, 0, uint32(len(m.RtmpBody.Payload)), RTMP_MSG_AMF0_COMMAND, streamID, 0)
+			typeID := encodeCommandMessage(conn, m)
+			head := newRtmpHeader(RTMP_CSID_COMMAND, 0, uint32(len(m.RtmpBody.Payload)), typeID, streamID, 0)
 			m.RtmpHeader = head
 			return writeMessage(conn, m)
 		}
@@ -402,6 +488,10 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 					{
 						pro[i] = v
 					}
+				case "fourCcList":
+					{
+						pro[i] = v
+					}
 				case "level":
 					{
 						info[i] = v
@@ -422,8 +512,8 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 			m.TransactionId = 1
 			m.Properties = pro
 			m.Infomation = info
-			m.Encode0()
-			head := newRtmpHeader(RTMP_CSID_COMMAND, 0, uint32(len(m.RtmpBody.Payload)), RTMP_MSG_AMF0_COMMAND, 0, 0)
+			typeID := encodeCommandMessage(conn, m)
+			head := newRtmpHeader(RTMP_CSID_COMMAND, 0, uint32(len(m.RtmpBody.Payload)), typeID, 0, 0)
 			m.RtmpHeader = head
 			return writeMessage(conn, m)
 		}
@@ -497,7 +587,7 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 			m.RtmpHeader = head
 			return writeMessage(conn, m)
 		}
-	case SEND_PUBLISH_RESPONSE_MESSAGE, SEND_PUBLISH_START_MESSAGE:
+	case SEND_PUBLISH_RESPONSE_MESSAGE, SEND_PUBLISH_START_MESSAGE, SEND_UNPUBLISH_RESPONSE_MESSAGE:
 		{
 			data, ok := args.(AMFObjects)
 			if !ok {
@@ -505,7 +595,6 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 			}
 
 			info := newAMFObjects()
-			var streamID uint32
 
 			for i, v := range data {
 				switch i {
@@ -517,6 +606,10 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 					{
 						info[i] = v
 					}
+				case "description":
+					{
+						info[i] = v
+					}
 				case "streamid":
 					{
 						if t, ok := v.(uint32); ok {
@@ -532,13 +625,41 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 			m.CommandName = Response_OnStatus
 			m.TransactionId = 0
 			m.Infomation = info
-			m.Encode0()
-			head := newRtmpHeader(RTMP_CSID_COMMAND, 0, uint32(len(m.RtmpBody.Payload)), RTMP_MSG_AMF0_COMMAND, streamID, 0)
+			typeID := encodeCommandMessage(conn, m)
+			head := newRtmpHeader(RTMP_CSID_COMMAND, 0, uint32(len(m.RtmpBody.Payload)), typeID, streamID, 0)
 			m.RtmpHeader = head
 			return writeMessage(conn, m)
 		}
-	case SEND_UNPUBLISH_RESPONSE_MESSAGE:
+	case SEND_FCPUBLISH_RESPONSE_MESSAGE, SEND_FCUNPUBLISH_RESPONSE_MESSAGE:
 		{
+			// onFCPublish/onFCUnpublish: 命令名 + 事务ID(0) + null + {code, description}
+			data, ok := args.(AMFObjects)
+			if !ok {
+				return errors.New(message + ", The parameter is AMFObjects(map[string]interface{})")
+			}
+
+			info := newAMFObjects()
+
+			for i, v := range data {
+				switch i {
+				case "code", "level", "description":
+					{
+						info[i] = v
+					}
+				}
+			}
+
+			m := newResponseCallMessage()
+			m.CommandName = Response_OnFCPublish
+			if message == SEND_FCUNPUBLISH_RESPONSE_MESSAGE {
+				m.CommandName = Response_OnFCUnpublish
+			}
+			m.TransactionId = 0
+			m.Response = info
+			typeID := encodeCommandMessage(conn, m)
+			head := newRtmpHeader(RTMP_CSID_COMMAND, 0, uint32(len(m.RtmpBody.Payload)), typeID, 0, 0)
+			m.RtmpHeader = head
+			return writeMessage(conn, m)
 		}
 	case SEND_FULL_AUDIO_MESSAGE:
 		{
@@ -547,7 +668,7 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 				errors.New(SEND_FULL_AUDIO_MESSAGE + ", The parameter is AVPacket")
 			}
 
-			return sendAVMessage(conn, audio, true, true)
+			return sendAVMessage(conn, streamID, audio, true, true)
 		}
 	case SEND_AUDIO_MESSAGE:
 		{
@@ -556,7 +677,7 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 				errors.New(SEND_AUDIO_MESSAGE + ", The parameter is AVPacket")
 			}
 
-			return sendAVMessage(conn, audio, true, false)
+			return sendAVMessage(conn, streamID, audio, true, false)
 		}
 	case SEND_FULL_VDIEO_MESSAGE:
 		{
@@ -565,7 +686,7 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 				errors.New(SEND_FULL_VDIEO_MESSAGE + ", The parameter is AVPacket")
 			}
 
-			return sendAVMessage(conn, video, false, true)
+			return sendAVMessage(conn, streamID, video, false, true)
 		}
 	case SEND_VIDEO_MESSAGE:
 		{
@@ -574,357 +695,378 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 				errors.New(SEND_VIDEO_MESSAGE + ", The parameter is AVPacket")
 			}
 
-			return sendAVMessage(conn, video, false, false)
+			return sendAVMessage(conn, streamID, video, false, false)
 		}
-	}
-
-	return errors.New("send message no exist")
-}
-
-func writeMessage(conn *RtmpNetConnection, msg RtmpMessage) error {
-	if conn.writeSeqNum > conn.bandwidth {
-		conn.totalWrite += conn.writeSeqNum
-		conn.writeSeqNum = 0
-		sendMessage(conn, SEND_ACK_MESSAGE, conn.totalWrite)
-		sendMessage(conn, SEND_PING_REQUEST_MESSAGE, nil)
-	}
+	case SEND_DATA_MESSAGE:
+		{
+			data, ok := args.(*AVPacket)
+			if !ok {
+				return errors.New(SEND_DATA_MESSAGE + ", The parameter is AVPacket")
+			}
 
-	mark, need, err := encodeChunk12(msg.Header(), msg.Body().Payload, conn.writeChunkSize)
-	if err != nil {
-		return err
-	}
+			var head *RtmpHeader
+			csid := streamChunkStreamID(RTMP_CSID_DATA, streamID)
+			if data.Timestamp >= 0xffffff {
+				head = newRtmpHeader(csid, 0xffffff, uint32(len(data.Payload)), data.Type, streamID, data.Timestamp)
+			} else {
+				head = newRtmpHeader(csid, data.Timestamp, uint32(len(data.Payload)), data.Type, streamID, 0)
+			}
 
-	_, err = conn.bw.Write(mark)
-	if err != nil {
-		return err
-	}
+			m := newMetadataMessage()
+			m.RtmpHeader = head
+			m.RtmpBody.Payload = data.Payload
+			return writeMessage(conn, m)
+		}
+	case SEND_PLAY_STATUS_MESSAGE:
+		{
+			// onPlayStatus 是数据消息: "onPlayStatus" + {code, level, ...}
+			data, ok := args.(AMFObjects)
+			if !ok {
+				return errors.New(SEND_PLAY_STATUS_MESSAGE + ", The parameter is AMFObjects(map[string]interface{})")
+			}
 
-	err = conn.bw.Flush()
-	if err != nil {
-		return err
-	}
+			obj := newAMFObjects()
+			for i, v := range data {
+				if i != "streamid" {
+					obj[i] = v
+				}
+			}
 
-	conn.writeSeqNum += uint32(len(mark))
+			amf := newAMFEncoder()
+			amf.writeString(Data_OnPlayStatus)
+			amf.encodeObject(obj)
 
-	for need != nil && len(need) > 0 {
-		mark, need, err = encodeChunk1(msg.Header(), need, conn.writeChunkSize)
-		if err != nil {
-			return err
+			m := newMetadataMessage()
+			m.RtmpBody.Payload = amf.Bytes()
+			m.RtmpHeader = newRtmpHeader(streamChunkStreamID(RTMP_CSID_DATA, streamID), 0, uint32(len(m.RtmpBody.Payload)), RTMP_MSG_AMF0_METADATA, streamID, 0)
+			return writeMessage(conn, m)
 		}
+	case SEND_CALL_RESPONSE_MESSAGE:
+		{
+			m, ok := args.(*ResponseCallMessage)
+			if !ok {
+				return errors.New(SEND_CALL_RESPONSE_MESSAGE + ", The parameter is ResponseCallMessage")
+			}
 
-		_, err = conn.bw.Write(mark)
-		if err != nil {
-			return err
+			typeID := encodeCommandMessage(conn, m)
+			head := newRtmpHeader(RTMP_CSID_COMMAND, 0, uint32(len(m.RtmpBody.Payload)), typeID, 0, 0)
+			m.RtmpHeader = head
+			return writeMessage(conn, m)
 		}
+	case SEND_SHARED_OBJECT_MESSAGE:
+		{
+			m, ok := args.(*SharedObjectMessage)
+			if !ok {
+				return errors.New(SEND_SHARED_OBJECT_MESSAGE + ", The parameter is SharedObjectMessage")
+			}
 
-		err = conn.bw.Flush()
-		if err != nil {
-			return err
+			if err := m.Encode(); err != nil {
+				return err
+			}
+
+			// objectEncoding == 3 的连接用AMF3(16), 否则用AMF0(19)
+			typeID := byte(RTMP_MSG_AMF0_SHARED)
+			if m.ObjectEncoding == 3 {
+				typeID = RTMP_MSG_AMF3_SHARED
+			}
+
+			head := newRtmpHeader(RTMP_CSID_COMMAND, 0, uint32(len(m.RtmpBody.Payload)), typeID, 0, 0)
+			m.RtmpHeader = head
+			return writeMessage(conn, m)
 		}
+	}
 
-		conn.writeSeqNum += uint32(len(mark))
+	return errors.New("send message no exist")
+}
+
+func writeMessage(conn *RtmpNetConnection, msg RtmpMessage) error {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+
+	head := msg.Header()
+	timestamp := head.ChunkMessgaeHeader.Timestamp
+	if timestamp == 0xffffff {
+		timestamp = head.ChunkExtendedTimestamp.ExtendTimestamp
 	}
 
-	return nil
+	return conn.writeChunks(head, msg.Body().Payload, timestamp, false, nil)
 }
 
 // 当发送音视频数据的时候,当块类型为12的时候,Chunk Message Header有一个字段TimeStamp,指明一个时间
 // 当块类型为4,8的时候,Chunk Message Header有一个字段TimeStamp Delta,记录与上一个Chunk的时间差值
-// 当块类型为0的时候,Chunk Message Header没有时间字段,与上一个Chunk时间值相同
-func sendAVMessage(conn *RtmpNetConnection, av *AVPacket, isAudio bool, isFirst bool) error {
-	if conn.writeSeqNum > conn.bandwidth {
-		conn.totalWrite += conn.writeSeqNum
-		conn.writeSeqNum = 0
-		sendMessage(conn, SEND_ACK_MESSAGE, conn.totalWrite)
-		sendMessage(conn, SEND_PING_REQUEST_MESSAGE, nil)
-	}
+// 当块类型为1的时候,Chunk Message Header没有时间字段,与上一个Chunk时间增量相同
+//
+// isFirst 的时候 av.Timestamp 是绝对时间戳, 使用完整的消息头. 否则 av.Timestamp 是和上一个包的时间差值.
+// 块类型根据块流上一个消息的头选择, 编码之后的负载在订阅者之间共享.
+func sendAVMessage(conn *RtmpNetConnection, streamID uint32, av *AVPacket, isAudio bool, isFirst bool) error {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
 
-	var err error
-	var mark []byte
-	var need []byte
 	var head *RtmpHeader
 
 	if isAudio {
-		head = newRtmpHeader(RTMP_CSID_AUDIO, av.Timestamp, uint32(len(av.Payload)), RTMP_MSG_AUDIO, conn.streamID, 0)
+		head = newRtmpHeader(streamChunkStreamID(RTMP_CSID_AUDIO, streamID), av.Timestamp, uint32(len(av.Payload)), RTMP_MSG_AUDIO, streamID, 0)
 	} else {
-		head = newRtmpHeader(RTMP_CSID_VIDEO, av.Timestamp, uint32(len(av.Payload)), RTMP_MSG_VIDEO, conn.streamID, 0)
+		head = newRtmpHeader(streamChunkStreamID(RTMP_CSID_VIDEO, streamID), av.Timestamp, uint32(len(av.Payload)), RTMP_MSG_VIDEO, streamID, 0)
 	}
 
-	// 第一次是发送关键帧,需要完整的消息头(Chunk Basic Header(1) + Chunk Message Header(11) + Extended Timestamp(4)(可能会要包括))
-	// 后面开始,就是直接发送音视频数据,那么直接发送,不需要完整的块(Chunk Basic Header(1) + Chunk Message Header(7))
-	// 当Chunk Type为0时(即Chunk12),
-	if isFirst {
-		mark, need, err = encodeChunk12(head, av.Payload, conn.writeChunkSize)
-	} else {
-		mark, need, err = encodeChunk8(head, av.Payload, conn.writeChunkSize)
+	timestamp := av.Timestamp
+	if state, ok := conn.writeChunkStreams[head.ChunkBasicHeader.ChunkStreamID]; ok && !isFirst {
+		timestamp += state.timestamp
 	}
 
-	if err != nil {
-		return err
-	}
+	return conn.writeChunks(head, av.Payload, timestamp, isFirst, av.chunks)
+}
 
-	_, err = conn.bw.Write(mark)
-	if err != nil {
-		return err
-	}
+// 循环读块, 直到读完一个完整的消息. 消息的缓冲区在第一个块的时候按照 MessageLength 分配, 块的数据直接读到里面.
+// 需要 OnRecvFrame 的时候, 每个块(块头 + 块的数据)拷贝到 NetFrame.
+func readChunk(conn *RtmpNetConnection) (msg RtmpMessage, err error) {
+	tap := conn.hand1er != nil && (conn.server == nil || !conn.server.NoFrameTap)
 
-	err = conn.bw.Flush()
-	if err != nil {
-		return err
-	}
+	for {
+		var state *chunkReadState
+		var header []byte
 
-	conn.writeSeqNum += uint32(len(mark))
+		if state, header, err = readChunkHeader(conn); err != nil {
+			return nil, err
+		}
 
-	// 如果音视频数据太大,一次发送不完,那么在这里进行分割(data + Chunk Basic Header(1))
-	for need != nil && len(need) > 0 {
-		mark, need, err = encodeChunk1(head, need, conn.writeChunkSize)
-		if err != nil {
-			return err
+		h := &state.header
+		length := h.ChunkMessgaeHeader.MessageLength
+
+		if state.payload == nil {
+			// 消息的缓冲区按照 MessageLength 分配, 分配之前检查长度, 防止对端在很多块流上面声明很大的消息
+			if length > conn.limits.MaxMessageSize {
+				return nil, newProtocolError(ErrMessageTooLarge, "chunk stream %v, message length %v/%v", h.ChunkBasicHeader.ChunkStreamID, length, conn.limits.MaxMessageSize)
+			}
+
+			if conn.readPending+length > conn.limits.MaxPendingSize {
+				return nil, newProtocolError(ErrMessageTooLarge, "chunk stream %v, pending length %v/%v", h.ChunkBasicHeader.ChunkStreamID, conn.readPending+length, conn.limits.MaxPendingSize)
+			}
+
+			state.payload, state.buffer = newChunkPayload(h.ChunkMessgaeHeader.MessageTypeID, length)
+			state.read = 0
+			conn.readPending += length
 		}
 
-		_, err = conn.bw.Write(mark)
-		if err != nil {
-			return err
+		n := uint32(conn.readChunkSize)
+		if unRead := length - state.read; unRead < n {
+			n = unRead
 		}
 
-		err = conn.bw.Flush()
-		if err != nil {
-			return err
+		data := state.payload[state.read : state.read+n]
+		if _, err = io.ReadFull(conn.br, data); err != nil {
+			return nil, err
 		}
 
-		conn.writeSeqNum += uint32(len(mark))
-	}
+		state.read += n
+		conn.countRead(int(n))
+		conn.active()
 
-	return nil
+		// 每收到一个确认窗口的数据, 发送确认消息, 否则有些推流端会停止发送
+		if err = conn.acknowledge(); err != nil {
+			return nil, err
+		}
+
+		if tap {
+			frame := GetFrame()
+			frame.Appends(header, int32(len(header)))
+			frame.Appends(data, 0)
+			frame.Assign(h)
+			conn.hand1er.OnRecvFrame(frame)
+		}
+
+		// 读完了一个完整的消息就返回, 没读完继续读下一个块.
+		if state.read == length {
+			rtmpBody := new(RtmpBody)
+			rtmpBody.Payload = state.payload
+			rtmpBody.buffer = state.buffer
+			state.reset()
+			conn.readPending -= length
+
+			return newRtmpMessage(h.Clone(), rtmpBody, conn.limits.MaxAMFDepth)
+		}
+	}
 }
 
-func readChunk(conn *RtmpNetConnection) (msg RtmpMessage, err error) {
-	var frame = GetFrame()
-	head, err := conn.br.ReadByte()
-	frame.Append(head, 1)
-	conn.readSeqNum += 1
-	if err != nil {
-		return nil, err
+// 读块头(Basic Header + Message Header + Extended Timestamp), 更新块流的读状态.
+// 返回的 header 是块头的原始数据, 在下一次读块头之前有效.
+func readChunkHeader(conn *RtmpNetConnection) (state *chunkReadState, header []byte, err error) {
+	buf := conn.rheader[:0]
+
+	var b byte
+	if b, err = conn.br.ReadByte(); err != nil {
+		return
 	}
 
-	cbh := new(ChunkBasicHeader)
-	cbh.ChunkStreamID = uint32(head & 0x3f) // 0011 1111
-	cbh.ChunkType = (head & 0xc0) >> 6      // 1100 0000
-	FMT := (head & 0xc0) >> 6               // 1100 0000
+	buf = append(buf, b)
+
+	chunkType := (b & 0xc0) >> 6 // 1100 0000
+	csid := uint32(b & 0x3f)     // 0011 1111
+
 	// 如果块流ID为0,1的话,就需要计算.
-	cbh.ChunkStreamID, err = readChunkStreamID(conn, cbh.ChunkStreamID, frame)
-	if err != nil {
-		return nil, errors.New("get chunk stream id error :" + err.Error())
+	switch csid {
+	case 0:
+		{
+			if buf, err = readChunkHeaderBytes(conn, buf, 1); err != nil {
+				return
+			}
+
+			csid = 64 + uint32(buf[1])
+		}
+	case 1:
+		{
+			if buf, err = readChunkHeaderBytes(conn, buf, 2); err != nil {
+				return
+			}
+
+			csid = 64 + uint32(buf[1]) + 256*uint32(buf[2])
+		}
 	}
 
-	if conn.rtmpHeader[cbh.ChunkStreamID] == nil {
-		//conn.rtmpHeader[cbh.ChunkStreamID] = &RtmpHeader{ChunkBasicHeader.ChunkType: cbh.ChunkType, ChunkBasicHeader.ChunkStreamID: cbh.ChunkStreamID}
-		conn.rtmpHeader[cbh.ChunkStreamID] = &RtmpHeader{ChunkBasicHeader: ChunkBasicHeader{ChunkType: cbh.ChunkType, ChunkStreamID: cbh.ChunkStreamID}}
+	state, ok := conn.readChunkStreams[csid]
+	if !ok {
+		if len(conn.readChunkStreams) >= conn.limits.MaxChunkStreams && !evictChunkStream(conn) {
+			return nil, nil, newProtocolError(ErrTooManyChunkStreams, "chunk stream %v, %v/%v", csid, len(conn.readChunkStreams), conn.limits.MaxChunkStreams)
+		}
+
+		state = new(chunkReadState)
+		state.header.ChunkBasicHeader.ChunkStreamID = csid
+		conn.readChunkStreams[csid] = state
 	}
 
-	h := conn.rtmpHeader[cbh.ChunkStreamID]
-	if cbh.ChunkType != 3 && conn.incompleteRtmpBody[cbh.ChunkStreamID] != nil {
+	conn.readChunks++
+	state.used = conn.readChunks
+
+	if chunkType != 3 && state.payload != nil {
 		// 如果块类型不为3,那么这个rtmp的body应该为空.
-		return nil, errors.New("incompleteRtmpBody error")
+		return nil, nil, newProtocolError(ErrMalformedMessage, "chunk stream %v, chunk type %v inside a message, %v/%v", csid, chunkType, state.read, len(state.payload))
 	}
 
-	chunkHead, err := readChunkType(conn, h, cbh.ChunkType, frame)
-	if err != nil {
-		return nil, errors.New("get chunk type error :" + err.Error())
-	}
+	h := &state.header
+	h.ChunkBasicHeader.ChunkType = chunkType
 
-	if conn.incompleteRtmpBody[cbh.ChunkStreamID] == nil {
-		conn.incompleteRtmpBody[cbh.ChunkStreamID] = make([]byte, 0)
-	}
+	// Message Header: Type 0 -> 11 bytes, Type 1 -> 7 bytes, Type 2 -> 3 bytes, Type 3 -> 0 bytes
+	// type = 0的时间戳为绝对时间,其他的都为相对时间
+	size := [4]int{11, 7, 3, 0}[chunkType]
+	if size > 0 {
+		start := len(buf)
+		if buf, err = readChunkHeaderBytes(conn, buf, size); err != nil {
+			return
+		}
+
+		mh := buf[start:]
+		h.ChunkMessgaeHeader.Timestamp = util.BigEndian.Uint24(mh)
+
+		if chunkType <= 1 {
+			h.ChunkMessgaeHeader.MessageLength = util.BigEndian.Uint24(mh[3:])
+			h.ChunkMessgaeHeader.MessageTypeID = mh[6]
+		}
 
-	markRead := uint32(len(conn.incompleteRtmpBody[cbh.ChunkStreamID]))
-	needRead := uint32(conn.readChunkSize)
-	unRead := chunkHead.ChunkMessgaeHeader.MessageLength - markRead
-	if unRead < needRead {
-		needRead = unRead
+		if chunkType == 0 {
+			h.ChunkMessgaeHeader.MessageStreamID = util.LittleEndian.Uint32(mh[7:])
+		}
+
+		state.extended = h.ChunkMessgaeHeader.Timestamp == 0xffffff
 	}
 
-	buf := make([]byte, needRead)
-	n, err := io.ReadFull(conn.br, buf)
-	if err != nil {
-		return nil, err
+	// 时间戳值大于等于0xffffff的时候, 时间戳扩展字段必须发送. 后面的 Type 3 块也会带上这个字段.
+	if state.extended {
+		start := len(buf)
+		if buf, err = readChunkHeaderBytes(conn, buf, 4); err != nil {
+			return
+		}
+
+		h.ChunkExtendedTimestamp.ExtendTimestamp = util.BigEndian.Uint32(buf[start:])
 	}
-	frame.Appends(buf, 0)
-	conn.readSeqNum += uint32(n)
 
-	buf = append(conn.incompleteRtmpBody[cbh.ChunkStreamID], buf...)
-	conn.incompleteRtmpBody[cbh.ChunkStreamID] = buf
+	conn.countRead(len(buf))
 
-	frame.Assign(h)
-	frame.FMT = FMT
-	conn.hand1er.OnRecvFrame(frame)
+	return state, buf, nil
+}
 
-	// 如果读完了一个完整的块,那么就返回这个消息,没读完继续递归读块.
-	if uint32(len(conn.incompleteRtmpBody[cbh.ChunkStreamID])) == chunkHead.ChunkMessgaeHeader.MessageLength {
+// 去掉最久没有用的读完了的块流, 没有的时候(所有的块流都在组装消息)返回 false.
+// 去掉的块流以后用 Type 0 的块头重新开始.
+func evictChunkStream(conn *RtmpNetConnection) bool {
+	var evict *chunkReadState
+	for _, state := range conn.readChunkStreams {
+		if state.payload == nil && (evict == nil || state.used < evict.used) {
+			evict = state
+		}
+	}
 
-		rtmpHeader := chunkHead.Clone()
-		//rtmpBody := conn.incompleteRtmpBody[cbh.ChunkStreamID]
-		rtmpBody := new(RtmpBody)
-		rtmpBody.Payload = conn.incompleteRtmpBody[cbh.ChunkStreamID]
+	if evict == nil {
+		return false
+	}
 
-		msg = GetRtmpMessage(rtmpHeader, rtmpBody)
+	delete(conn.readChunkStreams, evict.header.ChunkBasicHeader.ChunkStreamID)
+	return true
+}
 
-		delete(conn.incompleteRtmpBody, cbh.ChunkStreamID)
+func readChunkHeaderBytes(conn *RtmpNetConnection, buf []byte, n int) ([]byte, error) {
+	start := len(buf)
+	buf = buf[:start+n]
 
-		return msg, nil
+	if _, err := io.ReadFull(conn.br, buf[start:]); err != nil {
+		return buf[:start], err
 	}
 
-	return readChunk(conn)
+	return buf, nil
 }
 
-func readChunkStreamID(conn *RtmpNetConnection, csid uint32, frame *NetFrame) (chunkStreamID uint32, err error) {
-	switch csid {
-	case 0:
-		{
-			u8, err := conn.br.ReadByte()
-			frame.Append(u8, 1)
-			conn.readSeqNum += 1
-			if err != nil {
-				return 0, err
-			}
-
-			chunkStreamID = 64 + uint32(u8)
-		}
-	case 1:
-		{
-			u16 := make([]byte, 2)
-			if _, err = io.ReadFull(conn.br, u16); err != nil {
-				return
-			}
-			frame.Appends(u16, 2)
-			conn.readSeqNum += 2
-			chunkStreamID = 64 + uint32(u16[0]) + 256*uint32(u16[1])
-		}
+// 收到的消息(包括聚集消息的子消息)先检查长度, 然后解析. 解析的时候 AMF 对象嵌套的深度不能超过 maxDepth.
+func newRtmpMessage(h *RtmpHeader, body *RtmpBody, maxDepth int) (msg RtmpMessage, err error) {
+	if err = checkMessage(h, body.Payload); err != nil {
+		return
 	}
 
-	chunkStreamID = csid
+	typeID := h.ChunkMessgaeHeader.MessageTypeID
+
+	if msg, err = decodeRtmpMessage(h, body, maxDepth); err == ErrAMFDepth {
+		err = newProtocolError(ErrAMFDepth, "message type %v, max depth %v", typeID, maxDepth)
+	} else if err != nil {
+		err = newProtocolError(ErrMalformedMessage, "message type %v, %v", typeID, err)
+	}
 
-	return chunkStreamID, nil
+	return
 }
 
-func readChunkType(conn *RtmpNetConnection, h *RtmpHeader, chunkType byte, frame *NetFrame) (head *RtmpHeader, err error) {
-	switch chunkType {
-	case 0:
-		{
-			// Timestamp 3 bytes
-			b := make([]byte, 3)
-			if _, err := io.ReadFull(conn.br, b); err != nil {
-				return nil, err
-			}
-			frame.Appends(b, 3)
-			conn.readSeqNum += 3
-			h.ChunkMessgaeHeader.Timestamp = util.BigEndian.Uint24(b) //type = 0的时间戳为绝对时间,其他的都为相对时间
-
-			// Message Length 3 bytes
-			if _, err = io.ReadFull(conn.br, b); err != nil { // 读取Message Length,这里的长度指的是一条信令或者一帧视频数据或音频数据的长度,而不是Chunk data的长度.
-				return nil, err
-			}
-			frame.Appends(b, 3)
-			conn.readSeqNum += 3
-			h.ChunkMessgaeHeader.MessageLength = util.BigEndian.Uint24(b)
-
-			// Message Type ID 1 bytes
-			v, err := conn.br.ReadByte() // 读取Message Type ID
-			if err != nil {
-				return nil, err
-			}
-			frame.Append(v, 1)
-			conn.readSeqNum += 1
-			h.ChunkMessgaeHeader.MessageTypeID = v
-
-			// Message Stream ID 4bytes
-			bb := make([]byte, 4)
-			if _, err = io.ReadFull(conn.br, bb); err != nil { // 读取Message Stream ID
-				return nil, err
-			}
-			frame.Appends(bb, 4)
-			conn.readSeqNum += 4
-			h.ChunkMessgaeHeader.MessageStreamID = util.LittleEndian.Uint32(bb)
-
-			// ExtendTimestamp 4 bytes
-			if h.ChunkMessgaeHeader.Timestamp == 0xffffff { // 对于type 0的chunk,绝对时间戳在这里表示,如果时间戳值大于等于0xffffff(16777215),该值必须是0xffffff,且时间戳扩展字段必须发送,其他情况没有要求
-				if _, err = io.ReadFull(conn.br, bb); err != nil {
-					return nil, err
-				}
-				frame.Appends(bb, 4)
-				conn.readSeqNum += 4
-				h.ChunkExtendedTimestamp.ExtendTimestamp = util.BigEndian.Uint32(bb)
-			}
-		}
-	case 1:
+// 检查协议控制消息和音视频消息的长度, GetRtmpMessage 解析消息的时候不再检查.
+func checkMessage(h *RtmpHeader, payload []byte) error {
+	typeID := h.ChunkMessgaeHeader.MessageTypeID
+	min := 0
+
+	switch typeID {
+	case RTMP_MSG_CHUNK_SIZE, RTMP_MSG_ABORT, RTMP_MSG_ACK, RTMP_MSG_ACK_SIZE, RTMP_MSG_BANDWIDTH:
 		{
-			// Timestamp 3 bytes
-			b := make([]byte, 3)
-			if _, err = io.ReadFull(conn.br, b); err != nil {
-				return nil, err
-			}
-			frame.Appends(b, 3)
-			conn.readSeqNum += 3
-			h.ChunkBasicHeader.ChunkType = chunkType
-			h.ChunkMessgaeHeader.Timestamp = util.BigEndian.Uint24(b)
-
-			// Message Length 3 bytes
-			if _, err = io.ReadFull(conn.br, b); err != nil {
-				return nil, err
-			}
-			frame.Appends(b, 3)
-			conn.readSeqNum += 3
-			h.ChunkMessgaeHeader.MessageLength = util.BigEndian.Uint24(b)
-
-			// Message Type ID 1 bytes
-			v, err := conn.br.ReadByte()
-			if err != nil {
-				return nil, err
-			}
-			frame.Append(v, 1)
-			conn.readSeqNum += 1
-			h.ChunkMessgaeHeader.MessageTypeID = v
-
-			// ExtendTimestamp 4 bytes
-			if h.ChunkMessgaeHeader.Timestamp == 0xffffff {
-				bb := make([]byte, 4)
-				if _, err := io.ReadFull(conn.br, bb); err != nil {
-					return nil, err
-				}
-				frame.Appends(bb, 4)
-				conn.readSeqNum += 4
-				h.ChunkExtendedTimestamp.ExtendTimestamp = util.BigEndian.Uint32(bb)
-			}
+			min = 4
 		}
-	case 2:
+	case RTMP_MSG_USER_CONTROL:
 		{
-			// Timestamp 3 bytes
-			b := make([]byte, 3)
-			if _, err = io.ReadFull(conn.br, b); err != nil {
-				return nil, err
-			}
-			frame.Appends(b, 3)
-			conn.readSeqNum += 3
-			h.ChunkBasicHeader.ChunkType = chunkType
-			h.ChunkMessgaeHeader.Timestamp = util.BigEndian.Uint24(b)
-
-			// ExtendTimestamp 4 bytes
-			if h.ChunkMessgaeHeader.Timestamp == 0xffffff {
-				bb := make([]byte, 4)
-				if _, err := io.ReadFull(conn.br, bb); err != nil {
-					return nil, err
+			min = 2
+			if len(payload) >= 2 {
+				switch util.BigEndian.Uint16(payload) {
+				case RTMP_USER_STREAM_EOF, RTMP_USER_STREAM_DRY, RTMP_USER_STREAM_IS_RECORDED, RTMP_USER_PING_REQUEST:
+					{
+						min = 6
+					}
+				case RTMP_USER_SET_BUFFLEN:
+					{
+						min = 10
+					}
 				}
-				frame.Appends(bb, 4)
-				conn.readSeqNum += 4
-				h.ChunkExtendedTimestamp.ExtendTimestamp = util.BigEndian.Uint32(bb)
 			}
 		}
-	case 3:
+	case RTMP_MSG_AUDIO, RTMP_MSG_VIDEO:
 		{
-			h.ChunkBasicHeader.ChunkType = chunkType
+			// 第一个字节是音视频的 Tag Header
+			min = 1
 		}
 	}
 
-	head = h
-	return head, nil
+	if len(payload) < min {
+		return newProtocolError(ErrMalformedMessage, "message type %v, length %v/%v", typeID, len(payload), min)
+	}
+
+	return nil
 }
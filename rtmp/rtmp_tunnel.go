@@ -0,0 +1,467 @@
+package rtmp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RTMPT(RTMP over HTTP), 客户端用 POST 请求收发 RTMP 的数据:
+// /open/1 创建会话, 返回会话的 id;
+// /send/<id>/<seq> 请求的内容是客户端发送的数据;
+// /idle/<id>/<seq> 轮询;
+// /close/<id>/<seq> 关闭会话.
+// send 和 idle 返回的第一个字节是轮询的间隔, 后面是服务器发送的数据.
+// 客户端可以同时发送几个请求, 到达的顺序可能和 seq 不一样, 按照 seq 的顺序处理 send 的数据.
+//
+// 一个会话就是一个 net.Conn, 和 TCP 的连接一样握手, 收发块, ServerHandler 看到的是一样的 RtmpNetConnection.
+//
+// 比如:
+// t := s.Tunnel()
+// http.Handle("/open/", t)
+// http.Handle("/send/", t)
+// http.Handle("/idle/", t)
+// http.Handle("/close/", t)
+type Tunnel struct {
+	server   *Server
+	lock     *sync.Mutex
+	sessions map[string]*tunnelConn
+}
+
+func (s *Server) Tunnel() *Tunnel {
+	return &Tunnel{
+		server:   s,
+		lock:     new(sync.Mutex),
+		sessions: make(map[string]*tunnelConn)}
+}
+
+// 没有数据的时候轮询的间隔逐渐变长, 有数据的时候回到 1
+var tunnelIntervals = []byte{0x01, 0x03, 0x05, 0x09, 0x11, 0x21}
+
+var (
+	errTunnelClosed  = errors.New("rtmpt session closed")
+	errTunnelPending = errors.New("rtmpt too many pending requests")
+)
+
+func (t *Tunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	// /open/1, /send/<id>/<seq>, /idle/<id>/<seq>, /close/<id>/<seq>
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	if parts[0] == "open" {
+		t.open(w, r)
+		return
+	}
+
+	if len(parts) < 3 {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	seq, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	t.lock.Lock()
+	c, ok := t.sessions[parts[1]]
+	t.lock.Unlock()
+
+	if !ok {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	c.active()
+
+	switch parts[0] {
+	case "send":
+		{
+			// 超过 RTMPT_MAX_SEND_SIZE 的时候不能截断, 关闭会话
+			data, err := ioutil.ReadAll(io.LimitReader(r.Body, RTMPT_MAX_SEND_SIZE+1))
+			if err == nil && len(data) > RTMPT_MAX_SEND_SIZE {
+				err = ErrMessageTooLarge
+			}
+
+			if err == nil {
+				err = c.push(seq, data)
+			}
+
+			if err != nil {
+				c.Close()
+				t.remove(c)
+				http.Error(w, "Bad request", 400)
+				return
+			}
+
+			t.poll(w, c)
+		}
+	case "idle":
+		{
+			if err := c.push(seq, nil); err != nil {
+				c.Close()
+				t.remove(c)
+				http.Error(w, "Bad request", 400)
+				return
+			}
+
+			t.poll(w, c)
+		}
+	case "close":
+		{
+			c.Close()
+			t.remove(c)
+			t.respond(w, []byte{0})
+		}
+	default:
+		{
+			http.Error(w, "Not found", 404)
+		}
+	}
+}
+
+func (t *Tunnel) open(w http.ResponseWriter, r *http.Request) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	c := newTunnelConn(hex.EncodeToString(id), r)
+
+	t.lock.Lock()
+	t.sessions[c.id] = c
+	t.lock.Unlock()
+
+	go t.watch(c)
+
+	// 和 TCP 连接 accept 之后一样
+	s := t.server
+	rtmpNetConn := newRtmpNetConnect(c, s)
+	rtmpNetConn.hand1er = s.Handler
+	go s.serve(rtmpNetConn)
+
+	t.respond(w, []byte(c.id+"\n"))
+}
+
+// 返回轮询的间隔和服务器发送的数据. 服务器关闭了会话并且数据都取走了之后返回 404.
+func (t *Tunnel) poll(w http.ResponseWriter, c *tunnelConn) {
+	data, err := c.pull()
+	if err != nil {
+		t.remove(c)
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	t.respond(w, data)
+}
+
+func (t *Tunnel) respond(w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Type", RTMPT_CONTENT_TYPE)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "Keep-Alive")
+	w.Write(data)
+}
+
+func (t *Tunnel) remove(c *tunnelConn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if v, ok := t.sessions[c.id]; ok && v == c {
+		delete(t.sessions, c.id)
+	}
+}
+
+// 客户端超过 Server.TunnelTimeout 没有请求, 关闭会话
+func (t *Tunnel) watch(c *tunnelConn) {
+	timeout := t.server.tunnelTimeout()
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if c.idle() > timeout {
+			c.Close()
+			t.remove(c)
+			return
+		}
+	}
+}
+
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string {
+	return "rtmpt"
+}
+
+func (a tunnelAddr) String() string {
+	return string(a)
+}
+
+// RTMPT 的会话, 实现 net.Conn.
+// Read 读客户端 send 的数据, 没有数据的时候阻塞; Write 写到 out, 客户端 send 或者 idle 的时候取走, out 满了的时候阻塞.
+type tunnelConn struct {
+	id        string
+	lock      *sync.Mutex
+	in        bytes.Buffer  // 客户端发送的数据
+	out       bytes.Buffer  // 服务器发送的数据
+	notify    chan struct{} // in 有数据, 连接关闭或者修改了读的 deadline
+	writable  chan struct{} // out 被取走了, 连接关闭或者修改了写的 deadline
+	deadline  time.Time     // 读的 deadline
+	wdeadline time.Time     // 写的 deadline
+	closed    bool
+	started   bool              // 收到了第一个请求, next 有效
+	next      uint64            // 下一个要处理的请求的 seq
+	pending   map[uint64][]byte // 先到的请求(seq 比 next 大), idle 的数据为 nil
+	polls     int               // 连续没有数据返回的轮询次数
+	last      time.Time         // 客户端最后一次请求的时间
+	local     tunnelAddr
+	remote    tunnelAddr
+}
+
+func newTunnelConn(id string, r *http.Request) *tunnelConn {
+	return &tunnelConn{
+		id:       id,
+		lock:     new(sync.Mutex),
+		notify:   make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+		pending:  make(map[uint64][]byte),
+		last:     time.Now(),
+		local:    tunnelAddr(r.Host),
+		remote:   tunnelAddr(r.RemoteAddr + "/" + id)}
+}
+
+func (c *tunnelConn) wakeup() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (c *tunnelConn) wakeupWriter() {
+	select {
+	case c.writable <- struct{}{}:
+	default:
+	}
+}
+
+func (c *tunnelConn) active() {
+	c.lock.Lock()
+	c.last = time.Now()
+	c.lock.Unlock()
+}
+
+func (c *tunnelConn) idle() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return time.Since(c.last)
+}
+
+// seq 的请求到了, send 的数据按照 seq 的顺序写到 in. 以前处理过的 seq(重发的请求)丢掉.
+func (c *tunnelConn) push(seq uint64, data []byte) error {
+	c.lock.Lock()
+
+	// 第一个请求(C0 C1, 客户端收到 S0 S1 S2 之后才发送下一个请求)的 seq 是起点
+	if !c.started {
+		c.started = true
+		c.next = seq
+	}
+
+	if seq < c.next {
+		c.lock.Unlock()
+		return nil
+	}
+
+	if _, ok := c.pending[seq]; !ok && len(c.pending) >= RTMPT_MAX_PENDING {
+		c.lock.Unlock()
+		return errTunnelPending
+	}
+
+	c.pending[seq] = data
+
+	for {
+		data, ok := c.pending[c.next]
+		if !ok {
+			break
+		}
+
+		delete(c.pending, c.next)
+		c.in.Write(data)
+		c.next++
+	}
+
+	c.lock.Unlock()
+
+	c.wakeup()
+	return nil
+}
+
+// 轮询的间隔 + 服务器发送的数据, 最多 RTMPT_MAX_POLL_SIZE
+func (c *tunnelConn) pull() (data []byte, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed && c.out.Len() == 0 {
+		return nil, errTunnelClosed
+	}
+
+	if c.out.Len() > 0 {
+		c.polls = 0
+	} else if c.polls < len(tunnelIntervals)-1 {
+		c.polls++
+	}
+
+	n := c.out.Len()
+	if n > RTMPT_MAX_POLL_SIZE {
+		n = RTMPT_MAX_POLL_SIZE
+	}
+
+	data = make([]byte, 1+n)
+	data[0] = tunnelIntervals[c.polls]
+	c.out.Read(data[1:])
+
+	if n > 0 {
+		c.wakeupWriter()
+	}
+
+	return
+}
+
+func (c *tunnelConn) Read(b []byte) (n int, err error) {
+	for {
+		c.lock.Lock()
+		if c.in.Len() > 0 {
+			n, err = c.in.Read(b)
+			c.lock.Unlock()
+			return
+		}
+
+		if c.closed {
+			c.lock.Unlock()
+			return 0, io.EOF
+		}
+
+		deadline := c.deadline
+		c.lock.Unlock()
+
+		if err = c.wait(c.notify, deadline); err != nil {
+			return
+		}
+	}
+}
+
+// out 满了的时候等客户端取走, 写的 deadline 到了返回超时
+func (c *tunnelConn) Write(b []byte) (n int, err error) {
+	for {
+		c.lock.Lock()
+		if c.closed {
+			c.lock.Unlock()
+			return n, errTunnelClosed
+		}
+
+		if space := RTMPT_MAX_OUT_SIZE - c.out.Len(); space > 0 {
+			if space > len(b)-n {
+				space = len(b) - n
+			}
+
+			c.out.Write(b[n : n+space])
+			n += space
+		}
+
+		if n == len(b) {
+			c.lock.Unlock()
+			return
+		}
+
+		deadline := c.wdeadline
+		c.lock.Unlock()
+
+		if err = c.wait(c.writable, deadline); err != nil {
+			return
+		}
+	}
+}
+
+// 等 notify 或者 deadline
+func (c *tunnelConn) wait(notify chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-notify
+		return nil
+	}
+
+	d := deadline.Sub(time.Now())
+	if d <= 0 {
+		return tunnelTimeoutError{}
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-notify:
+	case <-timer.C:
+	}
+
+	return nil
+}
+
+func (c *tunnelConn) Close() error {
+	c.lock.Lock()
+	c.closed = true
+	c.lock.Unlock()
+
+	c.wakeup()
+	c.wakeupWriter()
+	return nil
+}
+
+func (c *tunnelConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *tunnelConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *tunnelConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *tunnelConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.deadline = t
+	c.lock.Unlock()
+
+	c.wakeup()
+	return nil
+}
+
+func (c *tunnelConn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.wdeadline = t
+	c.lock.Unlock()
+
+	c.wakeupWriter()
+	return nil
+}
+
+type tunnelTimeoutError struct{}
+
+func (tunnelTimeoutError) Error() string   { return "rtmpt i/o timeout" }
+func (tunnelTimeoutError) Timeout() bool   { return true }
+func (tunnelTimeoutError) Temporary() bool { return true }
@@ -0,0 +1,562 @@
+package rtmp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/sevenzoe/gortmp/avformat"
+	"github.com/sevenzoe/gortmp/util"
+)
+
+// 录制的流比时间戳提前发送的时间, 播放器开始播放之前有数据可以缓冲
+const vodPreload = time.Second
+
+// 录制的 FLV 文件. 打开的时候扫描一遍, 记下 onMetaData, sequence header 和关键帧的位置(seek 用).
+type vodFile struct {
+	file      *os.File
+	r         *bufio.Reader
+	metaData  *AVPacket     // 第一个 onMetaData
+	videoTag  *AVPacket     // 第一个视频 sequence header
+	audioTag  *AVPacket     // 第一个 AAC sequence header
+	keyframes []vodKeyframe // 视频关键帧, 没有视频的时候每秒一个音频帧
+	first     int64         // 第一个 tag 在文件中的位置
+}
+
+type vodKeyframe struct {
+	timestamp uint32 // 毫秒
+	offset    int64  // tag 在文件中的位置
+}
+
+func openVodFile(name string) (v *vodFile, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+
+	v = &vodFile{file: f, r: bufio.NewReader(f)}
+	if err = v.index(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return
+}
+
+func (v *vodFile) close() {
+	v.file.Close()
+}
+
+// 扫描整个文件, 只读 tag 头和音视频数据的前几个字节, onMetaData 和 sequence header 读完整的数据
+func (v *vodFile) index() (err error) {
+	header, err := avformat.ReadFLVHeader(v.r)
+	if err != nil {
+		return
+	}
+
+	// FLV Header 后面可能有扩展的数据, 然后是 PreviousTagSize0
+	v.first = 9
+	if header.DataOffse > 9 {
+		v.first = int64(header.DataOffse)
+	}
+	v.first += 4
+
+	if _, err = v.r.Discard(int(v.first - 9)); err != nil {
+		return
+	}
+
+	var audio []vodKeyframe // 没有视频的时候用音频帧 seek
+	hdr := make([]byte, 11)
+
+	for offset := v.first; ; {
+		if _, e := io.ReadFull(v.r, hdr); e != nil {
+			break // 文件结束
+		}
+
+		size := int(util.BigEndian.Uint24(hdr[1:4]))
+		timestamp := uint32(hdr[7])<<24 | util.BigEndian.Uint24(hdr[4:7])
+
+		n := size
+		if n > 5 {
+			n = 5
+		}
+
+		head, e := v.r.Peek(n)
+		if e != nil {
+			break
+		}
+
+		pkt, _ := newVodPacket(hdr[0], timestamp, head)
+
+		full := false
+		switch hdr[0] {
+		case RTMP_MSG_VIDEO:
+			{
+				if pkt.isVideoSequenceHeader() {
+					full = v.videoTag == nil
+				} else if pkt.isKeyFrame() {
+					v.keyframes = append(v.keyframes, vodKeyframe{timestamp, offset})
+				}
+			}
+		case RTMP_MSG_AUDIO:
+			{
+				if pkt.isAACSequenceHeader() {
+					full = v.audioTag == nil
+				} else if len(audio) == 0 || timestamp >= audio[len(audio)-1].timestamp+1000 {
+					audio = append(audio, vodKeyframe{timestamp, offset})
+				}
+			}
+		case RTMP_MSG_AMF0_METADATA:
+			{
+				full = v.metaData == nil
+			}
+		}
+
+		if full {
+			payload := make([]byte, size)
+			if _, e = io.ReadFull(v.r, payload); e != nil {
+				break
+			}
+
+			pkt, _ = newVodPacket(hdr[0], timestamp, payload)
+
+			switch hdr[0] {
+			case RTMP_MSG_VIDEO:
+				{
+					v.videoTag = pkt
+				}
+			case RTMP_MSG_AUDIO:
+				{
+					v.audioTag = pkt
+				}
+			case RTMP_MSG_AMF0_METADATA:
+				{
+					if name, _ := newAMFDecoder(payload).decodeObject(); name == Data_OnMetaData {
+						v.metaData = pkt
+					}
+				}
+			}
+		} else if _, e = v.r.Discard(size); e != nil {
+			break
+		}
+
+		if _, e = v.r.Discard(4); e != nil { // PreviousTagSize
+			break
+		}
+
+		offset += int64(11 + size + 4)
+	}
+
+	if len(v.keyframes) == 0 {
+		v.keyframes = audio
+	}
+
+	_, err = v.seek(0)
+	return
+}
+
+// 从和 ms 最接近的关键帧开始读, 返回关键帧的时间戳. 没有关键帧的时候从头开始读.
+func (v *vodFile) seek(ms uint32) (timestamp uint32, err error) {
+	k := vodKeyframe{offset: v.first}
+
+	// 时间戳的差用有符号数计算, 第一个关键帧就在 ms 后面的时候 uint32 相减会回绕
+	distance := func(timestamp uint32) int64 {
+		d := int64(timestamp) - int64(ms)
+		if d < 0 {
+			return -d
+		}
+
+		return d
+	}
+
+	for i, kf := range v.keyframes {
+		if i == 0 || distance(kf.timestamp) < distance(k.timestamp) {
+			k = kf
+		}
+
+		if kf.timestamp > ms {
+			break
+		}
+	}
+
+	if _, err = v.file.Seek(k.offset, io.SeekStart); err != nil {
+		return
+	}
+
+	v.r.Reset(v.file)
+	return k.timestamp, nil
+}
+
+// 读下一个音视频或者数据消息, 文件结束的时候返回 io.EOF
+func (v *vodFile) read() (pkt *AVPacket, err error) {
+	for {
+		var tag avformat.FLVTag
+		if tag, err = avformat.ReadFLVTag(v.r); err != nil {
+			return
+		}
+
+		v.r.Discard(4) // PreviousTagSize
+
+		if tag.Data.Len() == 0 {
+			continue
+		}
+
+		if pkt, err = newVodPacket(tag.TagType, uint32(tag.TimestampExtended)<<24|tag.Timestamp, tag.Data.Bytes()); err != nil {
+			continue
+		}
+
+		switch pkt.Type {
+		case RTMP_MSG_VIDEO, RTMP_MSG_AUDIO, RTMP_MSG_AMF0_METADATA:
+			{
+				return pkt, nil
+			}
+		}
+	}
+}
+
+// FLV tag 转换成 AVPacket, 解析视频 tag 头和音频格式
+func newVodPacket(tagType byte, timestamp uint32, payload []byte) (pkt *AVPacket, err error) {
+	pkt = new(AVPacket)
+	pkt.Type = tagType
+	pkt.Timestamp = timestamp
+	pkt.Payload = payload
+
+	if len(payload) == 0 {
+		return
+	}
+
+	switch tagType {
+	case RTMP_MSG_VIDEO:
+		{
+			err = pkt.decodeVideoTagHeader()
+		}
+	case RTMP_MSG_AUDIO:
+		{
+			tmp := payload[0]
+			pkt.SoundFormat = tmp >> 4
+			pkt.SoundRate = (tmp & 0x0c) >> 2
+			pkt.SoundSize = (tmp & 0x02) >> 1
+			pkt.SoundType = tmp & 0x01
+		}
+	}
+
+	return
+}
+
+// 录制的流的播放状态, 只在读文件的 goroutine 里面使用.
+// 按照时间戳的速度发送(提前 vodPreload), 时间戳是文件里面的时间戳, 播放器可以显示播放的位置.
+type vodPlayer struct {
+	s       *RtmpNetStream
+	item    *playItem
+	file    *vodFile
+	begin   time.Time // 开始计时的时间
+	clock   uint32    // 开始计时的时候的时间戳
+	last    uint32    // 最后发送的时间戳
+	seeks   int       // seek 的次数, 等待的时候 seek 了, 读到的包不用发送
+	paused  bool      // 暂停的时候不读文件
+	stopped bool      // 停止播放了
+	waitKey bool      // 重新接收视频的时候, 从关键帧开始发送
+	vsent   bool      // 已经用完整的消息头发送了视频
+	asent   bool      // 已经用完整的消息头发送了音频
+	vtime   uint32    // 上一个视频的时间戳
+	atime   uint32    // 上一个音频的时间戳
+}
+
+// 读 FLV 文件发送给播放者. 从 start 最接近的关键帧开始, 先发送 onMetaData 和 sequence header.
+// 文件的读错误当作文件结束, 只返回发送的错误.
+func (s *RtmpNetStream) sendFile(item *playItem) (err error) {
+	v, err := openVodFile(item.file())
+	if err != nil {
+		fmt.Println("vod open file error :", err)
+		return nil
+	}
+	defer v.close()
+
+	p := &vodPlayer{s: s, item: item, file: v}
+	p.paused, _, _ = s.receiving()
+
+	var start uint32 // 毫秒
+	if item.start > 0 {
+		start = uint32(item.start * 1000)
+	}
+
+	if p.seek(start); p.stopped {
+		return nil
+	}
+
+	if err = p.sendHeaders(); err != nil {
+		return
+	}
+
+	end := p.clock + item.limit() // duration 限制的时间戳
+
+	for {
+		if err = p.poll(); err != nil || p.stopped {
+			return
+		}
+
+		pkt, e := v.read()
+		if e != nil {
+			return nil // 文件结束
+		}
+
+		if item.duration >= 0 && pkt.Timestamp > end {
+			return nil
+		}
+
+		var ok bool
+		if ok, err = p.wait(pkt.Timestamp); err != nil {
+			return
+		}
+
+		if !ok {
+			continue
+		}
+
+		if err = p.send(pkt); err != nil {
+			return
+		}
+	}
+}
+
+// 处理控制(暂停, seek), 暂停的时候一直等到恢复或者停止
+func (p *vodPlayer) poll() (err error) {
+	for !p.stopped {
+		if p.paused {
+			select {
+			case <-p.item.stop:
+				{
+					p.stopped = true
+				}
+			case c := <-p.item.control:
+				{
+					err = p.handle(c)
+				}
+			}
+		} else {
+			select {
+			case <-p.item.stop:
+				{
+					p.stopped = true
+				}
+			case c := <-p.item.control:
+				{
+					err = p.handle(c)
+				}
+			default:
+				{
+					return nil
+				}
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	return nil
+}
+
+func (p *vodPlayer) handle(c playControl) (err error) {
+	switch c.kind {
+	case "pause":
+		{
+			if c.flag == p.paused {
+				return nil
+			}
+
+			// 恢复的时候从暂停的位置接着计时
+			p.paused = c.flag
+			p.clock = p.last
+			p.begin = time.Now()
+		}
+	case "seek":
+		{
+			if p.seek(c.offset); p.stopped {
+				return nil
+			}
+
+			prmdSeek := newPlayStatusData(p.s.streamID, NetStream_Seek_Notify, Level_Status, fmt.Sprintf("Seeking %v (stream ID: %v).", p.clock, p.s.streamID), p.item.name)
+
+			err = p.s.sendMessage(SEND_PLAY_RESPONSE_MESSAGE, prmdSeek)
+			if err != nil {
+				return
+			}
+
+			prmdStart := newPlayStatusData(p.s.streamID, NetStream_Play_Start, Level_Status, "Started playing "+p.item.name, p.item.name)
+
+			err = p.s.sendMessage(SEND_PLAY_RESPONSE_MESSAGE, prmdStart)
+			if err != nil {
+				return
+			}
+
+			return p.sendHeaders()
+		}
+	}
+
+	return nil
+}
+
+// 等到 ts 应该发送的时候. 返回 false 表示停止播放了或者 seek 了, 这个包不用发送.
+func (p *vodPlayer) wait(ts uint32) (ok bool, err error) {
+	seeks := p.seeks
+
+	for {
+		if err = p.poll(); err != nil || p.stopped || p.seeks != seeks {
+			return false, err
+		}
+
+		var d time.Duration
+		if ts > p.clock {
+			d = time.Duration(ts-p.clock) * time.Millisecond
+		}
+
+		wait := d - vodPreload - time.Since(p.begin)
+		if wait <= 0 {
+			return true, nil
+		}
+
+		select {
+		case <-p.item.stop:
+			{
+				p.stopped = true
+			}
+		case c := <-p.item.control:
+			{
+				err = p.handle(c)
+			}
+		case <-time.After(wait):
+			{
+			}
+		}
+	}
+}
+
+// seek 到和 offset 最接近的关键帧, 之后的音视频用完整的消息头发送
+func (p *vodPlayer) seek(offset uint32) {
+	ts, err := p.file.seek(offset)
+	if err != nil {
+		fmt.Println("vod seek error :", err)
+		p.stopped = true
+		return
+	}
+
+	p.seeks++
+	p.clock = ts
+	p.last = ts
+	p.begin = time.Now()
+	p.vsent = false
+	p.asent = false
+	p.waitKey = false
+}
+
+// 开始播放和 seek 之后, 先发送 onMetaData 和 sequence header, 时间戳和关键帧一样
+func (p *vodPlayer) sendHeaders() (err error) {
+	ts := p.clock
+
+	if meta := p.file.metaData; meta != nil {
+		meta = meta.Clone()
+		meta.Timestamp = ts
+		if err = p.s.sendMessage(SEND_DATA_MESSAGE, meta); err != nil {
+			return
+		}
+	}
+
+	_, audio, video := p.s.receiving()
+
+	if vTag := p.file.videoTag; vTag != nil && video {
+		vTag = vTag.Clone()
+		vTag.Timestamp = ts
+		if err = p.send(vTag); err != nil {
+			return
+		}
+	}
+
+	if aTag := p.file.audioTag; aTag != nil && audio {
+		aTag = aTag.Clone()
+		aTag.Timestamp = ts
+		if err = p.send(aTag); err != nil {
+			return
+		}
+	}
+
+	return nil
+}
+
+// 第一个音视频用完整的消息头(绝对时间戳), 之后用相对时间戳. receiveAudio/receiveVideo(false) 的时候不发送.
+func (p *vodPlayer) send(pkt *AVPacket) (err error) {
+	_, audio, video := p.s.receiving()
+	ts := pkt.Timestamp
+
+	switch pkt.Type {
+	case RTMP_MSG_VIDEO:
+		{
+			if !video {
+				p.waitKey = true
+				return nil
+			}
+
+			if p.waitKey && !pkt.isVideoSequenceHeader() {
+				if !pkt.isKeyFrame() {
+					return nil
+				}
+				p.waitKey = false
+			}
+
+			if pkt.VideoIsExHeader && !p.s.conn.supportFourCC(pkt.VideoFourCC) {
+				if pkt, err = pkt.toLegacyVideoPacket(); err != nil {
+					return nil
+				}
+			}
+
+			if !p.vsent {
+				p.vsent = true
+				p.vtime = ts
+				err = p.s.sendMessage(SEND_FULL_VDIEO_MESSAGE, pkt)
+				break
+			}
+
+			pkt.Timestamp = 0
+			if ts > p.vtime {
+				pkt.Timestamp = ts - p.vtime // 相对时间戳
+				p.vtime = ts
+			}
+
+			err = p.s.sendMessage(SEND_VIDEO_MESSAGE, pkt)
+		}
+	case RTMP_MSG_AUDIO:
+		{
+			if !audio {
+				return nil
+			}
+
+			if !p.asent {
+				p.asent = true
+				p.atime = ts
+				err = p.s.sendMessage(SEND_FULL_AUDIO_MESSAGE, pkt)
+				break
+			}
+
+			pkt.Timestamp = 0
+			if ts > p.atime {
+				pkt.Timestamp = ts - p.atime // 相对时间戳
+				p.atime = ts
+			}
+
+			err = p.s.sendMessage(SEND_AUDIO_MESSAGE, pkt)
+		}
+	default:
+		{
+			err = p.s.sendMessage(SEND_DATA_MESSAGE, pkt)
+		}
+	}
+
+	if ts > p.last {
+		p.last = ts
+	}
+
+	return
+}
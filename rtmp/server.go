@@ -2,6 +2,7 @@ package rtmp
 
 import (
 	//"bufio"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"runtime"
@@ -13,28 +14,163 @@ var begintime time.Time
 
 var handler ServerHandler = new(DefaultServerHandler)
 
+var (
+	callHandlers     = make(map[string]CallHandler)
+	callHandlersLock = new(sync.RWMutex)
+)
+
+// 客户端 NetConnection.call(command, responder, args...) 的处理函数.
+// 返回值作为 _result 发送给客户端, 返回 error 的时候发送 _error.
+type CallHandler func(conn *RtmpNetConnection, args []AMFObject) (result AMFObject, err error)
+
 type Server struct {
-	Addr        string
-	Handler     ServerHandler
-	ReadTimeout time.Duration
-	WriteTimout time.Duration
-	Lock        *sync.Mutex
+	Addr          string
+	Handler       ServerHandler
+	CallHandlers  map[string]CallHandler // 自定义命令的处理函数, key 为命令名. 开始服务之后用 HandleCall 添加
+	ReadTimeout   time.Duration
+	WriteTimout   time.Duration
+	PingInterval  time.Duration // 发送 PingRequest 的间隔, 0 使用默认值
+	PingTimeout   time.Duration // 超过这个时间没有收到对端的数据就关闭连接, 0 使用默认值
+	NoFrameTap    bool          // 不需要 Handler.OnRecvFrame 的时候设置为 true, 读块的时候不再拷贝 NetFrame
+	Limits        Limits        // 接收数据的限制
+	TLSConfig     *tls.Config   // 不为 nil 的时候是 RTMPS(RTMP over TLS), 证书可以用 util.Certificates
+	TunnelTimeout time.Duration // RTMPT 的会话超过这个时间没有请求就关闭, 0 使用默认值
+	Lock          *sync.Mutex
+
+	callLock sync.RWMutex // 保护 CallHandlers
 }
 
 func ListenAndServe(addr string) error {
-	s := Server{
-		Addr:        addr,                            // 服务器的IP地址和端口信息
-		Handler:     handler,                         // 请求处理函数的路由复用器
-		ReadTimeout: time.Duration(time.Second * 15), // timeout
-		WriteTimout: time.Duration(time.Second * 15), // timeout
-		Lock:        new(sync.Mutex)}                 // lock
+	s := newServer(addr)
 	return s.ListenAndServer()
 }
 
+// RTMPS, 比如 ListenAndServeTLS(":443", certs.TLSConfig())
+func ListenAndServeTLS(addr string, tlsConfig *tls.Config) error {
+	s := newServer(addr)
+	s.TLSConfig = tlsConfig
+	return s.ListenAndServer()
+}
+
+func newServer(addr string) *Server {
+	return &Server{
+		Addr:         addr,                             // 服务器的IP地址和端口信息
+		Handler:      handler,                          // 请求处理函数的路由复用器
+		ReadTimeout:  time.Duration(time.Second * 15),  // timeout
+		WriteTimout:  time.Duration(time.Second * 15),  // timeout
+		PingInterval: RTMP_PING_INTERVAL * time.Second, // keepalive
+		PingTimeout:  RTMP_PING_TIMEOUT * time.Second,  // dead peer
+		NoFrameTap:   true,                             // DefaultServerHandler 不处理 NetFrame
+		Lock:         new(sync.Mutex)}                  // lock
+}
+
+// 注册自定义命令的处理函数, 所有的服务器都使用, Server.CallHandlers 里面有同名的命令的时候优先使用 Server 的
+func HandleCall(command string, h CallHandler) {
+	callHandlersLock.Lock()
+	defer callHandlersLock.Unlock()
+
+	callHandlers[command] = h
+}
+
+func (s *Server) HandleCall(command string, h CallHandler) {
+	s.callLock.Lock()
+	defer s.callLock.Unlock()
+
+	if s.CallHandlers == nil {
+		s.CallHandlers = make(map[string]CallHandler)
+	}
+
+	s.CallHandlers[command] = h
+}
+
+func (s *Server) callHandler(command string) (h CallHandler, ok bool) {
+	s.callLock.RLock()
+	h, ok = s.CallHandlers[command]
+	s.callLock.RUnlock()
+
+	if ok {
+		return
+	}
+
+	callHandlersLock.RLock()
+	defer callHandlersLock.RUnlock()
+
+	h, ok = callHandlers[command]
+	return
+}
+
+func (s *Server) pingInterval() time.Duration {
+	if s.PingInterval > 0 {
+		return s.PingInterval
+	}
+
+	return RTMP_PING_INTERVAL * time.Second
+}
+
+func (s *Server) tunnelTimeout() time.Duration {
+	if s.TunnelTimeout > 0 {
+		return s.TunnelTimeout
+	}
+
+	return RTMPT_SESSION_TIMEOUT * time.Second
+}
+
+func (s *Server) pingTimeout() time.Duration {
+	if s.PingTimeout > 0 {
+		return s.PingTimeout
+	}
+
+	return RTMP_PING_TIMEOUT * time.Second
+}
+
+// 接收数据的限制, 超过限制的时候返回 *ProtocolError 并且关闭连接. 字段为 0 的时候使用默认值.
+type Limits struct {
+	MaxMessageSize  uint32 // 一个消息的最大长度
+	MaxPendingSize  uint32 // 所有块流正在组装的消息的总长度
+	MinChunkSize    uint32 // 对端 Set Chunk Size 的最小值
+	MaxChunkSize    uint32 // 对端 Set Chunk Size 的最大值
+	MaxChunkStreams int    // 同时正在组装消息的块流个数
+	MaxAMFDepth     int    // AMF 对象嵌套的最大深度
+}
+
+func (s *Server) limits() (l Limits) {
+	if s != nil {
+		l = s.Limits
+	}
+
+	if l.MaxMessageSize == 0 {
+		l.MaxMessageSize = RTMP_MAX_MESSAGE_SIZE
+	}
+
+	if l.MaxPendingSize == 0 {
+		l.MaxPendingSize = RTMP_MAX_PENDING_SIZE
+	}
+
+	if l.MinChunkSize == 0 {
+		l.MinChunkSize = RTMP_MIN_PEER_CHUNK_SIZE
+	}
+
+	if l.MaxChunkSize == 0 {
+		l.MaxChunkSize = RTMP_MAX_PEER_CHUNK_SIZE
+	}
+
+	if l.MaxChunkStreams == 0 {
+		l.MaxChunkStreams = RTMP_MAX_CHUNK_STREAMS
+	}
+
+	if l.MaxAMFDepth == 0 {
+		l.MaxAMFDepth = RTMP_MAX_AMF_DEPTH
+	}
+
+	return
+}
+
 // golang http.ListenAndServer source code
 func (s *Server) ListenAndServer() error {
 	addr := s.Addr
-	if addr == "" {
+	if addr == "" && s.TLSConfig != nil {
+		addr = ":443"
+	} else if addr == "" {
 		addr = ":1935"
 	}
 
@@ -43,6 +179,11 @@ func (s *Server) ListenAndServer() error {
 		return err
 	}
 
+	// TLS 握手在第一次读的时候, 和 RTMP 握手一样受 ReadTimeout 限制
+	if s.TLSConfig != nil {
+		l = tls.NewListener(l, s.TLSConfig)
+	}
+
 	for i := 0; i < runtime.NumCPU(); i++ {
 		go s.loop(l)
 	}
@@ -84,6 +225,11 @@ func (s *Server) serve(rtmpNetConn *RtmpNetConnection) {
 
 	begintime = time.Now()
 
+	// 握手和 connect 完成之前限制读的时间, 防止连接上来不发数据占用资源. 之后由 keepalive 检测对端
+	if s.ReadTimeout > 0 {
+		rtmpNetConn.conn.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+	}
+
 	/* Handshake */
 	err := handshake(rtmpNetConn.brw) // 握手
 	if err != nil {
@@ -140,13 +286,31 @@ func (s *Server) serve(rtmpNetConn *RtmpNetConnection) {
 		}
 	}
 
-	err = sendMessage(rtmpNetConn, SEND_ACK_WINDOW_SIZE_MESSAGE, uint32(512<<10)) // 服务器端发送协议消息 '窗口确认大小' 到客户端
+	// Enhanced RTMP, 客户端支持的视频编码. 例如 ["av01", "vp09", "hvc1"]
+	data = decodeAMFObject(connect.Object, "fourCcList")
+	if data != nil {
+		list, ok := data.([]AMFObject)
+		if !ok {
+			fmt.Println("rtmp connet message <fourCcList> decode error")
+			rtmpNetConn.Close()
+			return
+		}
+
+		rtmpNetConn.fourCcList = make([]string, 0, len(list))
+		for _, v := range list {
+			if fourcc, ok := v.(string); ok {
+				rtmpNetConn.fourCcList = append(rtmpNetConn.fourCcList, fourcc)
+			}
+		}
+	}
+
+	err = sendMessage(rtmpNetConn, SEND_ACK_WINDOW_SIZE_MESSAGE, uint32(RTMP_SERVER_ACK_WINDOW)) // 服务器端发送协议消息 '窗口确认大小' 到客户端
 	if err != nil {
 		rtmpNetConn.Close()
 		return
 	}
 
-	err = sendMessage(rtmpNetConn, SEND_SET_PEER_BANDWIDTH_MESSAGE, uint32(512<<10)) // 服务器端发送协议消息 '设置对端带宽' 到客户端
+	err = sendMessage(rtmpNetConn, SEND_SET_PEER_BANDWIDTH_MESSAGE, uint32(RTMP_SERVER_ACK_WINDOW)) // 服务器端发送协议消息 '设置对端带宽' 到客户端
 	if err != nil {
 		rtmpNetConn.Close()
 		return
@@ -167,9 +331,15 @@ func (s *Server) serve(rtmpNetConn *RtmpNetConnection) {
 	}
 
 	rtmpNetConn.connected = true
+	rtmpNetConn.conn.SetReadDeadline(time.Time{})
+
+	go rtmpNetConn.keepalive(s.pingInterval(), s.pingTimeout())
 
 	/* NetStream */
 
+	// 流0是 NetConnection 自己, 其他的流由 createStream 创建
 	handler := s.Handler
-	newNetStream(rtmpNetConn, handler).msgLoopProc()
+	ns := newNetStream(rtmpNetConn, handler)
+	rtmpNetConn.addStream(ns)
+	ns.msgLoopProc()
 }
@@ -0,0 +1,168 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 一对证书和私钥文件(PEM)
+type CertificateFile struct {
+	Cert string
+	Key  string
+}
+
+// TLS 证书, RTMPS 和 HTTPS 一起用.
+// 握手的时候按照 SNI(ClientHelloInfo.ServerName) 选择证书, 没有匹配的时候用第一个.
+// 证书文件修改之后重新加载: 后台每 Interval 检查一次文件的修改时间(握手的时候不访问文件), 加载失败的时候接着用以前的证书.
+type Certificates struct {
+	Files    []CertificateFile
+	Interval time.Duration // <= 0 的时候不检查
+
+	lock      *sync.Mutex        // 保护 certs
+	certs     []*tls.Certificate // 和 Files 一一对应
+	modTime   []time.Time        // 加载的时候文件的修改时间, 只在检查的 goroutine 里面使用
+	done      chan struct{}      // Close 的时候关闭, 停止检查
+	closeOnce *sync.Once
+}
+
+func NewCertificates(files []CertificateFile, interval time.Duration) (c *Certificates, err error) {
+	if len(files) == 0 {
+		return nil, errors.New("NewCertificates error, no certificate.")
+	}
+
+	c = &Certificates{
+		Files:     files,
+		Interval:  interval,
+		lock:      new(sync.Mutex),
+		done:      make(chan struct{}),
+		closeOnce: new(sync.Once)}
+
+	if err = c.load(); err != nil {
+		return nil, err
+	}
+
+	if interval > 0 {
+		go c.watch()
+	}
+
+	return
+}
+
+// 停止检查证书文件
+func (c *Certificates) Close() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+func (c *Certificates) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: c.GetCertificate}
+}
+
+// tls.Config.GetCertificate
+func (c *Certificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.Lock()
+	certs := c.certs
+	c.lock.Unlock()
+
+	name := strings.TrimSuffix(hello.ServerName, ".")
+	if name != "" {
+		for _, cert := range certs {
+			if cert.Leaf.VerifyHostname(name) == nil {
+				return cert, nil
+			}
+		}
+	}
+
+	return certs[0], nil
+}
+
+// 每 Interval 检查一次证书文件, 修改了就重新加载
+func (c *Certificates) watch() {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			{
+				if !c.modified() {
+					continue
+				}
+
+				if err := c.load(); err != nil {
+					fmt.Println("reload certificate error :", err)
+				} else {
+					fmt.Println("reload certificate :", c.Files)
+				}
+			}
+		case <-c.done:
+			{
+				return
+			}
+		}
+	}
+}
+
+// 加载所有的证书, 全部成功的时候才替换以前的
+func (c *Certificates) load() (err error) {
+	certs := make([]*tls.Certificate, 0, len(c.Files))
+	modTime := make([]time.Time, 0, len(c.Files))
+
+	for _, f := range c.Files {
+		var info os.FileInfo
+		if info, err = os.Stat(f.Cert); err != nil {
+			return
+		}
+
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(f.Cert, f.Key); err != nil {
+			return
+		}
+
+		// SNI 按照证书里面的名字选择
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return
+		}
+
+		certs = append(certs, &cert)
+		modTime = append(modTime, c.newer(info.ModTime(), f.Key))
+	}
+
+	c.lock.Lock()
+	c.certs = certs
+	c.lock.Unlock()
+
+	c.modTime = modTime
+
+	return
+}
+
+// 证书和私钥文件里面比较新的修改时间
+func (c *Certificates) newer(t time.Time, filename string) time.Time {
+	if info, err := os.Stat(filename); err == nil && info.ModTime().After(t) {
+		return info.ModTime()
+	}
+
+	return t
+}
+
+// 证书文件有没有修改, 文件不存在(比如正在替换)的时候当作没有修改
+func (c *Certificates) modified() bool {
+	for i, f := range c.Files {
+		info, err := os.Stat(f.Cert)
+		if err != nil {
+			return false
+		}
+
+		if !c.newer(info.ModTime(), f.Key).Equal(c.modTime[i]) {
+			return true
+		}
+	}
+
+	return false
+}
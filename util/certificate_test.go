@@ -0,0 +1,129 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 自签名的证书和私钥写到 dir 下面的 name.crt, name.key
+func writeCertificate(t *testing.T, dir, name string, hosts ...string) CertificateFile {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := CertificateFile{Cert: filepath.Join(dir, name+".crt"), Key: filepath.Join(dir, name+".key")}
+
+	if err = os.WriteFile(f.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.WriteFile(f.Key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func certificateHost(t *testing.T, c *Certificates, serverName string) string {
+	cert, err := c.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert.Leaf.DNSNames[0]
+}
+
+func TestCertificatesSNI(t *testing.T) {
+	dir := t.TempDir()
+	files := []CertificateFile{
+		writeCertificate(t, dir, "a", "a.example.com"),
+		writeCertificate(t, dir, "b", "*.b.example.com"),
+	}
+
+	c, err := NewCertificates(files, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 没有 SNI 或者没有匹配的时候用第一个
+	for serverName, host := range map[string]string{
+		"":                 "a.example.com",
+		"a.example.com":    "a.example.com",
+		"x.b.example.com":  "*.b.example.com",
+		"x.b.example.com.": "*.b.example.com",
+		"c.example.com":    "a.example.com",
+	} {
+		if got := certificateHost(t, c, serverName); got != host {
+			t.Fatalf("server name %q, certificate %v, want %v", serverName, got, host)
+		}
+	}
+}
+
+func TestCertificatesReload(t *testing.T) {
+	dir := t.TempDir()
+	files := []CertificateFile{writeCertificate(t, dir, "a", "a.example.com")}
+
+	c, err := NewCertificates(files, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 加载失败(私钥不对)的时候接着用以前的证书
+	if err = os.WriteFile(files[0].Key, []byte("bad key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(files[0].Key, future, future)
+	time.Sleep(50 * time.Millisecond)
+
+	if got := certificateHost(t, c, "a.example.com"); got != "a.example.com" {
+		t.Fatalf("certificate %v after bad reload", got)
+	}
+
+	// 替换证书文件, 修改时间变了之后加载新的证书
+	writeCertificate(t, dir, "a", "new.example.com")
+
+	future = future.Add(time.Minute)
+	os.Chtimes(files[0].Cert, future, future)
+	os.Chtimes(files[0].Key, future, future)
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if certificateHost(t, c, "") == "new.example.com" {
+			return
+		}
+	}
+
+	t.Fatal("certificate not reloaded")
+}
@@ -5,24 +5,8 @@ import (
 	//"fmt"
 	"io"
 	"net"
-	"os"
-	"unsafe"
 )
 
-/*
-#include <sys/uio.h>
-// Structure for scatter/gather I/O.
-struct iovec{
-     void *iov_base; // Pointer to data.
-     size_t iov_len; // Length of data.
-};
-*/
-
-type SysIOVec struct {
-	Base   uintptr
-	Length uint64
-}
-
 type IOVec struct {
 	Data   [][]byte
 	Length int
@@ -78,35 +62,29 @@ func (iov *IOVec) WriteTo(w io.Writer, n int) (written int, err error) {
 	return
 }
 
+// 小于这个长度的内存块拷贝到 smallBuffer, 和相邻的小内存块合并成一个 iovec
+const smallBufferSize = 16
+
+type ioVecEntry struct {
+	data   []byte // 大内存块, 不拷贝
+	offset int    // 小内存块在 smallBuffer 中的位置
+	length int    // 小内存块的长度
+}
+
+// 聚集写(scatter/gather I/O). Write 只记录内存块, Flush 的时候一次写出去.
+// w 是 *net.TCPConn 的时候使用 writev 系统调用, 否则依次调用 w.Write.
+// 大内存块不拷贝, Flush 之前调用者不能修改.
 type IOVecWriter struct {
-	fd          uintptr
+	w           io.Writer
 	smallBuffer []byte
-	sysIOV      []SysIOVec
+	entries     []ioVecEntry
+	buffers     net.Buffers
+	length      int
 }
 
 func NewIOVecWriter(w io.Writer) (iow *IOVecWriter) {
-	var err error
-	var file *os.File
-
-	// TODO:是否要增加其他的类型断言
-	switch value := w.(type) {
-	case *net.TCPConn:
-		{
-			file, err = value.File()
-			if err != nil {
-				return
-			}
-		}
-	case *os.File:
-		{
-			file = value
-		}
-	default:
-		return
-	}
-
 	iow = &IOVecWriter{
-		fd: file.Fd(),
+		w: w,
 	}
 
 	return
@@ -118,88 +96,71 @@ func NewIOVecWriter(w io.Writer) (iow *IOVecWriter) {
 //  ---   --------------   ---   ---   ---   -----------
 //
 // 1 -> 5个字节, 3 -> 15个字节, 4 -> 10个字节, 5 -> 15个字节
-
-// 1,3,4,5内存块太小(小于16个字节),因此我们将它组装起来为samllbuffer
-// 并且将Base置于每次组装smallBuffer前总长度的尾部.
-//
-// samllbuffer:
-//  1   3   4   5   ........
-//  ------------------------------
-// |                              |
-//  ------------------------------
-//  <-->  第一个小内存块,假设地址为0xF10000
-//    5
-//  <------> 第二个小内存块,假设地址为0xF20000
-//	   20
-//  <----------> 第三个小内存块,假设地址为0xF30000
-//       30
-//  <--------------> 第四个小内存块,假设地址为0xF40000
-//          45
 //
-// 开始Base == 每次组装smallBuffer尾部
-// 即:
-// Base1 = 0, smallBuffer += 5,
-// Base3 = 5, smallBuffer += 15,
-// Base4 = 20, smallBuffer += 10,
-// Base5 = 30, smallBuffer += 15,
+// 1,3,4,5内存块太小(小于16个字节),因此我们将它们拷贝到 smallBuffer, 记录在 smallBuffer 中的位置.
+// 3,4,5 是相邻的, 合并成一个内存块. smallBuffer 在 append 的时候地址可能会变化,
+// 因此 Flush 的时候才将位置转换为 smallBuffer 的切片.
 //
-// 然后我们将每一块内存块都取出来,比samllBuffer小的内存块,我们就将Base指向内存块的地址
-// 之前小于16个字节的内存块,肯定会比smallBuffer小,因为smallBuffer是所有小内存快的总和.
-// 即:
-// Base1 = &smallBuffer[0], Base1 = 0xF10000,
-// Base3 = &smallBuffer[5], Base3 = 0xF20000,
-// Base4 = &smallBuffer[20], Base4 = 0xF30000,
-// Base5 = &smallBuffer[30], Base5 = 0xF40000,
+// 最后写出去的内存块: 1 | 2 | 3+4+5 | 6
 
 func (iow *IOVecWriter) Write(data []byte) (written int, err error) {
-	siov := SysIOVec{
-		Length: uint64(len(data)),
+	if len(data) == 0 {
+		return 0, nil
 	}
 
-	// unsafe.Pointer == void *
-	// Base 用整数的形式来记录内存中有几个数据
-	// 如果数据小于16,这个时候小块内存的Base还不是数据的内存地址
-	if siov.Length < 16 {
-		// Base 置于上一块samllBuffer的末尾
-		// 然后拼接smallBuffer
-		siov.Base = uintptr(len(iow.smallBuffer))
+	if len(data) < smallBufferSize {
+		// 和上一个小内存块相邻, 合并
+		if n := len(iow.entries); n > 0 && iow.entries[n-1].data == nil {
+			iow.entries[n-1].length += len(data)
+		} else {
+			iow.entries = append(iow.entries, ioVecEntry{offset: len(iow.smallBuffer), length: len(data)})
+		}
+
 		iow.smallBuffer = append(iow.smallBuffer, data...)
 	} else {
-		siov.Base = uintptr(unsafe.Pointer(&data[0]))
+		iow.entries = append(iow.entries, ioVecEntry{data: data})
 	}
 
-	iow.sysIOV = append(iow.sysIOV, siov)
+	iow.length += len(data)
+
+	return len(data), nil
+}
 
-	return written, nil
+// 还没有写出去的字节数
+func (iow *IOVecWriter) Buffered() int {
+	return iow.length
 }
 
-func (iow *IOVecWriter) Flush() error {
+func (iow *IOVecWriter) Flush() (err error) {
+	if len(iow.entries) == 0 {
+		return nil
+	}
+
 	// 取出每一块内存
-	for i, _ := range iow.sysIOV {
-		siov := &iow.sysIOV[i] // 一定要拿地址,如果这里不是取地址,那么无法改变下面Base的值
-		if siov.Base < uintptr(len(iow.smallBuffer)) {
-			// 这个时候小块内存的Base就是数据的内存地址
-			siov.Base = uintptr(unsafe.Pointer(&iow.smallBuffer[siov.Base]))
+	iow.buffers = iow.buffers[:0]
+	for _, e := range iow.entries {
+		if e.data != nil {
+			iow.buffers = append(iow.buffers, e.data)
+		} else {
+			iow.buffers = append(iow.buffers, iow.smallBuffer[e.offset:e.offset+e.length])
 		}
 	}
 
-	N := 1024
-	count := len(iow.sysIOV)
-	// 每次最多取1024个内存块(不管是大内存块,还是小内存块)
-	for i := 0; i < count; i += N {
-		n := count - i
-		if n > N {
-			n = N
-		}
+	// net.Buffers.WriteTo 会修改 buffers, 用一个拷贝
+	bufs := iow.buffers
+	_, err = bufs.WriteTo(iow.w)
 
-		// _, _, errno := syscall.Syscall(syscall.SYS_WRITEV, iow.fd, uintptr(unsafe.Pointer(&iow.sysIOV[i])), uintptr(n))
-		// if errno != 0 {
-		// 	return errors.New(errno.Error())
-		// }
+	for i := range iow.buffers {
+		iow.buffers[i] = nil
 	}
 
-	iow.sysIOV = iow.sysIOV[:0]
+	for i := range iow.entries {
+		iow.entries[i] = ioVecEntry{}
+	}
+
+	iow.entries = iow.entries[:0]
 	iow.smallBuffer = iow.smallBuffer[:0]
+	iow.length = 0
 
-	return nil
+	return
 }
@@ -8,10 +8,12 @@ import (
 	"flag"
 	"log"
 	"net/http"
+	"strings"
 	"text/template"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/sevenzoe/gortmp/rtmp"
 )
 
 const (
@@ -20,6 +22,9 @@ const (
 
 	// Poll file for changes with this period.
 	filePeriod = 10 * time.Second
+
+	// WebSocket 发布者一个消息的最大长度, 一个消息最多是一个 Tag(加上 FLV Header, Tag 头和 PreviousTagSize)
+	publishReadLimit = rtmp.RTMP_MAX_MESSAGE_SIZE + 64
 )
 
 var (
@@ -44,20 +49,41 @@ func reader(ws *websocket.Conn) {
 	}
 }
 
+// /live/{app}/{stream}: 订阅一个正在发布的直播流, 用 WebSocket 发送 FLV
 func liveWs(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/live/")
+	if parts := strings.Split(path, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	sub, err := rtmp.SubscribeFLV(path, r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
 	r.Header.Del("Origin")
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		sub.Close()
 		if _, ok := err.(websocket.HandshakeError); !ok {
 			log.Println(err)
 		}
 		return
 	}
-	wsPool.Append(ws)
+	wsPool.Append(ws, sub)
 }
 
-func serveWs(w http.ResponseWriter, r *http.Request) {
-	r.Header.Del("Origin")
+// /publish/{app}/{stream}: 浏览器用 WebSocket 发送 FLV 发布直播流, 和 RTMP 的发布者一样经过 OnPublishing
+func publishWs(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/publish/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	// 发布要检查 Origin(和 Host 一样), 其他网站的页面不能用浏览器的连接发布
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		if _, ok := err.(websocket.HandshakeError); !ok {
@@ -65,7 +91,21 @@ func serveWs(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	wsPool.Append(ws)
+
+	ws.SetReadLimit(publishReadLimit)
+
+	pub, err := flvServer.PublishFLV(ws.UnderlyingConn(), parts[0], parts[1])
+	if err != nil {
+		log.Println("WebSocket publish", r.URL.Path, "error:", err)
+		ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()), time.Now().Add(writeWait))
+		ws.Close()
+		return
+	}
+
+	err = pub.Serve(&wsReader{wsc: ws})
+	if err != nil && !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		log.Println("WebSocket publish", pub.StreamPath(), "error:", err)
+	}
 }
 
 func serveHome(w http.ResponseWriter, r *http.Request) {
@@ -2,9 +2,8 @@
 package main
 
 import (
-	"encoding/hex"
 	"fmt"
-	"os"
+	"io"
 	"sync"
 	"time"
 
@@ -18,54 +17,60 @@ const (
 
 	// Send pings to client with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
-)
 
-var (
-	tracWs *os.File
+	// Maximum message size allowed from the client.
+	maxMessageSize = 512
 )
 
+// 一个 WebSocket FLV 播放者, 订阅一个广播(rtmp.FlvSubscriber).
+// pushLoop 发送 FLV Tag 和 ping, recvLoop 读客户端的消息和 pong, 任何一个结束都关闭连接和取消订阅.
 type WsStat struct {
 	wsc       *ws.Conn
 	wscAddr   string
-	frameC    chan *rtmp.NetFrame
-	isClosed  bool
-	isFMT0    bool //表示首帧以推送
-	isPlay    bool //开始播放
+	sub       *rtmp.FlvSubscriber
+	closeOnce sync.Once
 	sendTimes int
 	sendSize  int
-	recvTimes int
-	recvSize  int
 }
 
-func NewStat(wsc *ws.Conn) *WsStat {
+func NewStat(wsc *ws.Conn, sub *rtmp.FlvSubscriber) *WsStat {
 	return &WsStat{
 		wsc:     wsc,
 		wscAddr: wsc.RemoteAddr().String(),
-		frameC:  make(chan *rtmp.NetFrame, 64),
+		sub:     sub,
 	}
 }
 
+func (c *WsStat) close(removeC chan *ws.Conn) {
+	c.closeOnce.Do(func() {
+		c.sub.Close()
+		c.wsc.Close()
+		removeC <- c.wsc
+	})
+}
+
 func (c *WsStat) recvLoop(removeC chan *ws.Conn) {
+	defer c.close(removeC)
 	defer func() {
 		if x := recover(); x != nil {
 			fmt.Printf("WebSocket [%v] RecvLoop Error: %v\n", c.wscAddr, x)
 		}
 	}()
 
-	for !c.isClosed {
-		msgType, msgData, err := c.wsc.ReadMessage()
-		if err != nil {
+	c.wsc.SetReadLimit(maxMessageSize)
+	c.wsc.SetReadDeadline(time.Now().Add(pongWait))
+	c.wsc.SetPongHandler(func(string) error { c.wsc.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+
+	for {
+		if _, _, err := c.wsc.ReadMessage(); err != nil {
 			fmt.Printf("WebSocket [%v] RecvLoop Error: %v\n", c.wscAddr, err)
-			c.isClosed = true
-		} else {
-			fmt.Printf("WebSocket [%v] RecvLoop: {msgType:%v, msgData:[%x]}\n", c.wscAddr, msgType, msgData)
-			c.isPlay = true
+			return
 		}
-
 	}
 }
 
 func (c *WsStat) pushLoop(removeC chan *ws.Conn) {
+	defer c.close(removeC)
 	defer func() {
 		if x := recover(); x != nil {
 			fmt.Printf("WebSocket [%v] PushLoop Error: %v\n", c.wscAddr, x)
@@ -73,104 +78,85 @@ func (c *WsStat) pushLoop(removeC chan *ws.Conn) {
 	}()
 
 	pingTicker := time.NewTicker(pingPeriod)
-	for !c.isClosed {
+	defer pingTicker.Stop()
+
+	for {
 		select {
 		case <-pingTicker.C:
 			c.wsc.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.wsc.WriteMessage(ws.PingMessage, []byte{}); err != nil {
 				fmt.Printf("WebSocket [%v] PingMessage Error: %v\n", c.wscAddr, err)
-			} else {
-				fmt.Printf("WebSocket [%v] PingMessage Success\n", c.wscAddr)
-			}
-		case frame, ok := <-c.frameC:
-			if !ok {
-				fmt.Printf("WebSocket [%v] Conn Close\n", c.wscAddr)
-				c.wsc.Close()
-				c.isClosed = true
-			} else {
-				if !c.isFMT0 && frame.FMT != 0 {
-					dateLen := int32(len(frame.Data))
-					fmt.Printf("DROP:<%v>:{FMT: %v, CSID: %v}, "+
-						"{Timestamp: %6v, MsgLength: %4v, MsgTypeID: %v, StreamID: %v, ExTimestamp: %v}, "+
-						"{DataLen: %4v, HeadLen: %4v, MissLen: %4v}\n",
-						c.sendTimes, frame.FMT, frame.CSID, frame.Timestamp,
-						frame.MsgLength, frame.MsgTypeID, frame.StreamID,
-						frame.ExTimestamp, dateLen, frame.HeadLength, dateLen-int32(frame.HeadLength)-int32(frame.MsgLength))
-				}
-				if frame != nil && (c.isFMT0 || frame.FMT == 0) {
-					c.isFMT0 = true
-					if isTracFrameData {
-						if c.sendTimes <= 100 {
-							tracWs.Write([]byte(hex.EncodeToString(frame.Data)))
-							if c.sendTimes == 100 {
-								tracWs.Close()
-							} else {
-								tracWs.Write([]byte("\n"))
-							}
-						}
-					}
-					c.wsc.SetWriteDeadline(time.Now().Add(writeWait))
-					err := c.wsc.WriteMessage(ws.BinaryMessage, frame.Data)
-					if err != nil {
-						fmt.Printf("WebSocket [%v] Push Frame Error: %v\n", c.wscAddr, err)
-						c.wsc.Close()
-						c.isClosed = true
-					} else {
-						c.sendTimes++
-						c.sendSize += len(frame.Data)
-						if c.sendTimes%100 == 0 {
-							fmt.Printf("{Addr: %v} :<%v>: {FMT: %v, CSID: %v, Size: %v}\n",
-								c.wscAddr, c.sendTimes, frame.FMT, frame.CSID, c.sendSize)
-						}
-					}
-				}
+				return
 			}
-			if frame != nil {
-				frame.Refs(-1)
+		case tag := <-c.sub.Tags():
+			c.wsc.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.wsc.WriteMessage(ws.BinaryMessage, tag); err != nil {
+				fmt.Printf("WebSocket [%v] Push Tag Error: %v\n", c.wscAddr, err)
+				return
 			}
-		}
-	}
-	for {
-		select {
-		case frame := <-c.frameC:
-			if frame != nil {
-				frame.Refs(-1)
+
+			c.sendTimes++
+			c.sendSize += len(tag)
+			if c.sendTimes%100 == 0 {
+				fmt.Printf("{Addr: %v} :<%v>: {Stream: %v, Size: %v}\n",
+					c.wscAddr, c.sendTimes, c.sub.StreamPath(), c.sendSize)
 			}
+		case <-c.sub.Done():
+			fmt.Printf("WebSocket [%v] Stream Finished: %v\n", c.wscAddr, c.sub.StreamPath())
+			c.wsc.SetWriteDeadline(time.Now().Add(writeWait))
+			c.wsc.WriteMessage(ws.CloseMessage, ws.FormatCloseMessage(ws.CloseNormalClosure, ""))
+			return
 		}
 	}
 }
 
-func (c *WsStat) RecvLoop(removeC chan *ws.Conn) {
-	for !c.isClosed {
-		c.recvLoop(removeC)
-	}
-	removeC <- c.wsc
+// WebSocket 的二进制消息连起来作为一个 io.Reader(FLV 发布者), 每个消息重新设置读的 deadline
+type wsReader struct {
+	wsc *ws.Conn
+	r   io.Reader
 }
 
-func (c *WsStat) PushLoop(removeC chan *ws.Conn) {
-	for !c.isClosed {
-		c.pushLoop(removeC)
+func (r *wsReader) Read(b []byte) (n int, err error) {
+	for {
+		if r.r == nil {
+			var msgType int
+			r.wsc.SetReadDeadline(time.Now().Add(pongWait))
+			if msgType, r.r, err = r.wsc.NextReader(); err != nil {
+				return
+			}
+
+			if msgType != ws.BinaryMessage {
+				r.r = nil
+				continue
+			}
+		}
+
+		n, err = r.r.Read(b)
+		if err == io.EOF {
+			r.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return
 	}
-	removeC <- c.wsc
 }
 
 type WsPool struct {
-	wscm     map[*ws.Conn]*WsStat
-	appendC  chan *ws.Conn
-	removeC  chan *ws.Conn
-	frameC   chan *rtmp.NetFrame
-	stopC    chan struct{}
-	isStop   bool
-	frameCnt int
-	mu       sync.RWMutex
+	wscm    map[*ws.Conn]*WsStat
+	appendC chan *WsStat
+	removeC chan *ws.Conn
+	stopC   chan struct{}
+	isStop  bool
+	mu      sync.RWMutex
 }
 
 func NewWsPool() *WsPool {
 	return &WsPool{
 		wscm:    make(map[*ws.Conn]*WsStat),
-		appendC: make(chan *ws.Conn, 16),
+		appendC: make(chan *WsStat, 16),
 		removeC: make(chan *ws.Conn, 16),
-		frameC:  make(chan *rtmp.NetFrame, 64),
 		stopC:   make(chan struct{}, 2),
 	}
 }
@@ -184,19 +170,17 @@ func (p *WsPool) doFor() {
 
 	for {
 		select {
-		case wsc, ok := <-p.appendC:
-			if wsc != nil && ok {
+		case stat, ok := <-p.appendC:
+			if stat != nil && ok {
 				p.mu.Lock()
-				_, exist := p.wscm[wsc]
+				_, exist := p.wscm[stat.wsc]
 				if !exist {
-					stat := NewStat(wsc)
-					p.wscm[wsc] = stat
-					//stat.isPlay = true
-					go stat.PushLoop(p.removeC)
-					go stat.RecvLoop(p.removeC)
+					p.wscm[stat.wsc] = stat
+					go stat.pushLoop(p.removeC)
+					go stat.recvLoop(p.removeC)
 				}
 				p.mu.Unlock()
-				fmt.Printf("Append WebSocket Conn: %v\n", wsc.RemoteAddr().String())
+				fmt.Printf("Append WebSocket Conn: %v, Stream: %v\n", stat.wscAddr, stat.sub.StreamPath())
 			}
 		case wsc, ok := <-p.removeC:
 			if wsc != nil && ok {
@@ -205,30 +189,9 @@ func (p *WsPool) doFor() {
 				if exist {
 					delete(p.wscm, wsc)
 				}
-				if !stat.isClosed {
-					stat.wsc.Close()
-				}
 				p.mu.Unlock()
 				fmt.Printf("Remove WebSocket Conn: %v, %+v\n", wsc.RemoteAddr().String(), stat)
 			}
-		case frame, ok := <-p.frameC:
-			if frame != nil && ok {
-				p.frameCnt++
-				//msg := fmt.Sprintf("<%v>:{FMT: %v, CSID: %v, Size: %v}",
-				//p.frameCnt, frame.FMT, frame.CSID, len(frame.Data))
-				pushCnt := 0
-				p.mu.Lock()
-				for _, stat := range p.wscm {
-					if !stat.isClosed && stat.isPlay {
-						stat.frameC <- frame
-						frame.Refs(1)
-						pushCnt++
-					}
-				}
-				p.mu.Unlock()
-				//fmt.Printf("%s, pushCnt： %v\n", msg, pushCnt)
-				frame.Refs(0)
-			}
 		case _, ok := <-p.stopC:
 			if !ok {
 				p.isStop = true
@@ -248,27 +211,18 @@ func (p *WsPool) Run() {
 func (p *WsPool) Stop() {
 }
 
-func (p *WsPool) Append(wsc *ws.Conn) {
-	p.appendC <- wsc
+// 连接已经升级成 WebSocket, sub 已经订阅了广播
+func (p *WsPool) Append(wsc *ws.Conn, sub *rtmp.FlvSubscriber) {
+	p.appendC <- NewStat(wsc, sub)
 }
 
 func (p *WsPool) Remove(wsc *ws.Conn) {
 	p.removeC <- wsc
 }
 
-func (p *WsPool) PushRtmpNetFrame(frame *rtmp.NetFrame) {
-	p.frameC <- frame
-}
-
 func (p *WsPool) WsCount() int {
 	p.mu.Lock()
 	cnt := len(p.wscm)
 	p.mu.Unlock()
 	return cnt
 }
-
-func init() {
-	if isTracFrameData {
-		tracWs, _ = os.Create("./tracWs.txt")
-	}
-}